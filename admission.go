@@ -0,0 +1,90 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"fmt"
+)
+
+// AdmissionPolicy tells what enqueueing does when the token bucket of
+// the priority of the data is empty, see WithAdmission.
+type AdmissionPolicy int
+
+const (
+	// AdmissionWait makes the enqueue wait for a token, or until the
+	// context of EnqueueCtx is done.
+	AdmissionWait AdmissionPolicy = iota
+	// AdmissionReject makes the enqueue return an error wrapping
+	// ErrQuotaExceeded.
+	AdmissionReject
+	// AdmissionDowngrade moves the data to the next priority, i.e. the
+	// one dequeued after it, and so on until the bucket of the priority
+	// has a token or the priority has no bucket.
+	AdmissionDowngrade
+)
+
+// admission is the token bucket admission control of a queue.
+type admission struct {
+	buckets map[int]*PriorityLimiter
+	policy  AdmissionPolicy
+	next    int // the step to the priority dequeued after another
+}
+
+// WithAdmission makes the enqueues of the queue take a token from the
+// bucket of the priority of the data, if it has one, so that abusive
+// producers cannot flood the high priorities: buckets maps priorities
+// to their limiter, e.g. NewPriorityLimiter(100, 10) for 100 data per
+// second in bursts of 10, and the priorities without a bucket are not
+// limited. The priority is the one given by the PriorityMapper, if any.
+// When the bucket is empty, the policy applies. The token of data that
+// is then not queued, e.g. since the queue is full or closed, is given
+// back.
+func WithAdmission(buckets map[int]*PriorityLimiter, policy AdmissionPolicy) Option {
+	return func(q *Queue) {
+		q.admission = &admission{buckets: buckets, policy: policy}
+	}
+}
+
+// setup sets the direction of the next priorities, which are the
+// smaller ones if the queue is reversed.
+func (a *admission) setup(reversed bool) {
+	a.next = 1
+	if reversed {
+		a.next = -1
+	}
+}
+
+// admit takes a token for the priority, waiting until ctx is done under
+// AdmissionWait, and returns the priority the data is admitted with and
+// the bucket of the token, if any.
+func (a *admission) admit(ctx context.Context, priority int) (int, *PriorityLimiter, error) {
+	for {
+		l := a.buckets[priority]
+		switch {
+		case l == nil:
+			return priority, nil, nil
+		case a.policy == AdmissionWait:
+			if err := l.Wait(ctx, priority); err != nil {
+				return priority, nil, err
+			}
+			return priority, l, nil
+		case l.Allow():
+			return priority, l, nil
+		case a.policy == AdmissionReject:
+			return priority, nil, fmt.Errorf("priority %d: %w", priority, ErrQuotaExceeded)
+		}
+		priority += a.next
+	}
+}
+
+// refund gives back the admission tokens of entries that were not
+// queued, so that rejected enqueues don't use up the budget.
+func (q *Queue) refund(entries ...*entry) {
+	for _, e := range entries {
+		if e.bucket != nil {
+			e.bucket.refund()
+			e.bucket = nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmission(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		q := New(WithAdmission(map[int]*PriorityLimiter{1: NewPriorityLimiter(0.001, 2)}, AdmissionReject))
+		assert.Equal(t, nil, q.Enqueue(`a`, 1))
+		assert.Equal(t, nil, q.Enqueue(`b`, 1))
+		assert.ErrorIs(t, q.Enqueue(`c`, 1), ErrQuotaExceeded)
+		assert.Equal(t, nil, q.Enqueue(`d`, 2), "not limited")
+		assert.Equal(t, 3, q.Len())
+	})
+
+	t.Run("downgrade", func(t *testing.T) {
+		buckets := map[int]*PriorityLimiter{
+			1: NewPriorityLimiter(0.001, 1),
+			2: NewPriorityLimiter(0.001, 1),
+		}
+		q := New(WithAdmission(buckets, AdmissionDowngrade))
+		for _, data := range []string{`a`, `b`, `c`} {
+			assert.Equal(t, nil, q.Enqueue(data, 1))
+		}
+		for _, want := range []int{1, 2, 3} {
+			_, priority, _ := q.Peek()
+			assert.Equal(t, want, priority)
+			q.Dequeue()
+		}
+
+		q = New(WithMaxFirst(), WithAdmission(map[int]*PriorityLimiter{5: NewPriorityLimiter(0.001, 1)}, AdmissionDowngrade))
+		q.Enqueue(`a`, 5)
+		q.Enqueue(`b`, 5)
+		_, priority, _ := q.Peek()
+		assert.Equal(t, 5, priority)
+		q.Dequeue()
+		_, priority, _ = q.Peek()
+		assert.Equal(t, 4, priority, "dequeued later with WithMaxFirst")
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		q := New(WithAdmission(map[int]*PriorityLimiter{1: NewPriorityLimiter(20, 1)}, AdmissionWait))
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, nil, q.Enqueue(i, 1))
+		}
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+		assert.Equal(t, 3, q.Len())
+	})
+	t.Run("wait until the context is done", func(t *testing.T) {
+		q := New(WithAdmission(map[int]*PriorityLimiter{1: NewPriorityLimiter(0, 1)}, AdmissionWait))
+		assert.Equal(t, nil, q.Enqueue(`a`, 1))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, q.EnqueueCtx(ctx, `b`, 1))
+		assert.Equal(t, 1, q.Len())
+	})
+
+	t.Run("refund on rejection", func(t *testing.T) {
+		limiter := NewPriorityLimiter(0, 1)
+		q := New(WithCapacity(1), WithAdmission(map[int]*PriorityLimiter{1: limiter}, AdmissionReject))
+		q.Enqueue(`a`, 2)
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(`b`, 1))
+		q.Close()
+		assert.Equal(t, ErrQueueClosed, q.EnqueueBatch([]Task{{Data: `c`, Priority: 1}}))
+		assert.Equal(t, ErrQueueClosed, q.Enqueue(`d`, 1))
+		assert.Equal(t, true, limiter.Allow(), "the token is left")
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"strconv"
+	"time"
+)
+
+// AgeBounds are the upper bounds of the buckets of AgeHistogram.
+var AgeBounds = [...]time.Duration{
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// AgeHistogram counts pending data by age: younger than each of
+// AgeBounds, and then older than all of them.
+type AgeHistogram [len(AgeBounds) + 1]int
+
+// AgingReport holds the age histograms of the pending data by priority
+// band name, or by priority if the queue has no bands, so that operators
+// see at once whether old data is piling up somewhere.
+type AgingReport map[string]AgeHistogram
+
+// Aging returns the aging report of the queue. Like Histogram, it scans
+// the whole queue, so it is meant for periodic sampling.
+func (q *Queue) Aging() AgingReport {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	now := q.now()
+	report := make(AgingReport)
+	for _, item := range (*q.heap)[1:] {
+		e := entryOf(item)
+		if e.cancelled {
+			continue
+		}
+		key := strconv.Itoa(e.Priority)
+		if i := q.bandIndex(e.Priority); i >= 0 {
+			key = q.bands[i].Name
+		}
+		h := report[key]
+		h[ageBucket(now.Sub(e.since))]++
+		report[key] = h
+	}
+	return report
+}
+
+func ageBucket(age time.Duration) int {
+	for i, bound := range AgeBounds {
+		if age < bound {
+			return i
+		}
+	}
+	return len(AgeBounds)
+}
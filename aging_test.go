@@ -0,0 +1,28 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAging(t *testing.T) {
+	q, clock := mockNewQueueWithClock()
+	q.Enqueue(`old`, 1)
+	clock.advance(time.Minute)
+	q.Enqueue(`older than 1s`, 1)
+	clock.advance(5 * time.Second)
+	q.Enqueue(`new`, 2)
+	q.EnqueueCancelable(`cancelled`, 2)()
+	clock.advance(time.Millisecond)
+	assert.Equal(t, AgingReport{
+		"1": {0, 0, 0, 1, 1},
+		"2": {1, 0, 0, 0, 0},
+	}, q.Aging())
+
+	q.SetBands(Band{Name: "all"})
+	assert.Equal(t, AgingReport{"all": {1, 0, 0, 1, 1}}, q.Aging())
+}
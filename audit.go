@@ -0,0 +1,198 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditOp is what happened to an item of a queue, see AuditEvent.
+type AuditOp string
+
+// The operations of the audit log.
+const (
+	AuditEnqueue AuditOp = "enqueue"
+	AuditDequeue AuditOp = "dequeue"
+	AuditCancel  AuditOp = "cancel"
+	AuditExpire  AuditOp = "expire"
+	AuditDrop    AuditOp = "drop"
+)
+
+// AuditEvent is a line of an audit log, in JSON.
+type AuditEvent struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Op   AuditOp   `json:"op"`
+	// Item is the Seq of the enqueue of the item, so that the events of
+	// an item can be matched. A retried item is enqueued again.
+	Item     uint64 `json:"item"`
+	Priority int    `json:"priority"`
+	// Request identifies the data, see WithAuditLog.
+	Request string `json:"request,omitempty"`
+	// Prev is the Hash of the previous event, empty for the first one.
+	Prev string `json:"prev"`
+	// Hash is the SHA-256 of Prev and of the event without Hash, in hex,
+	// so that any change to the log breaks the chain.
+	Hash string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of the event chained to prev.
+func (ev AuditEvent) hash() (string, error) {
+	ev.Hash = ""
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(ev.Prev+"\n"), line...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog streams the events of queues to an append-only sink, as JSON
+// lines chained by hashes, so that compliance teams can verify the order
+// and handling of the requests after the fact, see VerifyAuditLog. It
+// may be shared by several queues. It is safe for concurrent use.
+type AuditLog struct {
+	lock   sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	seq    uint64
+	prev   string
+	err    error // the first write error
+}
+
+// NewAuditLog returns an AuditLog starting a new chain in w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog returns an AuditLog appending to the file at path, which
+// is created if needed. The chain of the file is verified first, and
+// continued.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	last, err := verifyAuditLog(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &AuditLog{w: file, closer: file, seq: last.Seq, prev: last.Hash}, nil
+}
+
+// append writes the event, and returns its Seq. It keeps the first write
+// error, after which events are no longer written.
+func (l *AuditLog) append(ev AuditEvent) uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err != nil {
+		return 0
+	}
+	l.seq++
+	ev.Seq, ev.Prev = l.seq, l.prev
+	if ev.Item == 0 {
+		ev.Item = ev.Seq
+	}
+	if ev.Hash, l.err = ev.hash(); l.err != nil {
+		return 0
+	}
+	line, _ := json.Marshal(ev)
+	if _, l.err = l.w.Write(append(line, '\n')); l.err != nil {
+		return 0
+	}
+	l.prev = ev.Hash
+	return ev.Seq
+}
+
+// Err returns the first error writing the log, after which events are
+// no longer written.
+func (l *AuditLog) Err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.err
+}
+
+// Close closes the file of a log opened by OpenAuditLog.
+func (l *AuditLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closer == nil {
+		return nil
+	}
+	if l.err == nil {
+		l.err = os.ErrClosed
+	}
+	return l.closer.Close()
+}
+
+// VerifyAuditLog checks the chain of the events of an audit log, and
+// returns their number. It returns an error wrapping ErrTampered at the
+// first event that was changed, removed or inserted.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	last, err := verifyAuditLog(r)
+	return int(last.Seq), err
+}
+
+// verifyAuditLog returns the last event of a verified audit log.
+func verifyAuditLog(r io.Reader) (AuditEvent, error) {
+	in := bufio.NewScanner(r)
+	in.Buffer(nil, 1<<20)
+	var last AuditEvent
+	for in.Scan() {
+		var ev AuditEvent
+		if err := json.Unmarshal(in.Bytes(), &ev); err != nil {
+			return last, fmt.Errorf("audit event %d: %w", last.Seq+1, err)
+		}
+		hash, err := ev.hash()
+		if err != nil {
+			return last, err
+		}
+		if ev.Seq != last.Seq+1 || ev.Prev != last.Hash || ev.Hash != hash {
+			return last, fmt.Errorf("audit event %d: %w", last.Seq+1, ErrTampered)
+		}
+		last = ev
+	}
+	return last, in.Err()
+}
+
+// WithAuditLog streams the enqueues of the queue, and the dequeues,
+// cancellations, expirations and drops of its items, to the audit log.
+// The events are written with the lock of the queue held, in the order
+// of the operations. If describe is not nil, it identifies the data of
+// the events, e.g. by request id, but it must not reveal its contents.
+func WithAuditLog(l *AuditLog, describe func(data interface{}) string) Option {
+	return func(q *Queue) {
+		q.auditLog, q.describe = l, describe
+	}
+}
+
+// audit logs an operation on the entry, if the queue has an audit log.
+// It must be called with the lock held.
+func (q *Queue) audit(e *entry, op AuditOp) {
+	if q.auditLog == nil {
+		return
+	}
+	ev := AuditEvent{Time: q.now().UTC(), Op: op, Priority: e.Priority}
+	if op != AuditEnqueue {
+		ev.Item = e.audited
+	}
+	if q.describe != nil {
+		data := e.data
+		if f, ok := data.(*Future); ok {
+			data = f.Data
+		}
+		ev.Request = q.describe(data)
+	}
+	if seq := q.auditLog.append(ev); op == AuditEnqueue {
+		e.audited = seq
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func auditEvents(t *testing.T, log []byte) []AuditEvent {
+	var events []AuditEvent
+	in := bufio.NewScanner(bytes.NewReader(log))
+	for in.Scan() {
+		var ev AuditEvent
+		assert.Equal(t, nil, json.Unmarshal(in.Bytes(), &ev))
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	var sink bytes.Buffer
+	clock := &mockClock{t: time.Unix(1600000000, 0)}
+	q := New(WithClock(clock), WithAuditLog(NewAuditLog(&sink), func(data interface{}) string {
+		return "req-" + data.(string)
+	}))
+	q.Enqueue("a", 2)
+	cancel := q.EnqueueCancelable("b", 1)
+	q.EnqueueTTL("c", 1, time.Second)
+	cancel()
+	clock.advance(time.Second)
+	q.Dequeue()
+
+	var got []string
+	for _, ev := range auditEvents(t, sink.Bytes()) {
+		got = append(got, string(ev.Op)+" "+ev.Request)
+	}
+	assert.Equal(t, []string{"enqueue req-a", "enqueue req-b", "enqueue req-c", "cancel req-b", "expire req-c", "dequeue req-a"}, got)
+	events := auditEvents(t, sink.Bytes())
+	assert.Equal(t, uint64(1), events[5].Item, "the dequeue refers to the enqueue")
+	assert.Equal(t, uint64(2), events[3].Item)
+	assert.Equal(t, 2, events[5].Priority)
+
+	n, err := VerifyAuditLog(bytes.NewReader(sink.Bytes()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 6, n)
+
+	lines := strings.SplitAfter(sink.String(), "\n")
+	tampered := strings.Join(append(lines[:2:2], lines[3:]...), "")
+	n, err = VerifyAuditLog(strings.NewReader(tampered))
+	assert.Equal(t, true, errors.Is(err, ErrTampered), "removed event")
+	assert.Equal(t, 2, n)
+	tampered = strings.Replace(sink.String(), `"priority":2`, `"priority":0`, 1)
+	_, err = VerifyAuditLog(strings.NewReader(tampered))
+	assert.Equal(t, true, errors.Is(err, ErrTampered), "changed event")
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		l, err := OpenAuditLog(path)
+		assert.Equal(t, nil, err)
+		q := New(WithAuditLog(l, nil))
+		q.Enqueue(1, 1)
+		assert.Equal(t, nil, l.Close())
+
+		l, err = OpenAuditLog(path)
+		assert.Equal(t, nil, err, "the chain continues")
+		q = New(WithAuditLog(l, nil))
+		q.Enqueue(2, 1)
+		q.Dequeue()
+		assert.Equal(t, nil, l.Err())
+		l.Close()
+
+		file, _ := os.Open(path)
+		defer file.Close()
+		n, err := VerifyAuditLog(file)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 3, n)
+	})
+}
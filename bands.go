@@ -0,0 +1,115 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sort"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// Band is a class of priorities, from Min up to the Min of the next
+// band, e.g. "interactive" or "batch". The bands of a queue are dequeued
+// by Rank, the lowest first, and the data of a band in the order of the
+// queue, so that the relative order of whole classes can change at
+// runtime without touching the priorities of the data.
+type Band struct {
+	Name string
+	Min  int // the first band also holds the priorities below its Min
+	Rank int
+}
+
+// WithBands sets the priority bands of the queue, see SetBands.
+func WithBands(bands ...Band) Option {
+	return func(q *Queue) {
+		q.bands = sortBands(bands)
+	}
+}
+
+func sortBands(bands []Band) []Band {
+	sorted := append([]Band(nil), bands...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Min < sorted[j].Min })
+	return sorted
+}
+
+// SetBands redefines the priority bands of the queue, e.g. to put a
+// class ahead of the others during an incident, and re-classifies the
+// pending data in one pass, so that the change applies to the backlog
+// too. It takes O(n) time, where n is the size of the queue.
+func (q *Queue) SetBands(bands ...Band) {
+	q.lock.Lock()
+	defer q.unlock()
+	q.bands = sortBands(bands)
+	if !q.banded {
+		q.bandHeap()
+	}
+	for _, item := range (*q.heap)[1:] {
+		q.classify(entryOf(item))
+	}
+	q.heap.Compact(func(*heap.Item) bool { return false }) // heapifies
+	if q.floor != nil {
+		q.floor.reindex()
+	}
+	if q.delayed != nil {
+		for _, item := range (*q.delayed)[1:] {
+			q.classify(entryOf(item))
+		}
+	}
+}
+
+// Bands returns the priority bands of the queue, by Min.
+func (q *Queue) Bands() []Band {
+	q.lock.Lock()
+	defer q.unlock()
+	return append([]Band(nil), q.bands...)
+}
+
+// BandOf returns the band of the priority, and false if the queue has no
+// bands.
+func (q *Queue) BandOf(priority int) (Band, bool) {
+	q.lock.Lock()
+	defer q.unlock()
+	i := q.bandIndex(priority)
+	if i < 0 {
+		return Band{}, false
+	}
+	return q.bands[i], true
+}
+
+// bandIndex returns the index of the band of the priority, or -1 if
+// there is none. It must be called with the lock held.
+func (q *Queue) bandIndex(priority int) int {
+	if len(q.bands) == 0 {
+		return -1
+	}
+	i := sort.Search(len(q.bands), func(i int) bool { return q.bands[i].Min > priority }) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+// classify sets the rank of the entry. It must be called with the lock
+// held.
+func (q *Queue) classify(e *entry) {
+	if i := q.bandIndex(e.Priority); i >= 0 {
+		e.rank = q.bands[i].Rank
+	} else {
+		e.rank = 0
+	}
+}
+
+// bandHeap orders the heap by rank first, and then in its former order.
+// It must be called with the lock held.
+func (q *Queue) bandHeap() {
+	base := *q.heap
+	h := heap.NewHeapFunc(func(a, b *heap.Item) bool {
+		if ra, rb := entryOf(a).rank, entryOf(b).rank; ra != rb {
+			return ra < rb
+		}
+		return base.Before(a, b)
+	})
+	h = append(h, base[1:]...)
+	q.heap = &h
+	q.banded = true
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBands(t *testing.T) {
+	interactive := Band{Name: "interactive", Min: 0, Rank: 0}
+	batch := Band{Name: "batch", Min: 10, Rank: 1}
+	q := New(WithBands(batch, interactive))
+	assert.Equal(t, []Band{interactive, batch}, q.Bands())
+	band, ok := q.BandOf(-5)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, interactive, band)
+	band, _ = q.BandOf(12)
+	assert.Equal(t, batch, band)
+	_, ok = New().BandOf(1)
+	assert.Equal(t, false, ok)
+
+	for _, p := range []int{12, 5, 11, 3} {
+		q.Enqueue(p, p)
+	}
+	data, _, _ := q.Peek()
+	assert.Equal(t, 3, data)
+
+	// during an incident, batch jobs go first
+	batch.Rank = -1
+	q.SetBands(interactive, batch)
+	q.Enqueue(4, 4)
+	q.Enqueue(10, 10)
+	var order []interface{}
+	for !q.Empty() {
+		data, _ := q.Dequeue()
+		order = append(order, data)
+	}
+	assert.Equal(t, []interface{}{10, 11, 12, 3, 4, 5}, order)
+
+	t.Run("set at runtime on a queue without bands", func(t *testing.T) {
+		q := New(WithMaxFirst())
+		for _, p := range []int{1, 20, 2, 30} {
+			q.Enqueue(p, p)
+		}
+		q.SetBands(Band{Name: "low", Min: 0, Rank: 0}, Band{Name: "high", Min: 10, Rank: 1})
+		assert.Equal(t, []interface{}{2, 1, 30, 20}, q.DequeueBatch(4))
+	})
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Batcher collects data from a queue into batches for dynamic batching,
+// e.g. to run a deep model on several requests at once. A batch is
+// emitted as soon as it holds maxBatch items, or maxWait after its first
+// item was taken from the queue, whichever comes first, or when Flush
+// is called.
+type Batcher struct {
+	q        *Queue
+	maxBatch int
+	maxWait  time.Duration
+	out      chan []interface{}
+	flush    chan struct{}
+	sizing   *BatchSizing
+
+	lock       sync.Mutex
+	collecting bool // a batch has its first item, see Flush
+}
+
+// BatchSizing makes a Batcher adapt its maximum batch size to the
+// priority mix of the queue: small batches when interactive traffic
+// dominates, to keep its latency low, and large batches for bulk
+// traffic, to maximize throughput.
+type BatchSizing struct {
+	// Min and Max bound the maximum batch size, which is Min when all
+	// the queued items are interactive and Max when none is.
+	Min, Max int
+	// Interactive reports whether items of the given priority are
+	// interactive traffic.
+	Interactive func(priority int) bool
+}
+
+// NewBatcher is the constructor of Batcher.
+func NewBatcher(q *Queue, maxBatch int, maxWait time.Duration) *Batcher {
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	return &Batcher{
+		q:        q,
+		maxBatch: maxBatch,
+		maxWait:  maxWait,
+		out:      make(chan []interface{}),
+		flush:    make(chan struct{}, 1),
+	}
+}
+
+// NewAdaptiveBatcher is like NewBatcher, but the maximum batch size is
+// chosen between sizing.Min and sizing.Max from the priority histogram
+// of the queue every time a batch starts.
+func NewAdaptiveBatcher(q *Queue, sizing BatchSizing, maxWait time.Duration) *Batcher {
+	if sizing.Min < 1 {
+		sizing.Min = 1
+	}
+	if sizing.Max < sizing.Min {
+		sizing.Max = sizing.Min
+	}
+	b := NewBatcher(q, sizing.Max, maxWait)
+	b.sizing = &sizing
+	return b
+}
+
+// batchSize returns the maximum size of the next batch.
+func (b *Batcher) batchSize() int {
+	if b.sizing == nil {
+		return b.maxBatch
+	}
+	total, interactive := 0, 0
+	for priority, n := range b.q.Histogram() {
+		total += n
+		if b.sizing.Interactive(priority) {
+			interactive += n
+		}
+	}
+	if total == 0 {
+		return b.maxBatch // no mix to learn from, keep the last size
+	}
+	span := b.sizing.Max - b.sizing.Min
+	b.maxBatch = b.sizing.Max - (span*interactive+total/2)/total
+	return b.maxBatch
+}
+
+// Flush makes the batch being collected be emitted right away, e.g.
+// when the model becomes idle earlier than expected. It does nothing if
+// no batch is being collected.
+func (b *Batcher) Flush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.collecting {
+		return
+	}
+	select {
+	case b.flush <- struct{}{}:
+	default: // already pending
+	}
+}
+
+// collects marks whether a batch is being collected. A flush left
+// pending by the previous batch is discarded.
+func (b *Batcher) collects(collecting bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.collecting = collecting
+	select {
+	case <-b.flush:
+	default:
+	}
+}
+
+// Batches returns the channel on which batches are emitted. It is
+// closed when Run returns.
+func (b *Batcher) Batches() <-chan []interface{} {
+	return b.out
+}
+
+// Run collects and emits batches until ctx is done, or until the queue
+// is closed and drained. The batch being collected at that point is
+// flushed, so that no item taken from the queue is lost: consumers
+// should keep receiving until Batches is closed.
+func (b *Batcher) Run(ctx context.Context) {
+	defer close(b.out)
+	for {
+		first, err := b.q.DequeueCtx(ctx)
+		if err != nil {
+			return
+		}
+		b.collects(true)
+		batch := b.collect(ctx, first, b.batchSize())
+		b.collects(false)
+		b.out <- batch
+	}
+}
+
+func (b *Batcher) collect(ctx context.Context, first interface{}, maxBatch int) []interface{} {
+	batch := make([]interface{}, 1, maxBatch)
+	batch[0] = first
+	batch = append(batch, b.q.DequeueBatch(maxBatch-1)...)
+	if len(batch) == maxBatch {
+		return batch
+	}
+	wctx, cancel := context.WithTimeout(ctx, b.maxWait)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-b.flush:
+			cancel()
+		case <-wctx.Done():
+		}
+	}()
+	for len(batch) < maxBatch {
+		data, err := b.q.DequeueCtx(wctx)
+		if err != nil {
+			break
+		}
+		batch = append(batch, data)
+	}
+	cancel()
+	<-stopped // so that it takes no flush of the next batch
+	return batch
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatcher(t *testing.T) {
+	t.Run("flush on max batch size", func(t *testing.T) {
+		q := New()
+		for i := 0; i < 10; i++ {
+			q.Enqueue(i, 10-i)
+		}
+		b := NewBatcher(q, 4, time.Hour)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go b.Run(ctx)
+		assert.Equal(t, []interface{}{9, 8, 7, 6}, <-b.Batches())
+		assert.Equal(t, []interface{}{5, 4, 3, 2}, <-b.Batches())
+		q.Enqueue(-1, 0)
+		q.Enqueue(-2, 0)
+		assert.ElementsMatch(t, []interface{}{1, 0, -1, -2}, <-b.Batches())
+	})
+
+	t.Run("flush on max wait", func(t *testing.T) {
+		q := New()
+		b := NewBatcher(q, 100, 20*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go b.Run(ctx)
+		start := time.Now()
+		q.Enqueue(`a`, 1)
+		q.Enqueue(`b`, 1)
+		batch := <-b.Batches()
+		assert.Equal(t, []interface{}{`a`, `b`}, batch)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+	})
+
+	t.Run("explicit flush", func(t *testing.T) {
+		q := New()
+		b := NewBatcher(q, 100, time.Hour)
+		b.Flush() // nothing to flush yet
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go b.Run(ctx)
+		q.Enqueue(`a`, 1)
+		q.Enqueue(`b`, 1)
+		time.Sleep(10 * time.Millisecond)
+		b.Flush()
+		assert.Equal(t, []interface{}{`a`, `b`}, <-b.Batches())
+	})
+
+	t.Run("no flush while waiting for the first item", func(t *testing.T) {
+		q := New()
+		b := NewBatcher(q, 2, time.Hour)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go b.Run(ctx)
+		time.Sleep(10 * time.Millisecond)
+		b.Flush() // while Run waits for an item
+		q.Enqueue(`a`, 1)
+		time.Sleep(10 * time.Millisecond)
+		q.Enqueue(`b`, 1)
+		assert.Equal(t, []interface{}{`a`, `b`}, <-b.Batches())
+	})
+
+	t.Run("flush on shutdown", func(t *testing.T) {
+		q := New()
+		b := NewBatcher(q, 100, time.Hour)
+		ctx, cancel := context.WithCancel(context.Background())
+		go b.Run(ctx)
+		q.Enqueue(`a`, 1)
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		assert.Equal(t, []interface{}{`a`}, <-b.Batches())
+		_, ok := <-b.Batches()
+		assert.Equal(t, false, ok)
+	})
+
+	t.Run("batch size adapts to the priority mix", func(t *testing.T) {
+		q := New()
+		b := NewAdaptiveBatcher(q, BatchSizing{Min: 2, Max: 10, Interactive: func(priority int) bool {
+			return priority == 0
+		}}, time.Millisecond)
+		assert.Equal(t, 10, b.batchSize(), "starts at max")
+		for i := 0; i < 4; i++ {
+			q.Enqueue(`interactive`, 0)
+		}
+		assert.Equal(t, 2, b.batchSize())
+		for i := 0; i < 4; i++ {
+			q.Enqueue(`bulk`, 1)
+		}
+		assert.Equal(t, 6, b.batchSize())
+		q.DequeueBatch(4)
+		assert.Equal(t, 10, b.batchSize())
+		q.DequeueBatch(4)
+		assert.Equal(t, 10, b.batchSize(), "keeps the last size")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 8; i++ {
+			q.Enqueue(`interactive`, 0)
+		}
+		go b.Run(ctx)
+		assert.Equal(t, 2, len(<-b.Batches()))
+	})
+
+	t.Run("closes output on cancellation", func(t *testing.T) {
+		q := New()
+		b := NewBatcher(q, 8, time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			b.Run(ctx)
+			close(done)
+		}()
+		cancel()
+		<-done
+		_, ok := <-b.Batches()
+		assert.Equal(t, false, ok)
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "sync/atomic"
+
+// retryBudget is a token bucket bounding the extra load of hedges and
+// retries: every original item deposits ratio tokens, up to burst, and
+// every extra one withdraws a whole token. It is guarded by the lock of
+// the queue.
+type retryBudget struct {
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+func (b *retryBudget) deposit() {
+	b.tokens += b.ratio
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// WithRetryBudget bounds the extra load of hedged duplicates and retries
+// to a ratio of the original items, e.g. 0.1 for 10%, so that tail
+// latency mitigation cannot itself overload the system during an
+// incident. Up to burst extra items may be enqueued at once when the
+// budget was not used for a while, and the budget starts full. There is
+// no budget by default.
+func WithRetryBudget(ratio float64, burst int) Option {
+	return func(q *Queue) {
+		q.budget = &retryBudget{ratio: ratio, burst: float64(burst), tokens: float64(burst)}
+	}
+}
+
+// AllowRetry reports whether the retry budget of the queue allows one
+// more extra item, such as a retry done by the application, and spends
+// it if so. It is always true if there is no budget, see
+// WithRetryBudget.
+func (q *Queue) AllowRetry() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.allowRetry()
+}
+
+// allowRetry must be called with the lock held.
+func (q *Queue) allowRetry() bool {
+	if q.budget == nil || q.budget.withdraw() {
+		return true
+	}
+	atomic.AddUint64(&q.stats.throttled, 1)
+	return false
+}
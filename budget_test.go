@@ -0,0 +1,50 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudget(t *testing.T) {
+	t.Run("unlimited by default", func(t *testing.T) {
+		q := New()
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, true, q.AllowRetry())
+		}
+	})
+
+	t.Run("ratio of the original items", func(t *testing.T) {
+		q := New(WithRetryBudget(0.25, 2))
+		assert.Equal(t, true, q.AllowRetry())
+		assert.Equal(t, true, q.AllowRetry())
+		assert.Equal(t, false, q.AllowRetry(), "burst spent")
+		for i := 0; i < 3; i++ {
+			q.Enqueue(i, i)
+		}
+		assert.Equal(t, false, q.AllowRetry())
+		q.Enqueue(3, 3)
+		assert.Equal(t, true, q.AllowRetry())
+		assert.Equal(t, false, q.AllowRetry())
+		for i := 0; i < 100; i++ {
+			q.Enqueue(i, i)
+		}
+		assert.Equal(t, true, q.AllowRetry())
+		assert.Equal(t, true, q.AllowRetry())
+		assert.Equal(t, false, q.AllowRetry(), "capped at burst")
+		assert.Equal(t, uint64(4), q.Stats().Throttled())
+	})
+
+	t.Run("hedges are throttled", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock(WithRetryBudget(0.1, 0))
+		q.EnqueueHedged(`critical`, 5, time.Second, 0)
+		assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		clock.advance(time.Second)
+		assert.Eventually(t, func() bool { return q.Stats().Throttled() == 1 }, time.Second, time.Millisecond)
+		assert.Equal(t, 1, q.Len())
+		assert.Equal(t, uint64(0), q.Stats().Hedged())
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of a queue, which tests can replace with
+// a fake one, see WithClock.
+type Clock interface {
+	Now() time.Time
+	// After sends the time on the returned channel once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// timer is a callback that can be stopped, see afterFunc.
+type timer interface {
+	// Stop reports whether it stopped the callback before it ran.
+	Stop() bool
+}
+
+// afterFunc calls f in its own goroutine once d has elapsed on the
+// clock, like time.AfterFunc, which it is for the real clock.
+func afterFunc(c Clock, d time.Duration, f func()) timer {
+	if _, ok := c.(realClock); ok {
+		return time.AfterFunc(d, f)
+	}
+	t := &clockTimer{stop: make(chan struct{})}
+	fired := c.After(d)
+	go func() {
+		select {
+		case <-fired:
+			if t.fire() {
+				f()
+			}
+		case <-t.stop:
+		}
+	}()
+	return t
+}
+
+// clockTimer is a timer of a clock other than the real one.
+type clockTimer struct {
+	lock sync.Mutex
+	done bool // stopped or fired
+	stop chan struct{}
+}
+
+func (t *clockTimer) Stop() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return false
+	}
+	t.done = true
+	close(t.stop)
+	return true
+}
+
+func (t *clockTimer) fire() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.done {
+		return false
+	}
+	t.done = true
+	return true
+}
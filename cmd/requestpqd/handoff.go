@@ -0,0 +1,74 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/lkevinzc/requestpq/v2"
+)
+
+// handoffFD is the file descriptor of the pipe on which the previous
+// process of a graceful restart sends its backlog, after the listener.
+const handoffFD = listenFDsStart + 1
+
+// handoffEnv tells the new process of a graceful restart that a backlog
+// is coming on handoffFD.
+const handoffEnv = "REQUESTPQD_HANDOFF"
+
+// inheritedBacklog returns the pipe of the backlog of the previous
+// process, if any.
+func inheritedBacklog() *os.File {
+	if os.Getenv(handoffEnv) != "1" {
+		return nil
+	}
+	os.Unsetenv(handoffEnv) // not for the next restart
+	return os.NewFile(handoffFD, "handoff")
+}
+
+// sendBacklog drains the closed queue into w, as JSON lines, in the
+// order of the queue. It returns the number of tasks sent. Tasks are
+// removed from the queue before being sent, so that none is served
+// twice.
+func sendBacklog(w io.Writer, q *requestpq.Queue) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	for {
+		data, err := q.Dequeue()
+		if err != nil {
+			return n, nil // drained
+		}
+		if err := enc.Encode(data.(task)); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// receiveBacklog enqueues the tasks sent by sendBacklog into their queue
+// of s until r is closed. It returns the number of tasks received.
+// Since the tasks come in the order of the previous queue, ties are
+// still broken in FIFO order.
+func receiveBacklog(r io.Reader, s *server) (int, error) {
+	in := bufio.NewScanner(r)
+	in.Buffer(nil, 64<<20)
+	n := 0
+	for in.Scan() {
+		var t task
+		if err := json.Unmarshal(in.Bytes(), &t); err != nil {
+			return n, err
+		}
+		x, err := s.queue(t.Queue)
+		if err != nil {
+			return n, err
+		}
+		if err := x.enqueue(t, true); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, in.Err()
+}
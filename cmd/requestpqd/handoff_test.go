@@ -0,0 +1,48 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBacklogHandoff(t *testing.T) {
+	old := newServer(limits{}, time.Minute, 0)
+	x, _ := old.queue("")
+	for i, data := range []string{`"low"`, `"high 1"`, `"high 2"`} {
+		priority := 1
+		if i == 0 {
+			priority = 2
+		}
+		x.enqueue(task{Data: json.RawMessage(data), Priority: priority}, false)
+	}
+	other, _ := old.queue("other")
+	other.enqueue(task{Data: json.RawMessage(`"other"`)}, false)
+	var pipe bytes.Buffer
+	for _, x := range old.all() {
+		x.q.Close()
+		_, err := sendBacklog(&pipe, x.q)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 0, x.q.Len())
+	}
+
+	// the budgets of the new process don't drop tasks of the backlog
+	s := newServer(limits{bytes: 1}, time.Minute, 0)
+	x, _ = s.queue("")
+	x.enqueue(task{Data: json.RawMessage(`"new"`), Priority: 1}, true)
+	n, err := receiveBacklog(&pipe, s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, n)
+	var got []string
+	for _, data := range x.q.DequeueBatch(4) {
+		got = append(got, string(data.(task).Data))
+	}
+	assert.Equal(t, []string{`"new"`, `"high 1"`, `"high 2"`, `"low"`}, got)
+	other, _ = s.queue("other")
+	assert.Equal(t, 1, other.q.Len())
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation, see sd_listen_fds(3).
+const listenFDsStart = 3
+
+// listen returns the listener passed by systemd socket activation, or
+// by the previous process on a graceful restart, if any, and otherwise
+// listens on addr.
+func listen(addr string) (net.Listener, error) {
+	if activated(os.Getenv, os.Getpid()) {
+		f := os.NewFile(listenFDsStart, "listener")
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// activated tests if a listener was passed to the process. systemd sets
+// LISTEN_PID to the pid of the process, while restart leaves it unset.
+func activated(getenv func(string) string, pid int) bool {
+	if n, err := strconv.Atoi(getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return false
+	}
+	if s := getenv("LISTEN_PID"); s != "" && s != strconv.Itoa(pid) {
+		return false
+	}
+	return true
+}
+
+// restart starts a new process of the server, with the same arguments,
+// which takes over the listener, so that the old one can be shut down
+// gracefully without refusing connections, e.g. to upgrade the binary.
+// It returns the pipe on which to send the backlog of the old process
+// to the new one, see sendBacklog.
+func restart(l net.Listener) (*os.File, error) {
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	path, err := os.Executable()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{f, r} // from fd 3 on
+	cmd.Env = append(withoutListenEnv(os.Environ()), "LISTEN_FDS=1", handoffEnv+"=1")
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func withoutListenEnv(env []string) []string {
+	kept := env[:0:0]
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if name != "LISTEN_FDS" && name != "LISTEN_PID" && name != "LISTEN_FDNAMES" {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,23 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivated(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+	assert.Equal(t, false, activated(env(nil), 42))
+	assert.Equal(t, false, activated(env(map[string]string{"LISTEN_FDS": "0"}), 42))
+	assert.Equal(t, true, activated(env(map[string]string{"LISTEN_FDS": "1", "LISTEN_PID": "42"}), 42))
+	assert.Equal(t, false, activated(env(map[string]string{"LISTEN_FDS": "1", "LISTEN_PID": "7"}), 42), "meant for another process")
+	assert.Equal(t, true, activated(env(map[string]string{"LISTEN_FDS": "1"}), 42), "graceful restart")
+
+	assert.Equal(t, []string{"PATH=/bin", "LISTEN_ADDR=:80"},
+		withoutListenEnv([]string{"LISTEN_FDS=1", "PATH=/bin", "LISTEN_PID=7", "LISTEN_ADDR=:80", "LISTEN_FDNAMES=http"}))
+}
@@ -0,0 +1,347 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+// Command requestpqd serves priority queues over HTTP, so that services
+// not written in Go can share them. Data is any JSON value:
+//
+//	POST /enqueue          {"data": ..., "priority": 1}
+//	POST /dequeue?wait=5s  -> {"data": ..., "priority": 1}, or 204 if empty
+//	GET  /stats            -> {"len": 0, "enqueued": 0, ...}
+//	GET  /aging            -> {"1": [0, 2, 0, 0, 0], ...}
+//
+// Workers processing long tasks may rather lease them, so that a task is
+// redelivered if its worker dies before completing it:
+//
+//	POST /receive?wait=5s                 -> {"receipt": "1f", "data": ..., "priority": 1}
+//	POST /heartbeat?receipt=1f&extend=1m  -> 204, or 404 if the lease is over
+//	POST /complete?receipt=1f             -> 204, or 404 if the lease is over
+//	POST /release?receipt=1f              -> 204, or 404 if the lease is over
+//
+// A leased task is redelivered once its visibility timeout passes, see
+// the -visibility flag, unless heartbeats extend it, by the visibility
+// timeout if extend is omitted. After the first heartbeat, it is
+// redelivered as soon as the heartbeats stop for the -missed-heartbeat
+// duration. Release redelivers it right away.
+//
+// The aging report counts the queued tasks of every priority by age:
+// below 10ms, 100ms, 1s, 10s, and older.
+//
+// Every request may name its queue with the queue parameter, e.g.
+// /enqueue?queue=billing, or else is about the default queue. Queues are
+// created on first use, up to -max-queues, and are isolated from each
+// other: each has its own budgets, so that a tenant hitting the limits of
+// its queue degrades only that queue. Enqueue answers 503 when the queue
+// is full, see the -capacity flag, or when the data of its tasks, queued
+// or leased, would exceed -queue-bytes. Requests other than the long polls
+// answer 429 when the queue has -queue-concurrency requests in progress.
+//
+// When the queues are tenants, their producers may seal the data with the
+// keys of the tenant, see requestpq.Keyring, so that the operators of the
+// server can manage the backlog, by priority and metadata, but not read
+// the requests. With -sealed, enqueue answers 400 unless the data is a
+// requestpq.Envelope whose tenant is the queue:
+//
+//	POST /enqueue?queue=acme  {"data": {"tenant": "acme", "key_id": "k1", "nonce": ..., "ciphertext": ...}, "priority": 1}
+//
+// On SIGINT or SIGTERM the server stops accepting connections, ends the
+// long polls and finishes the other requests in progress.
+//
+// The server accepts a listening socket passed by systemd socket
+// activation instead of listening on -addr. On SIGHUP, it restarts
+// gracefully, e.g. after an upgrade of the binary: it starts a new
+// process that takes the socket over, and then shuts down, so that no
+// connection is refused meanwhile. Once its requests in progress are
+// finished, the old process hands the tasks still queued over to the new
+// one, through a pipe, so that none is lost or served twice.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+)
+
+type task struct {
+	Data     json.RawMessage `json:"data"`
+	Priority int             `json:"priority"`
+	// Queue is only set in the backlog handed over on restart.
+	Queue string `json:"queue,omitempty"`
+}
+
+type leased struct {
+	Receipt  string          `json:"receipt"`
+	Data     json.RawMessage `json:"data"`
+	Priority int             `json:"priority"`
+}
+
+type stats struct {
+	Len       int    `json:"len"`
+	Enqueued  uint64 `json:"enqueued"`
+	Dequeued  uint64 `json:"dequeued"`
+	Expired   uint64 `json:"expired"`
+	Cancelled uint64 `json:"cancelled"`
+	Dropped   uint64 `json:"dropped"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// maxWait bounds the long polls of /dequeue.
+const maxWait = time.Minute
+
+func newHandler(s *server) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/enqueue", s.handle(true, func(w http.ResponseWriter, r *http.Request, x *queue) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var t task
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil || t.Data == nil {
+			http.Error(w, "bad task", http.StatusBadRequest)
+			return
+		}
+		if err := s.check(x, t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := x.enqueue(t, false); {
+		case errors.Is(err, requestpq.ErrQueueFull), errors.Is(err, requestpq.ErrQueueClosed), err == errMemoryBudget:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	mux.HandleFunc("/dequeue", s.handle(false, func(w http.ResponseWriter, r *http.Request, x *queue) {
+		ctx, cancel, ok := poll(w, r)
+		if !ok {
+			return
+		}
+		defer cancel()
+		data, err := x.q.DequeueCtx(ctx)
+		if err != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		t := data.(task)
+		x.done(t)
+		t.Queue = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}))
+	mux.HandleFunc("/receive", s.handle(false, func(w http.ResponseWriter, r *http.Request, x *queue) {
+		ctx, cancel, ok := poll(w, r)
+		if !ok {
+			return
+		}
+		defer cancel()
+		l, err := x.d.Receive(ctx)
+		if err != nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leased{Receipt: l.Receipt, Data: l.Data.(task).Data, Priority: l.Priority})
+	}))
+	mux.HandleFunc("/heartbeat", s.handle(true, receipt(func(r *http.Request, x *queue, receipt string) error {
+		var extend time.Duration // the visibility timeout
+		if s := r.URL.Query().Get("extend"); s != "" {
+			var err error
+			if extend, err = time.ParseDuration(s); err != nil {
+				return errBadExtend
+			}
+		}
+		return x.d.Heartbeat(receipt, extend)
+	})))
+	mux.HandleFunc("/complete", s.handle(true, receipt(func(r *http.Request, x *queue, receipt string) error {
+		l, err := x.d.Get(receipt)
+		if err != nil {
+			return err
+		}
+		if err := x.d.Complete(receipt); err != nil {
+			return err
+		}
+		x.done(l.Data.(task))
+		return nil
+	})))
+	mux.HandleFunc("/release", s.handle(true, receipt(func(r *http.Request, x *queue, receipt string) error {
+		return x.d.Release(receipt)
+	})))
+	mux.HandleFunc("/stats", s.handle(false, func(w http.ResponseWriter, r *http.Request, x *queue) {
+		st := x.q.Stats()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats{
+			Len:       x.q.Len(),
+			Enqueued:  st.Enqueued(),
+			Dequeued:  st.Dequeued(),
+			Expired:   st.Expired(),
+			Cancelled: st.Cancelled(),
+			Dropped:   st.Dropped(),
+			Bytes:     atomic.LoadInt64(&x.bytes),
+		})
+	}))
+	mux.HandleFunc("/aging", s.handle(false, func(w http.ResponseWriter, r *http.Request, x *queue) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(x.q.Aging())
+	}))
+	return mux
+}
+
+// handle serves the requests about the queue named by the queue
+// parameter with fn. If limited is set, the requests take a slot of the
+// queue, or are answered 429 if there is none left.
+func (s *server) handle(limited bool, fn func(w http.ResponseWriter, r *http.Request, x *queue)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		x, err := s.queue(r.URL.Query().Get("queue"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if limited {
+			if err := x.acquire(); err != nil {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			defer x.release()
+		}
+		fn(w, r, x)
+	}
+}
+
+var errBadExtend = errors.New("bad extend")
+
+// poll checks a long poll request, and returns the context bounding its
+// wait. If the request is bad, it answers it and ok is false.
+func poll(w http.ResponseWriter, r *http.Request) (ctx context.Context, cancel context.CancelFunc, ok bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	var wait time.Duration
+	if s := r.URL.Query().Get("wait"); s != "" {
+		var err error
+		if wait, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "bad wait", http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	ctx, cancel = context.WithTimeout(r.Context(), wait)
+	return ctx, cancel, true
+}
+
+// receipt handles a request about the lease of a receipt with fn.
+func receipt(fn func(r *http.Request, x *queue, receipt string) error) func(http.ResponseWriter, *http.Request, *queue) {
+	return func(w http.ResponseWriter, r *http.Request, x *queue) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch err := fn(r, x, r.URL.Query().Get("receipt")); {
+		case errors.Is(err, requestpq.ErrNotFound):
+			http.Error(w, "lease is over", http.StatusNotFound)
+		case err == errBadExtend:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	capacity := flag.Int("capacity", 0, "maximum number of queued tasks per queue, 0 for unbounded")
+	queueBytes := flag.Int64("queue-bytes", 0, "maximum size of the data of the tasks of a queue, 0 for unbounded")
+	concurrency := flag.Int("queue-concurrency", 0, "maximum number of requests in progress per queue, long polls aside, 0 for unbounded")
+	maxQueues := flag.Int("max-queues", 100, "maximum number of queues, 0 for unbounded")
+	sealed := flag.Bool("sealed", false, "only accept data sealed in an envelope for the tenant of its queue")
+	grace := flag.Duration("grace", 30*time.Second, "how long to wait for requests in progress on shutdown")
+	visibility := flag.Duration("visibility", 30*time.Second, "how long a received task is leased without heartbeat")
+	missed := flag.Duration("missed-heartbeat", 0, "redeliver a leased task once its heartbeats stop for this long, 0 to wait for the visibility timeout")
+	flag.Parse()
+
+	s := newServer(limits{items: *capacity, bytes: *queueBytes, concurrency: *concurrency, queues: *maxQueues}, *visibility, *missed)
+	s.sealed = *sealed
+	// long polls end on shutdown rather than holding it up
+	polls, cancelPolls := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Handler:     newHandler(s),
+		BaseContext: func(net.Listener) context.Context { return polls },
+	}
+	srv.RegisterOnShutdown(cancelPolls)
+
+	l, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if backlog := inheritedBacklog(); backlog != nil {
+		go func() {
+			defer backlog.Close()
+			n, err := receiveBacklog(backlog, s)
+			log.Printf("received %d tasks from the previous process", n)
+			if err != nil {
+				log.Printf("handoff: %v", err)
+			}
+		}()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var handoff *os.File
+		select {
+		case <-ctx.Done():
+		case <-hup:
+			if handoff, err = restart(l); err != nil {
+				log.Printf("restart: %v", err)
+				<-ctx.Done()
+			}
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *grace)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		queues := s.all()
+		for _, x := range queues {
+			x.d.Close() // leased tasks are handed over too
+			x.q.Close()
+		}
+		if handoff != nil {
+			total := 0
+			for _, x := range queues {
+				n, err := sendBacklog(handoff, x.q)
+				total += n
+				if err != nil {
+					log.Printf("handoff: %v", err)
+					break
+				}
+			}
+			handoff.Close()
+			log.Printf("handed %d tasks over to the new process", total)
+		}
+	}()
+
+	log.Printf("serving on %s", l.Addr())
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
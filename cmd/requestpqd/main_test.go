@@ -0,0 +1,115 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	h := newHandler(newServer(limits{items: 2}, time.Minute, 0))
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusAccepted, do("POST", "/enqueue", `{"data": "low", "priority": 2}`).Code)
+	assert.Equal(t, http.StatusAccepted, do("POST", "/enqueue", `{"data": {"id": 1}, "priority": 1}`).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, do("POST", "/enqueue", `{"data": 3}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/enqueue", `{}`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("GET", "/enqueue", ``).Code)
+
+	w := do("GET", "/stats", ``)
+	assert.JSONEq(t, `{"len": 2, "enqueued": 2, "dequeued": 0, "expired": 0, "cancelled": 0, "dropped": 0, "bytes": 14}`, w.Body.String())
+
+	assert.JSONEq(t, `{"1": [1, 0, 0, 0, 0], "2": [1, 0, 0, 0, 0]}`, do("GET", "/aging", ``).Body.String())
+
+	assert.JSONEq(t, `{"data": {"id": 1}, "priority": 1}`, do("POST", "/dequeue", ``).Body.String())
+	assert.JSONEq(t, `{"data": "low", "priority": 2}`, do("POST", "/dequeue?wait=1ms", ``).Body.String())
+	assert.Equal(t, http.StatusNoContent, do("POST", "/dequeue?wait=1ms", ``).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/dequeue?wait=soon", ``).Code)
+
+	do("POST", "/enqueue", `{"data": "long", "priority": 1}`)
+	w = do("POST", "/receive", ``)
+	var x leased
+	assert.Equal(t, nil, json.NewDecoder(w.Body).Decode(&x))
+	assert.Equal(t, `"long"`, string(x.Data))
+	assert.Equal(t, http.StatusNoContent, do("POST", "/receive?wait=1ms", ``).Code)
+	assert.Equal(t, http.StatusNoContent, do("POST", "/heartbeat?receipt="+x.Receipt+"&extend=1h", ``).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/heartbeat?receipt="+x.Receipt+"&extend=long", ``).Code)
+	assert.Equal(t, http.StatusNoContent, do("POST", "/release?receipt="+x.Receipt, ``).Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/complete?receipt="+x.Receipt, ``).Code)
+	w = do("POST", "/receive", ``)
+	assert.Equal(t, nil, json.NewDecoder(w.Body).Decode(&x))
+	assert.Equal(t, `"long"`, string(x.Data), "redelivered")
+	assert.Equal(t, http.StatusNoContent, do("POST", "/complete?receipt="+x.Receipt, ``).Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/heartbeat?receipt="+x.Receipt, ``).Code)
+}
+
+func TestQueueLimits(t *testing.T) {
+	s := newServer(limits{bytes: 6, concurrency: 1, queues: 2}, time.Minute, 0)
+	h := newHandler(s)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	assert.Equal(t, http.StatusAccepted, do("POST", "/enqueue?queue=a", `{"data": "1234"}`).Code)
+	assert.Equal(t, http.StatusServiceUnavailable, do("POST", "/enqueue?queue=a", `{"data": "1234"}`).Code, "over budget")
+	assert.Equal(t, http.StatusAccepted, do("POST", "/enqueue?queue=b", `{"data": "1234"}`).Code, "other queue")
+	assert.Equal(t, http.StatusServiceUnavailable, do("POST", "/enqueue?queue=c", `{"data": 1}`).Code, "too many queues")
+
+	w := do("POST", "/receive?queue=a", ``)
+	var x leased
+	assert.Equal(t, nil, json.NewDecoder(w.Body).Decode(&x))
+	assert.Equal(t, http.StatusServiceUnavailable, do("POST", "/enqueue?queue=a", `{"data": 1}`).Code, "leased data counts")
+	assert.Equal(t, http.StatusNoContent, do("POST", "/complete?queue=a&receipt="+x.Receipt, ``).Code)
+	assert.Equal(t, http.StatusAccepted, do("POST", "/enqueue?queue=a", `{"data": 1}`).Code)
+	do("POST", "/dequeue?queue=a", ``)
+	assert.JSONEq(t, `{"len": 0, "enqueued": 2, "dequeued": 2, "expired": 0, "cancelled": 0, "dropped": 0, "bytes": 0}`, do("GET", "/stats?queue=a", ``).Body.String())
+
+	a, _ := s.queue("a")
+	assert.Equal(t, nil, a.acquire())
+	assert.Equal(t, http.StatusTooManyRequests, do("POST", "/enqueue?queue=a", `{"data": 1}`).Code, "busy")
+	assert.Equal(t, http.StatusOK, do("POST", "/dequeue?queue=b", ``).Code, "other queue")
+	a.release()
+	assert.Equal(t, http.StatusAccepted, do("POST", "/enqueue?queue=a", `{"data": 1}`).Code)
+}
+
+func TestSealed(t *testing.T) {
+	s := newServer(limits{}, time.Minute, 0)
+	s.sealed = true
+	h := newHandler(s)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	keys := requestpq.NewKeyring()
+	keys.Add("acme", "k1", make([]byte, 16))
+	e, _ := keys.Seal("acme", []byte("secret"), nil)
+	data, _ := json.Marshal(e)
+	sealed, _ := json.Marshal(task{Data: data, Priority: 1})
+
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/enqueue?queue=acme", `{"data": "secret"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/enqueue?queue=other", string(sealed)).Code, "other tenant")
+	assert.Equal(t, http.StatusAccepted, do("POST", "/enqueue?queue=acme", string(sealed)).Code)
+
+	var got task
+	assert.Equal(t, nil, json.NewDecoder(do("POST", "/dequeue?queue=acme", ``).Body).Decode(&got))
+	var opened requestpq.Envelope
+	assert.Equal(t, nil, json.Unmarshal(got.Data, &opened))
+	payload, err := keys.Open(&opened)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "secret", string(payload))
+}
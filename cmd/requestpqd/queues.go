@@ -0,0 +1,158 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+)
+
+// defaultQueue is the queue of the requests that don't name one.
+const defaultQueue = "default"
+
+var (
+	errTooManyQueues = errors.New("too many queues")
+	errMemoryBudget  = errors.New("memory budget of the queue exceeded")
+	errBusy          = errors.New("too many requests in progress for the queue")
+	errNotSealed     = errors.New("data is not sealed for the tenant of the queue")
+)
+
+// limits are the budgets of every queue, so that a tenant hitting the
+// limits of its queue degrades that queue only, and not the daemon.
+// Zero means unbounded.
+type limits struct {
+	// items bounds the queued tasks, see requestpq.WithCapacity.
+	items int
+	// bytes bounds the data of the queued and leased tasks.
+	bytes int64
+	// concurrency bounds the requests in progress other than the long
+	// polls, which bounds the CPU time taken by the queue.
+	concurrency int
+	// queues bounds the number of queues.
+	queues int
+}
+
+// queue is a named queue of the server.
+type queue struct {
+	name   string
+	q      *requestpq.Queue
+	d      *requestpq.Deliveries
+	bytes  int64 // of the data of the queued and leased tasks
+	budget int64
+	slots  chan struct{} // requests in progress, nil if unbounded
+}
+
+// server holds the queues of the daemon, created on first use.
+type server struct {
+	limits limits
+	// sealed requires the data to be a requestpq.Envelope whose tenant
+	// is the name of its queue.
+	sealed     bool
+	visibility time.Duration
+	missed     time.Duration
+	lock       sync.Mutex
+	queues     map[string]*queue
+}
+
+func newServer(l limits, visibility, missed time.Duration) *server {
+	return &server{limits: l, visibility: visibility, missed: missed, queues: make(map[string]*queue)}
+}
+
+// queue returns the queue of the given name, or of the default queue if
+// name is empty.
+func (s *server) queue(name string) (*queue, error) {
+	if name == "" {
+		name = defaultQueue
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if x, ok := s.queues[name]; ok {
+		return x, nil
+	}
+	if s.limits.queues > 0 && len(s.queues) >= s.limits.queues {
+		return nil, errTooManyQueues
+	}
+	q := requestpq.New(requestpq.WithCapacity(s.limits.items))
+	x := &queue{name: name, q: q, d: requestpq.NewDeliveries(q, s.visibility, s.missed), budget: s.limits.bytes}
+	if s.limits.concurrency > 0 {
+		x.slots = make(chan struct{}, s.limits.concurrency)
+	}
+	s.queues[name] = x
+	return x, nil
+}
+
+// all returns the queues by name.
+func (s *server) all() []*queue {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queues := make([]*queue, 0, len(s.queues))
+	for _, x := range s.queues {
+		queues = append(queues, x)
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+	return queues
+}
+
+// acquire takes a request slot of the queue, or returns errBusy.
+func (x *queue) acquire() error {
+	if x.slots == nil {
+		return nil
+	}
+	select {
+	case x.slots <- struct{}{}:
+		return nil
+	default:
+		return errBusy
+	}
+}
+
+func (x *queue) release() {
+	if x.slots != nil {
+		<-x.slots
+	}
+}
+
+// enqueue puts the task into the queue within its memory budget. If
+// block is set, as for the backlog handed over on restart, it waits for
+// room instead, and the budget is ignored so that no task is lost.
+func (x *queue) enqueue(t task, block bool) error {
+	n := int64(len(t.Data))
+	if b := atomic.AddInt64(&x.bytes, n); !block && x.budget > 0 && b > x.budget {
+		atomic.AddInt64(&x.bytes, -n)
+		return errMemoryBudget
+	}
+	t.Queue = x.name
+	var err error
+	if block {
+		err = x.q.Enqueue(t, t.Priority)
+	} else {
+		err = x.q.TryEnqueue(t, t.Priority)
+	}
+	if err != nil {
+		atomic.AddInt64(&x.bytes, -n)
+	}
+	return err
+}
+
+// done accounts for a task that left the queue for good.
+func (x *queue) done(t task) {
+	atomic.AddInt64(&x.bytes, -int64(len(t.Data)))
+}
+
+// check checks that the data of the task may be queued into x.
+func (s *server) check(x *queue, t task) error {
+	if !s.sealed {
+		return nil
+	}
+	var e requestpq.Envelope
+	if err := json.Unmarshal(t.Data, &e); err != nil || len(e.Ciphertext) == 0 || e.Tenant != x.name {
+		return errNotSealed
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+// Command requestpqload generates load on a requestpq.Queue and prints
+// the results as JSON, so that the performance of versions can be
+// tracked and compared by scripts:
+//
+//	requestpqload -producers 4 -consumers 4 -items 100000 -label v1.2.0 > v1.2.0.json
+//
+// The results hold the configuration of the run, the throughput, the
+// percentiles of the latency from enqueue to dequeue for every priority,
+// in nanoseconds, and the allocations made during the run.
+//
+// With -soak, it runs the configuration in rounds, with consecutive
+// seeds, for the given duration, and cross-checks invariants: the items
+// of the same producer and priority are dequeued in order, every item is
+// dequeued exactly once, and the goroutines and the heap don't grow from
+// round to round. It prints every violation as a line of JSON, with the
+// seed reproducing its round, and exits with status 1 if there is any:
+//
+//	requestpqload -soak 1h -items 10000
+//	{"round": 42, "seed": 169, "invariant": "order", "detail": "..."}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+)
+
+type config struct {
+	Label      string  `json:"label,omitempty"`
+	Producers  int     `json:"producers"`
+	Consumers  int     `json:"consumers"`
+	Items      int     `json:"items"`
+	Priorities int     `json:"priorities"`
+	Rate       float64 `json:"rate"` // items per second per producer, 0 for unlimited
+	Capacity   int     `json:"capacity"`
+	Seed       int64   `json:"seed"` // of the priorities of the first producer, the next ones get the next seeds
+}
+
+type result struct {
+	Config     config          `json:"config"`
+	Go         string          `json:"go"`
+	GOMAXPROCS int             `json:"gomaxprocs"`
+	Duration   time.Duration   `json:"duration_ns"`
+	Throughput float64         `json:"throughput"` // items per second
+	Latency    map[int]latency `json:"latency"`
+	Allocs     allocs          `json:"allocs"`
+}
+
+type latency struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+type allocs struct {
+	Mallocs      uint64  `json:"mallocs"`
+	Bytes        uint64  `json:"bytes"`
+	GC           uint32  `json:"gc"`
+	MallocsPerOp float64 `json:"mallocs_per_item"`
+	BytesPerOp   float64 `json:"bytes_per_item"`
+}
+
+// share returns the number of items enqueued by the i-th producer.
+func (c config) share(i int) int {
+	n := c.Items / c.Producers
+	if i < c.Items%c.Producers {
+		n++
+	}
+	return n
+}
+
+// item is the data enqueued by the producers.
+type item struct {
+	producer int
+	seq      int
+	priority int
+	enqueued time.Time
+}
+
+// run enqueues c.Items items, spread over the producers and with random
+// priorities, and dequeues them with the consumers, which pass them to
+// the checker, if any.
+func run(c config, k *checker) result {
+	var opts []requestpq.Option
+	if c.Capacity > 0 {
+		opts = append(opts, requestpq.WithCapacity(c.Capacity))
+	}
+	q := requestpq.New(opts...)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	var producers sync.WaitGroup
+	for i := 0; i < c.Producers; i++ {
+		n := c.share(i)
+		producers.Add(1)
+		go func(producer, n int, r *rand.Rand) {
+			defer producers.Done()
+			var tick *time.Ticker
+			if c.Rate > 0 {
+				tick = time.NewTicker(time.Duration(float64(time.Second) / c.Rate))
+				defer tick.Stop()
+			}
+			for j := 0; j < n; j++ {
+				if tick != nil {
+					<-tick.C
+				}
+				priority := r.Intn(c.Priorities)
+				q.Enqueue(&item{producer: producer, seq: j, priority: priority, enqueued: time.Now()}, priority)
+			}
+		}(i, n, rand.New(rand.NewSource(c.Seed+int64(i))))
+	}
+	go func() {
+		producers.Wait()
+		q.Close()
+	}()
+
+	var consumers sync.WaitGroup
+	var lock sync.Mutex
+	waits := make(map[int][]time.Duration)
+	for i := 0; i < c.Consumers; i++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			local := make(map[int][]time.Duration)
+			var check func(*item)
+			if k != nil {
+				check = k.consumer()
+			}
+			for {
+				data, err := q.DequeueCtx(context.Background())
+				if err != nil {
+					break
+				}
+				it := data.(*item)
+				if check != nil {
+					check(it)
+				}
+				local[it.priority] = append(local[it.priority], time.Since(it.enqueued))
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for priority, d := range local {
+				waits[priority] = append(waits[priority], d...)
+			}
+		}()
+	}
+	consumers.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	res := result{
+		Config:     c,
+		Go:         runtime.Version(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Duration:   elapsed,
+		Throughput: float64(c.Items) / elapsed.Seconds(),
+		Latency:    make(map[int]latency),
+		Allocs: allocs{
+			Mallocs: after.Mallocs - before.Mallocs,
+			Bytes:   after.TotalAlloc - before.TotalAlloc,
+			GC:      after.NumGC - before.NumGC,
+		},
+	}
+	if c.Items > 0 {
+		res.Allocs.MallocsPerOp = float64(res.Allocs.Mallocs) / float64(c.Items)
+		res.Allocs.BytesPerOp = float64(res.Allocs.Bytes) / float64(c.Items)
+	}
+	for priority, d := range waits {
+		res.Latency[priority] = percentiles(d)
+	}
+	return res
+}
+
+// percentiles sorts d and returns its nearest-rank percentiles.
+func percentiles(d []time.Duration) latency {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(d))+0.999999) - 1
+		if i < 0 {
+			i = 0
+		}
+		return d[i]
+	}
+	return latency{Count: len(d), P50: rank(0.5), P90: rank(0.9), P99: rank(0.99), Max: d[len(d)-1]}
+}
+
+func main() {
+	var c config
+	flag.StringVar(&c.Label, "label", "", "label of the run in the results, e.g. the version under test")
+	flag.IntVar(&c.Producers, "producers", 4, "number of goroutines enqueuing")
+	flag.IntVar(&c.Consumers, "consumers", 4, "number of goroutines dequeuing")
+	flag.IntVar(&c.Items, "items", 100000, "number of items to enqueue")
+	flag.IntVar(&c.Priorities, "priorities", 4, "number of priorities, drawn uniformly")
+	flag.Float64Var(&c.Rate, "rate", 0, "items per second per producer, 0 for unlimited")
+	flag.IntVar(&c.Capacity, "capacity", 0, "maximum number of queued items, 0 for unbounded")
+	flag.Int64Var(&c.Seed, "seed", 1, "seed of the priorities")
+	soakFor := flag.Duration("soak", 0, "run in rounds for this long, checking invariants, instead of once")
+	flag.Parse()
+	if c.Producers <= 0 || c.Consumers <= 0 || c.Priorities <= 0 || c.Items < 0 {
+		log.Fatal("producers, consumers and priorities must be positive")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	if *soakFor > 0 {
+		violations := 0
+		rounds := soak(c, *soakFor, func(v violation) {
+			violations++
+			enc.Encode(v)
+		})
+		log.Printf("%d rounds, %d violations", rounds, violations)
+		if violations > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(run(c, nil)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	res := run(config{Producers: 3, Consumers: 2, Items: 1000, Priorities: 2}, nil)
+	assert.Equal(t, 2, len(res.Latency))
+	assert.Equal(t, 1000, res.Latency[0].Count+res.Latency[1].Count)
+	assert.Greater(t, res.Throughput, 0.0)
+	assert.LessOrEqual(t, res.Latency[0].P50, res.Latency[0].Max)
+
+	b, err := json.Marshal(res)
+	assert.Equal(t, nil, err)
+	var decoded map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(b, &decoded))
+	assert.Contains(t, decoded, "throughput")
+	assert.Contains(t, decoded["latency"], "1")
+	assert.Equal(t, 1000.0, decoded["config"].(map[string]interface{})["items"])
+}
+
+func TestPercentiles(t *testing.T) {
+	var d []time.Duration
+	for i := 100; i > 0; i-- {
+		d = append(d, time.Duration(i))
+	}
+	assert.Equal(t, latency{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}, percentiles(d))
+	assert.Equal(t, latency{Count: 1, P50: 7, P90: 7, P99: 7, Max: 7}, percentiles([]time.Duration{7}))
+}
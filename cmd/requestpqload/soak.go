@@ -0,0 +1,127 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// violation is a broken invariant found by soak. Running the
+// configuration with its seed reproduces the round.
+type violation struct {
+	Round     int    `json:"round"`
+	Seed      int64  `json:"seed"`
+	Invariant string `json:"invariant"`
+	Detail    string `json:"detail"`
+}
+
+// checker cross-checks the items dequeued in a run: those of the same
+// producer and priority are dequeued in the order they were enqueued,
+// and every item is dequeued exactly once.
+type checker struct {
+	lock       sync.Mutex
+	seen       [][]bool // by producer and sequence number
+	violations []violation
+}
+
+func newChecker(c config) *checker {
+	k := &checker{seen: make([][]bool, c.Producers)}
+	for i := range k.seen {
+		k.seen[i] = make([]bool, c.share(i))
+	}
+	return k
+}
+
+func (k *checker) violate(invariant, format string, args ...interface{}) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.violations = append(k.violations, violation{Invariant: invariant, Detail: fmt.Sprintf(format, args...)})
+}
+
+// consumer returns the check of the items dequeued by one consumer. A
+// consumer dequeues one item at a time, so the items it gets of the same
+// producer and priority must come in order, whatever the others get.
+func (k *checker) consumer() func(it *item) {
+	last := make(map[[2]int]int)
+	return func(it *item) {
+		key := [2]int{it.producer, it.priority}
+		if prev, ok := last[key]; ok && it.seq < prev {
+			k.violate("order", "producer %d, priority %d: item %d dequeued after item %d", it.producer, it.priority, it.seq, prev)
+		}
+		last[key] = it.seq
+		k.lock.Lock()
+		dup := k.seen[it.producer][it.seq]
+		k.seen[it.producer][it.seq] = true
+		k.lock.Unlock()
+		if dup {
+			k.violate("conservation", "producer %d: item %d dequeued twice", it.producer, it.seq)
+		}
+	}
+}
+
+// finish checks that no item was lost, and returns the violations.
+func (k *checker) finish() []violation {
+	for producer, seen := range k.seen {
+		lost := 0
+		for _, ok := range seen {
+			if !ok {
+				lost++
+			}
+		}
+		if lost > 0 {
+			k.violate("conservation", "producer %d: %d items lost", producer, lost)
+		}
+	}
+	return k.violations
+}
+
+// soak runs the configuration in rounds of consecutive seeds, starting
+// from c.Seed, until d passes, checking the items of every round, and
+// that the goroutines of the rounds exit and the heap doesn't grow from
+// round to round. It passes the violations to report, and returns the
+// number of rounds.
+func soak(c config, d time.Duration, report func(violation)) int {
+	deadline := time.Now().Add(d)
+	goroutines := runtime.NumGoroutine()
+	var heap uint64
+	round := 0
+	for ; round == 0 || time.Now().Before(deadline); round++ {
+		rc := c
+		rc.Seed = c.Seed + int64(round)*int64(c.Producers)
+		k := newChecker(rc)
+		run(rc, k)
+		found := k.finish()
+
+		n, inUse := settle(goroutines)
+		if round == 0 {
+			heap = inUse
+		}
+		if n > goroutines {
+			found = append(found, violation{Invariant: "goroutines", Detail: fmt.Sprintf("%d goroutines after the round, %d before the first one", n, goroutines)})
+		}
+		if inUse > 2*heap+4<<20 {
+			found = append(found, violation{Invariant: "heap", Detail: fmt.Sprintf("%d bytes in use after the round, %d after the first one", inUse, heap)})
+		}
+		for _, v := range found {
+			v.Round, v.Seed = round, rc.Seed
+			report(v)
+		}
+	}
+	return round
+}
+
+// settle gives the goroutines of a round up to a second to exit, and
+// returns the number of goroutines and the heap in use after a GC.
+func settle(goroutines int) (int, uint64) {
+	n := runtime.NumGoroutine()
+	for wait := time.Now().Add(time.Second); n > goroutines && time.Now().Before(wait); n = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return n, m.HeapInuse
+}
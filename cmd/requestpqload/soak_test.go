@@ -0,0 +1,34 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	k := newChecker(config{Producers: 2, Items: 5})
+	a, b := k.consumer(), k.consumer()
+	a(&item{producer: 0, seq: 1, priority: 1})
+	b(&item{producer: 0, seq: 0, priority: 1}) // another consumer may lag
+	a(&item{producer: 1, seq: 1, priority: 1})
+	a(&item{producer: 1, seq: 0, priority: 1})
+	a(&item{producer: 1, seq: 0, priority: 1})
+	assert.Equal(t, []violation{
+		{Invariant: "order", Detail: "producer 1, priority 1: item 0 dequeued after item 1"},
+		{Invariant: "conservation", Detail: "producer 1: item 0 dequeued twice"},
+		{Invariant: "conservation", Detail: "producer 0: 1 items lost"},
+	}, k.finish())
+}
+
+func TestSoak(t *testing.T) {
+	var violations []violation
+	rounds := soak(config{Producers: 2, Consumers: 2, Items: 100, Priorities: 3}, 50*time.Millisecond, func(v violation) {
+		violations = append(violations, v)
+	})
+	assert.Greater(t, rounds, 1)
+	assert.Empty(t, violations)
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"reflect"
+)
+
+// CopyFunc returns a copy of data that shares no mutable memory with it.
+type CopyFunc func(data interface{}) interface{}
+
+// DeepCopy is a CopyFunc that recursively copies pointers, slices, maps,
+// arrays, interfaces and the exported fields of structs. Unexported
+// fields are copied shallowly, and channels and functions are shared.
+// Memory shared within data, cycles included, is shared within the copy
+// too.
+func DeepCopy(data interface{}) interface{} {
+	if data == nil {
+		return nil
+	}
+	return deepCopy(reflect.ValueOf(data), make(map[visit]reflect.Value)).Interface()
+}
+
+// visit is a pointer, map or slice already copied. The type tells apart
+// a struct from its first field, and the length a slice from its prefix.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func deepCopy(v reflect.Value, visited map[visit]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		key := visit{v.Pointer(), v.Type(), 0}
+		if c, ok := visited[key]; ok {
+			return c
+		}
+		c := reflect.New(v.Type().Elem())
+		visited[key] = c
+		c.Elem().Set(deepCopy(v.Elem(), visited))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopy(v.Elem(), visited))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		key := visit{v.Pointer(), v.Type(), v.Len()}
+		if c, ok := visited[key]; ok {
+			return c
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		visited[key] = c
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i), visited))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i), visited))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		key := visit{v.Pointer(), v.Type(), 0}
+		if c, ok := visited[key]; ok {
+			return c
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		visited[key] = c
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(deepCopy(iter.Key(), visited), deepCopy(iter.Value(), visited))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(deepCopy(v.Field(i), visited))
+			}
+		}
+		return c
+	default:
+		return v
+	}
+}
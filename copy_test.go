@@ -0,0 +1,77 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type copyPayload struct {
+	Name   string
+	Tensor []float32
+	Meta   map[string]*int
+	Next   *copyPayload
+	Any    interface{}
+	hidden []byte
+}
+
+func TestDeepCopy(t *testing.T) {
+	one := 1
+	src := &copyPayload{
+		Name:   `req`,
+		Tensor: []float32{1, 2, 3},
+		Meta:   map[string]*int{`one`: &one},
+		Next:   &copyPayload{Name: `next`},
+		Any:    []byte(`buf`),
+		hidden: []byte(`shared`),
+	}
+	dst := DeepCopy(src).(*copyPayload)
+	assert.Equal(t, src, dst)
+
+	src.Tensor[0] = 42
+	*src.Meta[`one`] = 42
+	src.Next.Name = `changed`
+	src.Any.([]byte)[0] = 'x'
+	assert.Equal(t, float32(1), dst.Tensor[0])
+	assert.Equal(t, 1, *dst.Meta[`one`])
+	assert.Equal(t, `next`, dst.Next.Name)
+	assert.Equal(t, []byte(`buf`), dst.Any)
+	assert.Nil(t, DeepCopy(nil))
+	assert.Equal(t, 3.14, DeepCopy(3.14))
+}
+
+func TestDeepCopyCycles(t *testing.T) {
+	ring := &copyPayload{Name: `a`, Next: &copyPayload{Name: `b`}}
+	ring.Next.Next = ring
+	ring.Any = ring.Next
+	dst := DeepCopy(ring).(*copyPayload)
+	assert.Equal(t, `b`, dst.Next.Name)
+	assert.Same(t, dst, dst.Next.Next)
+	assert.Same(t, dst.Next, dst.Any)
+	assert.NotSame(t, ring, dst)
+
+	self := map[string]interface{}{}
+	self[`self`] = self
+	copied := DeepCopy(self).(map[string]interface{})
+	copied[`new`] = true
+	assert.Equal(t, true, copied[`self`].(map[string]interface{})[`new`])
+	assert.Len(t, self, 1)
+}
+
+func TestCopyOnEnqueue(t *testing.T) {
+	buf := []byte(`first`)
+
+	q := New()
+	q.Enqueue(buf, 1)
+	copy(buf, `reuse`)
+	data, _ := q.Dequeue()
+	assert.Equal(t, []byte(`reuse`), data) // zero-copy by default
+
+	q = New(WithCopyOnEnqueue(DeepCopy))
+	q.Enqueue(buf, 1)
+	copy(buf, `again`)
+	data, _ = q.Dequeue()
+	assert.Equal(t, []byte(`reuse`), data)
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync"
+	"time"
+)
+
+// Response is the outcome of a task, delivered to its waiter.
+type Response struct {
+	Result interface{}
+	Err    error
+}
+
+// Correlator maps task IDs to the frontends waiting for their response,
+// so that a request handler which enqueues a task and the worker which
+// produces its result can be wired together. Waiters that don't get a
+// response within the timeout receive ErrTimeout and are forgotten.
+type Correlator struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	waiters map[string]*waiter
+}
+
+type waiter struct {
+	ch    chan Response
+	timer *time.Timer
+}
+
+// NewCorrelator is the constructor of Correlator.
+func NewCorrelator(timeout time.Duration) *Correlator {
+	return &Correlator{
+		timeout: timeout,
+		waiters: make(map[string]*waiter),
+	}
+}
+
+// Register starts waiting for the response of the task with the given
+// ID. The returned channel receives exactly one Response.
+func (c *Correlator) Register(id string) (<-chan Response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.waiters[id]; ok {
+		return nil, ErrDuplicateID
+	}
+	w := &waiter{ch: make(chan Response, 1)}
+	w.timer = time.AfterFunc(c.timeout, func() {
+		c.deliver(id, w, Response{Err: ErrTimeout})
+	})
+	c.waiters[id] = w
+	return w.ch, nil
+}
+
+// Resolve delivers the response of the task with the given ID. It
+// reports whether someone was still waiting for it.
+func (c *Correlator) Resolve(id string, result interface{}, err error) bool {
+	c.lock.Lock()
+	w, ok := c.waiters[id]
+	c.lock.Unlock()
+	if !ok {
+		return false
+	}
+	return c.deliver(id, w, Response{Result: result, Err: err})
+}
+
+// Forget stops waiting for the task with the given ID, e.g. when the
+// client went away. No response is delivered.
+func (c *Correlator) Forget(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if w, ok := c.waiters[id]; ok {
+		w.timer.Stop()
+		delete(c.waiters, id)
+	}
+}
+
+// Len returns the number of waiters.
+func (c *Correlator) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+func (c *Correlator) deliver(id string, w *waiter, resp Response) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.waiters[id] != w {
+		return false // already delivered, or forgotten
+	}
+	delete(c.waiters, id)
+	w.timer.Stop()
+	w.ch <- resp
+	return true
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorrelator(t *testing.T) {
+	t.Run("resolve and timeout", func(t *testing.T) {
+		c := NewCorrelator(20 * time.Millisecond)
+		ok, err := c.Register(`ok`)
+		assert.Equal(t, nil, err)
+		late, _ := c.Register(`late`)
+		_, err = c.Register(`ok`)
+		assert.Equal(t, ErrDuplicateID, err)
+
+		failure := errors.New("failure")
+		assert.Equal(t, true, c.Resolve(`ok`, 42, failure))
+		assert.Equal(t, false, c.Resolve(`ok`, 43, nil))
+		assert.Equal(t, Response{Result: 42, Err: failure}, <-ok)
+
+		assert.Equal(t, Response{Err: ErrTimeout}, <-late)
+		assert.Equal(t, false, c.Resolve(`late`, 42, nil))
+		assert.Equal(t, 0, c.Len())
+	})
+
+	t.Run("forget", func(t *testing.T) {
+		c := NewCorrelator(time.Hour)
+		_, _ = c.Register(`gone`)
+		c.Forget(`gone`)
+		assert.Equal(t, false, c.Resolve(`gone`, 42, nil))
+		assert.Equal(t, 0, c.Len())
+	})
+
+	t.Run("frontend and worker", func(t *testing.T) {
+		c := NewCorrelator(time.Second)
+		q := New()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			for {
+				data, err := q.DequeueCtx(ctx)
+				if err != nil {
+					return
+				}
+				id := data.(string)
+				c.Resolve(id, `result of `+id, nil)
+			}
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				ch, err := c.Register(id)
+				assert.Equal(t, nil, err)
+				q.Enqueue(id, 0)
+				resp := <-ch
+				assert.Equal(t, nil, resp.Err)
+				assert.Equal(t, `result of `+id, resp.Result)
+			}(fmt.Sprint(i))
+		}
+		wg.Wait()
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// EnqueueAt puts the data into the priority queue like Enqueue, but the
+// data is invisible until t: it is not dequeued nor counted by Len
+// before, e.g. to schedule retries or pace requests. Data whose time
+// has passed is enqueued right away.
+//
+// A timer makes delayed data visible on time, waking blocked consumers
+// up. If the queue is bounded, full and blocks, delayed data waits for
+// room; otherwise the overflow policy applies when it becomes visible.
+func (q *Queue) EnqueueAt(data interface{}, priority int, t time.Time) error {
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return err
+	}
+	return q.enqueueAt(e, t, true)
+}
+
+// enqueueAt puts the entry into the queue at t. If the queue is full
+// and the entry visible, it blocks or returns ErrQueueFull as block
+// tells.
+func (q *Queue) enqueueAt(e *entry, t time.Time, block bool) error {
+	e.visible = t
+	q.lock.Lock()
+	defer q.unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if !t.After(q.now()) {
+		return q.insert(e, block)
+	}
+	q.postpone(e)
+	if q.wal != nil {
+		q.logEnqueue(e)
+	}
+	return nil
+}
+
+// postpone holds the entry until its visible time. It must be called
+// with the lock held.
+func (q *Queue) postpone(e *entry) {
+	if q.delayed == nil {
+		h := heap.NewHeapFunc(func(a, b *heap.Item) bool {
+			return entryOf(a).visible.Before(entryOf(b).visible)
+		})
+		q.delayed = &h
+	}
+	q.delayed.Push(&e.Item)
+	q.promote() // arms the timer
+}
+
+// Delayed returns the number of delayed items that are not visible yet.
+func (q *Queue) Delayed() int {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	if q.delayed == nil {
+		return 0
+	}
+	return q.delayed.Len()
+}
+
+// promote makes the delayed entries whose time has come visible, and
+// arms the timer for the next one. It must be called with the lock
+// held.
+func (q *Queue) promote() {
+	if q.delayed == nil || q.delayed.Empty() {
+		return
+	}
+	now := q.now()
+	for !q.delayed.Empty() {
+		e := entryOf(q.delayed.Peek().(*heap.Item))
+		if e.visible.After(now) {
+			break
+		}
+		if q.full(e) && q.overflow == Block {
+			return // promoted again by the pop making room
+		}
+		q.delayed.Pop()
+		_ = q.place(e, false)
+	}
+	if q.delayed.Empty() {
+		return
+	}
+	next := entryOf(q.delayed.Peek().(*heap.Item)).visible
+	if q.delay != nil && !q.delayAt.After(next) {
+		return // fires early enough
+	}
+	if q.delay != nil {
+		q.delay.Stop()
+	}
+	q.delayAt = next
+	q.delay = afterFunc(q.clock, next.Sub(now), q.wake)
+}
+
+// wake is run by the delay timer.
+func (q *Queue) wake() {
+	q.lock.Lock()
+	defer q.unlock()
+	q.delay = nil
+	q.expire()
+}
+
+// discardDelayed discards the delayed entries of a closing queue: their
+// futures, e.g. of retries, are resolved with ErrQueueClosed. They are
+// not overflow drops, so they are not counted as dropped nor reported
+// to OnDrop. It must be called with the lock held.
+func (q *Queue) discardDelayed() {
+	if q.delayed == nil {
+		return
+	}
+	for !q.delayed.Empty() {
+		e := entryOf(q.delayed.Pop().(*heap.Item))
+		q.left(e)
+		q.audit(e, AuditCancel)
+		if e.group != nil {
+			e.group.done()
+		}
+		if _, ok := e.data.(*Future); ok {
+			q.discarded = append(q.discarded, e)
+		}
+	}
+	if q.delay != nil {
+		q.delay.Stop()
+		q.delay = nil
+	}
+}
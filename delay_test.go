@@ -0,0 +1,86 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueueAt(t *testing.T) {
+	t.Run("invisible until due", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock()
+		now := q.now()
+		q.EnqueueAt(`later`, 0, now.Add(2*time.Second))
+		q.EnqueueAt(`soon`, 0, now.Add(time.Second))
+		q.EnqueueAt(`now`, 5, now)
+		assert.Equal(t, 1, q.Len())
+		assert.Equal(t, 2, q.Delayed())
+		data, _ := q.Dequeue()
+		assert.Equal(t, `now`, data)
+		_, err := q.Dequeue()
+		assert.Equal(t, ErrQueueEmpty, err)
+
+		clock.advance(time.Second)
+		assert.Equal(t, 1, q.Len())
+		data, _ = q.Dequeue()
+		assert.Equal(t, `soon`, data)
+		clock.advance(time.Second)
+		data, _ = q.Dequeue()
+		assert.Equal(t, `later`, data)
+		assert.Equal(t, 0, q.Delayed())
+	})
+
+	t.Run("wakes blocked consumers", func(t *testing.T) {
+		q := New()
+		start := time.Now()
+		q.EnqueueAt(`test`, 0, start.Add(20*time.Millisecond))
+		data, err := q.DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `test`, data)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+	})
+
+	t.Run("wakes blocked consumers on the clock of the queue", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock()
+		q.EnqueueAt(`test`, 0, q.now().Add(time.Second))
+		got := make(chan interface{}, 1)
+		go func() {
+			data, _ := q.DequeueCtx(context.Background())
+			got <- data
+		}()
+		assert.Equal(t, 1, clock.waiting())
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 0, len(got))
+		clock.advance(time.Second)
+		assert.Equal(t, `test`, <-got)
+	})
+
+	t.Run("waits for room in a full queue", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock(WithCapacity(1))
+		q.Enqueue(`first`, 0)
+		q.EnqueueAt(`delayed`, 0, q.now().Add(time.Second))
+		clock.advance(time.Second)
+		assert.Equal(t, 1, q.Len())
+		assert.Equal(t, 1, q.Delayed())
+		data, _ := q.Dequeue()
+		assert.Equal(t, `first`, data)
+		assert.Equal(t, 1, q.Len())
+	})
+
+	t.Run("discarded on close", func(t *testing.T) {
+		q := New()
+		q.EnqueueAt(`test`, 0, time.Now().Add(time.Hour))
+		f := newFuture(`retried`)
+		q.EnqueueAt(f, 0, time.Now().Add(time.Hour))
+		q.Close()
+		assert.Equal(t, 0, q.Delayed())
+		assert.Equal(t, uint64(0), q.Stats().Dropped(), "not an overflow")
+		_, err := f.Wait(context.Background())
+		assert.Equal(t, ErrQueueClosed, err)
+		assert.Equal(t, ErrQueueClosed, q.EnqueueAt(`test`, 0, time.Now()))
+	})
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Deliveries hands the data of a queue out to external workers, e.g.
+// over RPC, with the lease and receipt model: every received item comes
+// with a receipt, and is hidden from the other workers until it is
+// completed, or redelivered once its visibility timeout passes.
+//
+// Workers processing long tasks heartbeat to extend the visibility
+// timeout. Once a worker has heartbeated, it must keep doing so at
+// least every missAfter: its item is redelivered as soon as the
+// heartbeats stop, instead of at the end of the timeout. The timeouts
+// are measured with the clock of the queue, see WithClock.
+type Deliveries struct {
+	q          *Queue
+	visibility time.Duration
+	missAfter  time.Duration
+	lock       sync.Mutex
+	next       uint64
+	leased     map[string]*delivery
+}
+
+// Delivery is an item received from Deliveries.
+type Delivery struct {
+	Receipt  string
+	Data     interface{}
+	Priority int
+}
+
+type delivery struct {
+	e     *entry
+	until time.Time // the visibility timeout
+	beat  time.Time // last heartbeat, if any
+	timer timer
+}
+
+// NewDeliveries returns Deliveries for the data of q, with the given
+// visibility timeout. A non-positive missAfter disables the redelivery
+// on missed heartbeats.
+func NewDeliveries(q *Queue, visibility, missAfter time.Duration) *Deliveries {
+	return &Deliveries{q: q, visibility: visibility, missAfter: missAfter, leased: make(map[string]*delivery)}
+}
+
+// Receive dequeues data like Queue.DequeueCtx, and leases it until its
+// visibility timeout.
+func (d *Deliveries) Receive(ctx context.Context) (Delivery, error) {
+	e, _, err := d.q.dequeueCtx(ctx)
+	if err != nil {
+		return Delivery{}, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.next++
+	receipt := strconv.FormatUint(d.next, 16)
+	x := &delivery{e: e, until: d.q.now().Add(d.visibility)}
+	d.leased[receipt] = x
+	d.arm(receipt, x)
+	return Delivery{Receipt: receipt, Data: e.data, Priority: e.Priority}, nil
+}
+
+// Heartbeat tells that the worker holding the receipt is alive, and
+// extends the visibility timeout to at least extend from now, or the
+// visibility timeout of d if extend is not positive. It returns
+// ErrNotFound if the lease is over, in which case the data was
+// redelivered or completed.
+func (d *Deliveries) Heartbeat(receipt string, extend time.Duration) error {
+	if extend <= 0 {
+		extend = d.visibility
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	x, ok := d.leased[receipt]
+	if !ok {
+		return ErrNotFound
+	}
+	x.beat = d.q.now()
+	if until := x.beat.Add(extend); until.After(x.until) {
+		x.until = until
+	}
+	d.arm(receipt, x)
+	return nil
+}
+
+// Get returns the leased item of a receipt, or ErrNotFound if the lease
+// is over.
+func (d *Deliveries) Get(receipt string) (Delivery, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	x, ok := d.leased[receipt]
+	if !ok {
+		return Delivery{}, ErrNotFound
+	}
+	return Delivery{Receipt: receipt, Data: x.e.data, Priority: x.e.Priority}, nil
+}
+
+// Complete ends the lease of processed data, and acks it, see
+// Queue.Ack. It returns ErrNotFound if the lease is already over.
+func (d *Deliveries) Complete(receipt string) error {
+	x, err := d.remove(receipt)
+	if err != nil {
+		return err
+	}
+	d.q.Ack()
+	if x.e.group != nil {
+		x.e.group.Ack()
+	}
+	return nil
+}
+
+// Release ends the lease of data that the worker gives up, which is
+// redelivered right away. It returns ErrNotFound if the lease is
+// already over, and the error of the queue, e.g. ErrQueueClosed, if the
+// data cannot be redelivered, in which case it stays leased.
+func (d *Deliveries) Release(receipt string) error {
+	x, err := d.remove(receipt)
+	if err != nil {
+		return err
+	}
+	return d.redeliver(receipt, x)
+}
+
+// Leased returns the number of items currently leased.
+func (d *Deliveries) Leased() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.leased)
+}
+
+// Close redelivers all the leased items, e.g. before the queue is
+// closed. The receipts of the redelivered items are refused afterwards.
+func (d *Deliveries) Close() {
+	d.lock.Lock()
+	leased := d.leased
+	d.leased = make(map[string]*delivery)
+	d.lock.Unlock()
+	for receipt, x := range leased {
+		x.timer.Stop()
+		d.redeliver(receipt, x)
+	}
+}
+
+func (d *Deliveries) remove(receipt string) (*delivery, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	x, ok := d.leased[receipt]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(d.leased, receipt)
+	x.timer.Stop()
+	return x, nil
+}
+
+// expiry returns when the lease ends.
+func (d *Deliveries) expiry(x *delivery) time.Time {
+	if d.missAfter > 0 && !x.beat.IsZero() {
+		if missed := x.beat.Add(d.missAfter); missed.Before(x.until) {
+			return missed
+		}
+	}
+	return x.until
+}
+
+// arm sets the timer ending the lease. It must be called with the lock
+// held.
+func (d *Deliveries) arm(receipt string, x *delivery) {
+	if x.timer != nil {
+		x.timer.Stop()
+	}
+	x.timer = afterFunc(d.q.clock, d.expiry(x).Sub(d.q.now()), func() {
+		d.lock.Lock()
+		if d.leased[receipt] != x || d.q.now().Before(d.expiry(x)) {
+			d.lock.Unlock()
+			return // completed, or extended meanwhile
+		}
+		delete(d.leased, receipt)
+		d.lock.Unlock()
+		d.redeliver(receipt, x)
+	})
+}
+
+// redeliver puts the data of an ended lease back into the queue, with
+// its priority. If the queue refuses it, e.g. since it is closed, the
+// data is leased again under its receipt, without a timeout, so that it
+// is not lost: the worker may still complete it.
+func (d *Deliveries) redeliver(receipt string, x *delivery) error {
+	acked := d.q.ack(1) // first, so that a bounded queue can make room
+	err := d.q.transfer(x.e, true)
+	if err == nil {
+		return nil
+	}
+	d.q.lock.Lock()
+	d.q.inflight += acked // still leased
+	d.q.lock.Unlock()
+	d.lock.Lock()
+	d.leased[receipt] = x
+	d.lock.Unlock()
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveries(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("complete", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`a`, 1)
+		d := NewDeliveries(q, time.Minute, 0)
+		x, err := d.Receive(ctx)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `a`, x.Data)
+		assert.Equal(t, 1, d.Leased())
+		assert.Equal(t, 1, q.Inflight())
+		y, err := d.Get(x.Receipt)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, x, y)
+		assert.Equal(t, nil, d.Complete(x.Receipt))
+		_, err = d.Get(x.Receipt)
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.ErrorIs(t, d.Complete(x.Receipt), ErrNotFound)
+		assert.Equal(t, 0, d.Leased())
+		assert.Equal(t, 0, q.Inflight())
+	})
+
+	t.Run("redelivered after the visibility timeout", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`a`, 2)
+		d := NewDeliveries(q, 10*time.Millisecond, 0)
+		x, _ := d.Receive(ctx)
+		y, err := d.Receive(ctx)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `a`, y.Data)
+		assert.Equal(t, 2, y.Priority)
+		assert.NotEqual(t, x.Receipt, y.Receipt)
+		assert.ErrorIs(t, d.Heartbeat(x.Receipt, time.Minute), ErrNotFound)
+	})
+
+	t.Run("heartbeats extend the lease", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`a`, 1)
+		d := NewDeliveries(q, 20*time.Millisecond, 20*time.Millisecond)
+		x, _ := d.Receive(ctx)
+		for i := 0; i < 5; i++ {
+			time.Sleep(10 * time.Millisecond)
+			assert.Equal(t, nil, d.Heartbeat(x.Receipt, 20*time.Millisecond))
+		}
+		assert.Equal(t, 0, q.Len())
+		assert.Equal(t, nil, d.Complete(x.Receipt))
+	})
+
+	t.Run("redelivered once heartbeats stop", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`a`, 1)
+		d := NewDeliveries(q, time.Minute, 10*time.Millisecond)
+		x, _ := d.Receive(ctx)
+		d.Heartbeat(x.Receipt, time.Hour)
+		wctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		y, err := d.Receive(wctx)
+		assert.Equal(t, nil, err, "long before the visibility timeout")
+		assert.Equal(t, `a`, y.Data)
+	})
+
+	t.Run("release and close", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`a`, 1)
+		q.Enqueue(`b`, 2)
+		d := NewDeliveries(q, time.Minute, 0)
+		x, _ := d.Receive(ctx)
+		assert.Equal(t, nil, d.Release(x.Receipt))
+		x, _ = d.Receive(ctx)
+		assert.Equal(t, `a`, x.Data)
+		d.Receive(ctx)
+		assert.Equal(t, 0, q.Len())
+		d.Close()
+		assert.Equal(t, 2, q.Len())
+		assert.Equal(t, 0, d.Leased())
+		assert.ErrorIs(t, d.Complete(x.Receipt), ErrNotFound)
+	})
+	t.Run("fake clock", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock()
+		q.Enqueue(`a`, 1)
+		d := NewDeliveries(q, time.Minute, 0)
+		x, _ := d.Receive(ctx)
+		assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		clock.advance(time.Minute)
+		assert.Eventually(t, func() bool { return q.Len() == 1 }, time.Second, time.Millisecond)
+		assert.ErrorIs(t, d.Complete(x.Receipt), ErrNotFound)
+	})
+
+	t.Run("kept leased once the queue is closed", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`a`, 1)
+		d := NewDeliveries(q, time.Minute, 0)
+		x, _ := d.Receive(ctx)
+		q.Close()
+		assert.ErrorIs(t, d.Release(x.Receipt), ErrQueueClosed)
+		assert.Equal(t, 1, d.Leased())
+		assert.Equal(t, 1, q.Inflight())
+		d.Close()
+		assert.Equal(t, 1, d.Leased())
+		assert.Equal(t, nil, d.Complete(x.Receipt))
+		assert.Equal(t, 0, q.Inflight())
+	})
+}
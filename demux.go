@@ -0,0 +1,55 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "sort"
+
+// DemuxByClass is like Decorate, but splits the tasks of inChan
+// into a fixed set of priority classes, each with its own output
+// channel, so that downstream can dedicate workers to every class. Like
+// a Band, a class holds the priorities from its value up to the next
+// class, and the first class also holds the priorities below it.
+//
+// The returned channels are keyed by class. Each is in priority order,
+// and is closed once inChan is closed and the data of its class is
+// delivered. A consumer that stops reading only holds up its own class,
+// unless WithSlowConsumer pauses the input. Nil tasks are reported
+// through the error handler of the first class.
+func DemuxByClass(inChan chan *Task, classes []int, opts ...DecorateOption) map[int]<-chan interface{} {
+	sorted := append([]int(nil), classes...)
+	sort.Ints(sorted)
+	unique := sorted[:0]
+	for i, class := range sorted {
+		if i == 0 || class != sorted[i-1] {
+			unique = append(unique, class)
+		}
+	}
+	outChans := make(map[int]<-chan interface{}, len(unique))
+	ins := make([]chan *Task, len(unique))
+	for i, class := range unique {
+		ins[i] = make(chan *Task)
+		outChans[class] = Decorate(ins[i], opts...)
+	}
+	go func() {
+		defer func() {
+			for _, in := range ins {
+				close(in)
+			}
+		}()
+		for task := range inChan {
+			if len(ins) == 0 {
+				continue
+			}
+			i := 0
+			if task != nil {
+				// the last class whose value is at most the priority
+				i = sort.Search(len(unique), func(i int) bool { return unique[i] > task.Priority }) - 1
+				if i < 0 {
+					i = 0
+				}
+			}
+			ins[i] <- task
+		}
+	}()
+	return outChans
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDemuxByClass(t *testing.T) {
+	inChan := make(chan *Task, 8)
+	for _, priority := range []int{12, -1, 5, 10, 0, 11, 3} {
+		inChan <- &Task{Data: priority, Priority: priority}
+	}
+	inChan <- nil
+	close(inChan)
+	var errs []error
+	outChans := DemuxByClass(inChan, []int{10, 0, 10}, WithErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+	assert.Equal(t, 2, len(outChans))
+
+	got := make(map[int][]interface{})
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for class, outChan := range outChans {
+		wg.Add(1)
+		go func(class int, outChan <-chan interface{}) {
+			defer wg.Done()
+			for data := range outChan {
+				lock.Lock()
+				got[class] = append(got[class], data)
+				lock.Unlock()
+			}
+		}(class, outChan)
+	}
+	wg.Wait()
+	assert.ElementsMatch(t, []interface{}{-1, 0, 3, 5}, got[0])
+	assert.ElementsMatch(t, []interface{}{10, 11, 12}, got[10])
+	assert.Equal(t, 1, len(errs))
+
+	t.Run("a stalled class does not hold up the others", func(t *testing.T) {
+		inChan := make(chan *Task)
+		outChans := DemuxByClass(inChan, []int{0, 10})
+		inChan <- &Task{Data: "stalled", Priority: 0}
+		inChan <- &Task{Data: "stalled", Priority: 1}
+		inChan <- &Task{Data: "served", Priority: 10}
+		assert.Equal(t, "served", <-outChans[10])
+		close(inChan)
+		assert.Equal(t, "stalled", <-outChans[0])
+	})
+}
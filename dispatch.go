@@ -0,0 +1,185 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// DispatchOption configures Queue.Dispatch.
+type DispatchOption func(*dispatchConfig)
+
+type dispatchConfig struct {
+	onFailure  func(data interface{}, err error)
+	deadLetter *Queue
+	retry      *RetryPolicy
+	limiter    *PriorityLimiter
+	preempt    int // see WithPreemption
+}
+
+// WithFailureHandler sets a callback invoked with the data whose handler
+// returned an error. Failures are otherwise ignored.
+func WithFailureHandler(fn func(data interface{}, err error)) DispatchOption {
+	return func(c *dispatchConfig) {
+		c.onFailure = fn
+	}
+}
+
+// Dispatch runs a pool of workers calling fn on the data of the queue,
+// in priority order, so that consumers don't have to write their own
+// loop. If workers is not positive, there is one per GOMAXPROCS.
+//
+// Dispatch returns once ctx is done or the queue is closed and drained,
+// after the calls of fn in progress return. It returns ctx.Err() in the
+// former case and nil in the latter.
+func (q *Queue) Dispatch(ctx context.Context, workers int, fn func(data interface{}) error, opts ...DispatchOption) error {
+	return q.DispatchCtx(ctx, workers, func(_ context.Context, data interface{}) error {
+		return fn(data)
+	}, opts...)
+}
+
+// DeadLetter is a failed item, as queued by WithDeadLetter.
+type DeadLetter struct {
+	Data     interface{}
+	Priority int
+	Err      error // of the last attempt
+	Attempts int
+}
+
+// Replay enqueues the failed data again into q with its priority.
+func (d *DeadLetter) Replay(q *Queue) error {
+	return q.Enqueue(d.Data, d.Priority)
+}
+
+// WithDeadLetter routes the data whose handler returned an error, and
+// that is not retried, to the dead-letter queue dlq as a *DeadLetter,
+// instead of dropping it, so that operators can inspect and replay
+// failures. The dead letters are enqueued with the priority of the
+// data, without blocking, so they are lost if dlq is full.
+func WithDeadLetter(dlq *Queue) DispatchOption {
+	return func(c *dispatchConfig) {
+		c.deadLetter = dlq
+	}
+}
+
+// WithDispatchRate paces the workers at rate data per second, with
+// bursts of up to burst data, e.g. for a downstream that only accepts so
+// many requests per second. The data waiting for a token stays queued,
+// so it keeps being reordered by priority. A worker waiting for data
+// holds a token, so a burst after an idle period may be one larger.
+func WithDispatchRate(rate float64, burst int) DispatchOption {
+	return func(c *dispatchConfig) {
+		c.limiter = NewPriorityLimiter(rate, burst)
+	}
+}
+
+// dequeue waits for the token of c, if it paces the workers, and then
+// for data of q. pacing lets one worker wait at a time, so that the
+// others don't hold tokens.
+func (c *dispatchConfig) dequeue(ctx context.Context, q *Queue, pacing *sync.Mutex) (*entry, error) {
+	if c.limiter == nil {
+		e, _, err := q.dequeueCtx(ctx)
+		return e, err
+	}
+	pacing.Lock()
+	defer pacing.Unlock()
+	if err := c.limiter.Wait(ctx, 0); err != nil {
+		return nil, err
+	}
+	e, _, err := q.dequeueCtx(ctx)
+	return e, err
+}
+
+// fail handles the data of q whose handler returned err: it is retried
+// if its policy allows it, and otherwise given up. It reports whether
+// the data was retried.
+func (c *dispatchConfig) fail(q *Queue, e *entry, err error) bool {
+	policy := e.retry
+	if policy == nil {
+		policy = c.retry
+	}
+	if q.retry(e, policy) {
+		return true
+	}
+	if f, ok := e.data.(*Future); ok {
+		f.Resolve(nil, err)
+	}
+	if c.deadLetter != nil {
+		letter := &DeadLetter{Data: e.data, Priority: e.Priority, Err: err, Attempts: e.attempts + 1}
+		c.deadLetter.TryEnqueue(letter, e.Priority)
+	}
+	if c.onFailure != nil {
+		c.onFailure(e.data, err)
+	}
+	return false
+}
+
+// DispatchCtx is like Dispatch, but fn also gets the context the data
+// was enqueued with by EnqueueCtx, or ctx if there is none, so that
+// cancellation at the origin of a request stops its processing.
+func (q *Queue) DispatchCtx(ctx context.Context, workers int, fn func(ctx context.Context, data interface{}) error, opts ...DispatchOption) error {
+	var cfg dispatchConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var wg sync.WaitGroup
+	var pacing sync.Mutex
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counters := q.stats.addWorker("")
+			defer q.stats.removeWorker(counters)
+			for {
+				e, err := cfg.dequeue(ctx, q, &pacing)
+				if err != nil {
+					return
+				}
+				taskCtx := e.ctx
+				if taskCtx == nil {
+					taskCtx = ctx
+				}
+				start := counters.begin(1)
+				err = cfg.run(taskCtx, q, e.data, fn)
+				failed := 0
+				if err != nil {
+					failed = 1
+				}
+				counters.end(start, 1, failed)
+				q.Ack()
+				if err != nil && cfg.fail(q, e, err) {
+					continue
+				}
+				if e.group != nil {
+					e.group.Ack()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Serve is like DispatchCtx for handlers that produce a result: the
+// futures enqueued by Submit and EnqueueWithResult are resolved with
+// the result of their data, or with the error of its last attempt,
+// while the result of other data is ignored.
+func (q *Queue) Serve(ctx context.Context, workers int, handler func(ctx context.Context, data interface{}) (interface{}, error), opts ...DispatchOption) error {
+	return q.DispatchCtx(ctx, workers, func(ctx context.Context, data interface{}) error {
+		f, ok := data.(*Future)
+		if !ok {
+			_, err := handler(ctx, data)
+			return err
+		}
+		result, err := handler(ctx, f.Data)
+		if err == nil {
+			f.Resolve(result, nil)
+		}
+		return err // resolved unless retried
+	}, opts...)
+}
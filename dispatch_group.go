@@ -0,0 +1,144 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DispatchGroup routes the data of a queue to several devices, e.g.
+// GPUs, each running its own batching pipeline: a device queue, a
+// Batcher and a worker goroutine processing the batches. Data goes to
+// the device chosen by the affinity function if any, and otherwise to
+// the least loaded device.
+type DispatchGroup struct {
+	q        *Queue
+	maxBatch int
+	maxWait  time.Duration
+	affinity func(data interface{}) string
+	devices  []*device
+	byKey    map[string]*device
+}
+
+type device struct {
+	key      string
+	queue    *Queue
+	process  func(batch []interface{})
+	counters *workerCounters // also in the stats of the queue of the group
+}
+
+// DeviceMetrics is a snapshot of the metrics of a device.
+type DeviceMetrics struct {
+	// Queued is the number of items waiting in the device queue.
+	Queued int
+	// Inflight is the number of items being processed.
+	Inflight int
+	Batches  uint64
+	Items    uint64
+	// MeanLatency and LastLatency are the mean and last processing
+	// times of a batch.
+	MeanLatency time.Duration
+	LastLatency time.Duration
+}
+
+// NewDispatchGroup returns a DispatchGroup taking data from q. The
+// batches of every device hold up to maxBatch items and wait up to
+// maxWait, as with NewBatcher. affinity may be nil; otherwise, data for
+// which it returns the key of a device goes to that device.
+func NewDispatchGroup(q *Queue, maxBatch int, maxWait time.Duration, affinity func(data interface{}) string) *DispatchGroup {
+	return &DispatchGroup{
+		q:        q,
+		maxBatch: maxBatch,
+		maxWait:  maxWait,
+		affinity: affinity,
+		byKey:    make(map[string]*device),
+	}
+}
+
+// AddDevice adds a device identified by key, whose batches are given to
+// process. Devices must be added before Run is called.
+func (g *DispatchGroup) AddDevice(key string, process func(batch []interface{})) {
+	d := &device{key: key, queue: New(), process: process, counters: g.q.stats.addWorker(key)}
+	g.devices = append(g.devices, d)
+	g.byKey[key] = d
+}
+
+// Run dispatches data until ctx is done or the queue is closed, and
+// then waits for the devices to process what was already dispatched.
+func (g *DispatchGroup) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, d := range g.devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			d.run(g.q, g.maxBatch, g.maxWait)
+		}(d)
+	}
+	defer wg.Wait()
+	defer func() {
+		for _, d := range g.devices {
+			d.queue.Close()
+		}
+	}()
+	if len(g.devices) == 0 {
+		return
+	}
+	for {
+		e, _, err := g.q.dequeueCtx(ctx)
+		if err != nil {
+			return
+		}
+		g.route(e.data).queue.transfer(e, true)
+	}
+}
+
+// route chooses the device of the data.
+func (g *DispatchGroup) route(data interface{}) *device {
+	if g.affinity != nil {
+		if d, ok := g.byKey[g.affinity(data)]; ok {
+			return d
+		}
+	}
+	best, load := g.devices[0], -1
+	for _, d := range g.devices {
+		if l := d.queue.Len() + int(atomic.LoadInt64(&d.counters.inflight)); load < 0 || l < load {
+			best, load = d, l
+		}
+	}
+	return best
+}
+
+func (d *device) run(source *Queue, maxBatch int, maxWait time.Duration) {
+	b := NewBatcher(d.queue, maxBatch, maxWait)
+	go b.Run(context.Background()) // stops once the queue is closed and drained
+	defer source.stats.removeWorker(d.counters)
+	for batch := range b.Batches() {
+		start := d.counters.begin(len(batch))
+		d.process(batch)
+		d.counters.end(start, len(batch), 0)
+		source.ack(len(batch))
+	}
+}
+
+// Metrics returns the metrics of every device by key.
+func (g *DispatchGroup) Metrics() map[string]DeviceMetrics {
+	metrics := make(map[string]DeviceMetrics, len(g.devices))
+	for _, d := range g.devices {
+		c := d.counters
+		m := DeviceMetrics{
+			Queued:      d.queue.Len(),
+			Inflight:    int(atomic.LoadInt64(&c.inflight)),
+			Batches:     atomic.LoadUint64(&c.calls),
+			Items:       atomic.LoadUint64(&c.handled),
+			LastLatency: time.Duration(atomic.LoadInt64(&c.last)),
+		}
+		if m.Batches > 0 {
+			m.MeanLatency = time.Duration(atomic.LoadInt64(&c.busy) / int64(m.Batches))
+		}
+		metrics[d.key] = m
+	}
+	return metrics
+}
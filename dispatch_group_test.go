@@ -0,0 +1,61 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchGroup(t *testing.T) {
+	q := New()
+	g := NewDispatchGroup(q, 4, time.Millisecond, func(data interface{}) string {
+		if s, ok := data.(string); ok && strings.HasPrefix(s, `gpu1:`) {
+			return `gpu1`
+		}
+		return ``
+	})
+	var lock sync.Mutex
+	got := make(map[string][]interface{})
+	for _, key := range []string{`gpu0`, `gpu1`} {
+		key := key
+		g.AddDevice(key, func(batch []interface{}) {
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			got[key] = append(got[key], batch...)
+			lock.Unlock()
+		})
+	}
+	for i := 0; i < 4; i++ {
+		q.Enqueue(`gpu1:pinned`, 1)
+	}
+	for i := 0; i < 40; i++ {
+		q.Enqueue(i, 1)
+	}
+	q.Close()
+	workers := q.Stats().Workers()
+	assert.Equal(t, 2, len(workers))
+	assert.Equal(t, `gpu1`, workers[1].Device)
+	g.Run(context.Background()) // returns once the queue is drained
+	assert.Empty(t, q.Stats().Workers(), "unregistered once stopped")
+
+	assert.Equal(t, 44, len(got[`gpu0`])+len(got[`gpu1`]))
+	pinned := 0
+	for _, data := range got[`gpu1`] {
+		if data == `gpu1:pinned` {
+			pinned++
+		}
+	}
+	assert.Equal(t, 4, pinned)
+	assert.NotEmpty(t, got[`gpu0`], "load is balanced")
+
+	metrics := g.Metrics()
+	assert.Equal(t, uint64(44), metrics[`gpu0`].Items+metrics[`gpu1`].Items)
+	assert.Equal(t, 0, metrics[`gpu0`].Queued+metrics[`gpu0`].Inflight)
+	assert.Greater(t, int64(metrics[`gpu0`].MeanLatency), int64(0))
+}
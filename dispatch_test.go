@@ -0,0 +1,130 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatch(t *testing.T) {
+	t.Run("drains a closed queue", func(t *testing.T) {
+		q := New()
+		for i := 0; i < N; i++ {
+			q.Enqueue(i, i)
+		}
+		q.Close()
+		var sum int64
+		var lock sync.Mutex
+		var failed []interface{}
+		err := q.Dispatch(context.Background(), 4, func(data interface{}) error {
+			atomic.AddInt64(&sum, int64(data.(int)))
+			if data.(int)%100 == 0 {
+				return errors.New("failure")
+			}
+			return nil
+		}, WithFailureHandler(func(data interface{}, err error) {
+			lock.Lock()
+			failed = append(failed, data)
+			lock.Unlock()
+		}))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, int64(N*(N-1)/2), sum)
+		assert.ElementsMatch(t, []interface{}{0, 100, 200, 300, 400, 500, 600, 700, 800, 900, 1000}, failed)
+	})
+
+	t.Run("priority order with one worker", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`low`, 2)
+		q.Enqueue(`high`, 1)
+		q.Close()
+		var order []interface{}
+		q.Dispatch(context.Background(), 1, func(data interface{}) error {
+			order = append(order, data)
+			return nil
+		})
+		assert.Equal(t, []interface{}{`high`, `low`}, order)
+	})
+
+	t.Run("stops on cancellation after calls in progress", func(t *testing.T) {
+		q := New()
+		ctx, cancel := context.WithCancel(context.Background())
+		started := make(chan struct{})
+		var done int32
+		go func() {
+			<-started
+			cancel()
+		}()
+		q.Enqueue(`slow`, 1)
+		err := q.Dispatch(ctx, 2, func(data interface{}) error {
+			close(started)
+			time.Sleep(10 * time.Millisecond)
+			atomic.StoreInt32(&done, 1)
+			return nil
+		})
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&done))
+	})
+
+	t.Run("paced", func(t *testing.T) {
+		q := New()
+		for i := 0; i < 4; i++ {
+			q.Enqueue(i, i)
+		}
+		q.Close()
+		var order []interface{}
+		var lock sync.Mutex
+		start := time.Now()
+		q.Dispatch(context.Background(), 2, func(data interface{}) error {
+			lock.Lock()
+			order = append(order, data)
+			lock.Unlock()
+			return nil
+		}, WithDispatchRate(20, 2))
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+		assert.ElementsMatch(t, []interface{}{0, 1, 2, 3}, order)
+	})
+
+	t.Run("passes task contexts", func(t *testing.T) {
+		q := New()
+		type key struct{}
+		q.EnqueueCtx(context.WithValue(context.Background(), key{}, `value`), `task`, 1)
+		q.Close()
+		q.DispatchCtx(context.Background(), 1, func(ctx context.Context, data interface{}) error {
+			assert.Equal(t, `value`, ctx.Value(key{}))
+			return nil
+		})
+	})
+}
+
+func TestDeadLetter(t *testing.T) {
+	q := New()
+	dlq := New()
+	q.Enqueue(`ok`, 1)
+	q.Enqueue(`bad`, 2)
+	q.Close()
+	failure := errors.New("failure")
+	q.Dispatch(context.Background(), 1, func(data interface{}) error {
+		if data == `bad` {
+			return failure
+		}
+		return nil
+	}, WithDeadLetter(dlq))
+
+	assert.Equal(t, 1, dlq.Len())
+	data, _ := dlq.Dequeue()
+	letter := data.(*DeadLetter)
+	assert.Equal(t, &DeadLetter{Data: `bad`, Priority: 2, Err: failure, Attempts: 1}, letter)
+
+	replayed := New()
+	assert.Equal(t, nil, letter.Replay(replayed))
+	data, priority, _ := replayed.Peek()
+	assert.Equal(t, `bad`, data)
+	assert.Equal(t, 2, priority)
+}
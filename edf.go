@@ -0,0 +1,38 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// earliestDeadlineFirst orders the entries of an EDF queue by deadline,
+// and the ties in the order of base, e.g. that of WithMaxFirst.
+func earliestDeadlineFirst(base heap.ItemHeap) heap.LessFunc {
+	return func(a, b *heap.Item) bool {
+		da, db := entryOf(a).deadline, entryOf(b).deadline
+		if !da.Equal(db) {
+			switch {
+			case da.IsZero():
+				return false
+			case db.IsZero():
+				return true
+			}
+			return da.Before(db)
+		}
+		return base.Before(a, b)
+	}
+}
+
+// DeadlineOf returns the deadline of ctx, or now plus budget if ctx has
+// none, e.g. to enqueue requests into an EDF queue with a default
+// latency budget.
+func DeadlineOf(ctx context.Context, budget time.Duration) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(budget)
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEDF(t *testing.T) {
+	q, clock := mockNewQueueWithClock(WithEDF())
+	now := q.now()
+	q.Enqueue(`no deadline`, 0)
+	q.EnqueueDeadline(`later`, 0, now.Add(3*time.Second))
+	q.EnqueueDeadline(`soon, low priority`, 9, now.Add(time.Second))
+	q.EnqueueDeadline(`missed`, 0, now.Add(500*time.Millisecond))
+	q.EnqueueTTL(`soon`, 1, time.Second)
+	clock.advance(time.Second / 2)
+	for _, expected := range []string{`soon`, `soon, low priority`, `later`, `no deadline`} {
+		data, _ := q.Dequeue()
+		assert.Equal(t, expected, data)
+	}
+}
+
+func TestEDFMaxFirst(t *testing.T) {
+	q, _ := mockNewQueueWithClock(WithEDF(), WithMaxFirst())
+	deadline := q.now().Add(time.Second)
+	q.Enqueue(`no deadline, low priority`, 1)
+	q.Enqueue(`no deadline`, 5)
+	q.EnqueueDeadline(`low priority`, 1, deadline)
+	q.EnqueueDeadline(`high priority`, 5, deadline)
+	for _, expected := range []string{`high priority`, `low priority`, `no deadline`, `no deadline, low priority`} {
+		data, _ := q.Dequeue()
+		assert.Equal(t, expected, data)
+	}
+}
+
+func TestDeadlineOf(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Unix(42, 0))
+	defer cancel()
+	assert.Equal(t, time.Unix(42, 0), DeadlineOf(ctx, time.Second))
+	deadline := DeadlineOf(context.Background(), time.Hour)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deadline, time.Second)
+
+	q := New(WithEDF())
+	late, cancelLate := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelLate()
+	soon, cancelSoon := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelSoon()
+	q.EnqueueCtx(late, `late`, 0)
+	q.EnqueueCtx(soon, `soon`, 1)
+	data, _ := q.Dequeue()
+	assert.Equal(t, `soon`, data)
+}
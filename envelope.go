@@ -0,0 +1,141 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Envelope is a payload encrypted for a tenant, so that a queue shared by
+// several tenants, or its operators, can manage the backlog, e.g. its
+// priorities and metadata, without being able to read the contents of
+// the requests. The producers seal the payloads and the consumers open
+// them with the keys of the tenant, which the queue never holds. The
+// metadata is readable, but authenticated along with the tenant and the
+// key: changing any of them fails the opening.
+type Envelope struct {
+	Tenant     string            `json:"tenant"`
+	KeyID      string            `json:"key_id"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Nonce      []byte            `json:"nonce"`
+	Ciphertext []byte            `json:"ciphertext"`
+}
+
+// Keyring holds the AES keys of the tenants, by key id, so that keys can
+// be rotated: envelopes are sealed with the last key added for their
+// tenant, and opened with the key they name. It is safe for concurrent
+// use.
+type Keyring struct {
+	lock    sync.RWMutex
+	keys    map[string]map[string]cipher.AEAD // by tenant and key id
+	current map[string]string                 // key id by tenant
+}
+
+// NewKeyring returns an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]map[string]cipher.AEAD), current: make(map[string]string)}
+}
+
+// Add adds the AES key of the tenant, of 16, 24 or 32 bytes, which seals
+// the next envelopes of the tenant. Envelopes are encrypted with
+// AES-GCM.
+func (k *Keyring) Add(tenant, keyID string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.keys[tenant] == nil {
+		k.keys[tenant] = make(map[string]cipher.AEAD)
+	}
+	k.keys[tenant][keyID] = aead
+	k.current[tenant] = keyID
+	return nil
+}
+
+// Remove removes a key of the tenant, e.g. once no envelope sealed with
+// it is queued anymore. If it was the current key, the tenant cannot
+// seal envelopes until another key is added.
+func (k *Keyring) Remove(tenant, keyID string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.keys[tenant], keyID)
+	if k.current[tenant] == keyID {
+		delete(k.current, tenant)
+	}
+}
+
+// key returns the cipher of a key, or of the current key of the tenant
+// if keyID is empty.
+func (k *Keyring) key(tenant, keyID string) (string, cipher.AEAD, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if keyID == "" {
+		keyID = k.current[tenant]
+	}
+	aead, ok := k.keys[tenant][keyID]
+	if !ok {
+		return "", nil, fmt.Errorf("key %q of tenant %q: %w", keyID, tenant, ErrNotFound)
+	}
+	return keyID, aead, nil
+}
+
+// Seal encrypts the payload for the tenant with its current key.
+func (k *Keyring) Seal(tenant string, payload []byte, metadata map[string]string) (*Envelope, error) {
+	keyID, aead, err := k.key(tenant, "")
+	if err != nil {
+		return nil, err
+	}
+	e := &Envelope{Tenant: tenant, KeyID: keyID, Metadata: metadata, Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	ad, err := e.authenticated()
+	if err != nil {
+		return nil, err
+	}
+	e.Ciphertext = aead.Seal(nil, e.Nonce, payload, ad)
+	return e, nil
+}
+
+// Open decrypts the payload of the envelope. It returns an error
+// wrapping ErrNotFound if the keyring lacks the key of the envelope, or
+// ErrSealed if it cannot be decrypted.
+func (k *Keyring) Open(e *Envelope) ([]byte, error) {
+	_, aead, err := k.key(e.Tenant, e.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := e.authenticated()
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, ErrSealed
+	}
+	payload, err := aead.Open(nil, e.Nonce, e.Ciphertext, ad)
+	if err != nil {
+		return nil, ErrSealed
+	}
+	return payload, nil
+}
+
+// authenticated returns the data of the envelope authenticated along
+// with its payload. The keys of the metadata are marshaled in order.
+func (e *Envelope) authenticated() ([]byte, error) {
+	return json.Marshal(struct {
+		Tenant   string            `json:"tenant"`
+		KeyID    string            `json:"key_id"`
+		Metadata map[string]string `json:"metadata"`
+	}{e.Tenant, e.KeyID, e.Metadata})
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyring(t *testing.T) {
+	producer, consumer := NewKeyring(), NewKeyring()
+	key := bytes.Repeat([]byte{1}, 32)
+	assert.Equal(t, nil, producer.Add("acme", "k1", key))
+	assert.Equal(t, nil, consumer.Add("acme", "k1", key))
+	assert.NotEqual(t, nil, producer.Add("acme", "bad", []byte("short")))
+
+	e, err := producer.Seal("acme", []byte(`{"prompt": "secret"}`), map[string]string{"model": "small"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "k1", e.KeyID)
+	assert.Equal(t, false, bytes.Contains(e.Ciphertext, []byte("secret")))
+
+	// the queue carries the envelope as is
+	q := New()
+	q.Enqueue(e, 1)
+	data, _ := q.Dequeue()
+	wire, _ := json.Marshal(data)
+	var got Envelope
+	assert.Equal(t, nil, json.Unmarshal(wire, &got))
+	payload, err := consumer.Open(&got)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"prompt": "secret"}`, string(payload))
+
+	got.Metadata["model"] = "large"
+	_, err = consumer.Open(&got)
+	assert.Equal(t, ErrSealed, err, "tampered metadata")
+
+	_, err = producer.Seal("other", nil, nil)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	t.Run("rotation", func(t *testing.T) {
+		assert.Equal(t, nil, producer.Add("acme", "k2", bytes.Repeat([]byte{2}, 16)))
+		e2, _ := producer.Seal("acme", []byte("new"), nil)
+		assert.Equal(t, "k2", e2.KeyID)
+		payload, err := producer.Open(e)
+		assert.Equal(t, nil, err, "old envelopes still open")
+		assert.Equal(t, `{"prompt": "secret"}`, string(payload))
+		_, err = consumer.Open(e2)
+		assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+		producer.Remove("acme", "k2")
+		_, err = producer.Seal("acme", nil, nil)
+		assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors below are shared by the queues and the subsystems built on
+// them, so that callers handle failures uniformly. A subsystem returns
+// them as is, or wraps them with fmt.Errorf and %w to add context, so
+// callers should test errors with errors.Is rather than ==.
+var (
+	// ErrQueueFull is returned when enqueueing into a bounded queue that
+	// is full without blocking.
+	ErrQueueFull = errors.New("queue is full")
+	// ErrQueueClosed is returned when enqueueing into a closed queue, and
+	// when dequeueing from a closed queue that has been drained.
+	ErrQueueClosed = errors.New("queue is closed")
+	// ErrQueueEmpty is returned when dequeueing from an empty queue
+	// without blocking.
+	ErrQueueEmpty = errors.New("queue is empty")
+	// ErrMaxInflight is returned when dequeueing without blocking while
+	// the maximum number of items in flight is reached.
+	ErrMaxInflight = errors.New("too many items in flight")
+	// ErrFenced is returned to a consumer that lost its lease, see
+	// Failover.
+	ErrFenced = errors.New("consumer fenced")
+	// ErrShed is returned when enqueueing data of a low priority into an
+	// overloaded queue, see WithShedding.
+	ErrShed = errors.New("load shed")
+	// ErrRejected is reported by the enqueue of a task rejected by a
+	// validator, see WithValidator and Rejection.
+	ErrRejected = errors.New("task rejected")
+	// ErrSealed is returned when an envelope cannot be opened: it was
+	// sealed with another key, or tampered with. See Keyring.
+	ErrSealed = errors.New("envelope cannot be opened")
+	// ErrTampered is returned when the hash chain of an audit log is
+	// broken, see VerifyAuditLog.
+	ErrTampered = errors.New("audit log tampered with")
+	// ErrNotFound is returned when an item or key is not known.
+	ErrNotFound = errors.New("not found")
+	// ErrQuotaExceeded is returned when a caller exceeds its share of a
+	// limited resource.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrExpired is returned when a deadline or TTL has passed.
+	ErrExpired = errors.New("expired")
+	// ErrTimeout is delivered to a waiter of a Correlator whose response
+	// did not arrive in time. It wraps ErrExpired.
+	ErrTimeout = fmt.Errorf("response timed out: %w", ErrExpired)
+	// ErrDuplicateID is returned when registering an ID with a Correlator
+	// that is already waiting for its response.
+	ErrDuplicateID = errors.New("id is already registered")
+	// ErrPreempted is returned by the handler of a preemptible task that
+	// stops at a checkpoint, see Queue.RunPreemptible.
+	ErrPreempted = errors.New("task preempted")
+	// ErrBackendUnavailable is returned when a remote backend or server
+	// cannot be reached.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+)
@@ -0,0 +1,28 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	q := NewBoundedQueue(1)
+	_, err := q.Dequeue()
+	assert.Equal(t, true, errors.Is(err, ErrQueueEmpty))
+	_, _, err = q.Peek()
+	assert.Equal(t, true, errors.Is(err, ErrQueueEmpty))
+	q.Enqueue(`a`, 1)
+	assert.Equal(t, true, errors.Is(q.TryEnqueue(`b`, 1), ErrQueueFull))
+	q.Close()
+	assert.Equal(t, true, errors.Is(q.Enqueue(`b`, 1), ErrQueueClosed))
+
+	assert.Equal(t, true, errors.Is(ErrTimeout, ErrExpired))
+	wrapped := fmt.Errorf("tenant a: %w", ErrQuotaExceeded)
+	assert.Equal(t, true, errors.Is(wrapped, ErrQuotaExceeded))
+	assert.Equal(t, false, errors.Is(wrapped, ErrBackendUnavailable))
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Failover runs one of several consumers of a queue at a time: the
+// first one to run is the primary, and the others are warm standbys. If
+// the active consumer stops heartbeating for a timeout, it is fenced
+// and a standby takes over.
+//
+// Fencing works with epochs: every lease has its own, and the leases of
+// older epochs are refused, so that a consumer that was only slow can't
+// take items anymore once a standby runs, even if it is still running.
+type Failover struct {
+	q       *Queue
+	timeout time.Duration
+	lock    sync.Mutex
+	epoch   uint64
+	current *Lease        // nil if no consumer is active
+	beat    time.Time     // last heartbeat of the current lease
+	changed chan struct{} // closed when the lease is released
+}
+
+// Lease is what a consumer run by Failover holds while it is active.
+type Lease struct {
+	f      *Failover
+	epoch  uint64
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewFailover returns a Failover for the consumers of q, which are
+// fenced after timeout without heartbeat.
+func NewFailover(q *Queue, timeout time.Duration) *Failover {
+	return &Failover{q: q, timeout: timeout, changed: make(chan struct{})}
+}
+
+// Run waits for the lease as a standby, and then calls consume with it.
+// If consume returns after being fenced, Run waits for the lease again;
+// otherwise, the lease is released for a standby, and Run returns the
+// error of consume. Run returns ctx.Err() once ctx is done.
+func (f *Failover) Run(ctx context.Context, consume func(l *Lease) error) error {
+	for {
+		l, err := f.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		err = consume(l)
+		fenced := !f.release(l)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !fenced {
+			return err
+		}
+	}
+}
+
+// Epoch returns the current epoch, which grows with every lease.
+func (f *Failover) Epoch() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.epoch
+}
+
+func (f *Failover) acquire(ctx context.Context) (*Lease, error) {
+	for {
+		f.lock.Lock()
+		if f.current == nil {
+			f.epoch++
+			l := &Lease{f: f, epoch: f.epoch}
+			l.ctx, l.cancel = context.WithCancel(ctx)
+			f.current, f.beat = l, time.Now()
+			f.lock.Unlock()
+			go f.watch(l)
+			return l, nil
+		}
+		changed := f.changed
+		f.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release releases the lease, unless it was fenced, which it reports.
+func (f *Failover) release(l *Lease) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.current != l {
+		return false
+	}
+	f.revoke()
+	return true
+}
+
+// revoke ends the current lease. It must be called with the lock held.
+func (f *Failover) revoke() {
+	f.current.cancel()
+	f.current = nil
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// watch fences the lease once it misses its heartbeats.
+func (f *Failover) watch(l *Lease) {
+	timer := time.NewTimer(f.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		f.lock.Lock()
+		if f.current != l {
+			f.lock.Unlock()
+			return
+		}
+		idle := time.Since(f.beat)
+		if idle >= f.timeout {
+			f.revoke()
+			f.lock.Unlock()
+			return
+		}
+		timer.Reset(f.timeout - idle)
+		f.lock.Unlock()
+	}
+}
+
+// Epoch returns the epoch of the lease, e.g. to fence writes to other
+// systems too.
+func (l *Lease) Epoch() uint64 {
+	return l.epoch
+}
+
+// Context returns a context done once the lease is fenced or released.
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+// Heartbeat tells that the consumer is alive, or returns ErrFenced if it
+// lost the lease.
+func (l *Lease) Heartbeat() error {
+	l.f.lock.Lock()
+	defer l.f.lock.Unlock()
+	if l.f.current != l {
+		return ErrFenced
+	}
+	l.f.beat = time.Now()
+	return nil
+}
+
+// Dequeue is like Queue.DequeueCtx with the context of the lease, and
+// heartbeats while it waits for data. It returns ErrFenced if the lease
+// is lost; data taken meanwhile is put back into the queue for the new
+// consumer, with its priority.
+func (l *Lease) Dequeue() (interface{}, error) {
+	for {
+		if err := l.Heartbeat(); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(l.ctx, l.f.timeout/2)
+		e, _, err := l.f.q.dequeueCtx(ctx)
+		cancel()
+		if err == context.DeadlineExceeded && l.ctx.Err() == nil {
+			continue
+		}
+		if l.Heartbeat() != nil {
+			if e != nil {
+				l.f.q.Ack()
+				l.f.q.transfer(e, true)
+			}
+			return nil, ErrFenced
+		}
+		if err != nil {
+			return nil, err
+		}
+		return e.data, nil
+	}
+}
+
+// Ack acks the data processed by the consumer, see Queue.Ack, and
+// heartbeats.
+func (l *Lease) Ack() error {
+	l.f.q.Ack()
+	return l.Heartbeat()
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailover(t *testing.T) {
+	q := New()
+	for i := 0; i < 10; i++ {
+		q.Enqueue(i, i)
+	}
+	f := NewFailover(q, 20*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	got := make(map[string][]interface{})
+	primaryCtx, stopPrimary := context.WithCancel(ctx)
+	consumer := func(name string, stall bool) func(l *Lease) error {
+		return func(l *Lease) error {
+			for {
+				data, err := l.Dequeue()
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				got[name] = append(got[name], data)
+				lock.Unlock()
+				if stall && data == 2 {
+					<-l.Context().Done() // hangs without heartbeat
+					assert.ErrorIs(t, l.Ack(), ErrFenced)
+					_, err := l.Dequeue()
+					assert.ErrorIs(t, err, ErrFenced, "no item once fenced")
+					stopPrimary() // rather than standing by
+					return err
+				}
+				l.Ack()
+			}
+		}
+	}
+
+	primary := make(chan error, 1)
+	go func() { primary <- f.Run(primaryCtx, consumer(`primary`, true)) }()
+	assert.Eventually(t, func() bool { return f.Epoch() == 1 }, time.Second, time.Millisecond)
+	standby := make(chan error, 1)
+	go func() { standby <- f.Run(ctx, consumer(`standby`, false)) }()
+
+	assert.Eventually(t, func() bool { return q.Len() == 0 }, time.Second, time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, []interface{}{0, 1, 2}, got[`primary`])
+	assert.Equal(t, []interface{}{3, 4, 5, 6, 7, 8, 9}, got[`standby`])
+	lock.Unlock()
+	assert.Equal(t, uint64(2), f.Epoch())
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, uint64(2), f.Epoch(), "heartbeats while waiting for data")
+	assert.ErrorIs(t, <-primary, context.Canceled)
+	cancel()
+	assert.ErrorIs(t, <-standby, context.Canceled)
+}
+
+func TestFailoverRelease(t *testing.T) {
+	f := NewFailover(New(), time.Second)
+	err := errors.New(`done`)
+	assert.Equal(t, err, f.Run(context.Background(), func(l *Lease) error {
+		assert.Equal(t, uint64(1), l.Epoch())
+		return err
+	}))
+	assert.Equal(t, nil, f.Run(context.Background(), func(l *Lease) error {
+		assert.Equal(t, uint64(2), l.Epoch(), "released for the next consumer")
+		return nil
+	}))
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// fairLevel schedules the tenants of one priority level of a queue in
+// rounds: the n-th queued data of a tenant is dequeued in the n-th round
+// from the current one, so that the tenants take turns whatever their
+// backlog. It is guarded by the lock of the queue.
+type fairLevel struct {
+	round   int64            // of the last data dequeued
+	tenants map[string]int64 // the round of the last data queued
+}
+
+// EnqueueKeyed puts the data of a tenant into the priority queue like
+// Enqueue, but round-robins across the tenants within each priority, so
+// that a noisy tenant cannot dominate its priority level: the data of
+// the same priority is dequeued one per tenant in turn, in FIFO order
+// within a tenant. A tenant without queued data rejoins at the current
+// round, without credit for the rounds it missed.
+//
+// The rounds are the keys of the data, see EnqueueKey, so the data of a
+// priority should either all be keyed by tenant or none of it. They are
+// ignored by WithLessFunc and WithEDF queues.
+func (q *Queue) EnqueueKeyed(tenant string, data interface{}, priority int) error {
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return err
+	}
+	e.keyed = true
+	q.lock.Lock()
+	defer q.unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.fair == nil {
+		q.fair = make(map[int]*fairLevel)
+	}
+	level := q.fair[e.Priority]
+	if level == nil {
+		level = &fairLevel{tenants: make(map[string]int64)}
+		q.fair[e.Priority] = level
+	}
+	round := level.round
+	last, ok := level.tenants[tenant]
+	if ok && last >= round {
+		round = last + 1
+	}
+	level.tenants[tenant] = round
+	e.Key = heap.Int64Key(round)
+	if q.reversed() {
+		e.Key = heap.Int64Key(-round) // keys are dequeued in reverse order
+	}
+	err = q.insert(e, true)
+	if (err != nil || e.Index() < 1) && level.tenants[tenant] == round {
+		// not queued: give the round back, unless the tenant queued
+		// more data while waiting for room
+		if ok {
+			level.tenants[tenant] = last
+		} else {
+			delete(level.tenants, tenant)
+		}
+	}
+	return err
+}
+
+// dequeuedKeyed moves the round of the priority level of a dequeued
+// keyed entry on, and forgets the tenants without data in the current
+// and next rounds, which would rejoin at the current round anyway. It
+// must be called with the lock held.
+func (q *Queue) dequeuedKeyed(e *entry) {
+	level := q.fair[e.Priority]
+	if level == nil {
+		return
+	}
+	round := e.Key[0]
+	if round < 0 {
+		round = -round
+	}
+	if round <= level.round {
+		return
+	}
+	level.round = round
+	for tenant, last := range level.tenants {
+		if last < round {
+			delete(level.tenants, tenant)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueueKeyed(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"min first": nil,
+		"max first": {WithMaxFirst()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			q := New(opts...)
+			for i := 0; i < 4; i++ {
+				q.EnqueueKeyed("noisy", "n", 1)
+			}
+			q.EnqueueKeyed("a", "a", 1)
+			q.EnqueueKeyed("b", "b", 1)
+			q.EnqueueKeyed("a", "a", 1)
+			q.EnqueueKeyed("x", "x", 2)
+			dequeue := func(n int) string {
+				var got []string
+				for i := 0; i < n; i++ {
+					data, _ := q.Dequeue()
+					got = append(got, data.(string))
+				}
+				return strings.Join(got, " ")
+			}
+			if name == "min first" {
+				assert.Equal(t, "n a b n a", dequeue(5))
+			} else {
+				assert.Equal(t, "x n a b n", dequeue(5))
+			}
+			// a returning tenant takes its turn in the current round
+			q.EnqueueKeyed("b", "b", 1)
+			if name == "min first" {
+				assert.Equal(t, "b n n x", dequeue(4))
+			} else {
+				assert.Equal(t, "a b n n", dequeue(4))
+			}
+			assert.Equal(t, 0, q.Len())
+			q.lock.Lock()
+			assert.Equal(t, map[string]int64{"noisy": 3}, q.fair[1].tenants, "the others are forgotten")
+			q.lock.Unlock()
+		})
+	}
+}
+
+func TestEnqueueKeyedNotQueued(t *testing.T) {
+	q := New(WithCapacity(2), WithOverflowPolicy(DropNewest))
+	q.EnqueueKeyed("a", "a1", 1)
+	q.EnqueueKeyed("b", "b1", 1)
+	q.EnqueueKeyed("a", "a2", 1) // dropped
+	data, _ := q.Dequeue()
+	assert.Equal(t, "a1", data)
+	q.EnqueueKeyed("a", "a3", 1)
+	data, _ = q.Dequeue()
+	assert.Equal(t, "b1", data)
+	q.EnqueueKeyed("b", "b2", 1)
+	data, _ = q.Dequeue()
+	assert.Equal(t, "a3", data, "a dropped data costs no round")
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "github.com/lkevinzc/requestpq/v2/heap"
+
+// softFloor reserves a share of the dequeues for system tasks. It keeps
+// the queued system tasks in a heap of their own, in the order of the
+// queue, so that the best one is found without scanning the queue. It
+// is guarded by the lock of the queue.
+type softFloor struct {
+	fraction float64
+	system   func(priority int) bool
+	heap     heap.ItemHeap
+	// credit grows by fraction on every dequeue and is spent by the
+	// dequeue of a system task; a system task is due once it reaches 1.
+	credit float64
+}
+
+// WithSoftFloor reserves a fraction of the dequeues, e.g. 0.05 for 5%,
+// for the system tasks, i.e. the data whose priority system reports, such
+// as health probes or cache refreshes, so that operational tasks keep
+// running when the queue is saturated with user traffic. When a system
+// task is due, the best queued one is dequeued ahead of the top of the
+// queue; otherwise the order of the queue applies. The floor is soft:
+// system tasks dequeued in order count towards it, and its credit does
+// not build up while there are none.
+func WithSoftFloor(fraction float64, system func(priority int) bool) Option {
+	return func(q *Queue) {
+		q.floor = &softFloor{fraction: fraction, system: system}
+		q.floor.heap = heap.NewHeapFunc(func(a, b *heap.Item) bool {
+			return q.heap.Before(&entryOf(a).Item, &entryOf(b).Item)
+		})
+	}
+}
+
+// track indexes a system entry pushed into the queue. It must be called
+// with the lock held.
+func (f *softFloor) track(e *entry) {
+	if !f.system(e.Priority) {
+		return
+	}
+	e.floor = heap.NewItem(e, 0)
+	f.heap.Push(e.floor)
+}
+
+// untrack removes the index of an entry that left the queue. It must be
+// called with the lock held.
+func (f *softFloor) untrack(e *entry) {
+	if e.floor != nil && e.floor.Index() >= 1 {
+		f.heap.Remove(e.floor.Index())
+	}
+	e.floor = nil
+}
+
+// due returns the best queued system entry if one is due, or nil. The
+// indexes of the entries removed from the queue otherwise, e.g. evicted
+// or restored, are dropped on the way. It must be called with the lock
+// held.
+func (f *softFloor) due() *entry {
+	if f.credit < 1 {
+		return nil
+	}
+	for !f.heap.Empty() {
+		item := f.heap.Peek().(*heap.Item)
+		e := entryOf(item)
+		if e.floor == item && e.Index() >= 1 {
+			return e
+		}
+		f.heap.Pop()
+	}
+	return nil
+}
+
+// dequeued accounts for a dequeued entry. It must be called with the
+// lock held.
+func (f *softFloor) dequeued(e *entry) {
+	f.credit += f.fraction
+	if f.system(e.Priority) {
+		f.credit--
+	}
+	switch {
+	case f.credit > 1:
+		f.credit = 1
+	case f.credit < 0:
+		f.credit = 0
+	}
+}
+
+// reindex drops the stale indexes and restores the order of the system
+// entries after the order of the queue changed. It must be called with
+// the lock held.
+func (f *softFloor) reindex() {
+	f.heap.Compact(func(item *heap.Item) bool {
+		e := entryOf(item)
+		return e.floor != item || e.Index() < 1
+	})
+}
+
+// top returns the entry that next would remove, or nil if the queue is
+// empty. It must be called with the lock held.
+func (q *Queue) top() *entry {
+	if q.floor != nil {
+		if e := q.floor.due(); e != nil {
+			return e
+		}
+	}
+	x := q.heap.Peek()
+	if x == nil {
+		return nil
+	}
+	return entryOf(x.(*heap.Item))
+}
+
+// next removes and returns the next item of the queue: the due system
+// entry, if any, or else the top of the heap. It returns nil if the
+// queue is empty. It must be called with the lock held.
+func (q *Queue) next() interface{} {
+	if q.floor == nil {
+		return q.heap.Pop()
+	}
+	if e := q.floor.due(); e != nil {
+		q.heap.Remove(e.Index())
+		q.floor.untrack(e)
+		return &e.Item
+	}
+	x := q.heap.Pop()
+	if x != nil {
+		q.floor.untrack(entryOf(x.(*heap.Item)))
+	}
+	return x
+}
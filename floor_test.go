@@ -0,0 +1,60 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftFloor(t *testing.T) {
+	system := func(priority int) bool { return priority >= 100 }
+	dequeueAll := func(q *Queue) []interface{} {
+		var got []interface{}
+		for {
+			data, ok := q.TryDequeue()
+			if !ok {
+				return got
+			}
+			got = append(got, data)
+		}
+	}
+
+	q := New(WithSoftFloor(0.25, system))
+	for i := 0; i < 8; i++ {
+		q.Enqueue(i, 1)
+	}
+	q.Enqueue("probe 2", 101)
+	q.Enqueue("probe 1", 100)
+	q.Enqueue(8, 1)
+	_, priority, _ := q.Peek()
+	assert.Equal(t, 1, priority)
+	assert.Equal(t, []interface{}{0, 1, 2, 3, "probe 1", 4, 5, 6, "probe 2", 7, 8}, dequeueAll(q))
+
+	t.Run("credit does not build up", func(t *testing.T) {
+		q := New(WithSoftFloor(0.5, system))
+		for i := 0; i < 10; i++ {
+			q.Enqueue(i, 1)
+		}
+		dequeueAll(q)
+		for _, data := range []string{"a", "b", "c"} {
+			q.Enqueue(data, 1)
+			q.Enqueue("probe "+data, 100)
+		}
+		data, priority, _ := q.Peek()
+		assert.Equal(t, "probe a", data)
+		assert.Equal(t, 100, priority)
+		assert.Equal(t, []interface{}{"probe a", "a", "probe b", "b", "probe c", "c"}, dequeueAll(q))
+	})
+
+	t.Run("skips the removed system tasks", func(t *testing.T) {
+		q := New(WithSoftFloor(1, system))
+		cancel := q.EnqueueCancelable("cancelled", 100)
+		q.Enqueue("probe", 101)
+		q.Enqueue("user", 1)
+		assert.Equal(t, true, cancel())
+		q.Dequeue() // the top, which builds credit
+		assert.Equal(t, []interface{}{"probe"}, dequeueAll(q))
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+)
+
+// Future is the pending result of data enqueued by EnqueueWithResult. It
+// is what workers dequeue: they process its Data and then Resolve it,
+// while the caller that enqueued it Waits for the result.
+type Future struct {
+	Data interface{}
+
+	once   sync.Once
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+func newFuture(data interface{}) *Future {
+	return &Future{Data: data, done: make(chan struct{})}
+}
+
+// Resolve sets the result of the future and wakes up its waiters. Only
+// the first call has an effect, and it reports whether it did.
+func (f *Future) Resolve(result interface{}, err error) bool {
+	resolved := false
+	f.once.Do(func() {
+		f.result, f.err = result, err
+		close(f.done)
+		resolved = true
+	})
+	return resolved
+}
+
+// Done returns a channel closed once the future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future is resolved and returns its result, or
+// until ctx is done and returns ctx.Err().
+func (f *Future) Wait(ctx context.Context) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// EnqueueWithResult puts a Future of the data into the priority queue
+// like Enqueue, turning the queue into an asynchronous RPC funnel: the
+// worker that dequeues the future resolves it with the result of the
+// data. A future that never reaches a worker is resolved with the error
+// that prevented it, such as ErrQueueClosed, ErrQueueFull if it was
+// dropped by the overflow policy, ErrExpired, or ErrRejected.
+func (q *Queue) EnqueueWithResult(data interface{}, priority int) *Future {
+	return q.enqueueFuture(nil, data, priority)
+}
+
+// Submit enqueues the data, waits for a worker to process it, and
+// returns the result of the handler given to Serve, or ctx.Err() if ctx
+// is done first, e.g. to queue inference requests behind a GPU. The data
+// is discarded if ctx is done before it is dequeued, as with EnqueueCtx.
+func (q *Queue) Submit(ctx context.Context, data interface{}, priority int) (interface{}, error) {
+	return q.enqueueFuture(ctx, data, priority).Wait(ctx)
+}
+
+func (q *Queue) enqueueFuture(ctx context.Context, data interface{}, priority int) *Future {
+	e, f, err := q.admitFuture(ctx, data, priority)
+	if err == nil {
+		_, err = q.enqueueEntry(e, true)
+	}
+	if err != nil {
+		f.Resolve(nil, err)
+	}
+	return f
+}
+
+// admitFuture is like admit for the future of data, which is discarded
+// once ctx is done. The future is returned even if the data is rejected.
+func (q *Queue) admitFuture(ctx context.Context, data interface{}, priority int) (*entry, *Future, error) {
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return nil, newFuture(data), err
+	}
+	f := newFuture(e.data)
+	e.data, e.ctx = f, ctx
+	if ctx != nil {
+		e.deadline, _ = ctx.Deadline()
+	}
+	return e, f, nil
+}
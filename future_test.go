@@ -0,0 +1,81 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueueWithResult(t *testing.T) {
+	t.Run("resolved by the worker", func(t *testing.T) {
+		q := New()
+		go func() {
+			data, _ := q.DequeueCtx(context.Background())
+			f := data.(*Future)
+			assert.Equal(t, true, f.Resolve(f.Data.(int)*2, nil))
+			assert.Equal(t, false, f.Resolve(0, errors.New("ignored")))
+		}()
+		result, err := q.EnqueueWithResult(21, 1).Wait(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 42, result)
+	})
+
+	t.Run("wait is cancelable", func(t *testing.T) {
+		q := New()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		_, err := q.EnqueueWithResult(`test`, 1).Wait(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("resolved with the enqueue error", func(t *testing.T) {
+		q := New()
+		q.Close()
+		_, err := q.EnqueueWithResult(`test`, 1).Wait(context.Background())
+		assert.Equal(t, ErrQueueClosed, err)
+	})
+
+	t.Run("resolved when dropped", func(t *testing.T) {
+		q := NewBoundedQueue(1, WithOverflowPolicy(DropLowestPriority))
+		f := q.EnqueueWithResult(`low`, 2)
+		q.Enqueue(`high`, 1)
+		<-f.Done()
+		_, err := f.Wait(context.Background())
+		assert.Equal(t, ErrQueueFull, err)
+	})
+
+}
+
+func TestSubmit(t *testing.T) {
+	q := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- q.Serve(ctx, 2, func(ctx context.Context, data interface{}) (interface{}, error) {
+			if data == `fail` {
+				return nil, errors.New("failure")
+			}
+			return data.(int) * 2, nil
+		})
+	}()
+
+	result, err := q.Submit(context.Background(), 21, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 42, result)
+	_, err = q.Submit(context.Background(), `fail`, 1)
+	assert.EqualError(t, err, "failure")
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-served)
+	submitCtx, submitCancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer submitCancel()
+	_, err = q.Submit(submitCtx, 1, 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, ok := q.TryDequeue()
+	assert.Equal(t, false, ok, "discarded")
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+)
+
+// Group tracks a set of related data enqueued together, e.g. the parts
+// of a scatter-gather request, so that one can wait for all of them.
+// The data of a group is done once dequeued, or, in ack mode, once
+// acknowledged. Data dropped by the overflow policy, expired or
+// discarded since its context is done is done too.
+type Group struct {
+	q       *Queue
+	ack     bool
+	lock    sync.Mutex
+	pending int
+	zero    chan struct{} // closed while pending is 0
+}
+
+// NewGroup returns a group of data enqueued into q, which is done once
+// dequeued.
+func NewGroup(q *Queue) *Group {
+	zero := make(chan struct{})
+	close(zero)
+	return &Group{q: q, zero: zero}
+}
+
+// NewAckGroup returns a group of data enqueued into q, which is done
+// once acknowledged with Ack, as Dispatch does when its handler returns.
+func NewAckGroup(q *Queue) *Group {
+	g := NewGroup(q)
+	g.ack = true
+	return g
+}
+
+// Enqueue puts the data into the queue of the group like Queue.Enqueue.
+func (g *Group) Enqueue(data interface{}, priority int) error {
+	e, err := g.q.admit(context.Background(), data, priority)
+	if err != nil {
+		return err
+	}
+	return g.enqueue(e)
+}
+
+// EnqueueWithResult puts a future of the data into the queue of the
+// group like Queue.EnqueueWithResult.
+func (g *Group) EnqueueWithResult(data interface{}, priority int) *Future {
+	return g.enqueueFuture(nil, data, priority)
+}
+
+func (g *Group) enqueueFuture(ctx context.Context, data interface{}, priority int) *Future {
+	e, f, err := g.q.admitFuture(ctx, data, priority)
+	if err == nil {
+		err = g.enqueue(e)
+	}
+	if err != nil {
+		f.Resolve(nil, err)
+	}
+	return f
+}
+
+func (g *Group) enqueue(e *entry) error {
+	e.group = g
+	g.add()
+	if _, err := g.q.enqueueEntry(e, true); err != nil {
+		g.done()
+		return err
+	}
+	return nil
+}
+
+// Ack acknowledges that the processing of a data of an ack group is
+// complete. It must be called once per data dequeued by something else
+// than Dispatch.
+func (g *Group) Ack() {
+	if g.ack {
+		g.done()
+	}
+}
+
+// Wait blocks until all the data of the group is done, or until ctx is
+// done, in which case it returns ctx.Err().
+func (g *Group) Wait(ctx context.Context) error {
+	g.lock.Lock()
+	zero := g.zero
+	g.lock.Unlock()
+	select {
+	case <-zero:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pending returns the number of data of the group that is not done.
+func (g *Group) Pending() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.pending
+}
+
+func (g *Group) add() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.pending == 0 {
+		g.zero = make(chan struct{})
+	}
+	g.pending++
+}
+
+func (g *Group) done() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.pending--
+	if g.pending == 0 {
+		close(g.zero)
+	}
+}
+
+// dequeued accounts for the entry taken from the queue.
+func (g *Group) dequeued() {
+	if !g.ack {
+		g.done()
+	}
+}
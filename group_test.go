@@ -0,0 +1,70 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup(t *testing.T) {
+	t.Run("done once dequeued", func(t *testing.T) {
+		q := New()
+		g := NewGroup(q)
+		assert.Equal(t, nil, g.Wait(context.Background()), "empty group")
+		g.Enqueue(`a`, 1)
+		g.Enqueue(`b`, 1)
+		q.Enqueue(`other`, 0)
+		assert.Equal(t, 2, g.Pending())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, g.Wait(ctx))
+		q.DequeueBatch(2)
+		assert.Equal(t, 1, g.Pending())
+		q.Dequeue()
+		assert.Equal(t, nil, g.Wait(context.Background()))
+	})
+
+	t.Run("dropped data is done", func(t *testing.T) {
+		q := NewBoundedQueue(1, WithOverflowPolicy(DropLowestPriority))
+		g := NewGroup(q)
+		g.Enqueue(`low`, 2)
+		q.Enqueue(`high`, 1)
+		assert.Equal(t, nil, g.Wait(context.Background()))
+	})
+
+	t.Run("ack mode", func(t *testing.T) {
+		q := New()
+		g := NewAckGroup(q)
+		g.Enqueue(`a`, 1)
+		q.Dequeue()
+		assert.Equal(t, 1, g.Pending())
+		g.Ack()
+		assert.Equal(t, 0, g.Pending())
+	})
+
+	t.Run("acked by dispatch after retries", func(t *testing.T) {
+		q := New()
+		g := NewAckGroup(q)
+		for i := 0; i < 10; i++ {
+			g.Enqueue(i, i)
+		}
+		var calls int32
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go q.Dispatch(ctx, 4, func(data interface{}) error {
+			if atomic.AddInt32(&calls, 1) <= 5 {
+				return errors.New("failure")
+			}
+			return nil
+		}, WithRetryPolicy(RetryPolicy{MaxAttempts: 10}))
+		assert.Equal(t, nil, g.Wait(context.Background()))
+		assert.Equal(t, int32(15), atomic.LoadInt32(&calls))
+	})
+}
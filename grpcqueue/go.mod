@@ -0,0 +1,16 @@
+module github.com/lkevinzc/requestpq/grpcqueue
+
+go 1.24
+
+require (
+	github.com/lkevinzc/requestpq/v2 v2.0.0
+	github.com/stretchr/testify v1.7.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
+
+replace github.com/lkevinzc/requestpq/v2 => ../
@@ -0,0 +1,239 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+// Package grpcqueue serves a requestpq.Queue out of process, as the
+// Queue service of proto/requestpq.proto, and implements a client of the
+// service which is a requestpq.PriorityQueue, so that the code using a
+// queue can move it out of process without changing.
+//
+// The package speaks the gRPC protocol over HTTP/2 without TLS, with the
+// few messages of the service encoded by hand, so that it depends on the
+// standard library only: any gRPC client or server generated from the
+// proto interoperates with it. It lives in a module of its own, since it
+// needs a more recent Go than the queue.
+package grpcqueue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+)
+
+var _ requestpq.PriorityQueue = (*Queue)(nil)
+
+// Queue is a client of a remote queue, which it reaches over a pool of
+// connections dialed on demand. The data must be []byte or string, and
+// is dequeued as []byte. It is safe for concurrent use.
+type Queue struct {
+	base    string
+	client  *http.Client
+	closing context.Context // done once the client is closed
+	stop    context.CancelFunc
+}
+
+// New returns a client of the queue served at addr, e.g. by the
+// http.Server of Server.HTTPServer.
+func New(addr string) *Queue {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	closing, stop := context.WithCancel(context.Background())
+	return &Queue{
+		base:    "http://" + addr + service,
+		client:  &http.Client{Transport: transport},
+		closing: closing,
+		stop:    stop,
+	}
+}
+
+// Enqueue puts the data into the remote queue. It returns ErrQueueFull
+// if the queue is full, and ErrQueueClosed if it is closed.
+func (q *Queue) Enqueue(data interface{}, priority int) error {
+	return q.EnqueueCtx(context.Background(), data, priority)
+}
+
+// EnqueueCtx is like Enqueue, but gives up once ctx is done.
+func (q *Queue) EnqueueCtx(ctx context.Context, data interface{}, priority int) error {
+	t := task{priority: int64(priority)}
+	switch d := data.(type) {
+	case []byte:
+		t.data = d
+	case string:
+		t.data = []byte(d)
+	default:
+		return fmt.Errorf("grpcqueue: %w: data of type %T is not bytes", requestpq.ErrRejected, data)
+	}
+	return q.call(ctx, "Enqueue", marshalEnqueue(t), func([]byte) error { return nil })
+}
+
+// Dequeue takes the data with highest priority from the remote queue. It
+// returns ErrQueueEmpty if the queue is empty, or ErrQueueClosed if it is
+// closed and drained.
+func (q *Queue) Dequeue() (interface{}, error) {
+	return q.dequeue(context.Background(), dequeueRequest{limit: 1, noWait: true})
+}
+
+// DequeueCtx is like Dequeue, but blocks until data is available or ctx
+// is done, in which case it returns ctx.Err(). Data sent by the server
+// as ctx is done may be lost.
+func (q *Queue) DequeueCtx(ctx context.Context) (interface{}, error) {
+	return q.dequeue(ctx, dequeueRequest{limit: 1})
+}
+
+func (q *Queue) dequeue(ctx context.Context, req dequeueRequest) (interface{}, error) {
+	var data []byte
+	dequeued := false
+	err := q.call(ctx, "Dequeue", req.marshal(), func(msg []byte) error {
+		t, err := parseTask(msg)
+		data, dequeued = t.data, true
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !dequeued {
+		return nil, requestpq.ErrQueueEmpty
+	}
+	return data, nil
+}
+
+// Peek gets the data with highest priority and its priority value
+// without removing it from the remote queue.
+func (q *Queue) Peek() (interface{}, int, error) {
+	var t task
+	err := q.call(context.Background(), "Peek", nil, func(msg []byte) (err error) {
+		t, err = parseTask(msg)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return t.data, int(t.priority), nil
+}
+
+// Len returns the size of the remote queue, or 0 if it cannot be
+// reached.
+func (q *Queue) Len() int {
+	n, _, _ := q.Stats(context.Background())
+	return n
+}
+
+// Stats returns the size and the counters of the remote queue, of which
+// the server sends Enqueued, Dequeued, Expired, Cancelled and Dropped.
+func (q *Queue) Stats(ctx context.Context) (int, requestpq.Counters, error) {
+	var s stats
+	err := q.call(ctx, "Stats", nil, func(msg []byte) (err error) {
+		s, err = parseStats(msg)
+		return err
+	})
+	return int(s.len), requestpq.Counters{
+		Enqueued:  s.enqueued,
+		Dequeued:  s.dequeued,
+		Expired:   s.expired,
+		Cancelled: s.cancelled,
+		Dropped:   s.dropped,
+	}, err
+}
+
+// Close closes the client, not the remote queue: the calls in progress
+// and the later ones fail with ErrQueueClosed.
+func (q *Queue) Close() {
+	q.stop()
+	q.client.CloseIdleConnections()
+}
+
+// call sends the request message to the method, and calls fn with every
+// response message.
+func (q *Queue) call(ctx context.Context, method string, req []byte, fn func(msg []byte) error) error {
+	if q.closing.Err() != nil {
+		return requestpq.ErrQueueClosed
+	}
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(q.closing, cancel)()
+	var body bytes.Buffer
+	writeMessage(&body, req)
+	r, err := http.NewRequestWithContext(callCtx, http.MethodPost, q.base+method, &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		r.Header.Set("Grpc-Timeout", formatTimeout(time.Until(deadline)))
+	}
+	resp, err := q.client.Do(r)
+	if err != nil {
+		return q.failed(ctx, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return q.failed(ctx, fmt.Errorf("HTTP status %s", resp.Status))
+	}
+	if resp.Header.Get("Grpc-Status") != "" { // a response of trailers only
+		return errorOf(resp.Header)
+	}
+	for {
+		msg, err := readMessage(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return q.failed(ctx, err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return errorOf(resp.Trailer)
+}
+
+// failed returns the error of a call that failed to complete.
+func (q *Queue) failed(ctx context.Context, err error) error {
+	switch {
+	case q.closing.Err() != nil:
+		return requestpq.ErrQueueClosed
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status
+	}
+	return fmt.Errorf("grpcqueue: %w: %v", requestpq.ErrBackendUnavailable, err)
+}
+
+// errorOf returns the error of the status in the trailer of a response,
+// the queue errors as is so that they can be compared with ==.
+func errorOf(trailer http.Header) error {
+	code, err := strconv.Atoi(trailer.Get("Grpc-Status"))
+	if err != nil {
+		return fmt.Errorf("grpcqueue: %w: no status", requestpq.ErrBackendUnavailable)
+	}
+	msg := decodeMessage(trailer.Get("Grpc-Message"))
+	switch code {
+	case codeOK:
+		return nil
+	case codeResourceExhausted:
+		if msg == requestpq.ErrQueueFull.Error() {
+			return requestpq.ErrQueueFull
+		}
+		return fmt.Errorf("grpcqueue: %w: %s", requestpq.ErrQueueFull, msg)
+	case codeUnavailable:
+		return requestpq.ErrQueueClosed
+	case codeNotFound:
+		return requestpq.ErrQueueEmpty
+	case codeInvalidArgument:
+		return fmt.Errorf("grpcqueue: %w: %s", requestpq.ErrRejected, msg)
+	case codeCanceled:
+		return context.Canceled
+	case codeDeadlineExceeded:
+		return context.DeadlineExceeded
+	}
+	return &statusError{code, msg}
+}
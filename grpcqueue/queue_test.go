@@ -0,0 +1,116 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package grpcqueue
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// serve serves the queue on a local port, and returns a client of it.
+func serve(t *testing.T, q *requestpq.Queue) *Queue {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen:", err)
+	}
+	srv := NewServer(q).HTTPServer("")
+	go srv.Serve(l)
+	client := New(l.Addr().String())
+	t.Cleanup(func() {
+		client.Close()
+		srv.Close()
+	})
+	return client
+}
+
+func TestQueue(t *testing.T) {
+	q := requestpq.NewBoundedQueue(3)
+	c := serve(t, q)
+
+	_, err := c.Dequeue()
+	assert.Equal(t, requestpq.ErrQueueEmpty, err)
+	_, _, err = c.Peek()
+	assert.Equal(t, requestpq.ErrQueueEmpty, err)
+
+	assert.Equal(t, nil, c.Enqueue([]byte(`b`), 2))
+	assert.Equal(t, nil, c.Enqueue(`a`, -1))
+	q.Enqueue(requestpq.Task{Data: []byte(`in process`), Priority: 3}, 3)
+	assert.Equal(t, requestpq.ErrQueueFull, c.Enqueue(`c`, 3))
+	assert.Equal(t, true, errors.Is(c.Enqueue(42, 0), requestpq.ErrRejected))
+	assert.Equal(t, 3, c.Len())
+
+	data, priority, err := c.Peek()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte(`a`), data)
+	assert.Equal(t, -1, priority)
+	for _, expected := range []string{`a`, `b`, `in process`} {
+		data, err := c.Dequeue()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, []byte(expected), data)
+	}
+
+	n, counters, err := c.Stats(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, requestpq.Counters{Enqueued: 3, Dequeued: 3}, counters)
+
+	t.Run("blocking dequeue", func(t *testing.T) {
+		done := make(chan interface{})
+		go func() {
+			data, _ := c.DequeueCtx(context.Background())
+			done <- data
+		}()
+		time.Sleep(10 * time.Millisecond)
+		c.Enqueue(`late`, 0)
+		assert.Equal(t, []byte(`late`), <-done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := c.DequeueCtx(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("closed queue", func(t *testing.T) {
+		q := requestpq.New()
+		c := serve(t, q)
+		q.Enqueue(`left`, 0)
+		q.Close()
+		assert.Equal(t, requestpq.ErrQueueClosed, c.Enqueue(`a`, 0))
+		data, err := c.DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, []byte(`left`), data)
+		_, err = c.DequeueCtx(context.Background())
+		assert.Equal(t, requestpq.ErrQueueClosed, err)
+	})
+}
+
+func TestClose(t *testing.T) {
+	c := serve(t, requestpq.New())
+	done := make(chan error)
+	go func() {
+		_, err := c.DequeueCtx(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	assert.Equal(t, requestpq.ErrQueueClosed, <-done)
+	assert.Equal(t, requestpq.ErrQueueClosed, c.Enqueue(`a`, 0))
+}
+
+func TestUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen:", err)
+	}
+	l.Close()
+	c := New(l.Addr().String())
+	defer c.Close()
+	assert.Equal(t, true, errors.Is(c.Enqueue(`a`, 0), requestpq.ErrBackendUnavailable))
+	assert.Equal(t, 0, c.Len())
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package grpcqueue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lkevinzc/requestpq/v2"
+)
+
+// Server serves a requestpq.Queue as the Queue service. It holds the
+// tasks as requestpq.Task values of []byte data, so that in-process
+// producers and consumers may share the queue with the remote ones.
+type Server struct {
+	q *requestpq.Queue
+}
+
+// NewServer returns the server of the queue.
+func NewServer(q *requestpq.Queue) *Server {
+	return &Server{q: q}
+}
+
+// HTTPServer returns an http.Server listening on addr, which serves the
+// queue over HTTP/2 without TLS, as gRPC clients of an insecure channel
+// expect. The caller runs ListenAndServe, or Serve, and Shutdown.
+func (s *Server) HTTPServer(addr string) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: s, Protocols: new(http.Protocols)}
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	return srv
+}
+
+// ServeHTTP serves the calls of the Queue service. It rejects the other
+// requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "grpcqueue: not a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	ctx := r.Context()
+	if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	msg, err := readMessage(r.Body)
+	if err == nil {
+		err = s.serve(ctx, w, strings.TrimPrefix(r.URL.Path, service), msg)
+	}
+	code, message := statusOf(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", encodeMessage(message))
+	}
+}
+
+// serve runs the method on its request message, and writes the response
+// messages.
+func (s *Server) serve(ctx context.Context, w http.ResponseWriter, method string, msg []byte) error {
+	switch method {
+	case "Enqueue":
+		t, err := parseEnqueue(msg)
+		if err != nil {
+			return err
+		}
+		priority := int(t.priority)
+		if err := s.q.TryEnqueue(requestpq.Task{Data: t.data, Priority: priority}, priority); err != nil {
+			return err
+		}
+		return writeMessage(w, nil)
+	case "Dequeue":
+		req, err := parseDequeue(msg)
+		if err != nil {
+			return err
+		}
+		return s.dequeue(ctx, w, req)
+	case "Peek":
+		data, priority, err := s.q.Peek()
+		if err != nil {
+			return err
+		}
+		return writeMessage(w, task{data: taskOf(data).data, priority: int64(priority)}.marshal())
+	case "Stats":
+		counters := s.q.Stats().Counters()
+		return writeMessage(w, stats{
+			len:       int64(s.q.Len()),
+			enqueued:  counters.Enqueued,
+			dequeued:  counters.Dequeued,
+			expired:   counters.Expired,
+			cancelled: counters.Cancelled,
+			dropped:   counters.Dropped,
+		}.marshal())
+	}
+	return &statusError{codeUnimplemented, "unknown method " + method}
+}
+
+// dequeue streams the tasks to the consumer. A task that cannot be sent
+// is put back into the queue for another consumer, with its priority but
+// after the tasks of that priority.
+func (s *Server) dequeue(ctx context.Context, w http.ResponseWriter, req dequeueRequest) error {
+	rc := http.NewResponseController(w)
+	for n := uint32(0); req.limit == 0 || n < req.limit; n++ {
+		var data interface{}
+		var err error
+		if req.noWait {
+			data, err = s.q.Dequeue()
+			if errors.Is(err, requestpq.ErrQueueEmpty) {
+				return nil
+			}
+		} else {
+			data, err = s.q.DequeueCtx(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		t := taskOf(data)
+		if err := writeMessage(w, t.marshal()); err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			s.q.Enqueue(data, int(t.priority))
+			return err
+		}
+	}
+	return nil
+}
+
+// taskOf returns the task of queued data, which in-process producers may
+// also have enqueued as []byte or string.
+func taskOf(data interface{}) task {
+	var t task
+	if d, ok := data.(requestpq.Task); ok {
+		data, t.priority = d.Data, int64(d.Priority)
+	}
+	switch d := data.(type) {
+	case []byte:
+		t.data = d
+	case string:
+		t.data = []byte(d)
+	}
+	return t
+}
+
+// statusOf returns the status code of the outcome of a call, and the
+// message of a failure.
+func statusOf(err error) (int, string) {
+	var status *statusError
+	switch {
+	case err == nil:
+		return codeOK, ""
+	case errors.As(err, &status):
+		return status.code, status.msg
+	case errors.Is(err, requestpq.ErrQueueFull), errors.Is(err, requestpq.ErrShed),
+		errors.Is(err, requestpq.ErrQuotaExceeded):
+		return codeResourceExhausted, err.Error()
+	case errors.Is(err, requestpq.ErrQueueClosed):
+		return codeUnavailable, err.Error()
+	case errors.Is(err, requestpq.ErrQueueEmpty):
+		return codeNotFound, err.Error()
+	case errors.Is(err, requestpq.ErrRejected):
+		return codeInvalidArgument, err.Error()
+	case errors.Is(err, context.Canceled):
+		return codeCanceled, err.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		return codeDeadlineExceeded, err.Error()
+	}
+	return codeInternal, err.Error()
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package grpcqueue
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	q := requestpq.New()
+	s := NewServer(q)
+
+	t.Run("not gRPC", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, service+"Peek", nil))
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		c := serve(t, q)
+		err := c.call(context.Background(), "Purge", nil, func([]byte) error { return nil })
+		assert.Equal(t, &statusError{codeUnimplemented, "unknown method Purge"}, err)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		c := serve(t, q)
+		for i, data := range []string{`a`, `b`, `c`} {
+			c.Enqueue(data, i)
+		}
+		var got []string
+		err := c.call(context.Background(), "Dequeue", dequeueRequest{limit: 2}.marshal(), func(msg []byte) error {
+			task, err := parseTask(msg)
+			got = append(got, string(task.data))
+			return err
+		})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, []string{`a`, `b`}, got)
+		assert.Equal(t, 1, q.Len())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		for _, d := range []time.Duration{time.Nanosecond, 1500 * time.Millisecond, 10 * time.Hour} {
+			timeout, ok := parseTimeout(formatTimeout(d))
+			assert.Equal(t, true, ok)
+			assert.Equal(t, d, timeout)
+		}
+		_, ok := parseTimeout("1x")
+		assert.Equal(t, false, ok)
+	})
+
+	t.Run("status message", func(t *testing.T) {
+		msg := "100% full\n"
+		assert.Equal(t, "100%25 full%0A", encodeMessage(msg))
+		assert.Equal(t, msg, decodeMessage(encodeMessage(msg)))
+	})
+}
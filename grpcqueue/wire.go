@@ -0,0 +1,311 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package grpcqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// service is the path prefix of the methods of the Queue service.
+const service = "/requestpq.v1.Queue/"
+
+// maxMessage bounds the size of the messages read, like the default of
+// the gRPC implementations.
+const maxMessage = 4 << 20
+
+// The gRPC status codes in use.
+const (
+	codeOK                = 0
+	codeCanceled          = 1
+	codeInvalidArgument   = 3
+	codeDeadlineExceeded  = 4
+	codeNotFound          = 5
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+	codeUnavailable       = 14
+)
+
+// statusError is a failed call whose status code has no queue error.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("grpcqueue: status %d: %s", e.code, e.msg)
+}
+
+var errMalformed = &statusError{codeInternal, "malformed message"}
+
+// task is the Task message.
+type task struct {
+	data     []byte
+	priority int64
+}
+
+// stats is the StatsResponse message.
+type stats struct {
+	len                                             int64
+	enqueued, dequeued, expired, cancelled, dropped uint64
+}
+
+// dequeueRequest is the DequeueRequest message.
+type dequeueRequest struct {
+	limit  uint32
+	noWait bool
+}
+
+func (t task) marshal() []byte {
+	var b []byte
+	b = appendBytes(b, 1, t.data)
+	return appendVarint(b, 2, uint64(t.priority))
+}
+
+func parseTask(msg []byte) (t task, err error) {
+	err = parseFields(msg, func(field int, v uint64, p []byte) {
+		switch field {
+		case 1:
+			t.data = p
+		case 2:
+			t.priority = int64(v)
+		}
+	})
+	return t, err
+}
+
+// marshalEnqueue returns the EnqueueRequest message of the task.
+func marshalEnqueue(t task) []byte {
+	return appendBytes(nil, 1, t.marshal())
+}
+
+func parseEnqueue(msg []byte) (t task, err error) {
+	var inner []byte
+	if err := parseFields(msg, func(field int, v uint64, p []byte) {
+		if field == 1 {
+			inner = p
+		}
+	}); err != nil {
+		return t, err
+	}
+	return parseTask(inner)
+}
+
+func (r dequeueRequest) marshal() []byte {
+	b := appendVarint(nil, 1, uint64(r.limit))
+	if r.noWait {
+		b = appendVarint(b, 2, 1)
+	}
+	return b
+}
+
+func parseDequeue(msg []byte) (r dequeueRequest, err error) {
+	err = parseFields(msg, func(field int, v uint64, p []byte) {
+		switch field {
+		case 1:
+			r.limit = uint32(v)
+		case 2:
+			r.noWait = v != 0
+		}
+	})
+	return r, err
+}
+
+func (s stats) marshal() []byte {
+	b := appendVarint(nil, 1, uint64(s.len))
+	for i, v := range []uint64{s.enqueued, s.dequeued, s.expired, s.cancelled, s.dropped} {
+		b = appendVarint(b, 2+i, v)
+	}
+	return b
+}
+
+func parseStats(msg []byte) (s stats, err error) {
+	err = parseFields(msg, func(field int, v uint64, p []byte) {
+		switch field {
+		case 1:
+			s.len = int64(v)
+		case 2:
+			s.enqueued = v
+		case 3:
+			s.dequeued = v
+		case 4:
+			s.expired = v
+		case 5:
+			s.cancelled = v
+		case 6:
+			s.dropped = v
+		}
+	})
+	return s, err
+}
+
+// appendVarint appends a varint field, unless it has the default value.
+func appendVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendBytes appends a length-delimited field, unless it is empty.
+func appendBytes(b []byte, field int, p []byte) []byte {
+	if len(p) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+// parseFields calls fn with the number and the value of every field of
+// the message: v for a varint, p for a length-delimited field. The fixed
+// size fields, which the messages don't have, are skipped.
+func parseFields(msg []byte, fn func(field int, v uint64, p []byte)) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errMalformed
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return errMalformed
+			}
+			msg = msg[n:]
+			fn(field, v, nil)
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return errMalformed
+			}
+			msg = msg[size:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return errMalformed
+			}
+			fn(field, 0, msg[n:n+int(l)])
+			msg = msg[n+int(l):]
+		default:
+			return errMalformed
+		}
+	}
+	return nil
+}
+
+// writeMessage writes a message with the gRPC framing: uncompressed, and
+// prefixed with its length.
+func writeMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// readMessage reads a message written by writeMessage. It returns io.EOF
+// at the end of the stream.
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, &statusError{codeUnimplemented, "compressed messages are not supported"}
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxMessage {
+		return nil, &statusError{codeResourceExhausted, "message too large"}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// timeoutUnits are the units of the grpc-timeout header, whose value has
+// at most 8 digits.
+var timeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+func formatTimeout(d time.Duration) string {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	for _, u := range timeoutUnits {
+		if v := (d + u.d - 1) / u.d; v < 1e8 {
+			return strconv.FormatInt(int64(v), 10) + string(u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+func parseTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	for _, u := range timeoutUnits {
+		if u.unit == s[len(s)-1] {
+			return time.Duration(v) * u.d, true
+		}
+	}
+	return 0, false
+}
+
+// encodeMessage percent-encodes the status message for the grpc-message
+// header.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func decodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if c, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
@@ -10,18 +10,153 @@
 // This implementation provides the option to record the item order by
 // time or count, so that the Less() compares the order if there is a
 // tie in the priority. This is useful for dealing with requests (FIFO).
+// Prefer a count, e.g. from a Stamper, to a time: coarse clocks, as on
+// Windows, give many items the same time, and then the same order.
+//
+// NewMaxHeap returns a heap ordered the other way round, where the
+// root is the item with the maximum priority; ties are still FIFO. Any
+// other order can be given to NewHeapFunc.
 //
 package heap
 
 import (
 	"math"
+	"math/bits"
+	"sync/atomic"
 )
 
 // An Item contains any data with a priority value.
 type Item struct {
 	Priority int
-	Data     interface{}
-	Order    uint64
+	// Key optionally refines the priority: items with the same priority
+	// are ordered by key, and only then by order.
+	Key   Key
+	Data  interface{}
+	Order uint64
+	index int
+}
+
+// Stamper hands out increasing orders to items, so that items of the
+// same priority are popped in the order they were stamped, whatever the
+// resolution of the clock. The zero value is ready to use, and it is
+// safe for concurrent use.
+type Stamper struct {
+	last uint64
+}
+
+// Stamp sets the order of the item to the next one, and returns it.
+func (s *Stamper) Stamp(it *Item) uint64 {
+	it.Order = atomic.AddUint64(&s.last, 1)
+	return it.Order
+}
+
+// ItemOption configures an Item at construction, see NewItem.
+type ItemOption func(*Item)
+
+// WithKey sets the key of the item.
+func WithKey(key Key) ItemOption {
+	return func(it *Item) {
+		it.Key = key
+	}
+}
+
+// WithOrder sets the order of the item.
+func WithOrder(order uint64) ItemOption {
+	return func(it *Item) {
+		it.Order = order
+	}
+}
+
+// WithStamper sets the order of the item to the next one of s.
+func WithStamper(s *Stamper) ItemOption {
+	return func(it *Item) {
+		s.Stamp(it)
+	}
+}
+
+// NewItem returns an item of the data with the priority. Prefer it and
+// the accessors of Item to the fields, which are kept for compatibility:
+// the layout of the items may change, and the fields of an item in a
+// heap must not be changed anyway.
+func NewItem(data interface{}, priority int, opts ...ItemOption) *Item {
+	it := &Item{Priority: priority, Data: data}
+	for _, opt := range opts {
+		opt(it)
+	}
+	return it
+}
+
+// GetPriority returns the priority of the item.
+func (it *Item) GetPriority() int {
+	return it.Priority
+}
+
+// GetKey returns the key of the item, which must not be modified.
+func (it *Item) GetKey() Key {
+	return it.Key
+}
+
+// GetData returns the data of the item.
+func (it *Item) GetData() interface{} {
+	return it.Data
+}
+
+// GetOrder returns the order of the item.
+func (it *Item) GetOrder() uint64 {
+	return it.Order
+}
+
+// Key is a composite priority compared lexicographically, e.g. (deadline,
+// sequence), so that secondary orderings don't have to be encoded into
+// a single int.
+type Key []int64
+
+// Int64Key returns the key of an int64 priority, which doesn't fit in
+// Priority on 32-bit platforms.
+func Int64Key(priority int64) Key {
+	return Key{priority}
+}
+
+// Float64Key returns the key of a float64 priority, e.g. a score, whose
+// order is that of the float64 values. NaNs sort after +Inf, whatever
+// their sign and payload, and like each other.
+func Float64Key(priority float64) Key {
+	if math.IsNaN(priority) {
+		priority = math.NaN()
+	}
+	bits := math.Float64bits(priority)
+	if bits>>63 == 1 {
+		bits = ^bits // negative values sort in reverse order of their bits
+	} else {
+		bits |= 1 << 63
+	}
+	return Key{int64(bits ^ 1<<63)}
+}
+
+// Compare returns -1, 0 or +1 if k sorts before, like or after other.
+// A key sorts before the longer keys it is a prefix of.
+func (k Key) Compare(other Key) int {
+	for i := 0; i < len(k) && i < len(other); i++ {
+		switch {
+		case k[i] < other[i]:
+			return -1
+		case k[i] > other[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(k) < len(other):
+		return -1
+	case len(k) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// Index returns the position of the item in the heap. A value less
+// than 1 means the item is not (or no longer) in a heap.
+func (it *Item) Index() int {
+	return it.index
 }
 
 // ItemHeap implements the basic min heap of Item.
@@ -37,6 +172,45 @@ func NewHeap() ItemHeap {
 	return h
 }
 
+// LessFunc reports whether item a must be popped before item b. A heap
+// not ordered by minFirst keeps its LessFunc in the dummy first item.
+type LessFunc func(a, b *Item) bool
+
+func minFirst(a, b *Item) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if c := a.Key.Compare(b.Key); c != 0 {
+		return c < 0
+	}
+	return a.Order < b.Order
+}
+
+// maxFirst reverses both the priority and the key, but not the order.
+func maxFirst(a, b *Item) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if c := a.Key.Compare(b.Key); c != 0 {
+		return c > 0
+	}
+	return a.Order < b.Order
+}
+
+// NewMaxHeap returns a ItemHeap instance that pops the item with the
+// maximum priority first.
+func NewMaxHeap() ItemHeap {
+	return NewHeapFunc(maxFirst)
+}
+
+// NewHeapFunc returns a ItemHeap instance ordered by less, whose root
+// is the item that less puts before all the others.
+func NewHeapFunc(less LessFunc) ItemHeap {
+	h := NewHeap()
+	h[0].Data = less
+	return h
+}
+
 // Len returns heap size (n-1) instead of the real array size (n).
 func (h ItemHeap) Len() int {
 	return len(h) - 1
@@ -49,15 +223,23 @@ func (h ItemHeap) Empty() bool {
 
 // Less serves as a comparator.
 func (h ItemHeap) Less(i, j int) bool {
-	if h[i].Priority == h[j].Priority {
-		return h[i].Order < h[j].Order
+	return h.Before(h[i], h[j])
+}
+
+// Before reports whether item a is popped before item b, according to
+// the order of the heap. The items need not be in the heap.
+func (h ItemHeap) Before(a, b *Item) bool {
+	if less, ok := h[0].Data.(LessFunc); ok {
+		return less(a, b)
 	}
-	return h[i].Priority < h[j].Priority
+	return minFirst(a, b)
 }
 
 // Swap swaps two array elements (i.e. items).
 func (h ItemHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
 }
 
 // Push pushes the element x onto the heap.
@@ -65,7 +247,27 @@ func (h ItemHeap) Swap(i, j int) {
 func (h *ItemHeap) Push(x interface{}) {
 	item := x.(*Item)
 	*h = append(*h, item)
-	h.up(h.Len())
+	item.index = h.Len()
+	h.up(item.index)
+}
+
+// PushAll pushes all the items onto the heap at once. For a large burst
+// compared to the size of the heap, it appends everything and then
+// restores the heap invariant bottom-up, in O(n + k) where k =
+// len(items), rather than O(k log(n + k)) for k calls to Push.
+func (h *ItemHeap) PushAll(items []*Item) {
+	n := h.Len()
+	*h = append(*h, items...)
+	for i, item := range items {
+		item.index = n + 1 + i
+	}
+	if n > 0 && len(items) < n/bits.Len(uint(n)) {
+		for _, item := range items {
+			h.up(item.index)
+		}
+		return
+	}
+	h.heapify()
 }
 
 // Pop removes and returns the minimum element (according to Less) from the heap.
@@ -82,9 +284,77 @@ func (h *ItemHeap) Pop() interface{} {
 	old[n] = nil // avoid memory leak
 	*h = old[0:n]
 	h.down(1)
+	item.index = -1
+	return item
+}
+
+// Remove removes and returns the element at index i from the heap.
+// The complexity is O(log n) where n = h.Len().
+// If i is out of range, Remove returns nil.
+func (h *ItemHeap) Remove(i int) interface{} {
+	n := h.Len()
+	if i < 1 || i > n {
+		return nil
+	}
+	if i != n {
+		h.Swap(i, n)
+	}
+	old := *h
+	item := old[n]
+	old[n] = nil // avoid memory leak
+	*h = old[0:n]
+	if i != n {
+		h.down(i)
+		h.up(i)
+	}
+	item.index = -1
 	return item
 }
 
+// Peek returns the minimum element (according to Less) without removing it.
+// The complexity is O(1). If the heap is empty, Peek returns nil.
+func (h ItemHeap) Peek() interface{} {
+	if h.Empty() {
+		return nil
+	}
+	return h[1]
+}
+
+// Compact removes every item for which drop returns true, and then
+// restores the heap invariant bottom-up. It returns the number of
+// removed items. The complexity is O(n) where n = h.Len().
+func (h *ItemHeap) Compact(drop func(*Item) bool) int {
+	old := *h
+	n := 1
+	for i := 1; i < len(old); i++ {
+		if drop(old[i]) {
+			old[i].index = -1
+			continue
+		}
+		old[n] = old[i]
+		old[n].index = n
+		n++
+	}
+	removed := len(old) - n
+	for i := n; i < len(old); i++ {
+		old[i] = nil // avoid memory leak
+	}
+	*h = old[0:n]
+	h.heapify()
+	return removed
+}
+
+// Reserve grows the underlying array so that it can hold at least n
+// items without reallocation.
+func (h *ItemHeap) Reserve(n int) {
+	if n+1 <= cap(*h) {
+		return
+	}
+	grown := make(ItemHeap, len(*h), n+1)
+	copy(grown, *h)
+	*h = grown
+}
+
 // ReOrder transforms old order values into smaller ones
 // while ensuring them in the original order. It should
 // be called when the order value is likely to overflow.
@@ -101,6 +371,12 @@ func (h ItemHeap) ReOrder() uint64 {
 	return uint64(h.Len())
 }
 
+func (h *ItemHeap) heapify() {
+	for i := parent(h.Len()); i >= 1; i-- {
+		h.down(i)
+	}
+}
+
 func (h *ItemHeap) up(j int) {
 	i := parent(j)
 	if j > 1 && h.Less(j, i) {
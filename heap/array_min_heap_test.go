@@ -5,6 +5,7 @@ package heap
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"sync"
 	"testing"
@@ -194,6 +195,116 @@ func TestEqualPriority(t *testing.T) {
 	fmt.Println()
 }
 
+func TestStamper(t *testing.T) {
+	h := NewHeap()
+	var s Stamper
+	for i := 0; i < 20; i++ {
+		item := &Item{Priority: 20, Data: i}
+		if order := s.Stamp(item); order != uint64(i+1) {
+			t.Errorf("stamp got %d; want %d", order, i+1)
+		}
+		h.Push(item)
+	}
+	h.verify(t, 1)
+	for i := 0; !h.Empty(); i++ {
+		if x := h.Pop().(*Item); x.Data != i {
+			t.Errorf("%d.th pop got %v; want %d", i, x.Data, i)
+		}
+	}
+}
+
+func TestNewItem(t *testing.T) {
+	it := NewItem(`data`, 3, WithKey(Key{1, 2}), WithOrder(7))
+	if it.GetData() != `data` || it.GetPriority() != 3 || it.GetKey().Compare(Key{1, 2}) != 0 || it.GetOrder() != 7 {
+		t.Errorf("got %v", it)
+	}
+	if it.Index() >= 1 {
+		t.Errorf("new item index %d; want less than 1", it.Index())
+	}
+
+	h := NewHeap()
+	var s Stamper
+	for i := 0; i < 3; i++ {
+		h.Push(NewItem(i, 1, WithStamper(&s)))
+	}
+	for i := 0; i < 3; i++ {
+		if x := h.Pop().(*Item); x.GetData() != i || x.GetOrder() != uint64(i+1) {
+			t.Errorf("%d.th pop got %v", i, x)
+		}
+	}
+}
+
+func TestMaxHeap(t *testing.T) {
+	h := NewMaxHeap()
+	for i, priority := range []int{3, 9, 1, 9, 5} {
+		h.Push(&Item{Priority: priority, Data: i, Order: uint64(i)})
+	}
+	h.verify(t, 1)
+	for _, want := range []int{1, 3, 4, 0, 2} {
+		if x := h.Pop().(*Item); x.Data != want {
+			t.Errorf("pop got %v; want %d", x.Data, want)
+		}
+	}
+	if !h.Before(&Item{Priority: 2}, &Item{Priority: 1}) {
+		t.Errorf("max heap pops priority 1 before 2")
+	}
+	if NewHeap().Before(&Item{Priority: 2}, &Item{Priority: 1}) {
+		t.Errorf("min heap pops priority 2 before 1")
+	}
+}
+
+func TestHeapFunc(t *testing.T) {
+	h := NewHeapFunc(func(a, b *Item) bool {
+		return len(a.Data.(string)) < len(b.Data.(string))
+	})
+	for _, data := range []string{`ccc`, `a`, `dddd`, `bb`} {
+		h.Push(&Item{Data: data})
+	}
+	h.verify(t, 1)
+	for _, want := range []string{`a`, `bb`, `ccc`, `dddd`} {
+		if x := h.Pop().(*Item); x.Data != want {
+			t.Errorf("pop got %v; want %s", x.Data, want)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	h := NewHeap()
+	h.Push(&Item{Priority: 1, Key: Key{5, 2}, Data: `c`})
+	h.Push(&Item{Priority: 1, Key: Key{5, 1}, Data: `b`})
+	h.Push(&Item{Priority: 1, Key: Key{5}, Data: `a`})
+	h.Push(&Item{Priority: 1, Key: Key{7}, Data: `d`})
+	h.Push(&Item{Priority: 0, Key: Key{9}, Data: `first`})
+	h.verify(t, 1)
+	for _, want := range []string{`first`, `a`, `b`, `c`, `d`} {
+		if x := h.Pop().(*Item); x.Data != want {
+			t.Errorf("pop got %v; want %s", x.Data, want)
+		}
+	}
+	if c := (Key{1, 2}).Compare(Key{1, 2}); c != 0 {
+		t.Errorf("compare equal keys got %d; want 0", c)
+	}
+}
+
+func TestFloat64Key(t *testing.T) {
+	values := []float64{math.Inf(-1), -1e300, -2.5, -1, -0.5, 0, 1e-300, 0.5, 1, 2.5, 1e300, math.Inf(1), math.NaN()}
+	for i := 1; i < len(values); i++ {
+		if Float64Key(values[i-1]).Compare(Float64Key(values[i])) >= 0 {
+			t.Errorf("key of %v does not sort before key of %v", values[i-1], values[i])
+		}
+	}
+	if Float64Key(-0.0).Compare(Float64Key(0)) > 0 {
+		t.Errorf("key of -0 sorts after key of 0")
+	}
+	negativeNaN := math.Float64frombits(0xfff8000000000001)
+	if Float64Key(negativeNaN).Compare(Float64Key(math.NaN())) != 0 {
+		t.Errorf("key of a negative NaN does not sort like key of NaN")
+	}
+	if Int64Key(math.MinInt64).Compare(Int64Key(math.MaxInt64)) >= 0 {
+		t.Errorf("int64 keys out of order")
+	}
+}
+
 func TestPopEmpty(t *testing.T) {
 	h := NewHeap()
 	h.verify(t, 1)
@@ -217,6 +328,171 @@ func TestPopEmpty(t *testing.T) {
 	}
 }
 
+func TestPeek(t *testing.T) {
+	h := NewHeap()
+	if h.Peek() != nil {
+		t.Errorf("peek an empty heap got %v; want nil", h.Peek())
+	}
+	for i := 20; i > 0; i-- {
+		h.Push(&Item{
+			Priority: i,
+			Data:     `test`,
+			Order:    uint64(time.Now().UnixNano()),
+		})
+		x := h.Peek().(*Item)
+		if x.Priority != i {
+			t.Errorf("peek got %v; want %d", x, i)
+		}
+	}
+	if h.Len() != 20 {
+		t.Errorf("heap size changed after peek: got %d; want %d", h.Len(), 20)
+	}
+	h.verify(t, 1)
+}
+
+func TestRemove(t *testing.T) {
+	h := NewHeap()
+	items := make([]*Item, 0, 50)
+	for i := 0; i < 50; i++ {
+		item := &Item{
+			Priority: rand.Intn(20),
+			Data:     i,
+			Order:    uint64(i),
+		}
+		items = append(items, item)
+		h.Push(item)
+	}
+	h.verify(t, 1)
+
+	for i := 0; i < 50; i += 2 {
+		idx := items[i].Index()
+		x := h.Remove(idx).(*Item)
+		if x != items[i] {
+			t.Errorf("remove at %d got %v; want %v", idx, x, items[i])
+		}
+		if x.Index() >= 1 {
+			t.Errorf("removed item still has index %d", x.Index())
+		}
+		h.verify(t, 1)
+	}
+	if h.Len() != 25 {
+		t.Errorf("heap size got %d; want %d", h.Len(), 25)
+	}
+	if h.Remove(0) != nil || h.Remove(26) != nil {
+		t.Errorf("remove out of range should return nil")
+	}
+	for i := 1; i <= h.Len(); i++ {
+		if h[i].Index() != i {
+			t.Errorf("item at %d has index %d", i, h[i].Index())
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	h := NewHeap()
+	for i := 0; i < 100; i++ {
+		h.Push(&Item{
+			Priority: rand.Intn(20),
+			Data:     i,
+			Order:    uint64(i),
+		})
+	}
+	removed := h.Compact(func(item *Item) bool {
+		return item.Data.(int)%3 == 0
+	})
+	if removed != 34 {
+		t.Errorf("compact removed %d; want %d", removed, 34)
+	}
+	if h.Len() != 66 {
+		t.Errorf("heap size got %d; want %d", h.Len(), 66)
+	}
+	h.verify(t, 1)
+	for i := 1; i <= h.Len(); i++ {
+		if h[i].Index() != i {
+			t.Errorf("item at %d has index %d", i, h[i].Index())
+		}
+	}
+	prev := h.Pop().(*Item)
+	for !h.Empty() {
+		x := h.Pop().(*Item)
+		if x.Data.(int)%3 == 0 {
+			t.Errorf("compacted item %v is still in the heap", x)
+		}
+		if x.Priority < prev.Priority {
+			t.Errorf("pop got %v after %v", x, prev)
+		}
+		prev = x
+	}
+}
+
+func TestPushAll(t *testing.T) {
+	for _, sizes := range [][2]int{{0, 100}, {100, 100}, {1000, 5}} {
+		h := NewHeap()
+		order := uint64(0)
+		for i := 0; i < sizes[0]; i++ {
+			order++
+			h.Push(&Item{Priority: rand.Intn(20), Order: order})
+		}
+		items := make([]*Item, sizes[1])
+		for i := range items {
+			order++
+			items[i] = &Item{Priority: rand.Intn(20), Order: order}
+		}
+		h.PushAll(items)
+		if h.Len() != sizes[0]+sizes[1] {
+			t.Errorf("heap size got %d; want %d", h.Len(), sizes[0]+sizes[1])
+		}
+		h.verify(t, 1)
+		for i := 1; i <= h.Len(); i++ {
+			if h[i].Index() != i {
+				t.Errorf("item at %d has index %d", i, h[i].Index())
+			}
+		}
+	}
+}
+
+func BenchmarkPushAll(b *testing.B) {
+	items := make([]*Item, 10000)
+	for i := range items {
+		items[i] = &Item{Priority: rand.Intn(20), Order: uint64(i)}
+	}
+	b.Run("Push", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h := NewHeap()
+			for _, item := range items {
+				h.Push(item)
+			}
+		}
+	})
+	b.Run("PushAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h := NewHeap()
+			h.PushAll(items)
+		}
+	})
+}
+
+func TestReserve(t *testing.T) {
+	h := NewHeap()
+	h.Push(&Item{Priority: 1, Data: `test`})
+	h.Reserve(100)
+	if cap(h) < 101 {
+		t.Errorf("capacity got %d; want at least %d", cap(h), 101)
+	}
+	arr := &h[0]
+	for i := 0; i < 99; i++ {
+		h.Push(&Item{Priority: rand.Intn(20), Data: `test`})
+	}
+	if arr != &h[0] {
+		t.Errorf("heap reallocated after reserve")
+	}
+	h.Reserve(10) // never shrinks
+	if cap(h) < 101 || h.Len() != 100 {
+		t.Errorf("reserve should not shrink the heap")
+	}
+	h.verify(t, 1)
+}
+
 func BenchmarkHeapDup(b *testing.B) {
 	const n = 10000
 	h := NewHeap()
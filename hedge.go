@@ -0,0 +1,130 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hedge links the copies of a hedged request: the first one popped
+// claims it, and the other one is then discarded like a cancelled item.
+type hedge struct {
+	lock   sync.Mutex
+	winner *entry
+	done   chan struct{} // closed once claimed or the original is gone
+	ended  bool
+}
+
+// claim reports whether e is the copy that gets processed.
+func (h *hedge) claim(e *entry) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.winner == nil {
+		h.winner = e
+		h.stop()
+	}
+	return h.winner == e
+}
+
+// end stops the hedging, since the original left the queue: expired,
+// dropped, cancelled or dequeued.
+func (h *hedge) end() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.stop()
+}
+
+// stop closes done once. It must be called with the lock held.
+func (h *hedge) stop() {
+	if !h.ended {
+		h.ended = true
+		close(h.done)
+	}
+}
+
+// lost reports whether another copy than e was already claimed.
+func (h *hedge) lost(e *entry) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.winner != nil && h.winner != e
+}
+
+// EnqueueHedged puts the data into the priority queue like Enqueue,
+// and, if it hasn't been dequeued after the given delay, a duplicate
+// with hedgePriority too, usually a more urgent one. Only the copy
+// dequeued first is processed, the other is discarded, so that critical
+// requests get a better tail latency without always paying double.
+//
+// The duplicate is not enqueued if the original already left the queue,
+// the queue is full or closed, or its retry budget is exhausted, see
+// WithRetryBudget. It keeps the context, deadline and key of the
+// original. The delay is measured with the clock of the queue, see
+// WithClock.
+func (q *Queue) EnqueueHedged(data interface{}, priority int, after time.Duration, hedgePriority int) error {
+	h := &hedge{done: make(chan struct{})}
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return err
+	}
+	e.hedge = h
+	queued, err := q.enqueueEntry(e, true)
+	if queued == nil {
+		return err
+	}
+	closing := q.closingChan()
+	var cancelled <-chan struct{}
+	if e.ctx != nil {
+		cancelled = e.ctx.Done()
+	}
+	go func() {
+		select {
+		case <-q.clock.After(after):
+		case <-h.done:
+			return
+		case <-closing:
+			return
+		case <-cancelled:
+			return
+		}
+		if !q.allowHedge(h) {
+			return
+		}
+		dup := newEntry(e.data, hedgePriority)
+		dup.Key, dup.deadline, dup.ctx = e.Key, e.deadline, e.ctx
+		dup.hedge, dup.extra = h, true
+		if _, err := q.enqueueEntry(dup, false); err == nil {
+			atomic.AddUint64(&q.stats.hedged, 1)
+		}
+	}()
+	return nil
+}
+
+// allowHedge reports whether the duplicate of a hedged request may be
+// enqueued, and spends the retry budget if so.
+func (q *Queue) allowHedge(h *hedge) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	h.lock.Lock()
+	ended := h.ended
+	h.lock.Unlock()
+	if ended || q.closed {
+		return false
+	}
+	return q.allowRetry()
+}
+
+// closingChan returns a channel closed once the queue is closed.
+func (q *Queue) closingChan() <-chan struct{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closing == nil {
+		q.closing = make(chan struct{})
+		if q.closed {
+			close(q.closing)
+		}
+	}
+	return q.closing
+}
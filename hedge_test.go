@@ -0,0 +1,75 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueueHedged(t *testing.T) {
+	t.Run("the duplicate wins", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock()
+		q.Enqueue(`busy`, 1)
+		assert.Equal(t, nil, q.EnqueueHedged(`critical`, 5, time.Second, 0))
+		assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		clock.advance(time.Second)
+		assert.Eventually(t, func() bool { return q.Len() == 3 }, time.Second, time.Millisecond)
+		assert.Equal(t, uint64(1), q.Stats().Hedged())
+
+		data, _ := q.Dequeue()
+		assert.Equal(t, `critical`, data)
+		data, _ = q.Dequeue()
+		assert.Equal(t, `busy`, data)
+		_, err := q.Dequeue()
+		assert.Equal(t, ErrQueueEmpty, err, "the original is discarded")
+		assert.Equal(t, uint64(1), q.Stats().Cancelled())
+	})
+
+	t.Run("no duplicate once dequeued", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock()
+		q.EnqueueHedged(`critical`, 5, time.Second, 0)
+		assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		data, _ := q.Dequeue()
+		assert.Equal(t, `critical`, data)
+		clock.advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 0, q.Len())
+		assert.Equal(t, uint64(0), q.Stats().Hedged())
+	})
+
+	t.Run("no duplicate when full", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock(WithCapacity(1))
+		q.EnqueueHedged(`critical`, 5, time.Second, 0)
+		assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		clock.advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 1, q.Len())
+		assert.Equal(t, uint64(0), q.Stats().Hedged())
+	})
+	t.Run("no duplicate once dropped", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock(WithCapacity(1), WithOverflowPolicy(DropOldest), WithRetryBudget(0, 1))
+		q.EnqueueHedged(`critical`, 5, time.Second, 0)
+		assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		q.Enqueue(`newer`, 1)
+		clock.advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 1, q.Len())
+		assert.Equal(t, uint64(0), q.Stats().Hedged())
+		assert.True(t, q.AllowRetry(), "the budget is not spent")
+	})
+
+	t.Run("no duplicate once closed", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock(WithRetryBudget(0, 1))
+		q.EnqueueHedged(`critical`, 5, time.Second, 0)
+		assert.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+		q.Close()
+		clock.advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 1, q.Len())
+		assert.Equal(t, uint64(0), q.Stats().Hedged())
+		assert.True(t, q.AllowRetry(), "the budget is not spent")
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Sample is a point-in-time measurement of a queue.
+type Sample struct {
+	Time     time.Time
+	Len      int
+	Enqueued uint64
+	Dequeued uint64
+	// Runtime is nil unless the history samples runtime metrics.
+	Runtime *RuntimeSample
+}
+
+// History records samples of a queue into a fixed-size ring buffer, so
+// that the recent evolution of the backlog can be inspected.
+type History struct {
+	q       *Queue
+	runtime bool
+	lock    sync.Mutex
+	samples []Sample
+	next    int
+	full    bool
+}
+
+// NewHistory returns a History keeping the last size samples of q. If
+// runtime is true, Go runtime metrics (GC pauses, heap size, number of
+// goroutines) are sampled alongside the queue, so that backlog growth
+// can be correlated with e.g. GC pressure. Reading them briefly stops
+// the world, so keep the sampling interval coarse.
+func NewHistory(q *Queue, size int, runtime bool) *History {
+	return &History{
+		q:       q,
+		runtime: runtime,
+		samples: make([]Sample, size),
+	}
+}
+
+// Record takes a sample of the queue now.
+func (h *History) Record() Sample {
+	sample := Sample{
+		Time:     h.q.now(),
+		Len:      h.q.Len(),
+		Enqueued: h.q.stats.Enqueued(),
+		Dequeued: h.q.stats.Dequeued(),
+	}
+	if h.runtime {
+		sample.Runtime = readRuntimeSample()
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.samples) == 0 {
+		return sample
+	}
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+	return sample
+}
+
+// Run records a sample at every interval until ctx is done.
+func (h *History) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Record()
+		}
+	}
+}
+
+// Samples returns the recorded samples, oldest first.
+func (h *History) Samples() []Sample {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.full {
+		return append([]Sample(nil), h.samples[:h.next]...)
+	}
+	return append(append([]Sample(nil), h.samples[h.next:]...), h.samples[:h.next]...)
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	q := New()
+	h := NewHistory(q, 3, false)
+	assert.Equal(t, 0, len(h.Samples()))
+	for i := 0; i < 5; i++ {
+		q.Enqueue(i, i)
+		h.Record()
+	}
+	samples := h.Samples()
+	assert.Equal(t, 3, len(samples))
+	for i, sample := range samples {
+		assert.Equal(t, i+3, sample.Len)
+		assert.Equal(t, uint64(i+3), sample.Enqueued)
+		assert.Nil(t, sample.Runtime)
+	}
+}
+
+func TestHistoryRuntime(t *testing.T) {
+	q := New()
+	h := NewHistory(q, 8, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return len(h.Samples()) > 0 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	sample := h.Samples()[0]
+	assert.NotNil(t, sample.Runtime)
+	assert.Greater(t, sample.Runtime.Goroutines, 0)
+	assert.Greater(t, sample.Runtime.HeapAlloc, uint64(0))
+}
@@ -0,0 +1,36 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "time"
+
+// OnIdle makes the queue call fn once it has been empty for d, e.g. to
+// downscale workers, release GPU memory or switch a model to low-power
+// mode. fn is called once per idle period, in its own goroutine; the
+// next enqueue ends the idle period. It replaces the previous callback.
+//
+// Idleness is tracked on a best-effort basis: fn may run concurrently
+// with an enqueue that ends the idle period.
+func (q *Queue) OnIdle(d time.Duration, fn func()) {
+	q.lock.Lock()
+	defer q.unlock()
+	q.busy()
+	q.idleAfter, q.onIdle = d, fn
+}
+
+// idle arms the idle timer if the queue is empty. It must be called with
+// the lock held.
+func (q *Queue) idle() {
+	if q.onIdle == nil || q.idleTimer != nil || q.size() > 0 {
+		return
+	}
+	q.idleTimer = afterFunc(q.clock, q.idleAfter, q.onIdle)
+}
+
+// busy ends the idle period. It must be called with the lock held.
+func (q *Queue) busy() {
+	if q.idleTimer != nil {
+		q.idleTimer.Stop()
+		q.idleTimer = nil
+	}
+}
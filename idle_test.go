@@ -0,0 +1,57 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnIdle(t *testing.T) {
+	t.Run("queue", func(t *testing.T) {
+		q := New()
+		var calls int32
+		q.Enqueue(`a`, 1)
+		q.OnIdle(10*time.Millisecond, func() { atomic.AddInt32(&calls, 1) })
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&calls), "not empty")
+
+		q.Dequeue()
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "once per idle period")
+
+		q.Enqueue(`b`, 1)
+		q.Dequeue()
+		q.Enqueue(`c`, 1) // ends the idle period before d
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		q.Dequeue()
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("fake clock", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock()
+		var calls int32
+		q.OnIdle(time.Second, func() { atomic.AddInt32(&calls, 1) })
+		assert.Equal(t, 1, clock.waiting())
+		clock.advance(time.Second - time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+		clock.advance(time.Millisecond)
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("decorated channel", func(t *testing.T) {
+		idle := make(chan struct{}, 1)
+		inChan := make(chan *Task)
+		outChan := Decorate(inChan, WithOnIdle(10*time.Millisecond, func() { idle <- struct{}{} }))
+		inChan <- &Task{Data: `a`, Priority: 1}
+		assert.Equal(t, `a`, <-outChan)
+		<-idle
+		close(inChan)
+	})
+}
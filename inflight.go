@@ -0,0 +1,66 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+// WithMaxInflight limits the number of items in flight, i.e. dequeued
+// but not acked yet with Ack, to protect downstream systems that can
+// only hold so many concurrent requests. Once the limit is reached,
+// blocking dequeues wait for an Ack, and the others return nothing, or
+// ErrMaxInflight for Dequeue. A non-positive max means no limit.
+func WithMaxInflight(max int) Option {
+	return func(q *Queue) {
+		q.maxInflight = max
+	}
+}
+
+// Ack tells the queue that the processing of a dequeued item is over,
+// successfully or not, which makes room for another one if the items in
+// flight are limited. Dispatch, Serve and DispatchGroup ack the items
+// they process.
+func (q *Queue) Ack() {
+	q.ack(1)
+}
+
+// ack acks n items at once, and returns how many were in flight.
+func (q *Queue) ack(n int) int {
+	q.lock.Lock()
+	defer q.unlock()
+	if n > q.inflight {
+		n = q.inflight
+	}
+	q.inflight -= n
+	if n > 0 {
+		// wakes up all the consumers, as those of a closed queue may
+		// have to end
+		q.wakeConsumers(-1)
+	}
+	return n
+}
+
+// Inflight returns the number of items dequeued and not acked yet. It is
+// only meaningful if the consumers call Ack.
+func (q *Queue) Inflight() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.inflight
+}
+
+// take is pop for consumers: it counts the popped entry as in flight,
+// and returns nil while the items in flight are at the limit. It must be
+// called with the lock held.
+func (q *Queue) take() *entry {
+	if q.held() {
+		return nil
+	}
+	e := q.pop()
+	if e != nil {
+		q.inflight++
+	}
+	return e
+}
+
+// held tests if queued items are held back by the limit on the items in
+// flight. It must be called with the lock held.
+func (q *Queue) held() bool {
+	return q.maxInflight > 0 && q.inflight >= q.maxInflight && q.size() > 0
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxInflight(t *testing.T) {
+	q := New(WithMaxInflight(2))
+	for i := 0; i < 4; i++ {
+		q.Enqueue(i, i)
+	}
+	q.Dequeue()
+	q.TryDequeue()
+	assert.Equal(t, 2, q.Inflight())
+	_, err := q.Dequeue()
+	assert.ErrorIs(t, err, ErrMaxInflight)
+	_, ok := q.TryDequeue()
+	assert.False(t, ok)
+	assert.Equal(t, 2, q.Len())
+
+	got := make(chan interface{})
+	go func() {
+		data, _ := q.DequeueCtx(context.Background())
+		got <- data
+	}()
+	select {
+	case <-got:
+		t.Fatal("dequeued beyond the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.Ack()
+	assert.Equal(t, 2, <-got)
+	assert.Equal(t, 2, q.Inflight())
+
+	q.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = q.DequeueCtx(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "waits for an ack rather than ending")
+	q.Ack()
+	q.Ack()
+	q.Ack() // ignored
+	data, err := q.Dequeue()
+	assert.Equal(t, 3, data)
+	_, err = q.Dequeue()
+	assert.ErrorIs(t, err, ErrQueueClosed)
+	assert.Equal(t, 1, q.Inflight())
+}
+
+func TestDispatchMaxInflight(t *testing.T) {
+	q := New(WithMaxInflight(2))
+	for i := 0; i < 20; i++ {
+		q.Enqueue(i, i)
+	}
+	q.Close()
+	var running, peak int32
+	q.Dispatch(context.Background(), 8, func(data interface{}) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	})
+	assert.LessOrEqual(t, peak, int32(2))
+	assert.Equal(t, 0, q.Inflight())
+	assert.Equal(t, uint64(20), q.Stats().Dequeued())
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+type jsonQueue struct {
+	Items  []jsonItem `json:"items"` // in dequeue order
+	Closed bool       `json:"closed,omitempty"`
+}
+
+type jsonItem struct {
+	Data     json.RawMessage `json:"data"`
+	Priority int             `json:"priority"`
+	Key      heap.Key        `json:"key,omitempty"`
+	Order    uint64          `json:"order"`
+	Deadline *time.Time      `json:"deadline,omitempty"`
+}
+
+// MarshalJSON dumps the queued data, in dequeue order, with its
+// priority, key, order stamp and deadline, e.g. for debugging. It fails
+// if some data cannot be marshaled. Delayed data is not dumped.
+func (q *Queue) MarshalJSON() ([]byte, error) {
+	q.lock.Lock()
+	q.expire()
+	var entries []*entry
+	for _, item := range (*q.heap)[1:] {
+		if e := entryOf(item); !e.cancelled {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return q.heap.Before(&entries[i].Item, &entries[j].Item) })
+	closed := q.closed
+	q.unlock()
+
+	dump := jsonQueue{Items: make([]jsonItem, len(entries)), Closed: closed}
+	for i, e := range entries {
+		data, err := json.Marshal(e.data)
+		if err != nil {
+			return nil, fmt.Errorf("requestpq: data of order %d and priority %d is not JSON-serializable: %w", e.Order, e.Priority, err)
+		}
+		dump.Items[i] = jsonItem{Data: data, Priority: e.Priority, Key: e.Key, Order: e.Order}
+		if !e.deadline.IsZero() {
+			deadline := e.deadline
+			dump.Items[i].Deadline = &deadline
+		}
+	}
+	return json.Marshal(dump)
+}
+
+// UnmarshalJSON replaces the queued data by that of a dump of
+// MarshalJSON, keeping the order stamps, e.g. to set up a queue in a
+// test. The data is unmarshaled into interface{} values, so that JSON
+// numbers become float64. A zero Queue becomes a queue with the default
+// options.
+func (q *Queue) UnmarshalJSON(b []byte) error {
+	var dump jsonQueue
+	if err := json.Unmarshal(b, &dump); err != nil {
+		return err
+	}
+	entries := make([]*entry, len(dump.Items))
+	for i, item := range dump.Items {
+		var data interface{}
+		if err := json.Unmarshal(item.Data, &data); err != nil {
+			return err
+		}
+		e := newEntry(data, item.Priority)
+		e.Key = item.Key
+		if item.Deadline != nil {
+			e.deadline = *item.Deadline
+		}
+		entries[i] = e
+	}
+
+	if q.heap == nil {
+		*q = *New()
+	}
+	q.lock.Lock()
+	defer q.unlock()
+	q.heap.Compact(func(item *heap.Item) bool {
+		q.left(entryOf(item))
+		return true
+	})
+	q.cancelled = 0
+	q.count = 0
+	for i, e := range entries {
+		q.push(e)
+		q.stamp(e, dump.Items[i].Order)
+		if e.Order > q.count {
+			q.count = e.Order
+		}
+	}
+	q.heap.Compact(func(*heap.Item) bool { return false }) // reorders by stamp
+	if q.floor != nil {
+		q.floor.reindex()
+	}
+	q.closed = dump.Closed
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueJSON(t *testing.T) {
+	q := New()
+	q.Enqueue(`low`, 2)
+	q.Enqueue(map[string]int{"id": 1}, 1)
+	q.EnqueueKey(`keyed`, 1, heap.Key{3})
+	q.EnqueueCancelable(`cancelled`, 0)()
+
+	b, err := json.Marshal(q)
+	assert.Equal(t, nil, err)
+	assert.JSONEq(t, `{"items": [
+		{"data": {"id": 1}, "priority": 1, "order": 2},
+		{"data": "keyed", "priority": 1, "key": [3], "order": 3},
+		{"data": "low", "priority": 2, "order": 1}
+	]}`, string(b))
+
+	var restored Queue
+	assert.Equal(t, nil, json.Unmarshal(b, &restored))
+	restored.Enqueue(`new`, 1)
+	assert.Equal(t, []interface{}{map[string]interface{}{"id": 1.0}, `new`, `keyed`, `low`}, restored.DequeueBatch(4))
+
+	assert.Equal(t, nil, json.Unmarshal([]byte(`{"items": [{"data": 1, "priority": 1, "order": 9}], "closed": true}`), q))
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, ErrQueueClosed, q.Enqueue(`test`, 1))
+
+	q = New()
+	q.Enqueue(func() {}, 1)
+	_, err = q.MarshalJSON()
+	assert.EqualError(t, err, "requestpq: data of order 1 and priority 1 is not JSON-serializable: json: unsupported type: func()")
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// PriorityLimiter is a token bucket rate limiter whose waiters get the
+// tokens in order of priority, the lowest value first, and in FIFO order
+// among equal priorities, unlike the unordered wakeups of
+// golang.org/x/time/rate.
+type PriorityLimiter struct {
+	lock    sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	tokens  float64
+	last    time.Time // when tokens was last refilled
+	waiters heap.ItemHeap
+	count   uint64
+	timer   *time.Timer
+	now     func() time.Time
+}
+
+// NewPriorityLimiter is the constructor of PriorityLimiter, allowing
+// rate events per second and bursts of up to burst events. The bucket
+// starts full, and is never refilled if rate is not positive.
+func NewPriorityLimiter(rate float64, burst int) *PriorityLimiter {
+	return &PriorityLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+		waiters: heap.NewHeap(),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token if one is available and nobody is waiting for it,
+// and reports whether it did.
+func (l *PriorityLimiter) Allow() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill()
+	if l.tokens >= 1 && l.waiters.Empty() {
+		l.tokens--
+		return true
+	}
+	return false
+}
+
+// Wait blocks until a token is available to the given priority and takes
+// it, or until ctx is done, in which case it returns ctx.Err() and takes
+// no token.
+func (l *PriorityLimiter) Wait(ctx context.Context, priority int) error {
+	l.lock.Lock()
+	l.refill()
+	if l.tokens >= 1 && l.waiters.Empty() {
+		l.tokens--
+		l.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.count++
+	item := heap.NewItem(ready, priority, heap.WithOrder(l.count))
+	l.waiters.Push(item)
+	l.arm()
+	l.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if item.Index() > 0 {
+			l.waiters.Remove(item.Index())
+		} else { // granted meanwhile
+			l.tokens++
+			l.grant()
+		}
+		return ctx.Err()
+	}
+}
+
+// refund gives back a token taken for an event that did not happen.
+func (l *PriorityLimiter) refund() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill()
+	if l.tokens++; l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.grant()
+}
+
+// refill adds the tokens accumulated since the last refill. It must be
+// called with the lock held.
+func (l *PriorityLimiter) refill() {
+	now := l.now()
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// grant hands the available tokens to the first waiters. It must be
+// called with the lock held.
+func (l *PriorityLimiter) grant() {
+	l.refill()
+	for l.tokens >= 1 {
+		x := l.waiters.Pop()
+		if x == nil {
+			return
+		}
+		l.tokens--
+		close(x.(*heap.Item).GetData().(chan struct{}))
+	}
+	l.arm()
+}
+
+// arm schedules a grant for when the next token is available, if there
+// are waiters and it refills. It must be called with the lock held.
+func (l *PriorityLimiter) arm() {
+	if l.waiters.Empty() || l.rate <= 0 {
+		return
+	}
+	d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if l.timer == nil {
+		l.timer = time.AfterFunc(d, func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			l.grant()
+		})
+		return
+	}
+	l.timer.Reset(d)
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityLimiter(t *testing.T) {
+	t.Run("burst, then rate", func(t *testing.T) {
+		l := NewPriorityLimiter(100, 2)
+		assert.Equal(t, true, l.Allow())
+		assert.Equal(t, true, l.Allow())
+		assert.Equal(t, false, l.Allow())
+		start := time.Now()
+		assert.Equal(t, nil, l.Wait(context.Background(), 1))
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(5*time.Millisecond))
+	})
+
+	t.Run("priority order, then FIFO", func(t *testing.T) {
+		l := NewPriorityLimiter(50, 1)
+		l.Allow()
+		var lock sync.Mutex
+		var order []string
+		var wg sync.WaitGroup
+		waiting := 0
+		wait := func(name string, priority int) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.Wait(context.Background(), priority)
+				lock.Lock()
+				order = append(order, name)
+				lock.Unlock()
+			}()
+			waiting++
+			assert.Eventually(t, func() bool {
+				l.lock.Lock()
+				defer l.lock.Unlock()
+				return l.waiters.Len() == waiting
+			}, time.Second, time.Millisecond)
+		}
+		l.lock.Lock()
+		l.tokens, l.last = -1, time.Now() // no token for a while
+		l.lock.Unlock()
+		wait(`low`, 2)
+		wait(`high 1`, 1)
+		wait(`high 2`, 1)
+		wg.Wait()
+		assert.Equal(t, []string{`high 1`, `high 2`, `low`}, order)
+	})
+
+	t.Run("zero rate", func(t *testing.T) {
+		l := NewPriorityLimiter(0, 1)
+		assert.Equal(t, true, l.Allow())
+		assert.Equal(t, false, l.Allow())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, l.Wait(ctx, 0), "never refilled")
+		assert.Equal(t, (*time.Timer)(nil), l.timer)
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		l := NewPriorityLimiter(1, 1)
+		l.Allow()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, l.Wait(ctx, 1))
+		assert.Equal(t, 0, l.waiters.Len())
+	})
+}
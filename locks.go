@@ -0,0 +1,65 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpinLock is a sync.Locker that spins instead of parking the goroutine.
+// It may beat sync.Mutex when critical sections are very short and the
+// number of contending goroutines is below GOMAXPROCS.
+type SpinLock struct {
+	state int32
+}
+
+// Lock locks l, spinning until it is available.
+func (l *SpinLock) Lock() {
+	for !atomic.CompareAndSwapInt32(&l.state, 0, 1) {
+		runtime.Gosched()
+	}
+}
+
+// Unlock unlocks l.
+func (l *SpinLock) Unlock() {
+	atomic.StoreInt32(&l.state, 0)
+}
+
+// InstrumentedMutex is a sync.Mutex which records how many times it was
+// acquired and how long goroutines waited for it, to profile the lock
+// contention of a queue.
+type InstrumentedMutex struct {
+	acquisitions uint64
+	waitNanos    uint64
+	mu           sync.Mutex
+}
+
+// LockStats is a snapshot of the counters of an InstrumentedMutex.
+type LockStats struct {
+	Acquisitions uint64
+	WaitTime     time.Duration
+}
+
+// Lock locks m.
+func (m *InstrumentedMutex) Lock() {
+	start := time.Now()
+	m.mu.Lock()
+	atomic.AddUint64(&m.acquisitions, 1)
+	atomic.AddUint64(&m.waitNanos, uint64(time.Since(start)))
+}
+
+// Unlock unlocks m.
+func (m *InstrumentedMutex) Unlock() {
+	m.mu.Unlock()
+}
+
+// Stats returns the counters of m.
+func (m *InstrumentedMutex) Stats() LockStats {
+	return LockStats{
+		Acquisitions: atomic.LoadUint64(&m.acquisitions),
+		WaitTime:     time.Duration(atomic.LoadUint64(&m.waitNanos)),
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithLocker(t *testing.T) {
+	for name, l := range map[string]sync.Locker{
+		"spin lock":          &SpinLock{},
+		"instrumented mutex": &InstrumentedMutex{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			q := New(WithLocker(l))
+			var wg sync.WaitGroup
+			for p := 0; p < 4; p++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < N; i++ {
+						v := rand.Intn(20)
+						q.Enqueue(v, v)
+					}
+				}()
+			}
+			for i := 0; i < 4*N; i++ {
+				_, err := q.DequeueCtx(context.Background())
+				assert.Equal(t, nil, err)
+			}
+			wg.Wait()
+			assert.Equal(t, true, q.Empty())
+		})
+	}
+}
+
+func TestInstrumentedMutex(t *testing.T) {
+	m := &InstrumentedMutex{}
+	q := New(WithLocker(m))
+	q.Enqueue(`test`, 1)
+	_, _ = q.Dequeue()
+	assert.Equal(t, uint64(2), m.Stats().Acquisitions)
+	assert.Greater(t, int64(m.Stats().WaitTime), int64(0))
+}
+
+func BenchmarkLocker(b *testing.B) {
+	for name, newLocker := range map[string]func() sync.Locker{
+		"mutex":              func() sync.Locker { return &sync.Mutex{} },
+		"spin lock":          func() sync.Locker { return &SpinLock{} },
+		"instrumented mutex": func() sync.Locker { return &InstrumentedMutex{} },
+	} {
+		b.Run(name, func(b *testing.B) {
+			q := New(WithLocker(newLocker()))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					q.Enqueue(`test`, 1)
+					_, _ = q.Dequeue()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LotteryQueue is a priority queue for soft prioritization: Dequeue draws
+// an item at random with a probability proportional to the weight of its
+// priority, so that the lower priorities are served less often rather
+// than starved. Items of the same priority are dequeued in FIFO order.
+//
+// The weights of the priorities are kept in a Fenwick tree, so that a
+// draw takes O(log p) time, where p is the number of distinct priorities
+// seen, instead of a scan of the queue.
+type LotteryQueue struct {
+	lock   sync.Mutex
+	weight func(priority int) float64
+	rand   *rand.Rand
+	levels []*lotteryLevel
+	index  map[int]int // of the levels, by priority
+	tree   fenwick     // the weights of the levels times their sizes
+	size   int
+	drawn  *lotteryLevel // by Peek, for the next Dequeue
+	closed bool
+	wait   chan struct{} // closed on enqueue and on close, if not nil
+}
+
+type lotteryLevel struct {
+	priority int
+	weight   float64
+	items    []interface{}
+	head     int
+}
+
+func (l *lotteryLevel) len() int {
+	return len(l.items) - l.head
+}
+
+// NewLotteryQueue returns a LotteryQueue whose items of priority p are
+// drawn with a weight of weight(p), which must be positive, e.g.
+// math.Pow(2, -float64(p)) for the lowest value first, each priority
+// being half as likely as the one before.
+func NewLotteryQueue(weight func(priority int) float64) *LotteryQueue {
+	return &LotteryQueue{
+		weight: weight,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		index:  make(map[int]int),
+		tree:   newFenwick(8),
+	}
+}
+
+// Enqueue puts the data into the queue. It returns ErrQueueClosed if the
+// queue is closed.
+func (q *LotteryQueue) Enqueue(data interface{}, priority int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	i, ok := q.index[priority]
+	if !ok {
+		i = len(q.levels)
+		q.index[priority] = i
+		q.levels = append(q.levels, &lotteryLevel{priority: priority, weight: q.weight(priority)})
+		if i >= q.tree.len() {
+			q.rebuild()
+		}
+	}
+	level := q.levels[i]
+	level.items = append(level.items, data)
+	q.tree.add(i, level.weight)
+	q.size++
+	if q.wait != nil {
+		close(q.wait)
+		q.wait = nil
+	}
+	return nil
+}
+
+// rebuild rebuilds the tree with room for twice the levels, which also
+// clears the rounding errors. It must be called with the lock held.
+func (q *LotteryQueue) rebuild() {
+	q.tree = newFenwick(2 * len(q.levels))
+	for i, level := range q.levels {
+		q.tree.add(i, level.weight*float64(level.len()))
+	}
+}
+
+// draw returns the level of the next item, or nil if the queue is empty.
+// It must be called with the lock held.
+func (q *LotteryQueue) draw() *lotteryLevel {
+	if q.size == 0 {
+		return nil
+	}
+	if q.drawn != nil {
+		return q.drawn
+	}
+	i := q.tree.search(q.rand.Float64() * q.tree.sum())
+	if i >= len(q.levels) || q.levels[i].len() == 0 {
+		// a rounding error, at the end of the tree or on an empty level
+		q.rebuild()
+		for i = range q.levels {
+			if q.levels[i].len() > 0 {
+				break
+			}
+		}
+	}
+	q.drawn = q.levels[i]
+	return q.drawn
+}
+
+// pop removes and returns the next item. It must be called with the lock
+// held, on a non-empty queue.
+func (q *LotteryQueue) pop() interface{} {
+	level := q.draw()
+	q.drawn = nil
+	data := level.items[level.head]
+	level.items[level.head] = nil // release the data for the garbage collector
+	level.head++
+	if level.head == len(level.items) {
+		level.items, level.head = level.items[:0], 0
+	} else if level.head > len(level.items)/2 {
+		level.items = append(level.items[:0], level.items[level.head:]...)
+		level.head = 0
+	}
+	q.tree.add(q.index[level.priority], -level.weight)
+	q.size--
+	if q.size == 0 {
+		q.rebuild() // clears the rounding errors
+	}
+	return data
+}
+
+// Dequeue draws the next data, or returns ErrQueueEmpty if the queue is
+// empty, or ErrQueueClosed if it is closed and drained.
+func (q *LotteryQueue) Dequeue() (interface{}, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.size == 0 {
+		if q.closed {
+			return nil, ErrQueueClosed
+		}
+		return nil, ErrQueueEmpty
+	}
+	return q.pop(), nil
+}
+
+// DequeueCtx is like Dequeue, but blocks until data is available or ctx
+// is done, in which case it returns ctx.Err().
+func (q *LotteryQueue) DequeueCtx(ctx context.Context) (interface{}, error) {
+	for {
+		q.lock.Lock()
+		if q.size > 0 {
+			data := q.pop()
+			q.lock.Unlock()
+			return data, nil
+		}
+		if q.closed {
+			q.lock.Unlock()
+			return nil, ErrQueueClosed
+		}
+		if q.wait == nil {
+			q.wait = make(chan struct{})
+		}
+		wait := q.wait
+		q.lock.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Peek draws the next data, which the next Dequeue takes, and returns it
+// with its priority without removing it from the queue.
+func (q *LotteryQueue) Peek() (interface{}, int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	level := q.draw()
+	if level == nil {
+		return nil, 0, ErrQueueEmpty
+	}
+	return level.items[level.head], level.priority, nil
+}
+
+// Len returns the size of the queue.
+func (q *LotteryQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// Close closes the queue: enqueues fail, while the remaining data may
+// still be dequeued.
+func (q *LotteryQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	if q.wait != nil {
+		close(q.wait)
+		q.wait = nil
+	}
+}
+
+// fenwick is a Fenwick tree, or binary indexed tree, of the weights of
+// n slots, which updates a weight and finds the slot of a cumulative
+// weight in O(log n) time. Its first element is unused.
+type fenwick []float64
+
+func newFenwick(n int) fenwick {
+	return make(fenwick, n+1)
+}
+
+func (f fenwick) len() int {
+	return len(f) - 1
+}
+
+// add adds delta to the weight of slot i.
+func (f fenwick) add(i int, delta float64) {
+	for i++; i < len(f); i += i & -i {
+		f[i] += delta
+	}
+}
+
+// sum returns the total weight.
+func (f fenwick) sum() float64 {
+	total := 0.0
+	for i := f.len(); i > 0; i -= i & -i {
+		total += f[i]
+	}
+	return total
+}
+
+// search returns the first slot whose cumulative weight exceeds w.
+func (f fenwick) search(w float64) int {
+	pos := 0
+	step := 1
+	for step*2 <= f.len() {
+		step *= 2
+	}
+	for ; step > 0; step /= 2 {
+		if next := pos + step; next <= f.len() && f[next] <= w {
+			pos = next
+			w -= f[next]
+		}
+	}
+	return pos
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLotteryQueue(t *testing.T) {
+	q := NewLotteryQueue(func(priority int) float64 { return math.Pow(2, -float64(priority)) })
+	q.rand = rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		q.Enqueue(i, i%3) // weights 4:2:1
+	}
+	const n = 10000
+	counts := make(map[int]int)
+	last := map[int]int{0: -1, 1: -1, 2: -1}
+	for i := 0; i < n; i++ {
+		data, priority, err := q.Peek()
+		assert.Equal(t, nil, err)
+		got, _ := q.Dequeue()
+		assert.Equal(t, data, got, "peeked")
+		counts[priority]++
+		assert.Less(t, last[priority], got.(int), "FIFO within a priority")
+		last[priority] = got.(int)
+		q.Enqueue(300+3*i+priority, priority) // keeps the sizes even
+	}
+	assert.InDelta(t, 4.0/7, float64(counts[0])/n, 0.02)
+	assert.InDelta(t, 2.0/7, float64(counts[1])/n, 0.02)
+	assert.InDelta(t, 1.0/7, float64(counts[2])/n, 0.02)
+
+	for q.Len() > 0 {
+		q.Dequeue()
+	}
+	_, err := q.Dequeue()
+	assert.Equal(t, ErrQueueEmpty, err)
+	_, _, err = q.Peek()
+	assert.Equal(t, ErrQueueEmpty, err)
+
+	t.Run("many priorities", func(t *testing.T) {
+		q := NewLotteryQueue(func(int) float64 { return 1 })
+		for i := 0; i < 100; i++ {
+			q.Enqueue(i, i)
+		}
+		seen := make(map[interface{}]bool)
+		for q.Len() > 0 {
+			data, _ := q.Dequeue()
+			seen[data] = true
+		}
+		assert.Equal(t, 100, len(seen))
+	})
+
+	t.Run("blocks", func(t *testing.T) {
+		q := NewLotteryQueue(func(int) float64 { return 1 })
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			q.Enqueue("data", 1)
+			q.Close()
+		}()
+		data, err := q.DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "data", data)
+		_, err = q.DequeueCtx(context.Background())
+		assert.Equal(t, ErrQueueClosed, err)
+		assert.Equal(t, ErrQueueClosed, q.Enqueue("late", 1))
+	})
+}
+
+func BenchmarkLotteryQueue(b *testing.B) {
+	q := NewLotteryQueue(func(priority int) float64 { return 1 / float64(priority+1) })
+	for i := 0; i < 1024; i++ {
+		q.Enqueue(i, i%64)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, _ := q.Dequeue()
+		q.Enqueue(data, data.(int)%64)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// MiddlewareOption configures Middleware.
+type MiddlewareOption func(*middleware)
+
+type middleware struct {
+	next      http.Handler
+	priority  func(*http.Request) int
+	sem       *PrioritySemaphore
+	limit     int
+	queued    int64
+	maxQueued int64
+	reject    http.Handler
+}
+
+// WithMaxConcurrency sets how many requests are handled at once. The
+// default is GOMAXPROCS.
+func WithMaxConcurrency(n int) MiddlewareOption {
+	return func(m *middleware) {
+		m.limit = n
+	}
+}
+
+// WithMaxQueued sets how many requests may wait for their turn, beyond
+// which they are rejected. There is no limit by default.
+func WithMaxQueued(n int) MiddlewareOption {
+	return func(m *middleware) {
+		m.maxQueued = int64(n)
+	}
+}
+
+// WithRejectHandler sets the handler of rejected requests, e.g. to add a
+// Retry-After header. The default one answers 503 Service Unavailable.
+func WithRejectHandler(h http.Handler) MiddlewareOption {
+	return func(m *middleware) {
+		m.reject = h
+	}
+}
+
+// Middleware queues the requests to next, handling a limited number of
+// them at once, in the order of the priorities given by priority, the
+// lowest value first, and in FIFO order among equal priorities. Requests
+// are rejected when the queue is full, and given up when their client
+// goes away while queued.
+func Middleware(next http.Handler, priority func(*http.Request) int, opts ...MiddlewareOption) http.Handler {
+	m := &middleware{
+		next:     next,
+		priority: priority,
+		limit:    runtime.GOMAXPROCS(0),
+		reject: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.sem = NewPrioritySemaphore(m.limit)
+	return m
+}
+
+func (m *middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !m.sem.TryAcquire() {
+		queued := atomic.AddInt64(&m.queued, 1)
+		if m.maxQueued > 0 && queued > m.maxQueued {
+			atomic.AddInt64(&m.queued, -1)
+			m.reject.ServeHTTP(w, r)
+			return
+		}
+		err := m.sem.Acquire(r.Context(), m.priority(r))
+		atomic.AddInt64(&m.queued, -1)
+		if err != nil {
+			return // the client went away
+		}
+	}
+	defer m.sem.Release()
+	m.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var order []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+		lock.Lock()
+		order = append(order, r.URL.Path)
+		lock.Unlock()
+	})
+	priority := func(r *http.Request) int {
+		p, _ := strconv.Atoi(r.URL.Query().Get("priority"))
+		return p
+	}
+	h := Middleware(next, priority, WithMaxConcurrency(1), WithMaxQueued(2)).(*middleware)
+
+	var wg sync.WaitGroup
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		}()
+		return w
+	}
+	state := func(permits, waiters int) func() bool {
+		return func() bool {
+			h.sem.lock.Lock()
+			defer h.sem.lock.Unlock()
+			return h.sem.permits == permits && h.sem.waiters.Len() == waiters
+		}
+	}
+	serve("/block")
+	assert.Eventually(t, state(0, 0), time.Second, time.Millisecond)
+	serve("/low?priority=2")
+	assert.Eventually(t, state(0, 1), time.Second, time.Millisecond)
+	serve("/high?priority=1")
+	assert.Eventually(t, state(0, 2), time.Second, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/rejected", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []string{"/block", "/high", "/low"}, order)
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// MPSCQueue is a priority queue for many producer goroutines and one
+// consumer goroutine, e.g. HTTP handler goroutines feeding a batching
+// goroutine. Producers take no lock: they push their items onto a
+// lock-free intake stack with a single compare-and-swap, and the
+// consumer takes the whole stack at once and moves its items into a
+// heap that only it touches, see BenchmarkMPSCQueue.
+//
+// Calling the dequeue methods and Len from several goroutines is a data
+// race.
+type MPSCQueue struct {
+	intake unsafe.Pointer // *mpscNode, the last enqueued item
+	heap   heap.ItemHeap
+	// count is the order stamp of the last item pushed into the heap.
+	count uint64
+}
+
+type mpscNode struct {
+	task Task
+	next *mpscNode
+}
+
+// NewMPSCQueue returns an empty MPSCQueue.
+func NewMPSCQueue() *MPSCQueue {
+	return &MPSCQueue{heap: heap.NewHeap()}
+}
+
+// Enqueue puts the data into the queue. It may be called by any number
+// of goroutines.
+func (q *MPSCQueue) Enqueue(data interface{}, priority int) {
+	n := &mpscNode{task: Task{Data: data, Priority: priority}}
+	for {
+		top := atomic.LoadPointer(&q.intake)
+		n.next = (*mpscNode)(top)
+		if atomic.CompareAndSwapPointer(&q.intake, top, unsafe.Pointer(n)) {
+			return
+		}
+	}
+}
+
+// drain moves the items of the intake into the heap, in the order they
+// were enqueued.
+func (q *MPSCQueue) drain() {
+	n := (*mpscNode)(atomic.SwapPointer(&q.intake, nil))
+	var fifo *mpscNode
+	for n != nil { // the stack is newest first
+		next := n.next
+		n.next, fifo = fifo, n
+		n = next
+	}
+	for ; fifo != nil; fifo = fifo.next {
+		if q.count == math.MaxUint64 {
+			q.count = q.heap.ReOrder()
+		}
+		q.count++
+		q.heap.Push(heap.NewItem(fifo.task.Data, fifo.task.Priority, heap.WithOrder(q.count)))
+	}
+}
+
+// TryDequeue gets & removes the data with highest priority. ok is false
+// if the queue is empty. It must only be called by the consumer.
+func (q *MPSCQueue) TryDequeue() (data interface{}, ok bool) {
+	q.drain()
+	x := q.heap.Pop()
+	if x == nil {
+		return nil, false
+	}
+	return x.(*heap.Item).GetData(), true
+}
+
+// DequeueCtx is like TryDequeue, but polls until an item is available
+// or ctx is done. It must only be called by the consumer.
+func (q *MPSCQueue) DequeueCtx(ctx context.Context) (interface{}, error) {
+	return poll(ctx, q.TryDequeue)
+}
+
+// Len returns the size of the queue. It must only be called by the
+// consumer.
+func (q *MPSCQueue) Len() int {
+	q.drain()
+	return q.heap.Len()
+}
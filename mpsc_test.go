@@ -0,0 +1,114 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMPSCQueue(t *testing.T) {
+	t.Run("priority order", func(t *testing.T) {
+		q := NewMPSCQueue()
+		for i := 0; i < N; i++ {
+			v := rand.Intn(20)
+			q.Enqueue(v, v)
+		}
+		assert.Equal(t, N, q.Len())
+		var localArr []interface{}
+		for {
+			data, ok := q.TryDequeue()
+			if !ok {
+				break
+			}
+			localArr = append(localArr, data)
+		}
+		assert.Equal(t, N, len(localArr))
+		isAscending(t, localArr)
+	})
+
+	t.Run("FIFO for equal priorities", func(t *testing.T) {
+		q := NewMPSCQueue()
+		for i := 0; i < 3; i++ {
+			q.Enqueue(i, 1)
+		}
+		q.Enqueue(`high`, 0)
+		data, _ := q.TryDequeue()
+		assert.Equal(t, `high`, data)
+		q.Enqueue(3, 1) // drained after the others
+		for i := 0; i < 4; i++ {
+			data, _ := q.TryDequeue()
+			assert.Equal(t, i, data)
+		}
+	})
+
+	t.Run("concurrent producers", func(t *testing.T) {
+		q := NewMPSCQueue()
+		const producers = 8
+		var wg sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for i := 0; i < N; i++ {
+					q.Enqueue([2]int{p, i}, 0)
+				}
+			}(p)
+		}
+		next := make([]int, producers)
+		for i := 0; i < producers*N; i++ {
+			data, err := q.DequeueCtx(context.Background())
+			assert.Equal(t, nil, err)
+			item := data.([2]int)
+			assert.Equal(t, next[item[0]], item[1], "FIFO per producer")
+			next[item[0]]++
+		}
+		wg.Wait()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		_, err := q.DequeueCtx(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+}
+
+// go test -bench=MPSC -cpu=1,4,32
+func BenchmarkMPSCQueue(b *testing.B) {
+	b.Run("queue", func(b *testing.B) {
+		q := New()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < b.N; i++ {
+				_, _ = q.DequeueCtx(context.Background())
+			}
+		}()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				q.Enqueue(i, i%20)
+			}
+		})
+		<-done
+	})
+
+	b.Run("mpsc queue", func(b *testing.B) {
+		q := NewMPSCQueue()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < b.N; i++ {
+				_, _ = q.DequeueCtx(context.Background())
+			}
+		}()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				q.Enqueue(i, i%20)
+			}
+		})
+		<-done
+	})
+}
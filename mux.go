@@ -0,0 +1,29 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "sync"
+
+// MuxChannels merges several input channels of different importance into
+// one output in priority order, the data of each input having the
+// priority it maps to. The inputs are read continuously into a decorated
+// channel, see Decorate, and the output is closed once all the
+// inputs are closed and their data is delivered.
+func MuxChannels(prios map[<-chan interface{}]int, opts ...DecorateOption) <-chan interface{} {
+	tasks := make(chan *Task)
+	var wg sync.WaitGroup
+	for in, priority := range prios {
+		wg.Add(1)
+		go func(in <-chan interface{}, priority int) {
+			defer wg.Done()
+			for data := range in {
+				tasks <- &Task{Data: data, Priority: priority}
+			}
+		}(in, priority)
+	}
+	go func() {
+		wg.Wait()
+		close(tasks)
+	}()
+	return Decorate(tasks, opts...)
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxChannels(t *testing.T) {
+	urgent := make(chan interface{}, 3)
+	bulk := make(chan interface{}, 3)
+	for i := 0; i < 3; i++ {
+		bulk <- "bulk"
+	}
+	out := MuxChannels(map[<-chan interface{}]int{urgent: 0, bulk: 1})
+	assert.Equal(t, "bulk", <-out)
+	time.Sleep(10 * time.Millisecond) // the next bulk is sent, the last queued
+	urgent <- "urgent"
+	time.Sleep(10 * time.Millisecond)
+	close(urgent)
+	close(bulk)
+	var got []interface{}
+	for data := range out {
+		got = append(got, data)
+	}
+	assert.Equal(t, []interface{}{"bulk", "urgent", "bulk"}, got)
+
+	t.Run("no input", func(t *testing.T) {
+		_, ok := <-MuxChannels(nil)
+		assert.Equal(t, false, ok)
+	})
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// OverflowPolicy decides what happens when enqueueing into a bounded
+// queue that is full.
+type OverflowPolicy int
+
+const (
+	// Block makes Enqueue wait for room, and TryEnqueue return ErrQueueFull.
+	Block OverflowPolicy = iota
+	// DropLowestPriority drops the item that would be dequeued last,
+	// which may be the new one.
+	DropLowestPriority
+	// DropOldest drops the item that has been queued the longest.
+	DropOldest
+	// DropNewest drops the new item.
+	DropNewest
+)
+
+// Option configures a Queue at construction.
+type Option func(*Queue)
+
+// WithLocker sets the lock protecting the queue, e.g. a SpinLock for
+// very short critical sections or an InstrumentedMutex to profile the
+// contention. The default is a sync.Mutex.
+func WithLocker(l sync.Locker) Option {
+	return func(q *Queue) {
+		q.lock = l
+	}
+}
+
+// WithCopyOnEnqueue makes the queue store fn(data) instead of data on
+// every enqueue, so producers can safely reuse their buffers. Without
+// this option the queue keeps a reference to the data as given.
+func WithCopyOnEnqueue(fn CopyFunc) Option {
+	return func(q *Queue) {
+		q.copy = fn
+	}
+}
+
+// WithCapacity bounds the queue to at most capacity items. Enqueue then
+// blocks while the queue is full, and TryEnqueue returns ErrQueueFull. A
+// non-positive capacity means the queue is unbounded.
+func WithCapacity(capacity int) Option {
+	return func(q *Queue) {
+		q.capacity = capacity
+	}
+}
+
+// Sizer is implemented by data that knows its size in bytes, see
+// WithMaxBytes.
+type Sizer interface {
+	Size() int
+}
+
+// WithMaxBytes bounds the total size of the queued data to maxBytes, the
+// sizes being those of the data implementing Sizer; the other data has no
+// size. When the data doesn't fit, the overflow policy applies as with
+// WithCapacity, dropping as many items as needed. Data larger than
+// maxBytes is still queued into an empty queue, so that it cannot block
+// forever. A non-positive maxBytes means no memory budget.
+func WithMaxBytes(maxBytes int64) Option {
+	return func(q *Queue) {
+		q.maxBytes = maxBytes
+	}
+}
+
+// WithOverflowPolicy sets the policy applied when the bounded queue is
+// full. The default is Block.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(q *Queue) {
+		q.overflow = policy
+	}
+}
+
+// WithOnDrop sets a callback invoked with every item dropped by the
+// overflow policy, e.g. to count them or answer them with a 503. It is
+// called synchronously by the enqueueing goroutine, without any lock
+// held.
+func WithOnDrop(fn func(data interface{}, priority int)) Option {
+	return func(q *Queue) {
+		q.onDrop = fn
+	}
+}
+
+// WithOnExpire sets a callback invoked with every item discarded after
+// its deadline. It is called synchronously by the goroutine that noticed
+// the expiry, without any lock held.
+func WithOnExpire(fn func(data interface{}, priority int)) Option {
+	return func(q *Queue) {
+		q.onExpire = fn
+	}
+}
+
+// WithMaxFirst makes the queue dequeue the data with the maximum
+// priority value first, for callers whose convention is "bigger number
+// = more important". Data with equal priorities is still FIFO.
+func WithMaxFirst() Option {
+	return func(q *Queue) {
+		h := heap.NewMaxHeap()
+		q.heap = &h
+	}
+}
+
+// WithLessFunc orders the queue by less instead of by priority, e.g. by
+// deadline, cost or tenant tier found in the data. The items given to
+// less hold the enqueued data, its priority, and an Order that grows
+// with every enqueue, to break ties in FIFO order. It takes precedence
+// over WithMaxFirst.
+func WithLessFunc(less heap.LessFunc) Option {
+	return func(q *Queue) {
+		q.less = less
+	}
+}
+
+// WithEDF makes the queue dequeue the data with the earliest deadline
+// first (EDF scheduling), whatever its priority. Deadlines are those of
+// EnqueueDeadline, EnqueueTTL and the contexts of EnqueueCtx; data
+// without deadline comes last. Ties are broken in the priority order of
+// the queue (see WithMaxFirst), then in FIFO order.
+func WithEDF() Option {
+	return func(q *Queue) {
+		q.edf = true
+	}
+}
+
+// WithClock sets the clock of the queue, which drives TTLs, deadlines,
+// delays and schedules. The default is the system clock.
+func WithClock(clock Clock) Option {
+	return func(q *Queue) {
+		q.clock = clock
+		q.now = clock.Now
+	}
+}
+
+// WithPriorityMapper sets a plugin rewriting the priority of every
+// enqueued item, see PriorityMapper.
+func WithPriorityMapper(mapper PriorityMapper) Option {
+	return func(q *Queue) {
+		q.mapper = mapper
+	}
+}
+
+// DecorateOption configures a decorated channel.
+type DecorateOption func(*decorateConfig)
+
+type decorateConfig struct {
+	onError    func(error)
+	idleAfter  time.Duration
+	onIdle     func()
+	slowAfter  time.Duration
+	slowPolicy SlowConsumerPolicy
+	onSlow     func()
+	limiter    *PriorityLimiter
+}
+
+// report passes an anomaly to the error handler, if any. Anomalous
+// tasks are skipped rather than stopping the decorated channel.
+func (c *decorateConfig) report(err error) {
+	if c.onError != nil {
+		c.onError(fmt.Errorf("decorated channel: %w", err))
+	}
+}
+
+// WithErrorHandler sets a callback invoked with the anomalies noticed by
+// a decorated channel, such as nil tasks, which are otherwise skipped
+// silently. It is called by the internal goroutines, so it must not
+// block for long.
+func WithErrorHandler(fn func(error)) DecorateOption {
+	return func(c *decorateConfig) {
+		c.onError = fn
+	}
+}
+
+// WithOnIdle makes a decorated channel call fn once no data has been
+// pending for d, see Queue.OnIdle.
+func WithOnIdle(d time.Duration, fn func()) DecorateOption {
+	return func(c *decorateConfig) {
+		c.idleAfter, c.onIdle = d, fn
+	}
+}
+
+// SlowConsumerPolicy tells what a decorated channel does when its
+// consumer stalls, see WithSlowConsumer.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerWait keeps waiting for the consumer.
+	SlowConsumerWait SlowConsumerPolicy = iota
+	// SlowConsumerDropOldest drops the oldest data buffered in the output
+	// channel to make room, and reports it to the error handler as an
+	// error wrapping ErrQueueFull.
+	SlowConsumerDropOldest
+	// SlowConsumerPause stops reading the input channel until the
+	// consumer catches up, so that producers block instead of the input
+	// backing up into the queue.
+	SlowConsumerPause
+)
+
+// WithSlowConsumer makes a decorated channel detect a consumer that
+// hasn't received from the output channel for threshold while data is
+// ready, call onStall, if not nil, e.g. to count stalls, and apply the
+// policy until the consumer receives again.
+func WithSlowConsumer(threshold time.Duration, policy SlowConsumerPolicy, onStall func()) DecorateOption {
+	return func(c *decorateConfig) {
+		c.slowAfter, c.slowPolicy, c.onSlow = threshold, policy, onStall
+	}
+}
+
+// WithRate paces the output of a decorated channel at rate data per
+// second, with bursts of up to burst data, e.g. for a downstream that
+// only accepts so many batches per second. The data waiting for a token
+// stays queued, so it keeps being reordered by priority.
+func WithRate(rate float64, burst int) DecorateOption {
+	return func(c *decorateConfig) {
+		c.limiter = NewPriorityLimiter(rate, burst)
+	}
+}
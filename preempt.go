@@ -0,0 +1,110 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+)
+
+// Preemptible is a long-running task that can be preempted at the
+// checkpoints of its handler, and resumed later from its progress.
+type Preemptible struct {
+	Data     interface{}
+	Priority int
+	// Progress is the metadata saved at the last checkpoint, to resume
+	// the task from.
+	Progress interface{}
+	// Preemptions counts how many times the task was preempted.
+	Preemptions int
+}
+
+// EnqueuePreemptible puts a preemptible task for the data into the
+// queue. Consumers dequeue it as a *Preemptible, and run it with
+// RunPreemptible.
+func (q *Queue) EnqueuePreemptible(data interface{}, priority int) error {
+	return q.Enqueue(&Preemptible{Data: data, Priority: priority}, priority)
+}
+
+// RunPreemptible runs fn on the task. At each checkpoint, fn saves its
+// progress by calling checkpoint, which reports whether fn should stop
+// because at least threshold items more important than the task are
+// queued. fn then returns ErrPreempted, and the task is enqueued again
+// with its progress, to be resumed once the backlog is served.
+// preempted reports whether this happened. The workers of Dispatch do
+// this with WithPreemption.
+func (q *Queue) RunPreemptible(task *Preemptible, threshold int, fn func(task *Preemptible, checkpoint func(progress interface{}) bool) error) (preempted bool, err error) {
+	checkpoint := func(progress interface{}) bool {
+		task.Progress = progress
+		return q.countBefore(task, threshold) >= threshold
+	}
+	err = fn(task, checkpoint)
+	if !errors.Is(err, ErrPreempted) {
+		return false, err
+	}
+	task.Preemptions++
+	return true, q.Enqueue(task, task.Priority)
+}
+
+// countBefore returns the number of queued items more important than
+// the task, up to max. Since no item comes before its parent in the
+// heap, only the items before the task and their children are visited.
+func (q *Queue) countBefore(task *Preemptible, max int) int {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	probe := newEntry(task, task.Priority)
+	q.stamp(probe, 0) // before any item of that priority
+	if q.banded {
+		q.classify(probe)
+	}
+	h := *q.heap
+	n := 0
+	for next := []int{1}; len(next) > 0 && n < max; {
+		i := next[len(next)-1]
+		next = next[:len(next)-1]
+		if i >= len(h) || !h.Before(h[i], &probe.Item) {
+			continue
+		}
+		if !entryOf(h[i]).cancelled {
+			n++
+		}
+		next = append(next, 2*i, 2*i+1)
+	}
+	return n
+}
+
+// WithPreemption lets the workers preempt the tasks of
+// EnqueuePreemptible, as RunPreemptible does, once at least threshold
+// items more important are queued. The handler gets the *Preemptible,
+// calls Checkpoint with its context, and returns ErrPreempted when told
+// to stop: the task is then enqueued again rather than failed.
+func WithPreemption(threshold int) DispatchOption {
+	return func(c *dispatchConfig) {
+		c.preempt = threshold
+	}
+}
+
+type checkpointKey struct{}
+
+// Checkpoint saves the progress of the preemptible task whose handler
+// got ctx from the workers of Dispatch, see WithPreemption, and reports
+// whether the handler should stop and return ErrPreempted. It is always
+// false for other contexts.
+func Checkpoint(ctx context.Context, progress interface{}) bool {
+	checkpoint, ok := ctx.Value(checkpointKey{}).(func(progress interface{}) bool)
+	return ok && checkpoint(progress)
+}
+
+// run calls fn on the data, through RunPreemptible if it is a task the
+// workers preempt.
+func (c *dispatchConfig) run(ctx context.Context, q *Queue, data interface{}, fn func(ctx context.Context, data interface{}) error) error {
+	task, ok := data.(*Preemptible)
+	if !ok || c.preempt <= 0 {
+		return fn(ctx, data)
+	}
+	_, err := q.RunPreemptible(task, c.preempt, func(task *Preemptible, checkpoint func(progress interface{}) bool) error {
+		return fn(context.WithValue(ctx, checkpointKey{}, checkpoint), task)
+	})
+	return err
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPreemptible(t *testing.T) {
+	q := New()
+	q.EnqueuePreemptible(`long`, 5)
+	data, _ := q.Dequeue()
+	task := data.(*Preemptible)
+
+	// sums 0..9, one step per checkpoint
+	handler := func(task *Preemptible, checkpoint func(progress interface{}) bool) error {
+		step, sum := 0, 0
+		if task.Progress != nil {
+			progress := task.Progress.([2]int)
+			step, sum = progress[0], progress[1]
+		}
+		for ; step < 10; step++ {
+			sum += step
+			if checkpoint([2]int{step + 1, sum}) && step < 9 {
+				return ErrPreempted
+			}
+		}
+		task.Data = sum
+		return nil
+	}
+
+	q.Enqueue(`urgent`, 1)
+	q.Enqueue(`bulk`, 9)
+	preempted, err := q.RunPreemptible(task, 1, handler)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, preempted)
+	assert.Equal(t, 1, task.Preemptions)
+	assert.Equal(t, [2]int{1, 0}, task.Progress)
+
+	data, _ = q.Dequeue()
+	assert.Equal(t, `urgent`, data)
+	data, _ = q.Dequeue()
+	assert.Equal(t, task, data, "resumed before less important items")
+	preempted, err = q.RunPreemptible(task, 1, handler)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, preempted)
+	assert.Equal(t, 45, task.Data)
+
+	failure := errors.New("failure")
+	preempted, err = q.RunPreemptible(task, 1, func(*Preemptible, func(interface{}) bool) error {
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, false, preempted)
+}
+
+func TestCountBefore(t *testing.T) {
+	task := &Preemptible{Data: `long`, Priority: 5}
+
+	t.Run("up to max", func(t *testing.T) {
+		q := New()
+		for i := 0; i < 10; i++ {
+			q.Enqueue(i, i)
+		}
+		assert.Equal(t, 5, q.countBefore(task, 10))
+		assert.Equal(t, 3, q.countBefore(task, 3))
+	})
+
+	t.Run("earliest deadline first", func(t *testing.T) {
+		q := New(WithEDF())
+		q.EnqueueDeadline(`soon`, 9, time.Now().Add(time.Minute))
+		q.Enqueue(`urgent`, 1)
+		q.Enqueue(`bulk`, 9)
+		assert.Equal(t, 2, q.countBefore(task, 10))
+	})
+
+	t.Run("bands", func(t *testing.T) {
+		q := New(WithBands(Band{Name: "interactive", Min: 0, Rank: 1}, Band{Name: "batch", Min: 10, Rank: 0}))
+		q.Enqueue(`batch`, 12)
+		q.Enqueue(`urgent`, 1)
+		q.Enqueue(`bulk`, 8)
+		assert.Equal(t, 2, q.countBefore(task, 10))
+	})
+
+	t.Run("less func", func(t *testing.T) {
+		q := New(WithLessFunc(func(a, b *heap.Item) bool {
+			if a.Priority == b.Priority {
+				return a.Order < b.Order
+			}
+			return a.Priority > b.Priority
+		}))
+		q.Enqueue(`urgent`, 9)
+		q.Enqueue(`bulk`, 1)
+		q.Enqueue(`same`, 5)
+		assert.Equal(t, 1, q.countBefore(task, 10))
+	})
+}
+
+func TestDispatchPreemption(t *testing.T) {
+	q := New()
+	q.EnqueuePreemptible(`long`, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	var runs []string
+	q.DispatchCtx(ctx, 1, func(ctx context.Context, data interface{}) error {
+		task, ok := data.(*Preemptible)
+		if !ok {
+			runs = append(runs, data.(string))
+			return nil
+		}
+		runs = append(runs, fmt.Sprintf("%v %v", task.Data, task.Progress))
+		if task.Progress == nil {
+			q.Enqueue(`urgent`, 1)
+			if Checkpoint(ctx, 1) {
+				return ErrPreempted
+			}
+		}
+		cancel()
+		return nil
+	}, WithPreemption(1))
+	assert.Equal(t, []string{`long <nil>`, `urgent`, `long 1`}, runs)
+	assert.Equal(t, false, Checkpoint(context.Background(), 1))
+}
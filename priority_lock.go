@@ -0,0 +1,40 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "context"
+
+// PriorityLock is a mutual exclusion lock granted to the waiter with the
+// lowest priority value next, and in FIFO order among equal priorities,
+// e.g. so that admin operations on shared model state cut ahead of
+// routine requests. A critical section in progress is never preempted.
+type PriorityLock struct {
+	sem *PrioritySemaphore
+}
+
+// NewPriorityLock is the constructor of PriorityLock.
+func NewPriorityLock() *PriorityLock {
+	return &PriorityLock{sem: NewPrioritySemaphore(1)}
+}
+
+// Lock blocks until the lock is granted to the given priority.
+func (l *PriorityLock) Lock(priority int) {
+	l.sem.Acquire(context.Background(), priority)
+}
+
+// LockCtx is like Lock, but gives up once ctx is done, in which case it
+// returns ctx.Err() and the lock is not held.
+func (l *PriorityLock) LockCtx(ctx context.Context, priority int) error {
+	return l.sem.Acquire(ctx, priority)
+}
+
+// TryLock takes the lock if it is free and nobody waits for it, and
+// reports whether it did.
+func (l *PriorityLock) TryLock() bool {
+	return l.sem.TryAcquire()
+}
+
+// Unlock releases the lock to the next waiter, if any.
+func (l *PriorityLock) Unlock() {
+	l.sem.Release()
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityLock(t *testing.T) {
+	l := NewPriorityLock()
+	l.Lock(5)
+	assert.Equal(t, false, l.TryLock())
+
+	var lock sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, name := range []string{`routine`, `admin`} {
+		wg.Add(1)
+		go func(name string, priority int) {
+			defer wg.Done()
+			l.Lock(priority)
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+			l.Unlock()
+		}(name, 1-i)
+		waiting := i + 1
+		assert.Eventually(t, func() bool {
+			l.sem.lock.Lock()
+			defer l.sem.lock.Unlock()
+			return l.sem.waiters.Len() == waiting
+		}, time.Second, time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.LockCtx(ctx, 0))
+
+	l.Unlock()
+	wg.Wait()
+	assert.Equal(t, []string{`admin`, `routine`}, order)
+	assert.Equal(t, true, l.TryLock())
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PriorityMapper is a plugin rewriting the priority of the items put
+// into a queue, e.g. to implement a policy across all the producers.
+// MapPriority is called after the data is copied, if it is, and without
+// the lock of the queue held. It must be safe for concurrent use.
+type PriorityMapper interface {
+	MapPriority(data interface{}, priority int) int
+}
+
+// PriorityMapperFunc adapts a function to the PriorityMapper interface.
+type PriorityMapperFunc func(data interface{}, priority int) int
+
+// MapPriority calls f.
+func (f PriorityMapperFunc) MapPriority(data interface{}, priority int) int {
+	return f(data, priority)
+}
+
+// WarmUpBoost is a PriorityMapper boosting the first requests of every
+// tenant, so that new API keys or sessions get a fast cold start. The
+// boost decays linearly over the first Requests requests.
+type WarmUpBoost struct {
+	tenant   func(data interface{}) string
+	requests int
+	boost    int
+	forget   time.Duration
+	now      func() time.Time
+	lock     sync.Mutex
+	tenants  map[string]*warmUp
+	swept    time.Time
+}
+
+type warmUp struct {
+	seen     int
+	lastSeen time.Time
+}
+
+// NewWarmUpBoost returns a WarmUpBoost. tenant returns the tenant of the
+// data. The first request of a tenant has its priority decreased by
+// boost, i.e. moved ahead in a default queue, and the next ones by less
+// and less until the requests-th one; use a negative boost with
+// WithMaxFirst. Tenants inactive for forget are forgotten, and boosted
+// again when they come back; if forget is not positive, they never are.
+func NewWarmUpBoost(tenant func(data interface{}) string, requests, boost int, forget time.Duration) *WarmUpBoost {
+	return &WarmUpBoost{
+		tenant:   tenant,
+		requests: requests,
+		boost:    boost,
+		forget:   forget,
+		now:      time.Now,
+		tenants:  make(map[string]*warmUp),
+	}
+}
+
+// MapPriority implements PriorityMapper.
+func (b *WarmUpBoost) MapPriority(data interface{}, priority int) int {
+	key := b.tenant(data)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	b.sweep(now)
+	w, ok := b.tenants[key]
+	if !ok {
+		w = &warmUp{}
+		b.tenants[key] = w
+	}
+	w.lastSeen = now
+	if w.seen >= b.requests {
+		return priority
+	}
+	boost := b.boost * (b.requests - w.seen) / b.requests
+	w.seen++
+	return priority - boost
+}
+
+// sweep forgets the inactive tenants, at most once per forget period.
+func (b *WarmUpBoost) sweep(now time.Time) {
+	if b.forget <= 0 || now.Sub(b.swept) < b.forget {
+		return
+	}
+	b.swept = now
+	for key, w := range b.tenants {
+		if now.Sub(w.lastSeen) >= b.forget {
+			delete(b.tenants, key)
+		}
+	}
+}
+
+// PriorityInference is a PriorityMapper computing the priority from the
+// content of the data with a user function, e.g. from the length of a
+// prompt or the tier of its user. The function gets a bounded time, so
+// that a slow classification cannot block admission: past the timeout,
+// or if it fails, the data gets the fallback priority.
+type PriorityInference struct {
+	fallbacks uint64 // first to keep it aligned on 32-bit platforms
+	infer     func(ctx context.Context, data interface{}, priority int) (int, error)
+	timeout   time.Duration
+	fallback  int
+	key       func(data interface{}) string
+	ttl       time.Duration
+	now       func() time.Time
+	lock      sync.Mutex
+	cache     map[string]inferred
+	swept     time.Time
+}
+
+type inferred struct {
+	priority int
+	expires  time.Time
+}
+
+// NewPriorityInference returns a PriorityInference calling infer with the
+// data and its priority, and a context done after timeout. infer must be
+// safe for concurrent use.
+func NewPriorityInference(infer func(ctx context.Context, data interface{}, priority int) (int, error), timeout time.Duration, fallback int) *PriorityInference {
+	return &PriorityInference{infer: infer, timeout: timeout, fallback: fallback, now: time.Now}
+}
+
+// Cache makes p remember the priorities inferred for the data of the same
+// key, e.g. the user of a request, for ttl. The result of a call that
+// ignores its context and times out is still remembered once it returns,
+// so that the next data of the key gets it. It must be called before p
+// is used.
+func (p *PriorityInference) Cache(key func(data interface{}) string, ttl time.Duration) *PriorityInference {
+	p.key, p.ttl = key, ttl
+	p.cache = make(map[string]inferred)
+	return p
+}
+
+// Fallbacks returns the number of data given the fallback priority.
+func (p *PriorityInference) Fallbacks() uint64 {
+	return atomic.LoadUint64(&p.fallbacks)
+}
+
+// MapPriority implements PriorityMapper.
+func (p *PriorityInference) MapPriority(data interface{}, priority int) int {
+	var key string
+	if p.cache != nil {
+		key = p.key(data)
+		if inferred, ok := p.lookup(key); ok {
+			return inferred
+		}
+	}
+	result := make(chan int, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	go func() {
+		inferred, err := p.infer(ctx, data, priority)
+		if err != nil {
+			close(result)
+			return
+		}
+		if p.cache != nil {
+			p.store(key, inferred)
+		}
+		result <- inferred
+	}()
+	select {
+	case inferred, ok := <-result:
+		if ok {
+			return inferred
+		}
+	case <-ctx.Done():
+	}
+	atomic.AddUint64(&p.fallbacks, 1)
+	return p.fallback
+}
+
+func (p *PriorityInference) lookup(key string) (int, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	inferred, ok := p.cache[key]
+	if !ok || !p.now().Before(inferred.expires) {
+		return 0, false
+	}
+	return inferred.priority, true
+}
+
+// store remembers the inferred priority of the key, and forgets the
+// expired ones, at most once per ttl.
+func (p *PriorityInference) store(key string, priority int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	p.cache[key] = inferred{priority: priority, expires: now.Add(p.ttl)}
+	if now.Sub(p.swept) < p.ttl {
+		return
+	}
+	p.swept = now
+	for key, inferred := range p.cache {
+		if !now.Before(inferred.expires) {
+			delete(p.cache, key)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityMapper(t *testing.T) {
+	q := New(WithPriorityMapper(PriorityMapperFunc(func(data interface{}, priority int) int {
+		return -priority
+	})))
+	q.Enqueue(`low`, 1)
+	q.Enqueue(`high`, 2)
+	data, priority, _ := q.Peek()
+	assert.Equal(t, `high`, data)
+	assert.Equal(t, -2, priority)
+}
+
+func TestWarmUpBoost(t *testing.T) {
+	clock := &mockClock{t: time.Unix(1600000000, 0)}
+	boost := NewWarmUpBoost(func(data interface{}) string {
+		return data.(string)
+	}, 4, 8, time.Hour)
+	boost.now = clock.now
+
+	var priorities []int
+	for i := 0; i < 6; i++ {
+		priorities = append(priorities, boost.MapPriority(`new`, 10))
+	}
+	assert.Equal(t, []int{2, 4, 6, 8, 10, 10}, priorities)
+	assert.Equal(t, 2, boost.MapPriority(`other`, 10))
+
+	clock.advance(30 * time.Minute)
+	assert.Equal(t, 10, boost.MapPriority(`new`, 10), "still known")
+	clock.advance(time.Hour)
+	assert.Equal(t, 2, boost.MapPriority(`new`, 10), "forgotten")
+
+	for i := 0; i < 4; i++ {
+		boost.MapPriority(`regular`, 5)
+	}
+	q := New(WithPriorityMapper(boost))
+	q.Enqueue(`regular`, 5)
+	q.Enqueue(`newcomer`, 10)
+	data, _ := q.Dequeue()
+	assert.Equal(t, `newcomer`, data)
+}
+
+func TestPriorityInference(t *testing.T) {
+	errUnknown := errors.New("unknown user")
+	slow := make(chan struct{})
+	var calls int64
+	infer := NewPriorityInference(func(ctx context.Context, data interface{}, priority int) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		switch user := data.(string); user {
+		case "slow":
+			<-slow
+			return 1, nil
+		case "unknown":
+			return 0, errUnknown
+		default:
+			return len(user), nil
+		}
+	}, 10*time.Millisecond, 9).Cache(func(data interface{}) string {
+		return data.(string)
+	}, time.Hour)
+	clock := &mockClock{t: time.Unix(1600000000, 0)}
+	infer.now = clock.now
+
+	q := New(WithPriorityMapper(infer))
+	q.Enqueue("abc", 0)
+	q.Enqueue("slow", 0)
+	q.Enqueue("unknown", 0)
+	q.Enqueue("ab", 0)
+	q.Enqueue("abc", 0)
+	assert.Equal(t, uint64(2), infer.Fallbacks())
+	assert.Equal(t, int64(4), atomic.LoadInt64(&calls), "cached")
+	var priorities []int
+	for !q.Empty() {
+		_, priority, _ := q.Peek()
+		q.Dequeue()
+		priorities = append(priorities, priority)
+	}
+	assert.Equal(t, []int{2, 3, 3, 9, 9}, priorities)
+
+	close(slow)
+	assert.Eventually(t, func() bool { return infer.MapPriority("slow", 0) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(4), atomic.LoadInt64(&calls), "the late result is cached")
+
+	clock.advance(time.Hour)
+	assert.Equal(t, 3, infer.MapPriority("abc", 0))
+	assert.Equal(t, int64(5), atomic.LoadInt64(&calls), "expired")
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// PriorityQueue is what the priority queues of the package have in
+// common, so that the code using a queue doesn't depend on its
+// implementation, e.g. to swap a Queue for a ShardedQueue.
+type PriorityQueue interface {
+	// Enqueue puts the data into the priority queue.
+	Enqueue(data interface{}, priority int) error
+	// Dequeue takes the data with highest priority from the queue. It
+	// returns ErrQueueEmpty if the queue is empty, or ErrQueueClosed if
+	// it is closed and drained.
+	Dequeue() (interface{}, error)
+	// Peek gets the data with highest priority and its priority value
+	// without removing it from the queue.
+	Peek() (interface{}, int, error)
+	// Len returns the size of the priority queue.
+	Len() int
+	// Close closes the queue: enqueues fail, while the remaining data may
+	// still be dequeued.
+	Close()
+}
+
+var (
+	_ PriorityQueue = (*Queue)(nil)
+	_ PriorityQueue = (*ShardedQueue)(nil)
+	_ PriorityQueue = (*WeightedQueue)(nil)
+	_ PriorityQueue = (*LotteryQueue)(nil)
+)
+
+// pollInterval is how often Dispatch polls a queue that cannot block.
+const pollInterval = 10 * time.Millisecond
+
+// Dispatch is like Queue.Dispatch for any implementation of
+// PriorityQueue. A queue that cannot block until data is available, i.e.
+// without a DequeueCtx(context.Context) (interface{}, error) method, is
+// polled while it is empty. Of the dispatch options, only
+// WithFailureHandler applies to other implementations than *Queue.
+func Dispatch(ctx context.Context, pq PriorityQueue, workers int, fn func(data interface{}) error, opts ...DispatchOption) error {
+	if q, ok := pq.(*Queue); ok {
+		return q.Dispatch(ctx, workers, fn, opts...)
+	}
+	var cfg dispatchConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	dequeue := func() (interface{}, error) {
+		for {
+			data, err := pq.Dequeue()
+			if !errors.Is(err, ErrQueueEmpty) {
+				return data, err
+			}
+			select {
+			case <-time.After(pollInterval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	if b, ok := pq.(interface {
+		DequeueCtx(context.Context) (interface{}, error)
+	}); ok {
+		dequeue = func() (interface{}, error) { return b.DequeueCtx(ctx) }
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				data, err := dequeue()
+				if err != nil {
+					return
+				}
+				if err := fn(data); err != nil && cfg.onFailure != nil {
+					cfg.onFailure(data, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	for name, pq := range map[string]PriorityQueue{
+		"queue":          New(),
+		"sharded queue":  NewShardedQueue(4),
+		"weighted queue": NewWeightedQueue(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := pq.Peek()
+			assert.Equal(t, ErrQueueEmpty, err)
+			for i := 0; i < 8; i++ {
+				assert.Equal(t, nil, pq.Enqueue(i, 10-i))
+			}
+			assert.Equal(t, 8, pq.Len())
+			data, priority, err := pq.Peek()
+			assert.Equal(t, nil, err)
+			assert.Equal(t, 7, data)
+			assert.Equal(t, 3, priority)
+
+			var sum int64
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error)
+			go func() {
+				done <- Dispatch(ctx, pq, 2, func(data interface{}) error {
+					if atomic.AddInt64(&sum, int64(data.(int))) == 28 {
+						cancel()
+					}
+					return nil
+				})
+			}()
+			assert.Equal(t, context.Canceled, <-done)
+			assert.Equal(t, int64(28), atomic.LoadInt64(&sum))
+
+			pq.Close()
+			assert.Equal(t, ErrQueueClosed, pq.Enqueue(0, 0))
+			_, err = pq.Dequeue()
+			assert.Equal(t, ErrQueueClosed, err)
+			assert.Equal(t, nil, Dispatch(context.Background(), pq, 1, nil))
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// processRestartDelay is the minimum delay between two starts of the
+// process of a ProcessWorker, so that a crashing one doesn't spin.
+const processRestartDelay = time.Second
+
+// ProcessWorker hands data to an external process, e.g. a Python script
+// serving a model, with a JSON lines protocol, so that code not written
+// in Go can consume a queue without a network server. For every data,
+// the process reads a line {"data": ...} on its stdin, and writes a line
+// {"result": ...} or {"error": "..."} on its stdout. Its stderr is that
+// of the current process.
+//
+// The process handles one data at a time, which provides backpressure:
+// to run N processes, serve the queue with N workers of one goroutine,
+// see Handle. A process that crashes is restarted for the next data.
+type ProcessWorker struct {
+	lock         sync.Mutex
+	name         string
+	args         []string
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	stdout       *bufio.Reader
+	started      time.Time
+	restartDelay time.Duration
+}
+
+type processRequest struct {
+	Data interface{} `json:"data"`
+}
+
+type processResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// NewProcessWorker is the constructor of ProcessWorker, running the
+// named program with the given arguments, as exec.Command does. The
+// process is started on the first data.
+func NewProcessWorker(name string, args ...string) *ProcessWorker {
+	return &ProcessWorker{name: name, args: args, restartDelay: processRestartDelay}
+}
+
+// Handle sends the data to the process and returns the result it sends
+// back, as a json.RawMessage, or the error it reports, so that it can be
+// given to Serve:
+//
+//	w := requestpq.NewProcessWorker("python3", "model.py")
+//	defer w.Close()
+//	go q.Serve(ctx, 1, w.Handle)
+//
+// If the process crashes, or if ctx is done meanwhile, in which case it
+// is killed, Handle returns an error wrapping ErrBackendUnavailable or
+// ctx.Err(), so that the data may be retried, see WithRetryPolicy.
+func (w *ProcessWorker) Handle(ctx context.Context, data interface{}) (interface{}, error) {
+	line, err := json.Marshal(processRequest{Data: data})
+	if err != nil {
+		return nil, err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.cmd == nil {
+		if err := w.start(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	done := make(chan error, 1)
+	var resp processResponse
+	go func() {
+		if _, err := w.stdin.Write(append(line, '\n')); err != nil {
+			done <- err
+			return
+		}
+		out, err := w.stdout.ReadBytes('\n')
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- json.Unmarshal(out, &resp)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		w.stop()
+		<-done
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		w.stop()
+		return nil, fmt.Errorf("worker process %s: %w: %v", w.name, ErrBackendUnavailable, err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// Close stops the process, if it runs.
+func (w *ProcessWorker) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.stop()
+	return nil
+}
+
+// start starts the process, no sooner than the restart delay after the
+// previous start. It must be called with the lock held.
+func (w *ProcessWorker) start(ctx context.Context) error {
+	if wait := time.Until(w.started.Add(w.restartDelay)); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	w.started = time.Now()
+	cmd := exec.Command(w.name, w.args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("worker process %s: %w: %v", w.name, ErrBackendUnavailable, err)
+	}
+	w.cmd, w.stdin, w.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stop kills the process, if it runs. It must be called with the lock
+// held.
+func (w *ProcessWorker) stop() {
+	if w.cmd == nil {
+		return
+	}
+	w.stdin.Close()
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+	w.cmd = nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHelperProcess is the external process of the ProcessWorker tests.
+// It doubles numbers, reports an error for "fail", crashes for "crash"
+// and hangs for "hang".
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("REQUESTPQ_HELPER_PROCESS") != "1" {
+		return
+	}
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		var req struct{ Data interface{} }
+		json.Unmarshal(in.Bytes(), &req)
+		switch req.Data {
+		case "fail":
+			fmt.Println(`{"error": "failure"}`)
+		case "crash":
+			os.Exit(1)
+		case "hang":
+			select {}
+		default:
+			fmt.Printf("{\"result\": %v}\n", req.Data.(float64)*2)
+		}
+	}
+	os.Exit(0)
+}
+
+func newHelperWorker(t *testing.T) *ProcessWorker {
+	t.Setenv("REQUESTPQ_HELPER_PROCESS", "1")
+	w := NewProcessWorker(os.Args[0], "-test.run=TestHelperProcess")
+	w.restartDelay = 0
+	return w
+}
+
+func TestProcessWorker(t *testing.T) {
+	w := newHelperWorker(t)
+	defer w.Close()
+	ctx := context.Background()
+
+	result, err := w.Handle(ctx, 21)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, json.RawMessage(`42`), result)
+	_, err = w.Handle(ctx, "fail")
+	assert.EqualError(t, err, "failure")
+
+	_, err = w.Handle(ctx, "crash")
+	assert.Equal(t, true, errors.Is(err, ErrBackendUnavailable))
+	result, err = w.Handle(ctx, 1)
+	assert.Equal(t, nil, err, "restarted")
+	assert.Equal(t, json.RawMessage(`2`), result)
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = w.Handle(timeout, "hang")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	t.Run("serves a queue", func(t *testing.T) {
+		q := New()
+		serveCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		go q.Serve(serveCtx, 1, w.Handle)
+		result, err := q.Submit(ctx, 5, 1)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, json.RawMessage(`10`), result)
+	})
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+// Ready returns a channel receiving a signal whenever the queue goes
+// from empty to non-empty, so that consumers can select over the queue,
+// timers and shutdown channels instead of polling:
+//
+//	for {
+//		select {
+//		case <-q.Ready():
+//			for data, ok := q.TryDequeue(); ok; data, ok = q.TryDequeue() {
+//				handle(data)
+//			}
+//		case <-done:
+//			return
+//		}
+//	}
+//
+// Signals don't queue up: a consumer must drain the queue after every
+// signal, as an item enqueued into a non-empty queue sends none. If the
+// queue is not empty when Ready is first called, a signal is pending
+// already. Consumers of the same queue share the channel, so only one of
+// them receives each signal.
+func (q *Queue) Ready() <-chan struct{} {
+	q.lock.Lock()
+	defer q.unlock()
+	if q.readiness == nil {
+		q.readiness = make(chan struct{}, 1)
+		if q.size() > 0 {
+			q.signalReady()
+		}
+	}
+	return q.readiness
+}
+
+// signalReady signals the Ready channel, if any, without blocking. It
+// must be called with the lock held.
+func (q *Queue) signalReady() {
+	select {
+	case q.readiness <- struct{}{}:
+	default: // pending already
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReady(t *testing.T) {
+	ready := func(q *Queue) bool {
+		select {
+		case <-q.Ready():
+			return true
+		default:
+			return false
+		}
+	}
+
+	t.Run("empty to non-empty", func(t *testing.T) {
+		q := New()
+		assert.False(t, ready(q))
+		q.Enqueue(`a`, 1)
+		q.Enqueue(`b`, 1)
+		assert.True(t, ready(q))
+		assert.False(t, ready(q), "one signal per transition")
+		q.Dequeue()
+		q.Dequeue()
+		q.EnqueueBatch([]Task{{Data: `c`}, {Data: `d`}})
+		assert.True(t, ready(q))
+	})
+
+	t.Run("pending if not empty", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`a`, 1)
+		assert.True(t, ready(q))
+	})
+
+	t.Run("delayed data", func(t *testing.T) {
+		q := New()
+		q.EnqueueAt(`a`, 1, time.Now().Add(10*time.Millisecond))
+		assert.False(t, ready(q))
+		select {
+		case <-q.Ready():
+		case <-time.After(time.Second):
+			t.Fatal("no signal once visible")
+		}
+		data, ok := q.TryDequeue()
+		assert.True(t, ok)
+		assert.Equal(t, `a`, data)
+	})
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+// Package redisqueue implements a priority queue stored in Redis, so that
+// the replicas of a service can share one. Like the in-memory queue, it
+// dequeues the data with the lowest priority value first, and in FIFO
+// order among equal priorities.
+//
+// The queue is a sorted set scored by priority, whose members are the
+// data prefixed with a sequence number taken from a counter: Redis sorts
+// the members of equal score lexicographically, hence in insertion
+// order.
+package redisqueue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+	// pollTimeout bounds every blocking pop of DequeueCtx, which checks
+	// its context in between, in seconds.
+	pollTimeout = "1"
+	// seqWidth is the number of digits of the sequence prefixes.
+	seqWidth = 20
+)
+
+// Queue is a priority queue of byte strings stored in Redis. It is safe
+// for concurrent use.
+type Queue struct {
+	addr string
+	key  string
+	lock sync.Mutex
+	conn *conn // for non-blocking commands, dialed on demand
+}
+
+// New returns the queue stored at key by the Redis server at addr. The
+// server is dialed on demand, and again after a failure.
+func New(addr, key string) *Queue {
+	return &Queue{addr: addr, key: key}
+}
+
+// Enqueue puts the data into the priority queue.
+func (q *Queue) Enqueue(data []byte, priority int) error {
+	seq, err := q.do("INCR", q.key+":seq")
+	if err != nil {
+		return err
+	}
+	member := fmt.Sprintf("%0*d:%s", seqWidth, seq, data)
+	_, err = q.do("ZADD", q.key, strconv.Itoa(priority), member)
+	return err
+}
+
+// Dequeue takes the data with the highest priority from the queue. It
+// returns requestpq.ErrQueueEmpty if the queue is empty.
+func (q *Queue) Dequeue() ([]byte, int, error) {
+	reply, err := q.do("ZPOPMIN", q.key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parsePop(reply, 0)
+}
+
+// DequeueCtx is like Dequeue, but blocks until data is available or ctx
+// is done, in which case it returns ctx.Err(). It blocks on a dedicated
+// connection.
+func (q *Queue) DequeueCtx(ctx context.Context) ([]byte, int, error) {
+	c, err := dial(q.addr, dialTimeout)
+	if err != nil {
+		return nil, 0, unavailable(err)
+	}
+	defer c.Close()
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				c.SetDeadline(time.Now()) // interrupts the blocking pop
+			case <-stop:
+			}
+		}()
+	}
+	for {
+		reply, err := c.do("BZPOPMIN", q.key, pollTimeout)
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		if err != nil {
+			return nil, 0, unavailable(err)
+		}
+		if reply != nil {
+			return parsePop(reply, 1) // the reply starts with the key
+		}
+	}
+}
+
+// Len returns the size of the priority queue.
+func (q *Queue) Len() (int, error) {
+	reply, err := q.do("ZCARD", q.key)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return int(n), nil
+}
+
+// Close closes the connection to the server.
+func (q *Queue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.conn == nil {
+		return nil
+	}
+	err := q.conn.Close()
+	q.conn = nil
+	return err
+}
+
+// do runs a command on the shared connection, which is dropped on
+// network errors.
+func (q *Queue) do(args ...string) (interface{}, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.conn == nil {
+		c, err := dial(q.addr, dialTimeout)
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		q.conn = c
+	}
+	reply, err := q.conn.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		q.conn.Close()
+		q.conn = nil
+		return nil, unavailable(err)
+	}
+	return reply, err
+}
+
+// parsePop returns the data and priority of the reply of a pop, made of
+// a member and its score after skip other fields.
+func parsePop(reply interface{}, skip int) ([]byte, int, error) {
+	fields, _ := reply.([]interface{})
+	if len(fields) < skip+2 {
+		return nil, 0, requestpq.ErrQueueEmpty
+	}
+	member, _ := fields[skip].(string)
+	score, _ := fields[skip+1].(string)
+	priority, err := strconv.ParseFloat(score, 64)
+	if err != nil || len(member) <= seqWidth {
+		return nil, 0, fmt.Errorf("redisqueue: malformed member %q", member)
+	}
+	return []byte(member[seqWidth+1:]), int(priority), nil
+}
+
+func unavailable(err error) error {
+	return fmt.Errorf("redisqueue: %w: %v", requestpq.ErrBackendUnavailable, err)
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package redisqueue
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis serves the few commands of the queue, over RESP.
+type fakeRedis struct {
+	net.Listener
+	lock     sync.Mutex
+	counters map[string]int64
+	sets     map[string][]fakeMember
+}
+
+type fakeMember struct {
+	score  float64
+	member string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot listen:", err)
+	}
+	r := &fakeRedis{Listener: l, counters: map[string]int64{}, sets: map[string][]fakeMember{}}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(c)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	in := bufio.NewReader(c)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(in, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			fmt.Fscanf(in, "$%d\r\n", &size)
+			buf := make([]byte, size+2)
+			io.ReadFull(in, buf)
+			args[i] = string(buf[:size])
+		}
+		io.WriteString(c, r.exec(args))
+	}
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func (r *fakeRedis) pop(key string) (fakeMember, bool) {
+	set := r.sets[key]
+	if len(set) == 0 {
+		return fakeMember{}, false
+	}
+	r.sets[key] = set[1:]
+	return set[0], true
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch args[0] {
+	case "INCR":
+		r.counters[args[1]]++
+		return fmt.Sprintf(":%d\r\n", r.counters[args[1]])
+	case "ZADD":
+		score, _ := strconv.ParseFloat(args[2], 64)
+		set := append(r.sets[args[1]], fakeMember{score, args[3]})
+		sort.Slice(set, func(i, j int) bool {
+			if set[i].score != set[j].score {
+				return set[i].score < set[j].score
+			}
+			return set[i].member < set[j].member
+		})
+		r.sets[args[1]] = set
+		return ":1\r\n"
+	case "ZCARD":
+		return fmt.Sprintf(":%d\r\n", len(r.sets[args[1]]))
+	case "ZPOPMIN":
+		m, ok := r.pop(args[1])
+		if !ok {
+			return "*0\r\n"
+		}
+		return "*2\r\n" + bulk(m.member) + bulk(fmt.Sprint(m.score))
+	case "BZPOPMIN":
+		m, ok := r.pop(args[1])
+		if !ok {
+			r.lock.Unlock()
+			time.Sleep(10 * time.Millisecond) // shorter than the real timeout
+			r.lock.Lock()
+			return "*-1\r\n"
+		}
+		return "*3\r\n" + bulk(args[1]) + bulk(m.member) + bulk(fmt.Sprint(m.score))
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestQueue(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.Close()
+	q := New(r.Addr().String(), "requests")
+	defer q.Close()
+
+	_, _, err := q.Dequeue()
+	assert.Equal(t, requestpq.ErrQueueEmpty, err)
+	for i, data := range []string{`low`, `high 1`, `high 2`, `high 3`} {
+		priority := 1
+		if i == 0 {
+			priority = 2
+		}
+		assert.Equal(t, nil, q.Enqueue([]byte(data), priority))
+	}
+	n, err := q.Len()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, n)
+
+	for i := 1; i <= 3; i++ {
+		data, priority, err := q.Dequeue()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf(`high %d`, i), string(data), "FIFO among equal priorities")
+		assert.Equal(t, 1, priority)
+	}
+	data, priority, err := q.DequeueCtx(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `low`, string(data))
+	assert.Equal(t, 2, priority)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, _, err = q.DequeueCtx(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	r.Close()
+	q.Close()
+	err = New(r.Addr().String(), "requests").Enqueue([]byte(`test`), 1)
+	assert.Equal(t, true, errors.Is(err, requestpq.ErrBackendUnavailable))
+}
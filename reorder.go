@@ -0,0 +1,147 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync"
+)
+
+// ReorderBuffer restores the dequeue order of results that were
+// processed out of order, using the sequence numbers from DequeueSeq.
+// It is not safe for concurrent use.
+type ReorderBuffer struct {
+	next    uint64
+	pending map[uint64]interface{}
+}
+
+// NewReorderBuffer returns a ReorderBuffer expecting start as the first
+// sequence number.
+func NewReorderBuffer(start uint64) *ReorderBuffer {
+	return &ReorderBuffer{
+		next:    start,
+		pending: make(map[uint64]interface{}),
+	}
+}
+
+// Put adds the result with the given sequence number, and returns the
+// results that are now ready in order, if any.
+func (b *ReorderBuffer) Put(seq uint64, result interface{}) []interface{} {
+	if seq < b.next {
+		return nil // already delivered
+	}
+	b.pending[seq] = result
+	var ready []interface{}
+	for {
+		r, ok := b.pending[b.next]
+		if !ok {
+			return ready
+		}
+		delete(b.pending, b.next)
+		ready = append(ready, r)
+		b.next++
+	}
+}
+
+// Next returns the sequence number of the next result to deliver.
+func (b *ReorderBuffer) Next() uint64 {
+	return b.next
+}
+
+// Len returns the number of results waiting for an earlier one.
+func (b *ReorderBuffer) Len() int {
+	return len(b.pending)
+}
+
+// Reorderer emits results from parallel workers on a channel in their
+// dequeue order. It is safe for concurrent use, and its memory is
+// bounded by a window: a worker putting a result too far ahead of the
+// next one to emit blocks until the gap is filled.
+type Reorderer struct {
+	lock    sync.Mutex
+	moved   *sync.Cond
+	buf     *ReorderBuffer
+	window  uint64
+	ready   []interface{} // in order, to send on out
+	sent    uint64        // the sequence number of the next result to send
+	sending bool          // a Put is sending the ready results
+	out     chan interface{}
+	done    chan struct{} // closed by Close
+	closed  bool
+}
+
+// NewReorderer returns a Reorderer expecting start as the first
+// sequence number and holding at most window results. The output
+// channel has a buffer of the same size.
+func NewReorderer(start uint64, window int) *Reorderer {
+	if window < 1 {
+		window = 1
+	}
+	r := &Reorderer{
+		buf:    NewReorderBuffer(start),
+		window: uint64(window),
+		sent:   start,
+		out:    make(chan interface{}, window),
+		done:   make(chan struct{}),
+	}
+	r.moved = sync.NewCond(&r.lock)
+	return r
+}
+
+// Output returns the channel on which results are emitted in order.
+func (r *Reorderer) Output() <-chan interface{} {
+	return r.out
+}
+
+// Put adds the result with the given sequence number. It blocks while
+// seq is a whole window ahead of the next result to emit. The results
+// ready in order are sent by one Put at a time, which blocks while the
+// output channel is full, but without the lock, so that the other Puts
+// and Close don't wait for the consumer. Put after Close is a no-op.
+func (r *Reorderer) Put(seq uint64, result interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for !r.closed && seq >= r.sent+r.window {
+		r.moved.Wait()
+	}
+	if r.closed {
+		return
+	}
+	r.ready = append(r.ready, r.buf.Put(seq, result)...)
+	if r.sending {
+		return // sent by the Put sending already
+	}
+	r.sending = true
+	for len(r.ready) > 0 && !r.closed {
+		res := r.ready[0]
+		r.ready[0] = nil
+		r.ready = r.ready[1:]
+		r.lock.Unlock()
+		select {
+		case r.out <- res:
+		case <-r.done:
+		}
+		r.lock.Lock()
+		r.sent++
+		r.moved.Broadcast()
+	}
+	r.sending = false
+	if r.closed {
+		close(r.out) // left to the sender by Close
+	}
+}
+
+// Close closes the output channel. Results still waiting for an
+// earlier one, or for room in the output channel, are discarded.
+func (r *Reorderer) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.done)
+	if !r.sending {
+		close(r.out)
+	}
+	r.moved.Broadcast()
+}
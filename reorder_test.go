@@ -0,0 +1,123 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	b := NewReorderBuffer(0)
+	assert.Equal(t, 0, len(b.Put(1, `b`)))
+	assert.Equal(t, 0, len(b.Put(2, `c`)))
+	assert.Equal(t, 2, b.Len())
+	assert.Equal(t, []interface{}{`a`, `b`, `c`}, b.Put(0, `a`))
+	assert.Equal(t, uint64(3), b.Next())
+	assert.Equal(t, 0, len(b.Put(1, `dup`)))
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestDequeueSeqFanOut(t *testing.T) {
+	q := New()
+	var want []interface{}
+	for i := 0; i < N; i++ {
+		q.Enqueue(i, 0)
+		want = append(want, i)
+	}
+
+	type result struct {
+		seq  uint64
+		data interface{}
+	}
+	results := make(chan result, N)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				data, seq, err := q.DequeueSeq(context.Background())
+				assert.Equal(t, nil, err)
+				if data == nil {
+					return
+				}
+				results <- result{seq, data}
+			}
+		}()
+	}
+	for w := 0; w < 4; w++ {
+		q.Enqueue(nil, 1)
+	}
+	wg.Wait()
+	close(results)
+
+	b := NewReorderBuffer(0)
+	var got []interface{}
+	for r := range results {
+		got = append(got, b.Put(r.seq, r.data)...)
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestReorderer(t *testing.T) {
+	const window = 8
+	q := New()
+	for i := 0; i < N; i++ {
+		q.Enqueue(i, 0)
+	}
+	r := NewReorderer(0, window)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				data, seq, err := q.DequeueSeq(context.Background())
+				assert.Equal(t, nil, err)
+				if data == nil {
+					return
+				}
+				r.lock.Lock()
+				assert.LessOrEqual(t, r.buf.Len(), window)
+				r.lock.Unlock()
+				r.Put(seq, data.(int)*2)
+			}
+		}()
+	}
+	for w := 0; w < 4; w++ {
+		q.Enqueue(nil, 1)
+	}
+	go func() {
+		wg.Wait()
+		r.Close()
+	}()
+	i := 0
+	for result := range r.Output() {
+		assert.Equal(t, i*2, result)
+		i++
+	}
+	assert.Equal(t, N, i)
+}
+
+func TestReordererStalledConsumer(t *testing.T) {
+	r := NewReorderer(0, 1)
+	r.Put(0, `a`) // fills the output channel
+	sending := make(chan struct{})
+	go func() {
+		r.Put(1, `b`)
+		close(sending)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	<-sending
+	var results []interface{}
+	for result := range r.Output() {
+		results = append(results, result)
+	}
+	assert.Equal(t, []interface{}{`a`}, results)
+}
@@ -5,104 +5,1303 @@
 // which makes it suitable for queuing web requests for batch
 // processing, e.g. in deep models.
 //
+// Building with the requestpq_minimal tag compiles out the optional
+// subsystems for small footprint deployments: the metrics history, the
+// write-ahead log and snapshots, the HTTP middleware and the process
+// workers. The core queue never needs them.
 package requestpq
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/lkevinzc/requestpq/heap"
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+const (
+	// vacuumRatio is the fraction of cancelled items in the heap above
+	// which the heap is compacted in the background.
+	vacuumRatio = 0.25
+	// vacuumMinItems avoids compacting small heaps, where cancelled items
+	// are cheap enough to be skipped when they are popped.
+	vacuumMinItems = 64
 )
 
 // Task defines the input format of decorated channel.
 type Task struct {
 	Data     interface{}
 	Priority int
+	// Ctx is the optional context of the request behind the task. Tasks
+	// whose context is done before they are dispatched are dropped.
+	Ctx context.Context
+}
+
+// TaskOf is the typed counterpart of Task, for DecorateChannelOf.
+type TaskOf[T any] struct {
+	Data     T
+	Priority int
+	Ctx      context.Context
 }
 
 // Queue is a thread-safe priority queue.
 type Queue struct {
-	heap  *heap.ItemHeap
-	lock  sync.Mutex
-	count uint64
+	stats       Stats // first to keep 64-bit counters aligned on 32-bit platforms
+	heap        *heap.ItemHeap
+	lock        sync.Locker
+	notEmpty    *sync.Cond
+	notFull     *sync.Cond
+	capacity    int
+	maxBytes    int64
+	bytes       int64 // of the queued data, see Sizer
+	overflow    OverflowPolicy
+	onDrop      func(data interface{}, priority int)
+	onExpire    func(data interface{}, priority int)
+	dropped     []*entry // to report once unlocked
+	expired     []*entry // to report once unlocked
+	count       uint64
+	seq         uint64
+	wheel       *timerWheel
+	now         func() time.Time
+	clock       Clock
+	cancelled   int
+	vacuuming   bool
+	closed      bool
+	closing     chan struct{} // closed by Close, see EnqueueHedged
+	copy        CopyFunc
+	less        heap.LessFunc
+	mapper      PriorityMapper
+	budget      *retryBudget
+	inflight    int // dequeued but not acked yet
+	maxInflight int
+	bands       []Band // by Min
+	banded      bool   // the heap is ordered by rank first
+	persistence        // see OpenQueue
+	edf         bool
+	idleAfter   time.Duration
+	onIdle      func()
+	idleTimer   timer              // armed or fired since the queue became empty
+	readiness   chan struct{}      // see Ready
+	waiters     []*blockedConsumer // blocked consumers, in FIFO order
+	floor       *softFloor         // see WithSoftFloor
+	validators  []Validator
+	admission   *admission
+	shedding    *shedding
+	shed        []*entry           // to report once unlocked
+	discarded   []*entry           // delayed on close, to report once unlocked
+	unlocks     uint64             // to mark the windows of the stats
+	fair        map[int]*fairLevel // by priority, see EnqueueKeyed
+	unique      map[string]*entry  // see EnqueueUnique
+	coalescing  bool
+	auditLog    *AuditLog
+	describe    func(data interface{}) string // of the audit events
+	delayed     *heap.ItemHeap
+	delay       timer
+	delayAt     time.Time // when the delay timer fires
 }
 
-// NewQueue is the constructor of Queue.
-func NewQueue() *Queue {
+// entry is what the queue keeps in its heap. The heap item is embedded
+// and its Data points back to the entry, so that both are allocated at
+// once.
+type entry struct {
+	heap.Item
+	data      interface{}
+	deadline  time.Time
+	ctx       context.Context
+	visible   time.Time
+	cancelled bool
+	hedge     *hedge           // shared with the other copy of a hedged request
+	extra     bool             // a hedged duplicate or a retry, see WithRetryBudget
+	bucket    *PriorityLimiter // of the admission token, until queued
+	retry     *RetryPolicy
+	attempts  int // failed attempts at processing the data, see retry
+	group     *Group
+	rank      int        // of the band of the priority, see Band
+	id        uint64     // in the write-ahead log, if any
+	since     time.Time  // when it was pushed
+	floor     *heap.Item // in the heap of the system tasks, see WithSoftFloor
+	keyed     bool       // by tenant, see EnqueueKeyed
+	audited   uint64     // the audit event of its enqueue, see WithAuditLog
+	size      int        // of the data, if it is a Sizer
+	charged   bool       // its size counts in the bytes of the queue
+	unique    string     // its key, see EnqueueUnique
+	moved     bool       // from another queue, see attach
+	// view is what the LessFunc of the queue sees: the item with the
+	// data instead of the entry. It is nil if there is no LessFunc.
+	view *heap.Item
+}
+
+func newEntry(data interface{}, priority int) *entry {
+	e := &entry{data: data}
+	e.Priority = priority
+	e.Item.Data = e
+	if s, ok := data.(Sizer); ok {
+		e.size = s.Size()
+	}
+	return e
+}
+
+func entryOf(item *heap.Item) *entry {
+	return item.GetData().(*entry)
+}
+
+// New returns a Queue configured by the options.
+func New(opts ...Option) *Queue {
 	h := heap.NewHeap()
-	q := Queue{heap: &h}
+	q := Queue{heap: &h, lock: &sync.Mutex{}, now: time.Now, clock: realClock{}}
+	for _, opt := range opts {
+		opt(&q)
+	}
+	if q.edf {
+		h := heap.NewHeapFunc(earliestDeadlineFirst(*q.heap))
+		q.heap = &h
+	}
+	if q.less != nil {
+		h := heap.NewHeapFunc(func(a, b *heap.Item) bool {
+			return q.less(entryOf(a).view, entryOf(b).view)
+		})
+		q.heap = &h
+	}
+	if q.bands != nil {
+		q.bandHeap()
+	}
+	if q.admission != nil {
+		q.admission.setup(q.reversed())
+	}
+	if q.shedding != nil {
+		q.shedding.reversed = q.reversed()
+	}
+	q.stats.now = q.now
+	q.notEmpty = sync.NewCond(q.lock)
+	q.notFull = sync.NewCond(q.lock)
 	return &q
 }
 
+// NewQueue is the constructor of Queue of v1.
+//
+// Deprecated: use New, which takes options.
+func NewQueue() *Queue {
+	return New()
+}
+
+// NewBoundedQueue returns a Queue holding at most capacity items.
+func NewBoundedQueue(capacity int, opts ...Option) *Queue {
+	return New(append([]Option{WithCapacity(capacity)}, opts...)...)
+}
+
 // Enqueue puts the data into the priority queue with a timestamp.
-func (q *Queue) Enqueue(data interface{}, priority int) {
+// If the queue is bounded and full, Enqueue blocks until there is room,
+// unless another overflow policy is configured. It returns
+// ErrQueueClosed if the queue is closed.
+func (q *Queue) Enqueue(data interface{}, priority int) error {
+	_, err := q.enqueue(data, priority, time.Time{}, true)
+	return err
+}
+
+// TryEnqueue puts the data into the priority queue like Enqueue, but
+// returns ErrQueueFull instead of blocking when the queue is full.
+func (q *Queue) TryEnqueue(data interface{}, priority int) error {
+	_, err := q.enqueue(data, priority, time.Time{}, false)
+	return err
+}
+
+// EnqueueBatch puts all the tasks into the priority queue in a single
+// critical section, in the given order. Tasks with a context are
+// discarded once it is done, and expire with its deadline, as with
+// EnqueueCtx. It returns ErrQueueClosed if the queue is closed before
+// all the tasks are queued. If a validator rejects a task, none is
+// queued, see WithValidator. If they all fit, the tasks are pushed at
+// once with heap.PushAll, which is cheaper than one by one for large
+// batches.
+func (q *Queue) EnqueueBatch(tasks []Task) error {
+	entries := make([]*entry, len(tasks))
+	for i := range tasks {
+		e, err := q.admit(tasks[i].Ctx, tasks[i].Data, tasks[i].Priority)
+		if err != nil {
+			q.refund(entries[:i]...)
+			return fmt.Errorf("task %d: %w", i, err)
+		}
+		e.ctx = tasks[i].Ctx
+		if e.ctx != nil {
+			e.deadline, _ = e.ctx.Deadline()
+		}
+		entries[i] = e
+	}
+	q.lock.Lock()
+	defer q.unlock()
+	if q.closed {
+		q.refund(entries...)
+		return ErrQueueClosed
+	}
+	q.expire()
+	if (q.capacity <= 0 || q.size()+len(entries) <= q.capacity) && q.maxBytes <= 0 && q.shedding == nil && q.count <= math.MaxUint64-uint64(len(entries)) {
+		q.pushAll(entries)
+		q.wakeConsumers(len(entries))
+		return nil
+	}
+	for i, e := range entries {
+		if err := q.insert(e, true); err != nil {
+			q.refund(entries[i+1:]...)
+			return err
+		}
+	}
+	return nil
+}
+
+// EnqueueTTL puts the data into the priority queue like Enqueue, but
+// the data is discarded if it is still in the queue after ttl.
+//
+// Expiry is driven by a hierarchical timer wheel advanced on each
+// queue operation, so it costs O(1) amortized per item regardless of
+// the number of pending items.
+func (q *Queue) EnqueueTTL(data interface{}, priority int, ttl time.Duration) error {
+	return q.EnqueueDeadline(data, priority, q.now().Add(ttl))
+}
+
+// EnqueueDeadline is like EnqueueTTL with an absolute deadline. Expired
+// data is never dequeued; it is discarded silently, or reported to the
+// OnExpire callback.
+func (q *Queue) EnqueueDeadline(data interface{}, priority int, deadline time.Time) error {
+	_, err := q.enqueue(data, priority, deadline, true)
+	return err
+}
+
+// EnqueueKey puts the data into the priority queue like Enqueue, with a
+// composite key refining the priority: data with the same priority is
+// dequeued in the lexicographic order of the keys, and only then in FIFO
+// order. With WithMaxFirst, keys are dequeued in reverse order too.
+func (q *Queue) EnqueueKey(data interface{}, priority int, key heap.Key) error {
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return err
+	}
+	e.Key = key
+	_, err = q.enqueueEntry(e, true)
+	return err
+}
+
+// EnqueueInt64 puts the data into the priority queue with an int64
+// priority, e.g. a timestamp, which doesn't fit in an int on 32-bit
+// platforms. It is a shorthand for EnqueueKey with priority 0 and
+// heap.Int64Key, so a queue should not mix it with other priorities.
+func (q *Queue) EnqueueInt64(data interface{}, priority int64) error {
+	return q.EnqueueKey(data, 0, heap.Int64Key(priority))
+}
+
+// EnqueueFloat64 puts the data into the priority queue with a float64
+// priority, e.g. a ranking score. It is a shorthand for EnqueueKey with
+// priority 0 and heap.Float64Key, so a queue should not mix it with
+// other priorities.
+func (q *Queue) EnqueueFloat64(data interface{}, priority float64) error {
+	return q.EnqueueKey(data, 0, heap.Float64Key(priority))
+}
+
+// EnqueueCtx puts the data into the priority queue like Enqueue, but
+// the data is discarded instead of being dequeued once ctx is done, e.g.
+// when the client behind a request went away. Discarded data is counted
+// as cancelled. It is checked lazily, so Len may include it meanwhile.
+// The deadline of ctx, if any, is the deadline of the data, as with
+// EnqueueDeadline.
+func (q *Queue) EnqueueCtx(ctx context.Context, data interface{}, priority int) error {
+	e, err := q.admit(ctx, data, priority)
+	if err != nil {
+		return err
+	}
+	e.ctx = ctx
+	if ctx != nil {
+		e.deadline, _ = ctx.Deadline()
+	}
+	_, err = q.enqueueEntry(e, true)
+	return err
+}
+
+// EnqueueCancelable puts the data into the priority queue like Enqueue
+// and returns a function that cancels it. cancel reports whether the
+// data was still queued, so it always returns false if the queue was
+// closed or full without room.
+//
+// Cancellation is O(1): the item is only marked as deleted and skipped
+// once it reaches the top, while a background vacuum compacts the queue
+// when cancelled items exceed a quarter of it.
+func (q *Queue) EnqueueCancelable(data interface{}, priority int) (cancel func() bool) {
+	e, _ := q.enqueue(data, priority, time.Time{}, true)
+	return func() bool {
+		if e == nil {
+			return false
+		}
+		return q.cancel(e)
+	}
+}
+
+func (q *Queue) cancel(e *entry) bool {
+	q.lock.Lock()
+	defer q.unlock()
+	if e.Index() < 1 || e.cancelled {
+		return false
+	}
+	e.cancelled = true
+	q.cancelled++
+	q.left(e)
+	q.audit(e, AuditCancel)
+	atomic.AddUint64(&q.stats.cancelled, 1)
+	q.roomMade()
+	n := q.cancelled
+	if !q.vacuuming && n >= vacuumMinItems && float64(n) > vacuumRatio*float64(q.heap.Len()) {
+		q.vacuuming = true
+		go q.vacuum()
+	}
+	return true
+}
+
+// vacuum drops all cancelled items from the heap.
+func (q *Queue) vacuum() {
 	q.lock.Lock()
 	defer q.lock.Unlock()
+	q.heap.Compact(func(item *heap.Item) bool {
+		if e := entryOf(item); e.cancelled {
+			q.left(e)
+			return true
+		}
+		return false
+	})
+	if q.floor != nil {
+		q.floor.reindex()
+	}
+	q.cancelled = 0
+	q.vacuuming = false
+}
+
+// admit prepares the entry of data before it is pushed. It must be
+// called without the lock held, so that copying, mapping priorities and
+// waiting for admission, until ctx is done, don't block other
+// operations.
+func (q *Queue) admit(ctx context.Context, data interface{}, priority int) (*entry, error) {
+	if q.copy != nil {
+		data = q.copy(data)
+	}
+	if q.validators != nil {
+		task := Task{Data: data, Priority: priority}
+		if err := q.validate(&task); err != nil {
+			return nil, err
+		}
+		data, priority = task.Data, task.Priority
+	}
+	if q.mapper != nil {
+		priority = q.mapper.MapPriority(data, priority)
+	}
+	var bucket *PriorityLimiter
+	if q.admission != nil {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		var err error
+		if priority, bucket, err = q.admission.admit(ctx, priority); err != nil {
+			return nil, err
+		}
+	}
+	e := newEntry(data, priority)
+	e.bucket = bucket
+	return e, nil
+}
+
+// enqueue is the common path of single-item enqueues. It returns the
+// queued entry, or nil if it was dropped by the overflow policy.
+func (q *Queue) enqueue(data interface{}, priority int, deadline time.Time, block bool) (*entry, error) {
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return nil, err
+	}
+	e.deadline = deadline
+	return q.enqueueEntry(e, block)
+}
+
+// transfer puts an entry taken from another queue into the queue,
+// keeping its priority, key, deadline, context and ack group. Unless
+// block, it returns ErrQueueFull rather than waiting for room.
+func (q *Queue) transfer(from *entry, block bool) error {
+	e := newEntry(from.data, from.Priority)
+	e.Key, e.deadline, e.ctx = from.Key, from.deadline, from.ctx
+	if from.group != nil && from.group.ack {
+		e.group = from.group // still pending
+	}
+	_, err := q.enqueueEntry(e, block)
+	return err
+}
+
+func (q *Queue) enqueueEntry(e *entry, block bool) (*entry, error) {
+	q.lock.Lock()
+	defer q.unlock()
+	if err := q.insert(e, block); err != nil {
+		return nil, err
+	}
+	if e.Index() < 1 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// unlock releases the lock, and then reports the entries expired or
+// dropped meanwhile, so that the callbacks and the waiters of futures
+// may use the queue.
+func (q *Queue) unlock() {
+	q.idle()
+	q.closeLog()
+	if q.unlocks++; q.unlocks%64 == 0 {
+		q.stats.rotate(q.now())
+	}
+	expired, dropped, shed, discarded := q.expired, q.dropped, q.shed, q.discarded
+	q.expired, q.dropped, q.shed, q.discarded = nil, nil, nil, nil
+	q.lock.Unlock()
+	for _, e := range expired {
+		if f, ok := e.data.(*Future); ok {
+			f.Resolve(nil, ErrExpired)
+		}
+		if q.onExpire != nil {
+			q.onExpire(e.data, e.Priority)
+		}
+	}
+	for _, e := range dropped {
+		if f, ok := e.data.(*Future); ok {
+			f.Resolve(nil, ErrQueueFull)
+		}
+		if q.onDrop != nil {
+			q.onDrop(e.data, e.Priority)
+		}
+	}
+	for _, e := range shed {
+		q.shedding.onShed(e.data, e.Priority)
+	}
+	for _, e := range discarded {
+		e.data.(*Future).Resolve(nil, ErrQueueClosed)
+	}
+}
+
+// full tests if the queue is bounded and has no more room for e. It
+// must be called with the lock held.
+func (q *Queue) full(e *entry) bool {
+	if q.capacity > 0 && q.size() >= q.capacity {
+		return true
+	}
+	return q.maxBytes > 0 && q.size() > 0 && q.bytes+int64(e.size) > q.maxBytes
+}
+
+// roomMade wakes the producers waiting for room, all of them with a
+// memory budget since the room may fit some but not others. It must be
+// called with the lock held.
+func (q *Queue) roomMade() {
+	if q.maxBytes > 0 {
+		q.notFull.Broadcast()
+		return
+	}
+	q.notFull.Signal()
+}
+
+// left accounts for an entry leaving the heap, or cancelled, once: its
+// data no longer counts in the memory budget, its unique key is free,
+// and its removal is logged.
+// It must be called with the lock held.
+func (q *Queue) left(e *entry) {
+	if e.charged {
+		q.bytes -= int64(e.size)
+		e.charged = false
+	}
+	q.unindex(e)
+	q.logRemove(e)
+	if e.hedge != nil && !e.extra {
+		e.hedge.end()
+	}
+}
+
+// insert makes room for the entry according to the overflow policy and
+// pushes it, unless the entry itself is dropped. The admission token of
+// an entry that is not queued is refunded. It must be called with the
+// lock held.
+func (q *Queue) insert(e *entry, block bool) error {
+	err := ErrQueueClosed
+	if !q.closed {
+		q.expire()
+		err = ErrShed
+		if !q.sheds(e) {
+			err = q.place(e, block)
+		}
+	}
+	if err != nil || e.Index() < 1 {
+		q.refund(e)
+	}
+	e.bucket = nil
+	return err
+}
+
+// place is insert for an open queue that is up to date. It must be
+// called with the lock held.
+func (q *Queue) place(e *entry, block bool) error {
+	if q.full(e) {
+		switch q.overflow {
+		case DropNewest:
+			q.drop(e)
+			return nil
+		case DropOldest:
+			for q.full(e) {
+				q.drop(q.evict(q.oldest()))
+			}
+		case DropLowestPriority:
+			q.stamp(e, q.count+1) // ties are lost by the newest
+			for q.full(e) {
+				worst := q.worst()
+				if q.heap.Before(&worst.Item, &e.Item) {
+					q.drop(e)
+					return nil
+				}
+				q.drop(q.evict(worst))
+			}
+		default:
+			if !block {
+				return ErrQueueFull
+			}
+			for q.full(e) {
+				q.notFull.Wait()
+				if q.closed {
+					return ErrQueueClosed
+				}
+				q.expire()
+			}
+		}
+	}
+	q.push(e)
+	q.wakeConsumers(1)
+	return nil
+}
+
+// oldest returns the queued entry enqueued first. It must be called
+// with the lock held and a non-empty queue.
+func (q *Queue) oldest() *entry {
+	var oldest *entry
+	for _, item := range (*q.heap)[1:] {
+		e := entryOf(item)
+		if e.cancelled {
+			continue
+		}
+		if oldest == nil || e.Order < oldest.Order {
+			oldest = e
+		}
+	}
+	return oldest
+}
+
+// worst returns the queued entry that would be dequeued last. It must
+// be called with the lock held and a non-empty queue.
+func (q *Queue) worst() *entry {
+	var worst *entry
+	for _, item := range (*q.heap)[1:] {
+		e := entryOf(item)
+		if e.cancelled {
+			continue
+		}
+		if worst == nil || q.heap.Before(&worst.Item, &e.Item) {
+			worst = e
+		}
+	}
+	return worst
+}
+
+// evict removes the queued entry to make room for another one. It must
+// be called with the lock held.
+func (q *Queue) evict(e *entry) *entry {
+	q.heap.Remove(e.Index())
+	return e
+}
+
+// drop accounts for an entry dropped by the overflow policy. It must be
+// called with the lock held.
+func (q *Queue) drop(e *entry) {
+	atomic.AddUint64(&q.stats.dropped, 1)
+	q.left(e)
+	q.audit(e, AuditDrop)
+	if e.group != nil {
+		e.group.done()
+	}
+	if _, ok := e.data.(*Future); ok || q.onDrop != nil {
+		q.dropped = append(q.dropped, e)
+	}
+}
+
+// stamp sets the order of the entry, which breaks priority ties. It must
+// be called with the lock held.
+func (q *Queue) stamp(e *entry, order uint64) {
+	e.Order = order
+	if q.less != nil {
+		e.view = heap.NewItem(e.data, e.Priority, heap.WithKey(e.Key), heap.WithOrder(order))
+	}
+}
+
+// push must be called with the lock held.
+func (q *Queue) push(e *entry) {
 	if q.count == math.MaxUint64 {
 		q.count = q.heap.ReOrder()
+		if q.less != nil {
+			for _, item := range (*q.heap)[1:] {
+				q.stamp(entryOf(item), item.Order)
+			}
+		}
 	}
+	q.prepare(e)
+	empty := q.size() == 0
+	q.heap.Push(&e.Item)
+	q.pushed(e)
+	if empty {
+		q.signalReady()
+	}
+}
+
+// pushAll pushes all the entries at once, see heap.PushAll. The order
+// stamps must not overflow. It must be called with the lock held.
+func (q *Queue) pushAll(entries []*entry) {
+	items := make([]*heap.Item, len(entries))
+	for i, e := range entries {
+		q.prepare(e)
+		items[i] = &e.Item
+	}
+	empty := q.size() == 0
+	q.heap.PushAll(items)
+	for _, e := range entries {
+		q.pushed(e)
+	}
+	if empty && len(entries) > 0 {
+		q.signalReady()
+	}
+}
+
+// prepare stamps an entry about to be pushed. It must be called with
+// the lock held.
+func (q *Queue) prepare(e *entry) {
 	q.count++
-	item := heap.Item{
-		Priority: priority,
-		Data:     data,
-		Order:    q.count,
+	q.stamp(e, q.count)
+	e.since = q.now()
+	if q.banded {
+		q.classify(e)
 	}
-	q.heap.Push(&item)
 }
 
-// Dequeue gets & removes the data with highest priority from the queue.
+// pushed accounts for a pushed entry. It must be called with the lock
+// held.
+func (q *Queue) pushed(e *entry) {
+	if q.floor != nil {
+		q.floor.track(e)
+	}
+	q.bytes += int64(e.size)
+	e.charged = true
+	if q.wal != nil && e.id == 0 {
+		q.logEnqueue(e)
+	}
+	q.busy()
+	if !e.moved {
+		q.audit(e, AuditEnqueue)
+		atomic.AddUint64(&q.stats.enqueued, 1)
+		if q.budget != nil && !e.extra {
+			q.budget.deposit()
+		}
+	}
+	if !e.deadline.IsZero() {
+		if q.wheel == nil {
+			q.wheel = newTimerWheel(defaultWheelTick, q.now())
+		}
+		q.wheel.add(&e.Item, e.deadline)
+	}
+}
+
+// expire removes items whose TTL has passed, and makes delayed items
+// whose time has come visible. It must be called with the lock held.
+func (q *Queue) expire() {
+	q.promote()
+	if q.wheel == nil {
+		return
+	}
+	q.wheel.advance(q.wheel.tickOf(q.now()), func(item *heap.Item) {
+		if item.Index() < 1 {
+			return
+		}
+		q.heap.Remove(item.Index())
+		if e := entryOf(item); e.cancelled {
+			q.cancelled--
+			q.left(e)
+		} else {
+			q.expireEntry(e)
+		}
+	})
+}
+
+// expireEntry accounts for an entry removed after its deadline. It must
+// be called with the lock held.
+func (q *Queue) expireEntry(e *entry) {
+	atomic.AddUint64(&q.stats.expired, 1)
+	q.left(e)
+	q.audit(e, AuditExpire)
+	if e.group != nil {
+		e.group.done()
+	}
+	q.roomMade()
+	if _, ok := e.data.(*Future); ok || q.onExpire != nil {
+		q.expired = append(q.expired, e)
+	}
+}
+
+// skip tests if an entry at the top of the heap must be discarded since
+// it is cancelled, its context is done, the other copy of its hedged
+// request was taken or it is expired, and accounts for it. Expired
+// entries are usually removed by the timer wheel, but the wheel may lag
+// behind by up to a tick. It must be called with the lock held.
+func (q *Queue) skip(e *entry) bool {
+	if e.cancelled {
+		q.cancelled--
+		q.left(e)
+		return true
+	}
+	if (e.ctx != nil && e.ctx.Err() != nil) || (e.hedge != nil && e.hedge.lost(e)) {
+		atomic.AddUint64(&q.stats.cancelled, 1)
+		q.roomMade()
+		if e.group != nil {
+			e.group.done()
+		}
+		q.left(e)
+		q.audit(e, AuditCancel)
+		return true
+	}
+	if !e.deadline.IsZero() && !q.now().Before(e.deadline) {
+		q.expireEntry(e)
+		return true
+	}
+	return false
+}
+
+// pop removes and returns the top entry that is neither cancelled nor
+// expired, or nil if there is none. It must be called with the lock held.
+func (q *Queue) pop() *entry {
+	for {
+		x := q.next()
+		if x == nil {
+			return nil
+		}
+		e := entryOf(x.(*heap.Item))
+		if q.skip(e) {
+			continue
+		}
+		if e.hedge != nil && !e.hedge.claim(e) {
+			atomic.AddUint64(&q.stats.cancelled, 1)
+			q.left(e)
+			q.audit(e, AuditCancel)
+			q.roomMade()
+			continue
+		}
+		atomic.AddUint64(&q.stats.dequeued, 1)
+		q.left(e)
+		q.audit(e, AuditDequeue)
+		if q.floor != nil {
+			q.floor.dequeued(e)
+		}
+		if e.keyed {
+			q.dequeuedKeyed(e)
+		}
+		if e.group != nil {
+			e.group.dequeued()
+		}
+		q.seq++
+		q.roomMade()
+		q.promote()
+		return e
+	}
+}
+
+// peek returns the top entry that is neither cancelled nor expired, or
+// nil if there is none. It must be called with the lock held.
+func (q *Queue) peek() *entry {
+	for {
+		e := q.top()
+		if e == nil {
+			return nil
+		}
+		if !q.skip(e) {
+			return e
+		}
+		q.next() // removes e
+	}
+}
+
+// size returns the number of items that are not cancelled. It must be
+// called with the lock held.
+func (q *Queue) size() int {
+	return q.heap.Len() - q.cancelled
+}
+
+// Dequeue gets & removes the data with highest priority from the queue,
+// or returns ErrQueueEmpty if it is empty. Once the queue is closed, the
+// remaining items are still dequeued, and then ErrQueueClosed is
+// returned instead.
 func (q *Queue) Dequeue() (interface{}, error) {
 	q.lock.Lock()
-	defer q.lock.Unlock()
-	item := q.heap.Pop()
-	if item == nil {
-		return nil, errors.New("pop an empty queue")
+	defer q.unlock()
+	q.expire()
+	e := q.take()
+	if e == nil {
+		if q.held() {
+			return nil, ErrMaxInflight
+		}
+		if q.closed {
+			return nil, ErrQueueClosed
+		}
+		return nil, ErrQueueEmpty
+	}
+	return e.data, nil
+}
+
+// TryDequeue gets & removes the data with highest priority from the
+// queue. ok is false if the queue is empty.
+func (q *Queue) TryDequeue() (data interface{}, ok bool) {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	e := q.take()
+	if e == nil {
+		return nil, false
+	}
+	return e.data, true
+}
+
+// DequeueBatch gets & removes up to max data with highest priority from
+// the queue in a single critical section. The data is returned in
+// priority order, and the result is empty if the queue is empty.
+func (q *Queue) DequeueBatch(max int) []interface{} {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	n := q.size()
+	if max < n {
+		n = max
+	}
+	if n <= 0 {
+		return nil
+	}
+	batch := make([]interface{}, 0, n)
+	for len(batch) < n {
+		e := q.take()
+		if e == nil {
+			break
+		}
+		batch = append(batch, e.data)
+	}
+	return batch
+}
+
+// detach removes up to max entries in priority order, to move them into
+// other queues with attach. Unlike dequeued entries, they are neither
+// counted nor audited, and their groups still wait for them.
+func (q *Queue) detach(max int) []*entry {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	var entries []*entry
+	for len(entries) < max {
+		x := q.next()
+		if x == nil {
+			break
+		}
+		e := entryOf(x.(*heap.Item))
+		if q.skip(e) {
+			continue
+		}
+		q.left(e)
+		q.roomMade()
+		entries = append(entries, e)
+	}
+	q.promote()
+	return entries
+}
+
+// attach puts an entry detached from another queue into the queue,
+// with everything but the state of the other queue, and without
+// counting it as enqueued again. Unless block, it returns ErrQueueFull
+// rather than waiting for room.
+func (q *Queue) attach(from *entry, block bool) error {
+	e := newEntry(from.data, from.Priority)
+	e.Key, e.deadline, e.ctx = from.Key, from.deadline, from.ctx
+	e.hedge, e.extra = from.hedge, from.extra
+	e.retry, e.attempts = from.retry, from.attempts
+	e.group, e.keyed, e.audited = from.group, from.keyed, from.audited
+	e.moved = true
+	_, err := q.enqueueEntry(e, block)
+	return err
+}
+
+// DequeueCtx gets & removes the data with highest priority from the
+// queue, blocking until an item is available or ctx is done. In the
+// latter case the context's error is returned. If the queue is closed
+// and empty, ErrQueueClosed is returned.
+//
+// Any number of consumers may block at once. They are served in the
+// order they blocked, one item each, and a consumer calling DequeueCtx
+// again can't jump ahead of those already waiting.
+func (q *Queue) DequeueCtx(ctx context.Context) (interface{}, error) {
+	e, _, err := q.dequeueCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return e.data, nil
+}
+
+// DequeueSeq is like DequeueCtx, but it also returns the dequeue
+// sequence number of the data. Sequence numbers start at 0 and are
+// given to every dequeued item in order, so that consumers processing
+// items in parallel can restore the total order afterwards, e.g. with a
+// ReorderBuffer. As every dequeue takes a number, all the consumers of
+// the queue should use DequeueSeq to avoid gaps.
+func (q *Queue) DequeueSeq(ctx context.Context) (data interface{}, seq uint64, err error) {
+	e, seq, err := q.dequeueCtx(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return e.data, seq, nil
+}
+
+func (q *Queue) dequeueCtx(ctx context.Context) (*entry, uint64, error) {
+	q.lock.Lock()
+	defer q.unlock()
+	var w *blockedConsumer
+	defer func() {
+		if w != nil {
+			q.leave(w)
+		}
+	}()
+	for {
+		q.expire()
+		if w != nil || len(q.waiters) == 0 { // no barging in
+			if e := q.take(); e != nil {
+				if q.closed && q.size() == 0 {
+					q.wakeConsumers(-1) // to end
+				}
+				return e, q.seq - 1, nil
+			}
+		}
+		if q.closed && !q.held() && q.size() == 0 {
+			return nil, 0, ErrQueueClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		if w == nil {
+			w = &blockedConsumer{wake: make(chan struct{}, 1)}
+			q.waiters = append(q.waiters, w)
+		}
+		q.unlock()
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+		}
+		q.lock.Lock()
+		w.woken = false
+	}
+}
+
+// Peek gets the data with highest priority and its priority value
+// without removing it from the queue.
+func (q *Queue) Peek() (interface{}, int, error) {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	e := q.peek()
+	if e == nil {
+		return nil, 0, ErrQueueEmpty
 	}
-	return item.(*heap.Item).Data, nil
+	return e.data, e.Priority, nil
+}
+
+// Close closes the queue: subsequent enqueues fail with ErrQueueClosed,
+// and so do blocked ones, while consumers may still dequeue the
+// remaining items. Delayed items that are not visible yet are
+// discarded, and their futures resolved with ErrQueueClosed. Consumers
+// blocked on an empty queue are woken up. Close is idempotent.
+func (q *Queue) Close() {
+	q.lock.Lock()
+	defer q.unlock()
+	if q.closing != nil && !q.closed {
+		close(q.closing)
+	}
+	q.closed = true
+	q.discardDelayed()
+	q.wakeConsumers(-1)
+	q.notFull.Broadcast()
+}
+
+// Closed tests if the queue is closed.
+func (q *Queue) Closed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.closed
+}
+
+// Reserve pre-grows the queue so that it can hold at least capacity
+// items without reallocation, e.g. to avoid growth-related latency
+// spikes during the first traffic burst after startup.
+func (q *Queue) Reserve(capacity int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.heap.Reserve(capacity)
+}
+
+// Stats returns the counters of the queue.
+func (q *Queue) Stats() *Stats {
+	return &q.stats
+}
+
+// Bytes returns the total size of the queued data, see Sizer.
+func (q *Queue) Bytes() int64 {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	return q.bytes
 }
 
 // Len returns the size of the priority queue.
 func (q *Queue) Len() int {
 	q.lock.Lock()
-	defer q.lock.Unlock()
-	return q.heap.Len()
+	defer q.unlock()
+	q.expire()
+	return q.size()
+}
+
+// Histogram returns the number of queued items per priority. It scans
+// the whole queue, so it is meant for periodic sampling rather than for
+// every operation.
+func (q *Queue) Histogram() map[int]int {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	histogram := make(map[int]int)
+	for _, item := range (*q.heap)[1:] {
+		if !entryOf(item).cancelled {
+			histogram[item.GetPriority()]++
+		}
+	}
+	return histogram
 }
 
 // Empty tests if the queue is empty.
 func (q *Queue) Empty() bool {
 	q.lock.Lock()
-	defer q.lock.Unlock()
-	return q.heap.Empty()
+	defer q.unlock()
+	q.expire()
+	return q.size() == 0
 }
 
-// DecorateChannel transforms a FIFO queue of normal channel
-// into priority queue with decorated channel.
+// Decorate transforms a FIFO queue of normal channel into priority
+// queue with decorated channel. Once inChan is closed and the remaining
+// data is delivered, the returned channel is closed.
+func Decorate(inChan <-chan *Task, opts ...DecorateOption) <-chan interface{} {
+	outChan := make(chan interface{})
+	decorate(context.Background(), inChan, unpackTask, packData, outChan, opts)
+	return outChan
+}
+
+// DecorateChannel is Decorate with the signature of v1.
+//
+// Deprecated: use Decorate, which takes options.
 func DecorateChannel(inChan chan *Task) (outChan chan interface{}) {
 	outChan = make(chan interface{})
-	pq := NewQueue()
-	cond := sync.NewCond(&pq.lock)
+	decorate(context.Background(), inChan, unpackTask, packData, outChan, nil)
+	return
+}
+
+// DecorateChannelCtx is like Decorate, but the returned channel
+// has the given buffer size, and both internal goroutines exit when ctx
+// is done, without delivering the remaining data. The returned channel
+// is closed in any case.
+func DecorateChannelCtx(ctx context.Context, inChan <-chan *Task, buffer int, opts ...DecorateOption) <-chan interface{} {
+	outChan := make(chan interface{}, buffer)
+	decorate(ctx, inChan, unpackTask, packData, outChan, opts)
+	return outChan
+}
+
+// DecorateTasks is like DecorateChannelCtx, but emits the tasks rather
+// than their data, so that consumers get the context of each task.
+func DecorateTasks(ctx context.Context, inChan <-chan *Task, buffer int, opts ...DecorateOption) <-chan *Task {
+	outChan := make(chan *Task, buffer)
+	decorate(ctx, inChan, unpackTask, func(task Task) (*Task, bool) {
+		return &task, true
+	}, outChan, opts)
+	return outChan
+}
+
+// DecorateChannelOf is like Decorate, but keeps the type of the
+// data, so that callers don't need type assertions on the output.
+func DecorateChannelOf[T any](in <-chan TaskOf[T], opts ...DecorateOption) <-chan T {
+	out := make(chan T)
+	decorate(context.Background(), in, func(task TaskOf[T]) (Task, error) {
+		return Task{Data: task.Data, Priority: task.Priority, Ctx: task.Ctx}, nil
+	}, func(task Task) (T, bool) {
+		data, ok := task.Data.(T)
+		return data, ok || task.Data == nil // the zero value for nil interfaces
+	}, out, opts)
+	return out
+}
+
+func unpackTask(task *Task) (Task, error) {
+	if task == nil {
+		return Task{}, errors.New("nil task")
+	}
+	return *task, nil
+}
+
+func packData(task Task) (interface{}, bool) {
+	return task.Data, true
+}
+
+// decorate runs the goroutines of a decorated channel, moving the tasks
+// unpacked from the input into the output in priority order. Tasks
+// whose context is done before they are sent are dropped.
+func decorate[I, O any](ctx context.Context, inChan <-chan I, unpack func(I) (Task, error), pack func(Task) (O, bool), outChan chan O, opts []DecorateOption) {
+	var cfg decorateConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	pq := New()
+	if cfg.onIdle != nil {
+		pq.OnIdle(cfg.idleAfter, cfg.onIdle)
+	}
+	input := newPauser()
 	go func() {
-		for task := range inChan {
-			pq.Enqueue(task.Data, task.Priority)
-			cond.Signal()
+		defer pq.Close() // wakes the consumer up
+		for {
+			select {
+			case input.gate <- struct{}{}:
+				<-input.gate
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-input.pausing:
+				continue
+			case in, ok := <-inChan:
+				if !ok {
+					return
+				}
+				task, err := unpack(in)
+				if err != nil {
+					cfg.report(err)
+					continue
+				}
+				pq.EnqueueCtx(task.Ctx, task.Data, task.Priority)
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	go func() {
+		defer close(outChan)
 		for {
 			pq.lock.Lock()
-			if pq.heap.Empty() {
-				cond.Wait()
+			if cfg.limiter != nil {
+				// wait for data before the token, so that it isn't wasted
+				// on an empty queue, and pop only then
+				for pq.size() == 0 && !pq.closed {
+					pq.notEmpty.Wait()
+				}
+				pq.unlock()
+				if cfg.limiter.Wait(ctx, 0) != nil {
+					return
+				}
+				pq.lock.Lock()
+			}
+			e := pq.pop()
+			for e == nil && !pq.closed {
+				pq.notEmpty.Wait()
+				e = pq.pop()
+			}
+			pq.unlock()
+			if e == nil || ctx.Err() != nil {
+				return
+			}
+			data, ok := pack(Task{Data: e.data, Priority: e.Priority, Ctx: e.ctx})
+			if !ok {
+				cfg.report(fmt.Errorf("unexpected data type %T", e.data))
+				continue
+			}
+			var done <-chan struct{}
+			if e.ctx != nil {
+				done = e.ctx.Done()
 			}
-			item := pq.heap.Pop()
-			if item == nil {
-				panic(fmt.Sprintf("pop an empty queue"))
+			if !send(ctx, outChan, data, done, &cfg, input) {
+				return
 			}
-			data := item.(*heap.Item).Data
-			pq.lock.Unlock()
-			outChan <- data
 		}
 	}()
-	return
+}
+
+// pauser pauses the reading of the input of a decorated channel: the
+// producer waits for gate, which is held while paused, before reading,
+// and stops waiting for input on pausing.
+type pauser struct {
+	gate    chan struct{}
+	pausing chan struct{}
+}
+
+func newPauser() *pauser {
+	return &pauser{gate: make(chan struct{}, 1), pausing: make(chan struct{}, 1)}
+}
+
+func (p *pauser) pause() {
+	p.gate <- struct{}{}
+	select {
+	case p.pausing <- struct{}{}:
+	default: // already notified
+	}
+}
+
+func (p *pauser) resume() {
+	<-p.gate
+}
+
+// send sends the data of a decorated channel to outChan, unless done is
+// closed first, and handles a stalled consumer. It returns false if ctx
+// is done.
+func send[O any](ctx context.Context, outChan chan O, data O, done <-chan struct{}, cfg *decorateConfig, input *pauser) bool {
+	var stall <-chan time.Time
+	if cfg.slowAfter > 0 {
+		timer := time.NewTimer(cfg.slowAfter)
+		defer timer.Stop()
+		stall = timer.C
+	}
+	paused := false
+	defer func() {
+		if paused {
+			input.resume()
+		}
+	}()
+	for {
+		select {
+		case outChan <- data:
+			return true
+		case <-done:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-stall:
+			stall = nil
+			if cfg.onSlow != nil {
+				cfg.onSlow()
+			}
+			switch cfg.slowPolicy {
+			case SlowConsumerDropOldest:
+				select {
+				case old := <-outChan:
+					cfg.report(fmt.Errorf("slow consumer, dropped %v: %w", old, ErrQueueFull))
+				default: // unbuffered, or emptied meanwhile
+				}
+			case SlowConsumerPause:
+				input.pause()
+				paused = true
+			}
+		}
+	}
 }
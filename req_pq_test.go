@@ -3,6 +3,7 @@
 package requestpq
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"math/rand"
@@ -10,17 +11,77 @@ import (
 	"testing"
 	"time"
 
-	"github.com/lkevinzc/requestpq/heap"
-
+	"github.com/lkevinzc/requestpq/v2/heap"
 	"github.com/stretchr/testify/assert"
 )
 
 var N int = 1024
 
 func mockNewQueue(initCount uint64) *Queue {
-	h := heap.NewHeap()
-	q := Queue{heap: &h, count: initCount}
-	return &q
+	q := New()
+	q.count = initCount
+	return q
+}
+
+// mockClock is a manually advanced clock for queues under test.
+type mockClock struct {
+	lock    sync.Mutex
+	t       time.Time
+	waiters []mockWaiter
+}
+
+type mockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (c *mockClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *mockClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, mockWaiter{at: c.t.Add(d), c: ch})
+	c.fire()
+	return ch
+}
+
+// waiting returns the number of pending After calls.
+func (c *mockClock) waiting() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+func (c *mockClock) now() time.Time { return c.Now() }
+
+func (c *mockClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+	c.fire()
+}
+
+func (c *mockClock) fire() {
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.t) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- c.t
+	}
+	c.waiters = waiters
+}
+
+func mockNewQueueWithClock(opts ...Option) (*Queue, *mockClock) {
+	c := &mockClock{t: time.Unix(1600000000, 0)}
+	q := New(append(opts, WithClock(c))...)
+	return q, c
 }
 
 func verify(t *testing.T, q *Queue) {
@@ -46,7 +107,7 @@ func isAscending(t *testing.T, arr []interface{}) {
 }
 
 func TestNewQueue(t *testing.T) {
-	q := NewQueue()
+	q := New()
 	assert.Equal(t, 0, q.Len())
 	q.Enqueue(`test`, 20)
 	assert.Equal(t, 1, q.Len())
@@ -58,9 +119,607 @@ func TestNewQueue(t *testing.T) {
 	}
 }
 
+func TestPeek(t *testing.T) {
+	q := New()
+	_, _, err := q.Peek()
+	assert.NotEqual(t, nil, err)
+	q.Enqueue(`low`, 20)
+	q.Enqueue(`high`, 1)
+	q.Enqueue(`high again`, 1)
+	data, priority, err := q.Peek()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `high`, data)
+	assert.Equal(t, 1, priority)
+	assert.Equal(t, 3, q.Len())
+	data, _ = q.Dequeue()
+	assert.Equal(t, `high`, data)
+	data, priority, _ = q.Peek()
+	assert.Equal(t, `high again`, data)
+	assert.Equal(t, 1, priority)
+}
+
+func TestBoundedQueue(t *testing.T) {
+	t.Run("try enqueue returns ErrQueueFull", func(t *testing.T) {
+		q := NewBoundedQueue(2)
+		assert.Equal(t, nil, q.TryEnqueue(`a`, 1))
+		assert.Equal(t, nil, q.TryEnqueue(`b`, 1))
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(`c`, 0))
+		assert.Equal(t, 2, q.Len())
+		_, _ = q.Dequeue()
+		assert.Equal(t, nil, q.TryEnqueue(`c`, 0))
+	})
+
+	t.Run("cancel and expiry make room", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock()
+		WithCapacity(2)(q)
+		cancel := q.EnqueueCancelable(`a`, 1)
+		q.EnqueueTTL(`b`, 1, time.Second)
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(`c`, 1))
+		cancel()
+		assert.Equal(t, nil, q.TryEnqueue(`c`, 1))
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(`d`, 1))
+		clock.advance(2 * time.Second)
+		assert.Equal(t, nil, q.TryEnqueue(`d`, 1))
+	})
+
+	t.Run("enqueue blocks until there is room", func(t *testing.T) {
+		q := NewBoundedQueue(4)
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < N; i++ {
+				q.Enqueue(i, 0)
+			}
+			q.EnqueueBatch([]Task{{Data: N, Priority: 0}, {Data: N + 1, Priority: 0}})
+			close(done)
+		}()
+		for i := 0; i < N+2; i++ {
+			assert.LessOrEqual(t, q.Len(), 4)
+			data, err := q.DequeueCtx(context.Background())
+			assert.Equal(t, nil, err)
+			assert.Equal(t, i, data)
+		}
+		<-done
+		assert.Equal(t, true, q.Empty())
+	})
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	type drop struct {
+		data     interface{}
+		priority int
+	}
+	fill := func(policy OverflowPolicy) (*Queue, *[]drop) {
+		var dropped []drop
+		q := NewBoundedQueue(3, WithOverflowPolicy(policy), WithOnDrop(func(data interface{}, priority int) {
+			dropped = append(dropped, drop{data, priority})
+		}))
+		q.Enqueue(`b`, 2)
+		q.Enqueue(`a`, 1)
+		q.Enqueue(`c`, 3)
+		return q, &dropped
+	}
+	drain := func(q *Queue) []interface{} {
+		var arr []interface{}
+		for !q.Empty() {
+			data, _ := q.Dequeue()
+			arr = append(arr, data)
+		}
+		return arr
+	}
+
+	t.Run("drop lowest priority", func(t *testing.T) {
+		q, dropped := fill(DropLowestPriority)
+		q.Enqueue(`x`, 0)
+		assert.Equal(t, []drop{{`c`, 3}}, *dropped)
+		assert.Equal(t, nil, q.TryEnqueue(`y`, 2)) // loses the tie
+		assert.Equal(t, []drop{{`c`, 3}, {`y`, 2}}, *dropped)
+		assert.Equal(t, []interface{}{`x`, `a`, `b`}, drain(q))
+		assert.Equal(t, uint64(2), q.Stats().Dropped())
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		q, dropped := fill(DropOldest)
+		q.Enqueue(`x`, 9)
+		q.EnqueueBatch([]Task{{Data: `y`, Priority: 0}})
+		assert.Equal(t, []drop{{`b`, 2}, {`a`, 1}}, *dropped)
+		assert.Equal(t, []interface{}{`y`, `c`, `x`}, drain(q))
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		q, dropped := fill(DropNewest)
+		cancel := q.EnqueueCancelable(`x`, 0)
+		assert.Equal(t, false, cancel())
+		q.EnqueueTTL(`y`, 0, time.Hour)
+		assert.Equal(t, []drop{{`x`, 0}, {`y`, 0}}, *dropped)
+		assert.Equal(t, []interface{}{`a`, `b`, `c`}, drain(q))
+	})
+
+	t.Run("block is the default", func(t *testing.T) {
+		q, dropped := fill(Block)
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(`x`, 0))
+		assert.Equal(t, 0, len(*dropped))
+	})
+}
+
+type sized string
+
+func (s sized) Size() int { return len(s) }
+
+func TestMaxBytes(t *testing.T) {
+	t.Run("try enqueue returns ErrQueueFull", func(t *testing.T) {
+		q := New(WithMaxBytes(10))
+		assert.Equal(t, nil, q.TryEnqueue(sized(`aaaaaa`), 1))
+		assert.Equal(t, nil, q.TryEnqueue(`no size`, 1))
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(sized(`bbbbbb`), 1))
+		assert.Equal(t, nil, q.TryEnqueue(sized(`cccc`), 1))
+		assert.Equal(t, int64(10), q.Bytes())
+		q.Dequeue()
+		assert.Equal(t, int64(4), q.Bytes())
+		assert.Equal(t, nil, q.TryEnqueue(sized(`bbbbbb`), 1))
+	})
+
+	t.Run("larger than the budget", func(t *testing.T) {
+		q := New(WithMaxBytes(2))
+		assert.Equal(t, nil, q.TryEnqueue(sized(`huge`), 1), "into an empty queue")
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(sized(`a`), 1))
+	})
+
+	t.Run("cancel and expiry make room", func(t *testing.T) {
+		q, clock := mockNewQueueWithClock(WithMaxBytes(4))
+		cancel := q.EnqueueCancelable(sized(`aa`), 1)
+		q.EnqueueTTL(sized(`bb`), 1, time.Second)
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(sized(`c`), 1))
+		cancel()
+		assert.Equal(t, nil, q.TryEnqueue(sized(`cc`), 1))
+		clock.advance(2 * time.Second)
+		assert.Equal(t, int64(2), q.Bytes())
+	})
+
+	t.Run("drops as many items as needed", func(t *testing.T) {
+		var dropped []interface{}
+		q := New(WithMaxBytes(6), WithOverflowPolicy(DropLowestPriority), WithOnDrop(func(data interface{}, priority int) {
+			dropped = append(dropped, data)
+		}))
+		q.Enqueue(sized(`aa`), 1)
+		q.Enqueue(sized(`bb`), 2)
+		q.Enqueue(sized(`cc`), 3)
+		q.Enqueue(sized(`xxxx`), 0)
+		assert.Equal(t, []interface{}{sized(`cc`), sized(`bb`)}, dropped)
+		assert.Equal(t, int64(6), q.Bytes())
+		q.Enqueue(sized(`yyy`), 4)
+		assert.Equal(t, sized(`yyy`), dropped[2])
+	})
+
+	t.Run("enqueue blocks until there is room", func(t *testing.T) {
+		q := New(WithMaxBytes(4))
+		q.Enqueue(sized(`aaa`), 1)
+		done := make(chan struct{})
+		go func() {
+			q.Enqueue(sized(`bbb`), 1)
+			close(done)
+		}()
+		select {
+		case <-done:
+			t.Fatal("enqueued over the budget")
+		case <-time.After(10 * time.Millisecond):
+		}
+		q.Dequeue()
+		<-done
+		assert.Equal(t, int64(3), q.Bytes())
+	})
+}
+
+func TestMaxFirst(t *testing.T) {
+	q := New(WithMaxFirst())
+	q.Enqueue(`low`, 1)
+	q.Enqueue(`high`, 10)
+	q.Enqueue(`high again`, 10)
+	for _, expected := range []string{`high`, `high again`, `low`} {
+		data, _ := q.Dequeue()
+		assert.Equal(t, expected, data)
+	}
+
+	t.Run("drop lowest priority", func(t *testing.T) {
+		q := NewBoundedQueue(2, WithMaxFirst(), WithOverflowPolicy(DropLowestPriority))
+		q.Enqueue(`b`, 2)
+		q.Enqueue(`a`, 3)
+		q.Enqueue(`x`, 1) // lowest, dropped
+		q.Enqueue(`c`, 5)
+		assert.Equal(t, 2, q.Len())
+		data, _ := q.Dequeue()
+		assert.Equal(t, `c`, data)
+		data, _ = q.Dequeue()
+		assert.Equal(t, `a`, data)
+	})
+}
+
+func TestEnqueueKey(t *testing.T) {
+	q := New()
+	// ordered by (class, deadline, sequence)
+	q.EnqueueKey(`late`, 1, heap.Key{200, 1})
+	q.EnqueueKey(`soon`, 1, heap.Key{100, 2})
+	q.EnqueueKey(`soon, first`, 1, heap.Key{100, 1})
+	q.EnqueueKey(`other class`, 2, heap.Key{0, 0})
+	q.Enqueue(`no key`, 1)
+	for _, expected := range []string{`no key`, `soon, first`, `soon`, `late`, `other class`} {
+		data, _ := q.Dequeue()
+		assert.Equal(t, expected, data)
+	}
+}
+
+func TestEnqueueFloat64(t *testing.T) {
+	q := New()
+	for _, score := range []float64{0.5, -1.25, 3, 0.25} {
+		q.EnqueueFloat64(score, score)
+	}
+	for _, expected := range []float64{-1.25, 0.25, 0.5, 3} {
+		data, _ := q.Dequeue()
+		assert.Equal(t, expected, data)
+	}
+
+	q = New(WithMaxFirst())
+	for _, ts := range []int64{math.MaxInt32 + 1, 1, math.MaxInt64} {
+		q.EnqueueInt64(ts, ts)
+	}
+	for _, expected := range []int64{math.MaxInt64, math.MaxInt32 + 1, 1} {
+		data, _ := q.Dequeue()
+		assert.Equal(t, expected, data)
+	}
+}
+
+func TestLessFunc(t *testing.T) {
+	type request struct {
+		name string
+		cost int
+	}
+	cheapest := WithLessFunc(func(a, b *heap.Item) bool {
+		ca, cb := a.Data.(request).cost, b.Data.(request).cost
+		if ca == cb {
+			return a.Order < b.Order
+		}
+		return ca < cb
+	})
+	q := New(cheapest, WithMaxFirst())
+	q.Enqueue(request{`big`, 100}, 1)
+	q.Enqueue(request{`small`, 1}, 0)
+	q.Enqueue(request{`medium`, 10}, 2)
+	q.Enqueue(request{`small again`, 1}, 3)
+	for _, expected := range []string{`small`, `small again`, `medium`, `big`} {
+		data, _ := q.Dequeue()
+		assert.Equal(t, expected, data.(request).name)
+	}
+
+	t.Run("drop lowest priority", func(t *testing.T) {
+		q := NewBoundedQueue(2, cheapest, WithOverflowPolicy(DropLowestPriority))
+		q.Enqueue(request{`a`, 1}, 0)
+		q.Enqueue(request{`b`, 5}, 0)
+		q.Enqueue(request{`c`, 5}, 0) // loses the tie
+		q.Enqueue(request{`d`, 2}, 0)
+		data, _ := q.Dequeue()
+		assert.Equal(t, `a`, data.(request).name)
+		data, _ = q.Dequeue()
+		assert.Equal(t, `d`, data.(request).name)
+		assert.Equal(t, 0, q.Len())
+	})
+}
+
+func TestEnqueueBatch(t *testing.T) {
+	q := New()
+	q.Enqueue(`first`, 10)
+	tasks := make([]Task, 0, N)
+	for i := 0; i < N; i++ {
+		v := rand.Intn(20)
+		tasks = append(tasks, Task{Data: v, Priority: v})
+	}
+	q.EnqueueBatch(tasks)
+	q.EnqueueBatch(nil)
+	assert.Equal(t, N+1, q.Len())
+	tasks = []Task{{Data: `second`, Priority: 10}, {Data: `third`, Priority: 10}}
+	q.EnqueueBatch(tasks)
+
+	var tens []interface{}
+	prev := -1
+	for !q.Empty() {
+		_, priority, _ := q.Peek()
+		data, _ := q.Dequeue()
+		assert.LessOrEqual(t, prev, priority)
+		prev = priority
+		if priority == 10 {
+			if s, ok := data.(string); ok {
+				tens = append(tens, s)
+			}
+		}
+	}
+	assert.Equal(t, []interface{}{`first`, `second`, `third`}, tens)
+}
+
+func TestEnqueueTTL(t *testing.T) {
+	q, clock := mockNewQueueWithClock()
+	q.EnqueueTTL(`short`, 1, 50*time.Millisecond)
+	q.EnqueueTTL(`long`, 2, time.Second)
+	q.Enqueue(`forever`, 3)
+	assert.Equal(t, 3, q.Len())
+
+	clock.advance(40 * time.Millisecond)
+	data, _, _ := q.Peek()
+	assert.Equal(t, `short`, data)
+
+	clock.advance(20 * time.Millisecond)
+	assert.Equal(t, 2, q.Len())
+	data, _ = q.Dequeue()
+	assert.Equal(t, `long`, data)
+
+	q.EnqueueTTL(`dequeued before expiry`, 0, 10*time.Millisecond)
+	data, _ = q.Dequeue()
+	assert.Equal(t, `dequeued before expiry`, data)
+
+	clock.advance(time.Hour)
+	assert.Equal(t, 1, q.Len())
+	data, _ = q.Dequeue()
+	assert.Equal(t, `forever`, data)
+	assert.Equal(t, true, q.Empty())
+}
+
+func TestTryDequeue(t *testing.T) {
+	q := New()
+	_, ok := q.TryDequeue()
+	assert.Equal(t, false, ok)
+	q.Enqueue(nil, 2) // nil data is not confused with an empty queue
+	q.Enqueue(`test`, 1)
+	data, ok := q.TryDequeue()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, `test`, data)
+	data, ok = q.TryDequeue()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, nil, data)
+	_, ok = q.TryDequeue()
+	assert.Equal(t, false, ok)
+}
+
+func TestDequeueBatch(t *testing.T) {
+	q := New()
+	assert.Equal(t, 0, len(q.DequeueBatch(10)))
+	for i := 0; i < 100; i++ {
+		v := rand.Intn(20)
+		q.Enqueue(v, v)
+	}
+	batch := q.DequeueBatch(30)
+	assert.Equal(t, 30, len(batch))
+	isAscending(t, batch)
+	assert.Equal(t, 70, q.Len())
+	assert.Equal(t, 0, len(q.DequeueBatch(0)))
+	batch = append(batch[len(batch)-1:], q.DequeueBatch(1000)...)
+	assert.Equal(t, 71, len(batch))
+	isAscending(t, batch)
+	assert.Equal(t, true, q.Empty())
+}
+
+func TestDequeueCtx(t *testing.T) {
+	t.Run("blocks until an item is enqueued", func(t *testing.T) {
+		q := New()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			q.Enqueue(`late`, 1)
+		}()
+		data, err := q.DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `late`, data)
+	})
+
+	t.Run("returns immediately when not empty", func(t *testing.T) {
+		q := New()
+		q.Enqueue(`low`, 2)
+		q.Enqueue(`high`, 1)
+		data, err := q.DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `high`, data)
+	})
+
+	t.Run("unblocks on cancellation", func(t *testing.T) {
+		q := New()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := q.DequeueCtx(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		q.Enqueue(`test`, 1)
+		assert.Equal(t, 1, q.Len())
+	})
+
+	t.Run("many blocked consumers", func(t *testing.T) {
+		q := New()
+		var wg sync.WaitGroup
+		results := make(chan interface{}, N)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					data, err := q.DequeueCtx(context.Background())
+					assert.Equal(t, nil, err)
+					if data == -1 {
+						return
+					}
+					results <- data
+				}
+			}()
+		}
+		for i := 0; i < N; i++ {
+			q.Enqueue(i, 0)
+		}
+		for i := 0; i < 8; i++ {
+			q.Enqueue(-1, 1)
+		}
+		wg.Wait()
+		assert.Equal(t, N, len(results))
+	})
+}
+
+func TestClose(t *testing.T) {
+	t.Run("rejects enqueues and drains", func(t *testing.T) {
+		q := New()
+		assert.Equal(t, nil, q.Enqueue(`low`, 2))
+		assert.Equal(t, nil, q.Enqueue(`high`, 1))
+		q.Close()
+		q.Close()
+		assert.Equal(t, true, q.Closed())
+		assert.Equal(t, ErrQueueClosed, q.Enqueue(`late`, 0))
+		assert.Equal(t, ErrQueueClosed, q.TryEnqueue(`late`, 0))
+		assert.Equal(t, ErrQueueClosed, q.EnqueueBatch([]Task{{Data: `late`}}))
+		assert.Equal(t, ErrQueueClosed, q.EnqueueTTL(`late`, 0, time.Second))
+		assert.Equal(t, false, q.EnqueueCancelable(`late`, 0)())
+		assert.Equal(t, 2, q.Len())
+
+		data, err := q.Dequeue()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `high`, data)
+		data, err = q.DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `low`, data)
+		_, err = q.Dequeue()
+		assert.Equal(t, ErrQueueClosed, err)
+		_, err = q.DequeueCtx(context.Background())
+		assert.Equal(t, ErrQueueClosed, err)
+	})
+
+	t.Run("wakes blocked consumers", func(t *testing.T) {
+		q := New()
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			go func() {
+				_, err := q.DequeueCtx(context.Background())
+				errs <- err
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+		for i := 0; i < 8; i++ {
+			assert.Equal(t, ErrQueueClosed, <-errs)
+		}
+	})
+
+	t.Run("wakes blocked producers", func(t *testing.T) {
+		q := NewBoundedQueue(1)
+		q.Enqueue(`first`, 1)
+		errs := make(chan error)
+		go func() {
+			errs <- q.Enqueue(`second`, 1)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+		assert.Equal(t, ErrQueueClosed, <-errs)
+		assert.Equal(t, 1, q.Len())
+	})
+}
+
+func TestEnqueueCtx(t *testing.T) {
+	q := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	q.EnqueueCtx(ctx, `gone`, 1)
+	q.EnqueueBatch([]Task{{Data: `gone too`, Priority: 1, Ctx: ctx}})
+	q.EnqueueCtx(context.Background(), `kept`, 2)
+	assert.Equal(t, 3, q.Len())
+	cancel()
+	data, err := q.Dequeue()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `kept`, data)
+	assert.Equal(t, uint64(2), q.Stats().Cancelled())
+	assert.Equal(t, 0, q.Len())
+
+	t.Run("batches expire with the deadline", func(t *testing.T) {
+		q := New()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		q.EnqueueBatch([]Task{{Data: `late`, Priority: 1, Ctx: ctx}})
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 0, q.Len())
+		assert.Equal(t, uint64(1), q.Stats().Expired())
+	})
+}
+
+func TestEnqueueCancelable(t *testing.T) {
+	t.Run("cancelled items are skipped", func(t *testing.T) {
+		q := New()
+		cancelHigh := q.EnqueueCancelable(`high`, 1)
+		q.Enqueue(`low`, 2)
+		cancelLow := q.EnqueueCancelable(`lower`, 3)
+		assert.Equal(t, true, cancelHigh())
+		assert.Equal(t, false, cancelHigh())
+		assert.Equal(t, 2, q.Len())
+		data, _, _ := q.Peek()
+		assert.Equal(t, `low`, data)
+		data, _ = q.Dequeue()
+		assert.Equal(t, `low`, data)
+		data, _ = q.Dequeue()
+		assert.Equal(t, `lower`, data)
+		assert.Equal(t, false, cancelLow())
+		assert.Equal(t, true, q.Empty())
+	})
+
+	t.Run("background vacuum compacts the heap", func(t *testing.T) {
+		q := New()
+		cancels := make([]func() bool, 0, N)
+		for i := 0; i < N; i++ {
+			cancels = append(cancels, q.EnqueueCancelable(i, rand.Intn(20)))
+		}
+		for i := 0; i < N; i += 2 {
+			cancels[i]()
+		}
+		assert.Equal(t, N/2, q.Len())
+		assert.Eventually(t, func() bool {
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			return q.heap.Len() < N*3/4 && !q.vacuuming
+		}, time.Second, time.Millisecond)
+		for !q.Empty() {
+			data, err := q.Dequeue()
+			assert.Equal(t, nil, err)
+			assert.Equal(t, 1, data.(int)%2)
+		}
+	})
+}
+
+func TestReserve(t *testing.T) {
+	q := New()
+	q.Enqueue(`test`, 1)
+	q.Reserve(N)
+	assert.GreaterOrEqual(t, cap(*q.heap), N+1)
+	assert.Equal(t, 1, q.Len())
+	data, _ := q.Dequeue()
+	assert.Equal(t, `test`, data)
+}
+
+func TestEnqueueDeadline(t *testing.T) {
+	q, clock := mockNewQueueWithClock()
+	var expired []interface{}
+	WithOnExpire(func(data interface{}, priority int) {
+		expired = append(expired, data)
+		q.Enqueue(`requeued `+data.(string), priority) // callbacks may use the queue
+	})(q)
+
+	q.EnqueueDeadline(`a`, 1, clock.now().Add(15*time.Millisecond))
+	q.EnqueueDeadline(`b`, 2, clock.now().Add(time.Second))
+	q.Enqueue(`c`, 3)
+
+	// the timer wheel has not reached the deadline of a yet, but a
+	// must not be dequeued once its deadline has passed
+	clock.advance(15 * time.Millisecond)
+	data, err := q.DequeueCtx(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `b`, data)
+	assert.Equal(t, []interface{}{`a`}, expired)
+	assert.Equal(t, []interface{}{`requeued a`, `c`}, q.DequeueBatch(10))
+
+	q.EnqueueDeadline(`d`, 1, clock.now().Add(time.Second))
+	clock.advance(time.Second + defaultWheelTick)
+	assert.Equal(t, 0, q.Len()) // expired by the timer wheel
+	assert.Equal(t, []interface{}{`a`, `d`}, expired)
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, uint64(2), q.Stats().Expired())
+}
+
 func TestQueue(t *testing.T) {
 	t.Run("random priority, more enqueue than dequeue", func(t *testing.T) {
-		q := NewQueue()
+		q := New()
 		for i := 0; i < 10000; i++ {
 			if rand.Intn(3) != 0 { // enq with prob = 2/3
 				v := rand.Intn(20)
@@ -76,7 +735,7 @@ func TestQueue(t *testing.T) {
 	})
 
 	t.Run("random priority, more dequeue than enqueue", func(t *testing.T) {
-		q := NewQueue()
+		q := New()
 		for i := 0; i < 10000; i++ {
 			if rand.Intn(3) == 0 { // enq with prob = 1/3
 				v := rand.Intn(20)
@@ -92,7 +751,7 @@ func TestQueue(t *testing.T) {
 	})
 
 	t.Run("equal priority, test enqueue sequence", func(t *testing.T) {
-		q := NewQueue()
+		q := New()
 		for i := 0; i < 10000; i++ {
 			if rand.Intn(3) == 0 { // enq with prob = 1/3
 				q.Enqueue(time.Now().UnixNano(), 20)
@@ -125,7 +784,7 @@ func TestQueue(t *testing.T) {
 func BenchmarkQueue(b *testing.B) {
 	b.Run("priority queue, equal priority", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			q := NewQueue()
+			q := New()
 			var wg sync.WaitGroup
 			wg.Add(1)
 			i := 0
@@ -152,7 +811,7 @@ func BenchmarkQueue(b *testing.B) {
 
 	b.Run("priority queue, random priority", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			q := NewQueue()
+			q := New()
 			var wg sync.WaitGroup
 			wg.Add(1)
 			i := 0
@@ -200,6 +859,55 @@ func BenchmarkQueue(b *testing.B) {
 	})
 }
 
+func BenchmarkEnqueueBatch(b *testing.B) {
+	tasks := make([]Task, N)
+	for i := range tasks {
+		tasks[i] = Task{Data: `test`, Priority: rand.Intn(20)}
+	}
+
+	b.Run("enqueue one by one", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q := New()
+			for j := range tasks {
+				q.Enqueue(tasks[j].Data, tasks[j].Priority)
+			}
+		}
+	})
+
+	b.Run("enqueue batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q := New()
+			q.EnqueueBatch(tasks)
+		}
+	})
+}
+
+func BenchmarkDequeueBatch(b *testing.B) {
+	b.Run("dequeue one by one", func(b *testing.B) {
+		q := New()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < N; j++ {
+				q.Enqueue(`test`, rand.Intn(20))
+			}
+			for !q.Empty() {
+				_, _ = q.Dequeue()
+			}
+		}
+	})
+
+	b.Run("dequeue batch", func(b *testing.B) {
+		q := New()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < N; j++ {
+				q.Enqueue(`test`, rand.Intn(20))
+			}
+			for !q.Empty() {
+				_ = q.DequeueBatch(32)
+			}
+		}
+	})
+}
+
 func TestDecorateChannel(t *testing.T) {
 	t.Run("enqueue-dequeue test", func(t *testing.T) {
 		N := 100
@@ -240,6 +948,12 @@ func TestDecorateChannel(t *testing.T) {
 					Priority: v,
 				}
 			}
+			// the sentinel is received only after the previous task has been
+			// enqueued, and it has the lowest priority so it comes out last
+			inChan <- &Task{
+				Data:     math.MaxInt32,
+				Priority: math.MaxInt32,
+			}
 			blocker <- true
 		}()
 		<-blocker // wait until all items are enqueued
@@ -248,10 +962,12 @@ func TestDecorateChannel(t *testing.T) {
 			data := <-outChan
 			localArr = append(localArr, data)
 			i++
-			if i == N {
+			if i == N+1 {
 				break
 			}
 		}
+		assert.Equal(t, math.MaxInt32, localArr[N])
+		localArr = localArr[:N]
 		for i := 0; i < 20; i++ {
 			fmt.Printf("%v ", localArr[i])
 		}
@@ -261,6 +977,160 @@ func TestDecorateChannel(t *testing.T) {
 		fmt.Println()
 		isAscending(t, localArr[1:]) // first item is taken and blocked immediately when it's enqueued
 	})
+
+	t.Run("closing input closes output", func(t *testing.T) {
+		inChan := make(chan *Task, N)
+		for i := 0; i < N; i++ {
+			inChan <- &Task{Data: i, Priority: i}
+		}
+		close(inChan)
+		var localArr []interface{}
+		for data := range DecorateChannel(inChan) {
+			localArr = append(localArr, data)
+		}
+		assert.Equal(t, N, len(localArr))
+	})
+}
+
+func TestDecorateChannelErrors(t *testing.T) {
+	inChan := make(chan *Task)
+	errs := make(chan error, 1)
+	outChan := Decorate(inChan, WithErrorHandler(func(err error) {
+		errs <- err
+	}))
+	inChan <- nil
+	inChan <- &Task{Data: `test`, Priority: 1}
+	close(inChan)
+	assert.Equal(t, `decorated channel: nil task`, (<-errs).Error())
+	assert.Equal(t, `test`, <-outChan)
+	_, ok := <-outChan
+	assert.Equal(t, false, ok)
+}
+
+func TestDecorateTasks(t *testing.T) {
+	inChan := make(chan *Task, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	type key struct{}
+	live := context.WithValue(context.Background(), key{}, `live`)
+	inChan <- &Task{Data: `cancelled`, Priority: 0, Ctx: ctx}
+	inChan <- &Task{Data: `live`, Priority: 1, Ctx: live}
+	inChan <- &Task{Data: `plain`, Priority: 2}
+	close(inChan)
+	var tasks []*Task
+	for task := range DecorateTasks(context.Background(), inChan, 0) {
+		tasks = append(tasks, task)
+	}
+	assert.Equal(t, 2, len(tasks))
+	assert.Equal(t, `live`, tasks[0].Data)
+	assert.Equal(t, `live`, tasks[0].Ctx.Value(key{}))
+	assert.Equal(t, `plain`, tasks[1].Data)
+	assert.Nil(t, tasks[1].Ctx)
+}
+
+func TestDecorateChannelCtx(t *testing.T) {
+	t.Run("buffered output in priority order", func(t *testing.T) {
+		inChan := make(chan *Task, N)
+		for i := N - 1; i >= 0; i-- {
+			inChan <- &Task{Data: i, Priority: i}
+		}
+		close(inChan)
+		outChan := DecorateChannelCtx(context.Background(), inChan, 8)
+		n := 0
+		for range outChan {
+			n++
+		}
+		assert.Equal(t, N, n)
+	})
+
+	t.Run("exits on cancellation", func(t *testing.T) {
+		inChan := make(chan *Task)
+		ctx, cancel := context.WithCancel(context.Background())
+		outChan := DecorateChannelCtx(ctx, inChan, 0)
+		for i := 0; i < 8; i++ {
+			inChan <- &Task{Data: i, Priority: i}
+		}
+		cancel()
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case _, ok := <-outChan:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Fatal("output channel not closed")
+			}
+		}
+	})
+}
+
+func TestSlowConsumer(t *testing.T) {
+	t.Run("drop oldest", func(t *testing.T) {
+		inChan := make(chan *Task)
+		stalls := make(chan struct{}, 1)
+		errs := make(chan error, 1)
+		outChan := DecorateChannelCtx(context.Background(), inChan, 1,
+			WithSlowConsumer(10*time.Millisecond, SlowConsumerDropOldest, func() { stalls <- struct{}{} }),
+			WithErrorHandler(func(err error) { errs <- err }))
+		inChan <- &Task{Data: `old`, Priority: 1}
+		inChan <- &Task{Data: `new`, Priority: 1}
+		<-stalls
+		assert.ErrorIs(t, <-errs, ErrQueueFull)
+		assert.Equal(t, `new`, <-outChan)
+		close(inChan)
+		_, ok := <-outChan
+		assert.False(t, ok)
+	})
+
+	t.Run("pause", func(t *testing.T) {
+		inChan := make(chan *Task)
+		stalls := make(chan struct{}, 1)
+		outChan := DecorateChannelCtx(context.Background(), inChan, 0,
+			WithSlowConsumer(10*time.Millisecond, SlowConsumerPause, func() { stalls <- struct{}{} }))
+		inChan <- &Task{Data: 1, Priority: 1}
+		<-stalls
+		select {
+		case inChan <- &Task{Data: 2, Priority: 2}:
+			t.Fatal("input read while paused")
+		case <-time.After(50 * time.Millisecond):
+		}
+		assert.Equal(t, 1, <-outChan)
+		inChan <- &Task{Data: 2, Priority: 2}
+		assert.Equal(t, 2, <-outChan)
+		close(inChan)
+	})
+}
+
+func TestDecorateChannelRate(t *testing.T) {
+	inChan := make(chan *Task)
+	outChan := DecorateChannelCtx(context.Background(), inChan, 0, WithRate(20, 1))
+	start := time.Now()
+	inChan <- &Task{Data: `first`, Priority: 3}
+	assert.Equal(t, `first`, <-outChan)
+	inChan <- &Task{Data: `low`, Priority: 2}
+	inChan <- &Task{Data: `high`, Priority: 1}
+	assert.Equal(t, `high`, <-outChan, "reordered while waiting for a token")
+	assert.Equal(t, `low`, <-outChan)
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	close(inChan)
+	_, ok := <-outChan
+	assert.False(t, ok)
+}
+
+func TestDecorateChannelOf(t *testing.T) {
+	type request struct{ id int }
+	in := make(chan TaskOf[*request], N)
+	for i := 0; i < N; i++ {
+		in <- TaskOf[*request]{Data: &request{id: i}, Priority: i}
+	}
+	close(in)
+	var ids []interface{}
+	for req := range DecorateChannelOf(in) {
+		ids = append(ids, req.id)
+	}
+	assert.Equal(t, N, len(ids))
+	isAscending(t, ids)
 }
 
 // go test -v -race -cover
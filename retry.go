@@ -0,0 +1,78 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy tells how data whose handler returned an error is retried
+// by Dispatch: it is enqueued again, with its priority, after an
+// exponential backoff, until it was attempted MaxAttempts times. Then it
+// goes to the dead-letter queue, if any. Retries are also denied by the
+// retry budget of the queue, see WithRetryBudget.
+type RetryPolicy struct {
+	MaxAttempts int           // in total, so 0 or 1 means no retry
+	Backoff     time.Duration // before the first retry
+	MaxBackoff  time.Duration // if not zero, caps the backoff
+	Multiplier  float64       // growth of the backoff, 2 if zero
+	// Jitter is the fraction of the backoff that is random, from 0 to 1,
+	// so that the retries of simultaneous failures spread out.
+	Jitter float64
+}
+
+// backoff returns the delay before the retry following the given number
+// of failed attempts.
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	d := float64(p.Backoff) * math.Pow(multiplier, float64(attempts-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	d -= d * p.Jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// WithRetryPolicy sets the retry policy of the data enqueued without
+// one, see EnqueueWithRetry. There are no retries by default.
+func WithRetryPolicy(policy RetryPolicy) DispatchOption {
+	return func(c *dispatchConfig) {
+		c.retry = &policy
+	}
+}
+
+// EnqueueWithRetry puts the data into the priority queue like Enqueue,
+// with its own retry policy, which takes precedence over the one given
+// to Dispatch.
+func (q *Queue) EnqueueWithRetry(data interface{}, priority int, policy RetryPolicy) error {
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return err
+	}
+	e.retry = &policy
+	_, err = q.enqueueEntry(e, true)
+	return err
+}
+
+// retry enqueues the failed entry again after its backoff, if policy
+// allows it, and reports whether it did. The attempts, context and
+// deadline of the entry travel with it.
+func (q *Queue) retry(e *entry, policy *RetryPolicy) bool {
+	attempts := e.attempts + 1
+	if policy == nil || attempts >= policy.MaxAttempts || !q.AllowRetry() {
+		return false
+	}
+	r := newEntry(e.data, e.Priority)
+	r.Key, r.deadline, r.ctx = e.Key, e.deadline, e.ctx
+	r.retry, r.attempts, r.extra = e.retry, attempts, true
+	if e.group != nil && e.group.ack {
+		r.group = e.group // still pending
+	}
+	return q.enqueueAt(r, q.now().Add(policy.backoff(attempts)), true) == nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Run("exponential backoff", func(t *testing.T) {
+		p := &RetryPolicy{Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+		assert.Equal(t, time.Millisecond, p.backoff(1))
+		assert.Equal(t, 2*time.Millisecond, p.backoff(2))
+		assert.Equal(t, 4*time.Millisecond, p.backoff(3))
+		assert.Equal(t, 5*time.Millisecond, p.backoff(4))
+		p.Jitter = 0.5
+		for i := 0; i < 100; i++ {
+			d := p.backoff(2)
+			assert.GreaterOrEqual(t, int64(d), int64(time.Millisecond))
+			assert.LessOrEqual(t, int64(d), int64(2*time.Millisecond))
+		}
+	})
+
+	t.Run("retried, then dead-lettered", func(t *testing.T) {
+		q := New()
+		dlq := New()
+		var lock sync.Mutex
+		attempts := map[interface{}]int{}
+		failure := errors.New("failure")
+		q.Enqueue(`flaky`, 1)
+		q.Enqueue(`broken`, 1)
+		q.EnqueueWithRetry(`once`, 1, RetryPolicy{MaxAttempts: 1})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			q.Dispatch(ctx, 2, func(data interface{}) error {
+				lock.Lock()
+				defer lock.Unlock()
+				attempts[data]++
+				if data == `broken` || data == `once` || attempts[data] < 3 {
+					return failure
+				}
+				return nil
+			}, WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}), WithDeadLetter(dlq))
+			close(done)
+		}()
+		assert.Eventually(t, func() bool { return dlq.Len() == 2 }, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		assert.Equal(t, map[interface{}]int{`flaky`: 3, `broken`: 3, `once`: 1}, attempts)
+		letters := map[interface{}]int{}
+		for _, data := range dlq.DequeueBatch(2) {
+			letter := data.(*DeadLetter)
+			assert.Equal(t, failure, letter.Err)
+			letters[letter.Data] = letter.Attempts
+		}
+		assert.Equal(t, map[interface{}]int{`broken`: 3, `once`: 1}, letters)
+	})
+
+	t.Run("denied by the retry budget", func(t *testing.T) {
+		q := New(WithRetryBudget(0, 0))
+		dlq := New()
+		q.Enqueue(`broken`, 1)
+		q.Close()
+		q.Dispatch(context.Background(), 1, func(data interface{}) error {
+			return errors.New("failure")
+		}, WithRetryPolicy(RetryPolicy{MaxAttempts: 3}), WithDeadLetter(dlq))
+		assert.Equal(t, 1, dlq.Len())
+		assert.Equal(t, uint64(1), q.Stats().Throttled())
+	})
+
+	t.Run("futures resolved after the last attempt", func(t *testing.T) {
+		q := New()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		calls := 0
+		go q.Serve(ctx, 1, func(ctx context.Context, data interface{}) (interface{}, error) {
+			calls++
+			if calls < 2 {
+				return nil, errors.New("failure")
+			}
+			return calls, nil
+		}, WithRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+		result, err := q.Submit(context.Background(), `test`, 1)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 2, result)
+	})
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "context"
+
+// Gathered holds the outcome of ScatterGather.
+type Gathered struct {
+	// Responses holds the responses of the tasks, by index. Those of the
+	// missed tasks are zero.
+	Responses []Response
+	// Missed holds the indexes of the tasks without response in time.
+	Missed []int
+}
+
+// ScatterGather enqueues the tasks as one group, waits for their
+// results until ctx is done, e.g. at a deadline, and returns whatever
+// results arrived in time, and which tasks were missed, for instance
+// to serve the members of a model ensemble that answered. The tasks are
+// processed by Serve, like the data of Submit. The missed tasks that are
+// still queued are then discarded, as with EnqueueCtx.
+func (q *Queue) ScatterGather(ctx context.Context, tasks []Task) Gathered {
+	scatterCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	g := NewAckGroup(q)
+	futures := make([]*Future, len(tasks))
+	for i, task := range tasks {
+		taskCtx := scatterCtx
+		if task.Ctx != nil {
+			taskCtx = task.Ctx
+		}
+		futures[i] = g.enqueueFuture(taskCtx, task.Data, task.Priority)
+	}
+	g.Wait(ctx)
+
+	gathered := Gathered{Responses: make([]Response, len(tasks))}
+	for i, f := range futures {
+		select {
+		case <-f.Done():
+			gathered.Responses[i] = Response{Result: f.result, Err: f.err}
+		default:
+			gathered.Missed = append(gathered.Missed, i)
+		}
+	}
+	return gathered
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScatterGather(t *testing.T) {
+	q := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	go q.Serve(ctx, 1, func(ctx context.Context, data interface{}) (interface{}, error) {
+		switch data {
+		case `slow`:
+			<-release
+		case `fail`:
+			return nil, errors.New("failure")
+		}
+		return data, nil
+	})
+
+	gatherCtx, gatherCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer gatherCancel()
+	gathered := q.ScatterGather(gatherCtx, []Task{
+		{Data: `fast`, Priority: 1},
+		{Data: `fail`, Priority: 2},
+		{Data: `slow`, Priority: 3},
+		{Data: `starved`, Priority: 4},
+	})
+	close(release)
+	assert.Equal(t, Response{Result: `fast`}, gathered.Responses[0])
+	assert.EqualError(t, gathered.Responses[1].Err, "failure")
+	assert.Equal(t, []int{2, 3}, gathered.Missed)
+	_, ok := q.TryDequeue()
+	assert.Equal(t, false, ok, "starved task discarded")
+
+	all := q.ScatterGather(context.Background(), []Task{{Data: 1}, {Data: 2}})
+	assert.Equal(t, []Response{{Result: 1}, {Result: 2}}, all.Responses)
+	assert.Empty(t, all.Missed)
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync"
+	"time"
+)
+
+// Schedule enqueues the data every interval, e.g. for periodic
+// maintenance tasks, until cancel is called or the queue is closed. The
+// first enqueue happens one interval from now. Intervals are measured
+// with the clock of the queue, see WithClock.
+func (q *Queue) Schedule(data interface{}, priority int, every time.Duration) (cancel func()) {
+	stop := make(chan struct{})
+	var once sync.Once
+	go func() {
+		for {
+			select {
+			case <-q.clock.After(every):
+				select {
+				case <-stop: // cancelled meanwhile
+					return
+				default:
+				}
+				if err := q.Enqueue(data, priority); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	q, clock := mockNewQueueWithClock()
+	cancel := q.Schedule(`tick`, 1, time.Minute)
+	waiting := func() bool { return clock.waiting() == 1 }
+
+	assert.Eventually(t, waiting, time.Second, time.Millisecond)
+	clock.advance(59 * time.Second)
+	assert.Equal(t, 0, q.Len())
+	clock.advance(time.Second)
+	assert.Eventually(t, func() bool { return q.Len() == 1 }, time.Second, time.Millisecond)
+
+	assert.Eventually(t, waiting, time.Second, time.Millisecond)
+	clock.advance(time.Minute)
+	assert.Eventually(t, func() bool { return q.Len() == 2 }, time.Second, time.Millisecond)
+
+	assert.Eventually(t, waiting, time.Second, time.Millisecond)
+	cancel()
+	cancel()
+	clock.advance(time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 2, q.Len())
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// PrioritySemaphore bounds the access to a scarce resource, such as
+// database connections or GPU memory, handing released permits to the
+// waiter with the lowest priority value first, and in FIFO order among
+// equal priorities.
+type PrioritySemaphore struct {
+	lock    sync.Mutex
+	permits int
+	waiters heap.ItemHeap // of chan struct{}, closed once granted
+	count   uint64
+}
+
+// NewPrioritySemaphore is the constructor of PrioritySemaphore, with n
+// permits.
+func NewPrioritySemaphore(n int) *PrioritySemaphore {
+	return &PrioritySemaphore{
+		permits: n,
+		waiters: heap.NewHeap(),
+	}
+}
+
+// Acquire takes a permit, blocking until one is available to the given
+// priority or until ctx is done, in which case it returns ctx.Err() and
+// takes no permit.
+func (s *PrioritySemaphore) Acquire(ctx context.Context, priority int) error {
+	s.lock.Lock()
+	if s.permits > 0 && s.waiters.Empty() {
+		s.permits--
+		s.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.count++
+	item := heap.NewItem(ready, priority, heap.WithOrder(s.count))
+	s.waiters.Push(item)
+	s.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		if item.Index() > 0 {
+			s.waiters.Remove(item.Index())
+			s.lock.Unlock()
+		} else { // granted meanwhile
+			s.lock.Unlock()
+			s.Release()
+		}
+		return ctx.Err()
+	}
+}
+
+// TryAcquire takes a permit if one is available without waiting, and
+// reports whether it did.
+func (s *PrioritySemaphore) TryAcquire() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.permits > 0 && s.waiters.Empty() {
+		s.permits--
+		return true
+	}
+	return false
+}
+
+// Release returns a permit, which goes to the first waiter if any.
+func (s *PrioritySemaphore) Release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if x := s.waiters.Pop(); x != nil {
+		close(x.(*heap.Item).GetData().(chan struct{}))
+		return
+	}
+	s.permits++
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrioritySemaphore(t *testing.T) {
+	t.Run("permits", func(t *testing.T) {
+		s := NewPrioritySemaphore(2)
+		assert.Equal(t, nil, s.Acquire(context.Background(), 1))
+		assert.Equal(t, true, s.TryAcquire())
+		assert.Equal(t, false, s.TryAcquire())
+		s.Release()
+		assert.Equal(t, true, s.TryAcquire())
+	})
+
+	t.Run("priority order, then FIFO", func(t *testing.T) {
+		s := NewPrioritySemaphore(1)
+		s.Acquire(context.Background(), 0)
+		var lock sync.Mutex
+		var order []string
+		var wg sync.WaitGroup
+		waiting := 0
+		acquire := func(name string, priority int) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Acquire(context.Background(), priority)
+				lock.Lock()
+				order = append(order, name)
+				lock.Unlock()
+				s.Release()
+			}()
+			waiting++
+			assert.Eventually(t, func() bool {
+				s.lock.Lock()
+				defer s.lock.Unlock()
+				return s.waiters.Len() == waiting
+			}, time.Second, time.Millisecond)
+		}
+		acquire(`low`, 2)
+		acquire(`high 1`, 1)
+		acquire(`high 2`, 1)
+		s.Release()
+		wg.Wait()
+		assert.Equal(t, []string{`high 1`, `high 2`, `low`}, order)
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		s := NewPrioritySemaphore(1)
+		s.Acquire(context.Background(), 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, s.Acquire(ctx, 1))
+		assert.Equal(t, 0, s.waiters.Len())
+		s.Release()
+		assert.Equal(t, true, s.TryAcquire())
+	})
+}
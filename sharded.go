@@ -0,0 +1,288 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"hash/fnv"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedQueue partitions items across several Queues, each with its own
+// lock, to reduce contention when there are many producers and
+// consumers. Items are ordered by priority within a shard only, so the
+// global order is approximate.
+type ShardedQueue struct {
+	set      atomic.Value // *shardSet
+	next     uint32
+	opts     []Option
+	adaptive AdaptiveConfig
+	lock     sync.Mutex // serializes resizing
+	waits    map[*Queue]LockStats
+	// notify is closed to wake the idle consumers blocked in DequeueCtx
+	notifyLock sync.Mutex
+	notify     chan struct{}
+	idle       int32
+}
+
+// shardSet is replaced as a whole when the shard count changes. Only the
+// first active shards receive new items; the others are retired, but
+// remain in the set so that their items can still be dequeued.
+type shardSet struct {
+	shards []*Queue
+	active int
+}
+
+// NewShardedQueue returns a ShardedQueue with n shards built with opts.
+// If n is not positive, there is one shard per GOMAXPROCS.
+func NewShardedQueue(n int, opts ...Option) *ShardedQueue {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	s := &ShardedQueue{opts: opts}
+	set := &shardSet{shards: make([]*Queue, n), active: n}
+	for i := range set.shards {
+		set.shards[i] = New(opts...)
+	}
+	s.set.Store(set)
+	return s
+}
+
+func (s *ShardedQueue) load() *shardSet {
+	return s.set.Load().(*shardSet)
+}
+
+// NumShards returns the number of shards receiving new items.
+func (s *ShardedQueue) NumShards() int {
+	return s.load().active
+}
+
+// Enqueue puts the data into a shard chosen round-robin. It returns
+// ErrQueueClosed if the queue is closed.
+func (s *ShardedQueue) Enqueue(data interface{}, priority int) error {
+	set := s.load()
+	i := atomic.AddUint32(&s.next, 1) % uint32(set.active)
+	err := set.shards[i].Enqueue(data, priority)
+	s.wake()
+	return err
+}
+
+// EnqueueKey puts the data into the shard chosen by a hash of key, e.g.
+// the id of the producer, so that the items of a producer stay in FIFO
+// order within their priority. It returns ErrQueueClosed if the queue
+// is closed.
+func (s *ShardedQueue) EnqueueKey(key string, data interface{}, priority int) error {
+	set := s.load()
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	err := set.shards[h.Sum32()%uint32(set.active)].Enqueue(data, priority)
+	s.wake()
+	return err
+}
+
+// Dequeue gets & removes the data with highest priority from the first
+// non-empty shard, starting from a shard chosen round-robin.
+func (s *ShardedQueue) Dequeue() (interface{}, error) {
+	set := s.load()
+	start := int(atomic.AddUint32(&s.next, 1) % uint32(len(set.shards)))
+	if data, ok := set.steal(start); ok {
+		return data, nil
+	}
+	if set.shards[0].Closed() {
+		return nil, ErrQueueClosed
+	}
+	return nil, ErrQueueEmpty
+}
+
+// DequeueMerged gets & removes the data with highest priority among the
+// heads of the shards, as a single queue would, at the cost of peeking
+// at every shard. If another consumer takes that head first, the next
+// item of the same shard is returned instead.
+func (s *ShardedQueue) DequeueMerged() (interface{}, error) {
+	set := s.load()
+	if best, _ := set.head(); best >= 0 {
+		if data, ok := set.steal(best); ok {
+			return data, nil
+		}
+	}
+	if set.shards[0].Closed() {
+		return nil, ErrQueueClosed
+	}
+	return nil, ErrQueueEmpty
+}
+
+// Peek gets the data with highest priority among the heads of the
+// shards, and its priority value, without removing it. Equal priorities
+// of different shards are not ordered.
+func (s *ShardedQueue) Peek() (interface{}, int, error) {
+	_, head := s.load().head()
+	if head == nil {
+		return nil, 0, ErrQueueEmpty
+	}
+	return head.data, head.Priority, nil
+}
+
+// Close closes all the shards, see Queue.Close.
+func (s *ShardedQueue) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, shard := range s.load().shards {
+		shard.Close()
+	}
+	s.broadcast()
+}
+
+// Len returns the total size of the shards.
+func (s *ShardedQueue) Len() int {
+	n := 0
+	for _, shard := range s.load().shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+// Consumer returns the consumer with the given id. Consumers with the
+// same id always share the same home shard, so that a worker goroutine
+// keeps hitting the same lock and memory, which helps the runtime keep
+// them local to one P. With as many workers as shards, each worker has
+// a shard of its own.
+func (s *ShardedQueue) Consumer(id int) *ShardConsumer {
+	if id < 0 {
+		id = -id
+	}
+	return &ShardConsumer{s: s, id: id}
+}
+
+// head returns the index of the shard whose head is dequeued first, in
+// the order of the shards, and a copy of that head. The index is -1 if
+// all the shards are empty.
+func (set *shardSet) head() (int, *entry) {
+	best, head := -1, (*entry)(nil)
+	for i, shard := range set.shards {
+		if e := shard.head(); e != nil && (head == nil || shard.before(e, head)) {
+			best, head = i, e
+		}
+	}
+	return best, head
+}
+
+// head returns a copy of the entry that Peek would return, or nil if the
+// queue is empty, to compare it with the heads of other queues.
+func (q *Queue) head() *entry {
+	q.lock.Lock()
+	defer q.unlock()
+	q.expire()
+	e := q.peek()
+	if e == nil {
+		return nil
+	}
+	c := *e
+	c.Item.Data = &c
+	return &c
+}
+
+// before reports whether the entry a is dequeued before b in the order
+// of the queue, e.g. WithMaxFirst or WithLessFunc.
+func (q *Queue) before(a, b *entry) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.heap.Before(&a.Item, &b.Item)
+}
+
+func (set *shardSet) steal(start int) (interface{}, bool) {
+	for i := 0; i < len(set.shards); i++ {
+		if data, ok := set.shards[(start+i)%len(set.shards)].TryDequeue(); ok {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// ShardConsumer dequeues from its home shard first, and steals from the
+// other shards when the home shard is empty.
+type ShardConsumer struct {
+	s  *ShardedQueue
+	id int
+}
+
+// Home returns the index of the home shard of the consumer. It only
+// changes when the number of shards does.
+func (c *ShardConsumer) Home() int {
+	return c.id % c.s.load().active
+}
+
+// Enqueue puts the data into the home shard, for workers that produce
+// follow-up items.
+func (c *ShardConsumer) Enqueue(data interface{}, priority int) error {
+	set := c.s.load()
+	err := set.shards[c.id%set.active].Enqueue(data, priority)
+	c.s.wake()
+	return err
+}
+
+// TryDequeue gets & removes data from the home shard, or from another
+// shard if the home shard is empty. ok is false if all are empty.
+func (c *ShardConsumer) TryDequeue() (data interface{}, ok bool) {
+	set := c.s.load()
+	return set.steal(c.id % set.active)
+}
+
+// DequeueCtx is like TryDequeue, but blocks until an item is available
+// or ctx is done. It returns ErrQueueClosed once the queue is closed and
+// all the shards are drained.
+func (c *ShardConsumer) DequeueCtx(ctx context.Context) (interface{}, error) {
+	for {
+		if data, ok := c.TryDequeue(); ok {
+			return data, nil
+		}
+		notify := c.s.wait()
+		closed := c.s.load().shards[0].Closed()
+		data, ok := c.TryDequeue() // enqueued before the wait
+		if ok || closed {
+			atomic.AddInt32(&c.s.idle, -1)
+			if !ok {
+				return nil, ErrQueueClosed
+			}
+			return data, nil
+		}
+		select {
+		case <-notify:
+			atomic.AddInt32(&c.s.idle, -1)
+		case <-ctx.Done():
+			atomic.AddInt32(&c.s.idle, -1)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// wait counts an idle consumer, which must be uncounted once woken, and
+// returns the channel that wakes it.
+func (s *ShardedQueue) wait() <-chan struct{} {
+	atomic.AddInt32(&s.idle, 1)
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	if s.notify == nil {
+		s.notify = make(chan struct{})
+	}
+	return s.notify
+}
+
+// wake wakes the idle consumers, if any, after an enqueue, so that the
+// producers don't take the lock of the notify channel otherwise.
+func (s *ShardedQueue) wake() {
+	if atomic.LoadInt32(&s.idle) > 0 {
+		s.broadcast()
+	}
+}
+
+// broadcast wakes all the consumers blocked in DequeueCtx.
+func (s *ShardedQueue) broadcast() {
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	if s.notify != nil {
+		close(s.notify)
+		s.notify = nil
+	}
+}
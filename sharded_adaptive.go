@@ -0,0 +1,139 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"runtime"
+	"time"
+)
+
+// AdaptiveConfig tunes how an adaptive ShardedQueue resizes itself.
+// Zero fields take default values.
+type AdaptiveConfig struct {
+	MinShards int // default 1
+	MaxShards int // default 4 * GOMAXPROCS
+	// Interval is the period of the resizing decisions. Default 1s.
+	Interval time.Duration
+	// A shard is added when the mean lock wait per acquisition over the
+	// last interval is above GrowAbove (default 10µs), and one is
+	// retired when it is below ShrinkBelow (default 1µs).
+	GrowAbove   time.Duration
+	ShrinkBelow time.Duration
+	// MigrateBatch is the number of items moved out of each retired
+	// shard per interval. Default 1024.
+	MigrateBatch int
+}
+
+// NewAdaptiveShardedQueue returns a ShardedQueue which starts with
+// cfg.MinShards shards and grows or shrinks according to the observed
+// lock contention once Adapt is running. The shards are built with opts
+// and an InstrumentedMutex.
+func NewAdaptiveShardedQueue(cfg AdaptiveConfig, opts ...Option) *ShardedQueue {
+	if cfg.MinShards <= 0 {
+		cfg.MinShards = 1
+	}
+	if cfg.MaxShards <= 0 {
+		cfg.MaxShards = 4 * runtime.GOMAXPROCS(0)
+	}
+	if cfg.MaxShards < cfg.MinShards {
+		cfg.MaxShards = cfg.MinShards
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.GrowAbove <= 0 {
+		cfg.GrowAbove = 10 * time.Microsecond
+	}
+	if cfg.ShrinkBelow <= 0 {
+		cfg.ShrinkBelow = time.Microsecond
+	}
+	if cfg.MigrateBatch <= 0 {
+		cfg.MigrateBatch = 1024
+	}
+	s := NewShardedQueue(cfg.MinShards, instrumented(opts)...)
+	s.adaptive = cfg
+	s.waits = make(map[*Queue]LockStats)
+	return s
+}
+
+// instrumented appends the instrumented lock to the shard options.
+func instrumented(opts []Option) []Option {
+	return append(append([]Option(nil), opts...), func(q *Queue) {
+		q.lock = &InstrumentedMutex{}
+	})
+}
+
+// Adapt resizes the queue every interval until ctx is done. Retired
+// shards stop receiving items and are drained gradually into the
+// active ones. It is a no-op for queues that are not adaptive.
+func (s *ShardedQueue) Adapt(ctx context.Context) {
+	if s.waits == nil {
+		return
+	}
+	ticker := time.NewTicker(s.adaptive.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.adjust()
+		}
+	}
+}
+
+// adjust makes one resizing decision and migrates items out of the
+// retired shards.
+func (s *ShardedQueue) adjust() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	set := s.load()
+	if set.shards[0].Closed() {
+		return // retired shards keep their items, which can be stolen
+	}
+	var wait time.Duration
+	var acquisitions uint64
+	for _, shard := range set.shards[:set.active] {
+		stats := shard.lock.(*InstrumentedMutex).Stats()
+		last := s.waits[shard]
+		wait += stats.WaitTime - last.WaitTime
+		acquisitions += stats.Acquisitions - last.Acquisitions
+	}
+	for _, shard := range set.shards {
+		s.waits[shard] = shard.lock.(*InstrumentedMutex).Stats()
+	}
+	if acquisitions > 0 {
+		mean := wait / time.Duration(acquisitions)
+		switch {
+		case mean > s.adaptive.GrowAbove && set.active < s.adaptive.MaxShards:
+			grown := &shardSet{shards: set.shards, active: set.active + 1}
+			if len(set.shards) == set.active {
+				grown.shards = append(append([]*Queue(nil), set.shards...), New(s.opts...))
+			}
+			set = grown
+		case mean < s.adaptive.ShrinkBelow && set.active > s.adaptive.MinShards:
+			set = &shardSet{shards: set.shards, active: set.active - 1}
+		}
+		s.set.Store(set)
+	}
+	for i, shard := range set.shards[set.active:] {
+		migrate(shard, set.shards[i%set.active], s.adaptive.MigrateBatch)
+	}
+}
+
+// migrate moves up to max entries from the retired shard into the
+// active one, without waiting for room: if the active shard is full, the
+// rest is put back, to move at a later interval.
+func migrate(retired, active *Queue, max int) {
+	entries := retired.detach(max)
+	for i, e := range entries {
+		if active.attach(e, false) == nil {
+			continue
+		}
+		for _, e := range entries[i:] {
+			retired.attach(e, false)
+		}
+		return
+	}
+}
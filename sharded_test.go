@@ -0,0 +1,321 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedQueue(t *testing.T) {
+	t.Run("shard count defaults to GOMAXPROCS", func(t *testing.T) {
+		s := NewShardedQueue(0)
+		assert.Equal(t, runtime.GOMAXPROCS(0), s.NumShards())
+	})
+
+	t.Run("consistent consumer mapping", func(t *testing.T) {
+		s := NewShardedQueue(4)
+		assert.Equal(t, s.Consumer(6).Home(), s.Consumer(6).Home())
+		assert.Equal(t, 2, s.Consumer(6).Home())
+		c := s.Consumer(1)
+		c.Enqueue(`low`, 2)
+		c.Enqueue(`high`, 1)
+		assert.Equal(t, 2, s.load().shards[1].Len())
+		data, ok := c.TryDequeue()
+		assert.Equal(t, true, ok)
+		assert.Equal(t, `high`, data)
+	})
+
+	t.Run("consumers steal from other shards", func(t *testing.T) {
+		s := NewShardedQueue(4)
+		s.Consumer(3).Enqueue(`test`, 1)
+		data, err := s.Consumer(0).DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `test`, data)
+		_, err = s.Dequeue()
+		assert.NotEqual(t, nil, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		_, err = s.Consumer(0).DequeueCtx(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("producers hashed to a shard", func(t *testing.T) {
+		s := NewShardedQueue(4)
+		for i := 0; i < 8; i++ {
+			s.EnqueueKey(`producer`, i, 1)
+		}
+		shards := 0
+		for _, shard := range s.load().shards {
+			if shard.Len() > 0 {
+				shards++
+				for i := 0; i < 8; i++ {
+					data, _ := shard.Dequeue()
+					assert.Equal(t, i, data)
+				}
+			}
+		}
+		assert.Equal(t, 1, shards)
+	})
+
+	t.Run("merged dequeue in global order", func(t *testing.T) {
+		s := NewShardedQueue(4)
+		for i := 0; i < 16; i++ {
+			s.Enqueue(15-i, 15-i)
+		}
+		for i := 0; i < 16; i++ {
+			data, err := s.DequeueMerged()
+			assert.Equal(t, nil, err)
+			assert.Equal(t, i, data)
+		}
+		_, err := s.DequeueMerged()
+		assert.Equal(t, ErrQueueEmpty, err)
+		s.Close()
+		_, err = s.DequeueMerged()
+		assert.Equal(t, ErrQueueClosed, err)
+	})
+
+	t.Run("merged dequeue in the order of the shards", func(t *testing.T) {
+		s := NewShardedQueue(4, WithMaxFirst())
+		for i := 0; i < 16; i++ {
+			s.Enqueue(i, i)
+		}
+		_, priority, _ := s.Peek()
+		assert.Equal(t, 15, priority)
+		for i := 15; i >= 0; i-- {
+			data, _ := s.DequeueMerged()
+			assert.Equal(t, i, data)
+		}
+	})
+
+	t.Run("concurrent producers and consumers", func(t *testing.T) {
+		s := NewShardedQueue(4)
+		var wg sync.WaitGroup
+		var got sync.Map
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(c *ShardConsumer) {
+				defer wg.Done()
+				for {
+					data, err := c.DequeueCtx(context.Background())
+					assert.Equal(t, nil, err)
+					if data == -1 {
+						return
+					}
+					got.Store(data, true)
+				}
+			}(s.Consumer(w))
+		}
+		for i := 0; i < N; i++ {
+			s.Enqueue(i, rand.Intn(20))
+		}
+		for w := 0; w < 4; w++ {
+			s.Consumer(w).Enqueue(-1, 100)
+		}
+		wg.Wait()
+		for i := 0; i < N; i++ {
+			_, ok := got.Load(i)
+			assert.Equal(t, true, ok)
+		}
+	})
+
+	t.Run("blocked consumers are woken", func(t *testing.T) {
+		s := NewShardedQueue(2)
+		got := make(chan interface{})
+		for w := 0; w < 2; w++ {
+			go func(c *ShardConsumer) {
+				data, err := c.DequeueCtx(context.Background())
+				if err != nil {
+					data = err
+				}
+				got <- data
+			}(s.Consumer(w))
+		}
+		time.Sleep(10 * time.Millisecond)
+		s.EnqueueKey(`a`, `stolen or not`, 0)
+		assert.Equal(t, `stolen or not`, <-got)
+		s.Close()
+		assert.Equal(t, ErrQueueClosed, <-got)
+
+		s = NewShardedQueue(2)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := s.Consumer(0).DequeueCtx(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Equal(t, int32(0), s.idle)
+	})
+
+	t.Run("close drains all shards", func(t *testing.T) {
+		s := NewShardedQueue(4)
+		for i := 0; i < 8; i++ {
+			s.Enqueue(i, i)
+		}
+		s.Close()
+		assert.Equal(t, ErrQueueClosed, s.Enqueue(8, 8))
+		c := s.Consumer(0)
+		for i := 0; i < 8; i++ {
+			_, err := c.DequeueCtx(context.Background())
+			assert.Equal(t, nil, err)
+		}
+		_, err := c.DequeueCtx(context.Background())
+		assert.Equal(t, ErrQueueClosed, err)
+		_, err = s.Dequeue()
+		assert.Equal(t, ErrQueueClosed, err)
+	})
+}
+
+func TestAdaptiveShardedQueue(t *testing.T) {
+	s := NewAdaptiveShardedQueue(AdaptiveConfig{MinShards: 1, MaxShards: 3, MigrateBatch: N / 4})
+	assert.Equal(t, 1, s.NumShards())
+
+	t.Run("grow under contention", func(t *testing.T) {
+		s.adaptive.GrowAbove = time.Nanosecond
+		for i := 0; i < 3; i++ {
+			s.load().shards[0].lock.(*InstrumentedMutex).waitNanos += uint64(time.Millisecond)
+			s.Enqueue(i, i)
+			s.adjust()
+		}
+		assert.Equal(t, 3, s.NumShards(), "capped at MaxShards")
+	})
+
+	t.Run("shrink and migrate", func(t *testing.T) {
+		s.adaptive.GrowAbove = time.Hour
+		s.adaptive.ShrinkBelow = time.Hour
+		for i := 0; i < N; i++ {
+			s.Enqueue(i, i)
+		}
+		total := s.Len()
+		s.adjust()
+		s.adjust()
+		assert.Equal(t, 1, s.NumShards())
+		assert.Equal(t, total, s.Len())
+
+		shards := s.load().shards
+		for i := 0; i < 4 && shards[1].Len()+shards[2].Len() > 0; i++ {
+			s.Enqueue(`tick`, 0)
+			s.adjust()
+		}
+		assert.Zero(t, shards[1].Len()+shards[2].Len())
+
+		prev := -1
+		for shards[0].Len() > 0 {
+			data, _ := shards[0].TryDequeue()
+			if v, ok := data.(int); ok {
+				assert.GreaterOrEqual(t, v, prev)
+				prev = v
+			}
+		}
+	})
+
+	t.Run("migrate entries without blocking", func(t *testing.T) {
+		clock := &mockClock{t: time.Unix(1600000000, 0)}
+		s := NewAdaptiveShardedQueue(AdaptiveConfig{}, WithClock(clock), WithCapacity(2))
+		active, retired := s.load().shards[0], New(s.opts...)
+		s.set.Store(&shardSet{shards: []*Queue{active, retired}, active: 1})
+		active.Enqueue(`queued`, 2)
+		retired.EnqueueTTL(`expiring`, 0, time.Second)
+		retired.Enqueue(`left behind`, 1)
+		s.adjust()
+		assert.Equal(t, 2, active.Len())
+		assert.Equal(t, 1, retired.Len())
+		clock.advance(2 * time.Second)
+		assert.Equal(t, 1, active.Len(), "the deadline is kept")
+	})
+
+	t.Run("migrate without dequeueing", func(t *testing.T) {
+		s := NewAdaptiveShardedQueue(AdaptiveConfig{MigrateBatch: 10})
+		active, retired := s.load().shards[0], New(s.opts...)
+		s.set.Store(&shardSet{shards: []*Queue{active, retired}, active: 1})
+		g := NewGroup(retired)
+		g.Enqueue(`grouped`, 1)
+		retired.EnqueueWithRetry(`retried`, 2, RetryPolicy{MaxAttempts: 3})
+		s.adjust()
+		assert.Equal(t, 2, active.Len())
+		assert.Equal(t, Counters{}, active.Stats().Counters())
+		assert.Equal(t, Counters{Enqueued: 2}, retired.Stats().Counters())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, g.Wait(ctx), "still pending")
+
+		data, _ := active.Dequeue()
+		assert.Equal(t, `grouped`, data)
+		e, _, _ := active.dequeueCtx(context.Background())
+		assert.Equal(t, 3, e.retry.MaxAttempts)
+	})
+
+	t.Run("not adaptive", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		NewShardedQueue(2).Adapt(ctx)
+	})
+}
+
+// go test -bench=Sharded -cpu=1,4,32
+func BenchmarkShardedQueue(b *testing.B) {
+	b.Run("single lock queue", func(b *testing.B) {
+		q := New()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				q.Enqueue(`test`, 1)
+				_, _ = q.TryDequeue()
+			}
+		})
+	})
+
+	b.Run("sharded queue, round-robin", func(b *testing.B) {
+		s := NewShardedQueue(0)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s.Enqueue(`test`, 1)
+				_, _ = s.Dequeue()
+			}
+		})
+	})
+
+	b.Run("sharded queue, hashed producers", func(b *testing.B) {
+		s := NewShardedQueue(0)
+		var id int32
+		b.RunParallel(func(pb *testing.PB) {
+			key := strconv.Itoa(int(atomic.AddInt32(&id, 1)))
+			for pb.Next() {
+				s.EnqueueKey(key, `test`, 1)
+				_, _ = s.Dequeue()
+			}
+		})
+	})
+
+	b.Run("sharded queue, merged dequeue", func(b *testing.B) {
+		s := NewShardedQueue(0)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s.Enqueue(`test`, 1)
+				_, _ = s.DequeueMerged()
+			}
+		})
+	})
+
+	b.Run("sharded queue, pinned consumers", func(b *testing.B) {
+		s := NewShardedQueue(0)
+		var id int32
+		var lock sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			lock.Lock()
+			c := s.Consumer(int(id))
+			id++
+			lock.Unlock()
+			for pb.Next() {
+				c.Enqueue(`test`, 1)
+				_, _ = c.TryDequeue()
+			}
+		})
+	})
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+// shedding is the load shedding policy of a queue, see WithShedding.
+type shedding struct {
+	watermark int
+	cutoff    int
+	onShed    func(data interface{}, priority int)
+	reversed  bool // the queue dequeues the greater priorities first
+}
+
+// WithShedding makes the queue shed load while it holds more than
+// watermark data: enqueueing data of a priority dequeued after cutoff
+// then returns ErrShed, and calls onShed, if not nil, with the data, so
+// that the latency of the important traffic holds during overloads. The
+// data of cutoff and of the priorities before it is still queued.
+// EnqueueBatch stops at the first data shed.
+func WithShedding(watermark, cutoff int, onShed func(data interface{}, priority int)) Option {
+	return func(q *Queue) {
+		q.shedding = &shedding{watermark: watermark, cutoff: cutoff, onShed: onShed}
+	}
+}
+
+// sheds reports whether the queue sheds the entry, and then remembers
+// it for onShed. It must be called with the lock held.
+func (q *Queue) sheds(e *entry) bool {
+	s := q.shedding
+	if s == nil || q.size() <= s.watermark {
+		return false
+	}
+	if s.reversed && e.Priority >= s.cutoff || !s.reversed && e.Priority <= s.cutoff {
+		return false
+	}
+	if s.onShed != nil {
+		q.shed = append(q.shed, e)
+	}
+	return true
+}
+
+// reversed reports whether the queue dequeues the greater priorities
+// first, as with WithMaxFirst. Queues ordered by WithLessFunc are not.
+func (q *Queue) reversed() bool {
+	if q.less != nil {
+		return false
+	}
+	return q.heap.Before(&newEntry(nil, 1).Item, &newEntry(nil, 0).Item)
+}
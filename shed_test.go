@@ -0,0 +1,37 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShedding(t *testing.T) {
+	var shed []interface{}
+	var q *Queue
+	q = New(WithShedding(2, 1, func(data interface{}, priority int) {
+		shed = append(shed, data)
+		q.Len() // called unlocked
+	}))
+	assert.Equal(t, nil, q.Enqueue(`a`, 2))
+	assert.Equal(t, nil, q.Enqueue(`b`, 2))
+	assert.Equal(t, nil, q.Enqueue(`c`, 2), "at the watermark")
+	assert.ErrorIs(t, q.Enqueue(`d`, 2), ErrShed)
+	assert.Equal(t, nil, q.Enqueue(`e`, 1), "important")
+	assert.Equal(t, nil, q.Enqueue(`f`, 0))
+	assert.ErrorIs(t, q.EnqueueBatch([]Task{{Data: `g`, Priority: 0}, {Data: `h`, Priority: 3}}), ErrShed)
+	assert.Equal(t, []interface{}{`d`, `h`}, shed)
+	assert.Equal(t, 6, q.Len())
+
+	for i := 0; i < 4; i++ {
+		q.Dequeue()
+	}
+	assert.Equal(t, nil, q.Enqueue(`i`, 2), "below the watermark again")
+
+	q = New(WithMaxFirst(), WithShedding(0, 5, nil))
+	q.Enqueue(`a`, 5)
+	assert.Equal(t, nil, q.Enqueue(`b`, 6))
+	assert.ErrorIs(t, q.Enqueue(`c`, 4), ErrShed)
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// snapshotVersion is the version of the snapshot format, to be bumped
+// on incompatible changes.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int
+	Entries []snapshotEntry // in enqueue order
+}
+
+type snapshotEntry struct {
+	Priority int
+	Key      heap.Key
+	Deadline time.Time
+	Visible  time.Time // of delayed data
+	Data     interface{}
+}
+
+// Snapshot writes the queued data, including the delayed data, to w with
+// encoding/gob, so that the queue can be checkpointed, e.g. on SIGTERM,
+// and restored after a deploy by RestoreQueue. The concrete types of the
+// data must be registered with gob.Register, but for the basic types.
+// Contexts, cancel functions and futures are not saved.
+func (q *Queue) Snapshot(w io.Writer) error {
+	q.lock.Lock()
+	q.expire()
+	entries := q.entries()
+	s := snapshot{Version: snapshotVersion, Entries: make([]snapshotEntry, len(entries))}
+	for i, e := range entries {
+		s.Entries[i] = snapshotEntry{Priority: e.Priority, Key: e.Key, Deadline: e.deadline, Visible: e.visible, Data: e.data}
+	}
+	q.unlock()
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+// RestoreQueue returns a new queue with the given options, holding the
+// data of a snapshot written by Queue.Snapshot, with its priorities and
+// deadlines, and in the same order. It returns ErrQueueFull if the data
+// does not fit in the capacity set by the options, unless their
+// overflow policy makes room.
+func RestoreQueue(r io.Reader, opts ...Option) (*Queue, error) {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	q := New(opts...)
+	for _, se := range s.Entries {
+		e := newEntry(se.Data, se.Priority)
+		e.Key, e.deadline = se.Key, se.Deadline
+		if err := q.enqueueAt(e, se.Visible, false); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+	"github.com/stretchr/testify/assert"
+)
+
+type snapshotData struct {
+	ID   int
+	Name string
+}
+
+func TestSnapshot(t *testing.T) {
+	gob.Register(snapshotData{})
+	q := New()
+	q.Enqueue(snapshotData{1, `low`}, 2)
+	q.Enqueue(`high 1`, 1)
+	q.EnqueueKey(`keyed`, 1, heap.Key{-1})
+	q.Enqueue(`high 2`, 1)
+	q.EnqueueCancelable(`cancelled`, 0)()
+	deadline := time.Now().Add(time.Hour)
+	q.EnqueueDeadline(`deadline`, 3, deadline)
+	q.EnqueueAt(`delayed`, 0, time.Now().Add(20*time.Millisecond))
+
+	var buf bytes.Buffer
+	assert.Equal(t, nil, q.Snapshot(&buf))
+	restored, err := RestoreQueue(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 5, restored.Len())
+	assert.Equal(t, 1, restored.Delayed())
+	assert.Equal(t, []interface{}{`high 1`, `high 2`, `keyed`, snapshotData{1, `low`}, `deadline`}, restored.DequeueBatch(5))
+	assert.Eventually(t, func() bool { return restored.Len() == 1 }, time.Second, time.Millisecond)
+
+	buf.Reset()
+	q.Snapshot(&buf)
+	_, err = RestoreQueue(bytes.NewReader(buf.Bytes()), WithCapacity(2))
+	assert.Equal(t, ErrQueueFull, err, "does not block")
+	restored, err = RestoreQueue(&buf, WithCapacity(2), WithOverflowPolicy(DropNewest))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []interface{}{`high 1`, snapshotData{1, `low`}}, restored.DequeueBatch(5))
+
+	_, err = RestoreQueue(bytes.NewReader([]byte("garbage")))
+	assert.NotEqual(t, nil, err)
+}
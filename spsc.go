@@ -0,0 +1,139 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// spscMaxBackoff bounds the sleep of a consumer polling an empty
+// SPSCQueue.
+const spscMaxBackoff = time.Millisecond
+
+// SPSCQueue is a priority queue for exactly one producer goroutine and
+// one consumer goroutine, e.g. an HTTP handler goroutine feeding a
+// batching goroutine. It takes no lock: the producer writes into a
+// lock-free ring buffer, and the consumer moves the items from the ring
+// into a heap that only it touches. The target is 5-10x the throughput
+// of Queue for this pattern, see BenchmarkSPSCQueue.
+//
+// Calling Enqueue or TryEnqueue from several goroutines, or the dequeue
+// methods and Len from several goroutines, is a data race.
+type SPSCQueue struct {
+	_    [64]byte // padding to keep head and tail on separate cache lines
+	head uint64   // next slot to read, written by the consumer
+	_    [56]byte
+	tail uint64 // next slot to write, written by the producer
+	_    [56]byte
+	ring []Task
+	mask uint64
+	heap heap.ItemHeap
+	// count is the order stamp of the last item pushed into the heap.
+	count uint64
+}
+
+// NewSPSCQueue returns an SPSCQueue whose ring buffer holds at least
+// size items, rounded up to a power of two. The heap is unbounded, so
+// size only limits the items not yet seen by the consumer.
+func NewSPSCQueue(size int) *SPSCQueue {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &SPSCQueue{
+		ring: make([]Task, n),
+		mask: uint64(n - 1),
+		heap: heap.NewHeap(),
+	}
+}
+
+// TryEnqueue puts the data into the queue, or returns ErrQueueFull if the
+// ring buffer is full. It must only be called by the producer.
+func (q *SPSCQueue) TryEnqueue(data interface{}, priority int) error {
+	tail := q.tail
+	if tail-atomic.LoadUint64(&q.head) == uint64(len(q.ring)) {
+		return ErrQueueFull
+	}
+	q.ring[tail&q.mask] = Task{Data: data, Priority: priority}
+	atomic.StoreUint64(&q.tail, tail+1)
+	return nil
+}
+
+// Enqueue puts the data into the queue, yielding until the consumer
+// makes room if the ring buffer is full. It must only be called by the
+// producer.
+func (q *SPSCQueue) Enqueue(data interface{}, priority int) {
+	for q.TryEnqueue(data, priority) == ErrQueueFull {
+		runtime.Gosched()
+	}
+}
+
+// drain moves the items of the ring buffer into the heap, in the order
+// they were enqueued.
+func (q *SPSCQueue) drain() {
+	head, tail := q.head, atomic.LoadUint64(&q.tail)
+	if head == tail {
+		return
+	}
+	for ; head != tail; head++ {
+		slot := &q.ring[head&q.mask]
+		if q.count == math.MaxUint64 {
+			q.count = q.heap.ReOrder()
+		}
+		q.count++
+		q.heap.Push(heap.NewItem(slot.Data, slot.Priority, heap.WithOrder(q.count)))
+		*slot = Task{} // release the data for the garbage collector
+	}
+	atomic.StoreUint64(&q.head, tail)
+}
+
+// TryDequeue gets & removes the data with highest priority. ok is false
+// if the queue is empty. It must only be called by the consumer.
+func (q *SPSCQueue) TryDequeue() (data interface{}, ok bool) {
+	q.drain()
+	x := q.heap.Pop()
+	if x == nil {
+		return nil, false
+	}
+	return x.(*heap.Item).GetData(), true
+}
+
+// DequeueCtx is like TryDequeue, but polls until an item is available
+// or ctx is done. It must only be called by the consumer.
+func (q *SPSCQueue) DequeueCtx(ctx context.Context) (interface{}, error) {
+	return poll(ctx, q.TryDequeue)
+}
+
+// poll calls try until it returns an item or ctx is done, spinning at
+// first and then sleeping with an exponential backoff.
+func poll(ctx context.Context, try func() (interface{}, bool)) (interface{}, error) {
+	backoff := time.Microsecond
+	for spins := 0; ; spins++ {
+		if data, ok := try(); ok {
+			return data, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if spins < 64 {
+			runtime.Gosched()
+			continue
+		}
+		time.Sleep(backoff)
+		if backoff < spscMaxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// Len returns the size of the queue. It must only be called by the
+// consumer.
+func (q *SPSCQueue) Len() int {
+	return q.heap.Len() + int(atomic.LoadUint64(&q.tail)-q.head)
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSPSCQueue(t *testing.T) {
+	t.Run("priority order", func(t *testing.T) {
+		q := NewSPSCQueue(N)
+		for i := 0; i < N; i++ {
+			v := rand.Intn(20)
+			q.Enqueue(v, v)
+		}
+		assert.Equal(t, N, q.Len())
+		var localArr []interface{}
+		for {
+			data, ok := q.TryDequeue()
+			if !ok {
+				break
+			}
+			localArr = append(localArr, data)
+		}
+		assert.Equal(t, N, len(localArr))
+		isAscending(t, localArr)
+	})
+
+	t.Run("FIFO for equal priorities", func(t *testing.T) {
+		q := NewSPSCQueue(4)
+		for i := 0; i < 3; i++ {
+			q.Enqueue(i, 1)
+		}
+		q.Enqueue(`high`, 0)
+		data, _ := q.TryDequeue()
+		assert.Equal(t, `high`, data)
+		for i := 0; i < 3; i++ {
+			data, _ := q.TryDequeue()
+			assert.Equal(t, i, data)
+		}
+	})
+
+	t.Run("full ring", func(t *testing.T) {
+		q := NewSPSCQueue(3)
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, nil, q.TryEnqueue(i, 0))
+		}
+		assert.Equal(t, ErrQueueFull, q.TryEnqueue(4, 0))
+		data, _ := q.TryDequeue()
+		assert.Equal(t, 0, data)
+		assert.Equal(t, nil, q.TryEnqueue(4, 0), "the ring is drained into the heap")
+		assert.Equal(t, 4, q.Len())
+	})
+
+	t.Run("concurrent producer and consumer", func(t *testing.T) {
+		q := NewSPSCQueue(16)
+		go func() {
+			for i := 0; i < N; i++ {
+				q.Enqueue(i, 0)
+			}
+		}()
+		for i := 0; i < N; i++ {
+			data, err := q.DequeueCtx(context.Background())
+			assert.Equal(t, nil, err)
+			assert.Equal(t, i, data)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		_, err := q.DequeueCtx(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+}
+
+// go test -bench=SPSC
+func BenchmarkSPSCQueue(b *testing.B) {
+	b.Run("queue", func(b *testing.B) {
+		q := New()
+		go func() {
+			for i := 0; i < b.N; i++ {
+				q.Enqueue(i, i%20)
+			}
+		}()
+		for i := 0; i < b.N; i++ {
+			_, _ = q.DequeueCtx(context.Background())
+		}
+	})
+
+	b.Run("spsc queue", func(b *testing.B) {
+		q := NewSPSCQueue(1024)
+		go func() {
+			for i := 0; i < b.N; i++ {
+				q.Enqueue(i, i%20)
+			}
+		}()
+		for i := 0; i < b.N; i++ {
+			_, _ = q.DequeueCtx(context.Background())
+		}
+	})
+}
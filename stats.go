@@ -0,0 +1,190 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds the counters of a queue. The counters are updated by the
+// queue and can be read concurrently.
+type Stats struct {
+	enqueued  uint64
+	dequeued  uint64
+	expired   uint64
+	cancelled uint64
+	dropped   uint64
+	hedged    uint64
+	throttled uint64
+
+	now      func() time.Time
+	markLock sync.Mutex
+	marks    *marks // of the windows, allocated on first use
+
+	workerLock sync.Mutex
+	workers    []*workerCounters // of the running worker pools
+	nextWorker int
+}
+
+// Enqueued returns the number of items put into the queue.
+func (s *Stats) Enqueued() uint64 { return atomic.LoadUint64(&s.enqueued) }
+
+// Dequeued returns the number of items taken from the queue.
+func (s *Stats) Dequeued() uint64 { return atomic.LoadUint64(&s.dequeued) }
+
+// Expired returns the number of items discarded after their TTL.
+func (s *Stats) Expired() uint64 { return atomic.LoadUint64(&s.expired) }
+
+// Cancelled returns the number of items cancelled while queued.
+func (s *Stats) Cancelled() uint64 { return atomic.LoadUint64(&s.cancelled) }
+
+// Dropped returns the number of items dropped by the overflow policy.
+func (s *Stats) Dropped() uint64 { return atomic.LoadUint64(&s.dropped) }
+
+// Hedged returns the number of duplicates enqueued by EnqueueHedged.
+func (s *Stats) Hedged() uint64 { return atomic.LoadUint64(&s.hedged) }
+
+// Throttled returns the number of hedges and retries denied by the retry
+// budget.
+func (s *Stats) Throttled() uint64 { return atomic.LoadUint64(&s.throttled) }
+
+// Counters is a snapshot of the counters of a queue, or their increase
+// over a window.
+type Counters struct {
+	Enqueued  uint64
+	Dequeued  uint64
+	Expired   uint64
+	Cancelled uint64
+	Dropped   uint64
+	Hedged    uint64
+	Throttled uint64
+}
+
+func (c Counters) sub(base Counters) Counters {
+	return Counters{
+		Enqueued:  c.Enqueued - base.Enqueued,
+		Dequeued:  c.Dequeued - base.Dequeued,
+		Expired:   c.Expired - base.Expired,
+		Cancelled: c.Cancelled - base.Cancelled,
+		Dropped:   c.Dropped - base.Dropped,
+		Hedged:    c.Hedged - base.Hedged,
+		Throttled: c.Throttled - base.Throttled,
+	}
+}
+
+// Counters returns the counters since the queue was created or reset.
+func (s *Stats) Counters() Counters {
+	return Counters{
+		Enqueued:  s.Enqueued(),
+		Dequeued:  s.Dequeued(),
+		Expired:   s.Expired(),
+		Cancelled: s.Cancelled(),
+		Dropped:   s.Dropped(),
+		Hedged:    s.Hedged(),
+		Throttled: s.Throttled(),
+	}
+}
+
+// Reset zeroes the counters, and those of the workers but the items in
+// flight, e.g. to compare them before and after a tuning change without
+// restarting the process. The updates concurrent with Reset may be kept
+// or lost.
+func (s *Stats) Reset() {
+	for _, c := range []*uint64{&s.enqueued, &s.dequeued, &s.expired, &s.cancelled, &s.dropped, &s.hedged, &s.throttled} {
+		atomic.StoreUint64(c, 0)
+	}
+	s.markLock.Lock()
+	if s.marks != nil {
+		*s.marks = marks{}
+	}
+	s.markLock.Unlock()
+	s.workerLock.Lock()
+	defer s.workerLock.Unlock()
+	for _, w := range s.workers {
+		atomic.StoreUint64(&w.handled, 0)
+		atomic.StoreUint64(&w.failed, 0)
+		atomic.StoreUint64(&w.calls, 0)
+		atomic.StoreInt64(&w.busy, 0)
+		atomic.StoreInt64(&w.last, 0)
+	}
+}
+
+// LastMinute returns the increase of the counters over the last minute,
+// or since the queue was created or reset if that is more recent.
+func (s *Stats) LastMinute() Counters {
+	return s.window(time.Minute)
+}
+
+// LastHour returns the increase of the counters over the last hour, or
+// since the queue was created or reset if that is more recent.
+func (s *Stats) LastHour() Counters {
+	return s.window(time.Hour)
+}
+
+// marks are snapshots of the counters, by second and by minute, each
+// ring covering twice its window. The windows start at the latest mark
+// before them, which the queue takes every so many operations, so they
+// may be a little longer, the more so with little traffic.
+type marks struct {
+	seconds [2 * 60]mark
+	minutes [2 * 60]mark
+}
+
+type mark struct {
+	at       int64 // in seconds since the epoch, 0 if unset
+	counters Counters
+}
+
+func (s *Stats) clock() time.Time {
+	if s.now == nil {
+		return time.Now()
+	}
+	return s.now()
+}
+
+// rotate takes the marks of now, unless they are taken already.
+func (s *Stats) rotate(now time.Time) {
+	s.markLock.Lock()
+	defer s.markLock.Unlock()
+	s.mark(now)
+}
+
+// mark is rotate with markLock held.
+func (s *Stats) mark(now time.Time) {
+	if s.marks == nil {
+		s.marks = &marks{}
+	}
+	sec := now.Unix()
+	m := &s.marks.seconds[sec%int64(len(s.marks.seconds))]
+	if m.at == sec {
+		return
+	}
+	c := s.Counters()
+	*m = mark{at: sec, counters: c}
+	if m := &s.marks.minutes[sec/60%int64(len(s.marks.minutes))]; m.at/60 != sec/60 {
+		*m = mark{at: sec, counters: c}
+	}
+}
+
+// window returns the increase of the counters since the latest mark
+// taken at least d ago.
+func (s *Stats) window(d time.Duration) Counters {
+	now := s.clock()
+	start := now.Add(-d).Unix()
+	s.markLock.Lock()
+	s.mark(now)
+	ring := s.marks.seconds[:]
+	if d > time.Minute {
+		ring = s.marks.minutes[:]
+	}
+	var base mark
+	for _, m := range ring {
+		if m.at != 0 && m.at <= start && m.at > base.at {
+			base = m
+		}
+	}
+	s.markLock.Unlock()
+	return s.Counters().sub(base.counters)
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"runtime"
+	"time"
+)
+
+// RuntimeSample holds the Go runtime metrics sampled with a queue.
+type RuntimeSample struct {
+	Goroutines int
+	HeapAlloc  uint64
+	NumGC      uint32
+	// LastGCPause is the duration of the most recent GC pause.
+	LastGCPause time.Duration
+	// GCPauseTotal is the cumulative GC pause time since the start.
+	GCPauseTotal time.Duration
+}
+
+func readRuntimeSample() *RuntimeSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	sample := RuntimeSample{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		NumGC:        m.NumGC,
+		GCPauseTotal: time.Duration(m.PauseTotalNs),
+	}
+	if m.NumGC > 0 {
+		sample.LastGCPause = time.Duration(m.PauseNs[(m.NumGC+255)%256])
+	}
+	return &sample
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	q, clock := mockNewQueueWithClock()
+	q.Enqueue(`a`, 1)
+	q.EnqueueTTL(`b`, 2, time.Second)
+	cancel := q.EnqueueCancelable(`c`, 3)
+	cancel()
+	_, _ = q.Dequeue()
+	clock.advance(2 * time.Second)
+	assert.Equal(t, 0, q.Len())
+
+	stats := q.Stats()
+	assert.Equal(t, uint64(3), stats.Enqueued())
+	assert.Equal(t, uint64(1), stats.Dequeued())
+	assert.Equal(t, uint64(1), stats.Expired())
+	assert.Equal(t, uint64(1), stats.Cancelled())
+}
+
+func TestStatsWindows(t *testing.T) {
+	q, clock := mockNewQueueWithClock()
+	stats := q.Stats()
+	q.Enqueue(`a`, 1)
+	assert.Equal(t, uint64(1), stats.LastMinute().Enqueued)
+	clock.advance(30 * time.Second)
+	q.Enqueue(`b`, 1)
+	q.Enqueue(`c`, 1)
+	assert.Equal(t, uint64(3), stats.LastMinute().Enqueued, "since creation")
+	clock.advance(40 * time.Second)
+	q.Enqueue(`d`, 1)
+	q.Dequeue()
+	assert.Equal(t, Counters{Enqueued: 3, Dequeued: 1}, stats.LastMinute())
+	assert.Equal(t, Counters{Enqueued: 4, Dequeued: 1}, stats.LastHour())
+	assert.Equal(t, Counters{Enqueued: 4, Dequeued: 1}, stats.Counters())
+
+	stats.Reset()
+	assert.Equal(t, Counters{}, stats.Counters())
+	assert.Equal(t, Counters{}, stats.LastMinute())
+	q.Enqueue(`e`, 1)
+	assert.Equal(t, uint64(1), stats.LastHour().Enqueued)
+	assert.Equal(t, 4, q.Len(), "the queue is unchanged")
+}
+
+func TestStatsConcurrentReset(t *testing.T) {
+	q := New()
+	stats := q.Stats()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			stats.Reset()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			q.Enqueue(i, 1)
+			stats.LastMinute()
+			stats.LastHour()
+		}
+	}()
+	wg.Wait()
+}
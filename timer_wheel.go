@@ -0,0 +1,113 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 4
+	// wheelSpan is the number of ticks covered by all levels.
+	wheelSpan = 1 << (wheelBits * wheelLevels)
+
+	defaultWheelTick = 10 * time.Millisecond
+)
+
+type wheelTimer struct {
+	item    *heap.Item
+	expires uint64
+}
+
+// timerWheel is a hierarchical timing wheel. Level 0 has one slot per
+// tick, and each upper level has slots covering a whole turn of the
+// level below it. Timers are cascaded down when the wheel reaches their
+// slot, so adding a timer and firing it are both O(1) amortized.
+//
+// The wheel holds no goroutine; it is advanced by its owner.
+type timerWheel struct {
+	tick    time.Duration
+	origin  time.Time
+	current uint64
+	size    int
+	slots   [wheelLevels][wheelSlots][]wheelTimer
+}
+
+func newTimerWheel(tick time.Duration, origin time.Time) *timerWheel {
+	return &timerWheel{tick: tick, origin: origin}
+}
+
+// tickOf converts a point in time to the wheel tick it belongs to.
+func (w *timerWheel) tickOf(t time.Time) uint64 {
+	if !t.After(w.origin) {
+		return 0
+	}
+	return uint64(t.Sub(w.origin) / w.tick)
+}
+
+// add schedules the item to fire once the wheel reaches deadline.
+// A deadline that has already passed fires on the next tick.
+func (w *timerWheel) add(item *heap.Item, deadline time.Time) {
+	expires := w.tickOf(deadline)
+	if deadline.After(w.origin) && deadline.Sub(w.origin)%w.tick != 0 {
+		expires++ // never fire early
+	}
+	if expires <= w.current {
+		expires = w.current + 1
+	}
+	w.place(wheelTimer{item: item, expires: expires})
+	w.size++
+}
+
+func (w *timerWheel) place(t wheelTimer) {
+	expires := t.expires
+	if expires-w.current >= wheelSpan {
+		expires = w.current + wheelSpan - 1 // re-placed when cascaded
+	}
+	delta := expires - w.current
+	level := 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	idx := (expires >> (wheelBits * level)) & wheelMask
+	w.slots[level][idx] = append(w.slots[level][idx], t)
+}
+
+// advance moves the wheel forward to the given tick and calls fire
+// for every timer that expires on the way.
+func (w *timerWheel) advance(to uint64, fire func(*heap.Item)) {
+	for w.current < to {
+		if w.size == 0 {
+			w.current = to
+			return
+		}
+		w.current++
+		for level := wheelLevels - 1; level > 0; level-- {
+			if w.current&(1<<(wheelBits*level)-1) != 0 {
+				continue
+			}
+			idx := (w.current >> (wheelBits * level)) & wheelMask
+			timers := w.slots[level][idx]
+			w.slots[level][idx] = nil
+			for _, t := range timers {
+				w.place(t)
+			}
+		}
+		idx := w.current & wheelMask
+		timers := w.slots[0][idx]
+		w.slots[0][idx] = nil
+		for _, t := range timers {
+			if t.expires > w.current {
+				w.place(t)
+				continue
+			}
+			w.size--
+			fire(t.item)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimerWheel(t *testing.T) {
+	origin := time.Unix(1600000000, 0)
+	tick := time.Millisecond
+	w := newTimerWheel(tick, origin)
+
+	want := make(map[*heap.Item]uint64)
+	for i := 0; i < 5000; i++ {
+		item := &heap.Item{Data: i}
+		var expires uint64
+		switch rand.Intn(3) {
+		case 0:
+			expires = uint64(rand.Intn(wheelSlots))
+		case 1:
+			expires = uint64(rand.Intn(wheelSlots * wheelSlots * 2))
+		default:
+			expires = uint64(rand.Intn(wheelSpan * 2))
+		}
+		if expires == 0 {
+			expires = 1
+		}
+		w.add(item, origin.Add(time.Duration(expires)*tick))
+		want[item] = expires
+	}
+	assert.Equal(t, len(want), w.size)
+
+	for to := uint64(0); w.size > 0; to += uint64(rand.Intn(5000)) {
+		w.advance(to, func(item *heap.Item) {
+			assert.Equal(t, want[item], w.current)
+			delete(want, item)
+		})
+	}
+	assert.Equal(t, 0, len(want))
+}
+
+func TestTimerWheelNeverEarly(t *testing.T) {
+	origin := time.Unix(1600000000, 0)
+	w := newTimerWheel(10*time.Millisecond, origin)
+	fired := false
+	w.add(&heap.Item{}, origin.Add(15*time.Millisecond))
+	w.advance(w.tickOf(origin.Add(19*time.Millisecond)), func(*heap.Item) { fired = true })
+	assert.Equal(t, false, fired)
+	w.advance(w.tickOf(origin.Add(20*time.Millisecond)), func(*heap.Item) { fired = true })
+	assert.Equal(t, true, fired)
+}
+
+func BenchmarkTimerWheel(b *testing.B) {
+	origin := time.Unix(1600000000, 0)
+	w := newTimerWheel(time.Millisecond, origin)
+	item := &heap.Item{}
+	for i := 0; i < b.N; i++ {
+		w.add(item, origin.Add(time.Duration(i%100000)*time.Millisecond))
+		if i%1000 == 0 {
+			w.advance(uint64(i/10), func(*heap.Item) {})
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "context"
+
+// WithCoalescing makes EnqueueUnique replace the queued data of the same
+// key with the new data, while it keeps the priority dequeued earlier,
+// so that for state updates, consumers get the latest value of every key
+// once. The queued data should not be a Future, whose waiter would never
+// get a result.
+func WithCoalescing() Option {
+	return func(q *Queue) {
+		q.coalescing = true
+	}
+}
+
+// EnqueueUnique puts the data into the priority queue like Enqueue,
+// unless data of the same key is already queued, e.g. because a client
+// retried its request: then the queued data is kept, unless the queue
+// coalesces, see WithCoalescing, and only gets the priority if that is
+// dequeued earlier than its own. The key is free again once its data is
+// dequeued, cancelled, expired or dropped. The keys are not saved by
+// snapshots nor by the write-ahead log.
+func (q *Queue) EnqueueUnique(key string, data interface{}, priority int) error {
+	e, err := q.admit(context.Background(), data, priority)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	q.expire()
+	return q.enqueueUnique(key, e)
+}
+
+// enqueueUnique is EnqueueUnique for an open queue that is up to date.
+// It must be called with the lock held.
+func (q *Queue) enqueueUnique(key string, e *entry) error {
+	if queued, ok := q.unique[key]; ok {
+		return q.update(queued, e)
+	}
+	if q.unique == nil {
+		q.unique = make(map[string]*entry)
+	}
+	// indexed while it may wait for room, so that a duplicate meanwhile
+	// updates it instead
+	e.unique = key
+	q.unique[key] = e
+	if err := q.insert(e, true); err != nil {
+		q.unindex(e)
+		return err
+	}
+	return nil
+}
+
+// update gives a uniquely keyed entry the priority of its duplicate e,
+// if it is dequeued earlier than its own, and the data of e if the queue
+// coalesces. Larger data must fit the memory budget, whose room is made
+// by the overflow policy like for insert. It must be called with the
+// lock held.
+func (q *Queue) update(queued, e *entry) error {
+	if !q.coalescing && !q.raises(queued, e) {
+		return nil
+	}
+	if q.coalescing && q.outgrows(queued, e) {
+		key := queued.unique
+		switch q.overflow {
+		case DropNewest:
+			q.drop(e)
+			return nil
+		case DropOldest:
+			for q.outgrows(queued, e) {
+				oldest := q.oldest()
+				q.drop(q.evict(oldest))
+				if oldest == queued {
+					return q.enqueueUnique(key, e)
+				}
+			}
+		case DropLowestPriority:
+			for q.outgrows(queued, e) {
+				worst := q.worst()
+				if worst == queued {
+					q.drop(e)
+					return nil
+				}
+				q.drop(q.evict(worst))
+			}
+		default:
+			for q.outgrows(queued, e) {
+				q.notFull.Wait()
+				if q.closed {
+					return ErrQueueClosed
+				}
+				q.expire()
+				if q.unique[key] != queued {
+					return q.enqueueUnique(key, e)
+				}
+			}
+		}
+	}
+	raise := q.raises(queued, e)
+	pushed := queued.Index() >= 1 // rather than waiting for room
+	if pushed && (raise || q.less != nil) {
+		q.heap.Remove(queued.Index())
+		if q.floor != nil {
+			q.floor.untrack(queued)
+		}
+	}
+	if raise {
+		queued.Priority = e.Priority
+	}
+	if q.coalescing {
+		if queued.charged {
+			q.bytes += int64(e.size - queued.size)
+		}
+		queued.data, queued.size = e.data, e.size
+	}
+	if !pushed {
+		return nil
+	}
+	if raise || q.less != nil {
+		q.stamp(queued, queued.Order) // the view of the LessFunc
+		if q.banded {
+			q.classify(queued)
+		}
+		q.heap.Push(&queued.Item)
+		if q.floor != nil {
+			q.floor.track(queued)
+		}
+	}
+	if q.wal != nil {
+		q.logRemove(queued)
+		q.logEnqueue(queued)
+	}
+	return nil
+}
+
+// raises reports whether the priority of e is dequeued earlier than the
+// one of the queued entry. It must be called with the lock held.
+func (q *Queue) raises(queued, e *entry) bool {
+	return e.Priority != queued.Priority && q.reversed() == (e.Priority > queued.Priority)
+}
+
+// outgrows reports whether coalescing e into the queued entry exceeds
+// the memory budget, which, like for full, a lone entry may exceed. It
+// must be called with the lock held.
+func (q *Queue) outgrows(queued, e *entry) bool {
+	return q.maxBytes > 0 && queued.charged && q.size() > 1 &&
+		q.bytes+int64(e.size-queued.size) > q.maxBytes
+}
+
+// unindex frees the key of a uniquely keyed entry that left the queue.
+// It must be called with the lock held.
+func (q *Queue) unindex(e *entry) {
+	if e.unique != "" && q.unique[e.unique] == e {
+		delete(q.unique, e.unique)
+	}
+}
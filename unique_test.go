@@ -0,0 +1,133 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueueUnique(t *testing.T) {
+	q, clock := mockNewQueueWithClock()
+	assert.Equal(t, nil, q.EnqueueUnique("a", `first a`, 5))
+	assert.Equal(t, nil, q.EnqueueUnique("b", `b`, 3))
+	assert.Equal(t, nil, q.EnqueueUnique("a", `retried a`, 7), "no-op")
+	assert.Equal(t, 2, q.Len())
+	data, priority, _ := q.Peek()
+	assert.Equal(t, `b`, data)
+	assert.Equal(t, 3, priority)
+
+	assert.Equal(t, nil, q.EnqueueUnique("a", `retried a`, 1), "refreshes the priority")
+	data, priority, _ = q.Peek()
+	assert.Equal(t, `first a`, data)
+	assert.Equal(t, 1, priority)
+	q.Dequeue()
+	assert.Equal(t, nil, q.EnqueueUnique("a", `new a`, 9), "free once dequeued")
+	assert.Equal(t, []interface{}{`b`, `new a`}, q.DequeueBatch(2))
+
+	q.EnqueueTTL(`expiring`, 1, time.Second)
+	clock.advance(2 * time.Second)
+	assert.Equal(t, nil, q.EnqueueUnique("a", `a`, 1))
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, map[string]*entry{"a": q.unique["a"]}, q.unique)
+	q.Dequeue()
+	assert.Empty(t, q.unique)
+
+	t.Run("max first", func(t *testing.T) {
+		q := New(WithMaxFirst())
+		q.EnqueueUnique("a", `a`, 5)
+		q.EnqueueUnique("a", `a`, 1)
+		_, priority, _ := q.Peek()
+		assert.Equal(t, 5, priority)
+		q.EnqueueUnique("a", `a`, 8)
+		_, priority, _ = q.Peek()
+		assert.Equal(t, 8, priority)
+	})
+
+	t.Run("waiting for room", func(t *testing.T) {
+		q := NewBoundedQueue(1)
+		q.Enqueue(`full`, 1)
+		done := make(chan struct{})
+		go func() {
+			q.EnqueueUnique("a", `a`, 5)
+			close(done)
+		}()
+		for {
+			q.lock.Lock()
+			_, ok := q.unique["a"]
+			q.lock.Unlock()
+			if ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, nil, q.EnqueueUnique("a", `duplicate`, 0))
+		q.Dequeue()
+		<-done
+		data, priority, _ := q.Peek()
+		assert.Equal(t, `a`, data)
+		assert.Equal(t, 0, priority)
+	})
+}
+
+func TestCoalescing(t *testing.T) {
+	q := New(WithCoalescing(), WithMaxBytes(100))
+	q.EnqueueUnique("cpu", sized(`cpu 10%`), 2)
+	q.EnqueueUnique("mem", sized(`mem 1G`), 1)
+	q.EnqueueUnique("cpu", sized(`cpu 80%`), 3)
+	assert.Equal(t, int64(13), q.Bytes())
+	q.EnqueueUnique("cpu", sized(`cpu 95%`), 0)
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, []interface{}{sized(`cpu 95%`), sized(`mem 1G`)}, q.DequeueBatch(2))
+	assert.Equal(t, int64(0), q.Bytes())
+
+	t.Run("less func", func(t *testing.T) {
+		q := New(WithCoalescing(), WithLessFunc(func(a, b *heap.Item) bool {
+			return a.Data.(int) < b.Data.(int)
+		}))
+		q.EnqueueUnique("a", 5, 0)
+		q.EnqueueUnique("b", 3, 0)
+		q.EnqueueUnique("a", 1, 0)
+		assert.Equal(t, []interface{}{1, 3}, q.DequeueBatch(2))
+	})
+
+	t.Run("memory budget", func(t *testing.T) {
+		q := New(WithCoalescing(), WithMaxBytes(10))
+		q.EnqueueUnique("b", sized(`bbbb`), 0)
+		q.EnqueueUnique("a", sized(`aaaa`), 1)
+		done := make(chan error)
+		go func() {
+			done <- q.EnqueueUnique("a", sized(`aaaaaaaa`), 1)
+		}()
+		select {
+		case <-done:
+			t.Fatal("coalesced past the budget")
+		case <-time.After(10 * time.Millisecond):
+		}
+		data, _ := q.Dequeue()
+		assert.Equal(t, sized(`bbbb`), data)
+		assert.Equal(t, nil, <-done)
+		assert.Equal(t, int64(8), q.Bytes())
+		data, _ = q.Dequeue()
+		assert.Equal(t, sized(`aaaaaaaa`), data)
+	})
+
+	t.Run("memory budget drops", func(t *testing.T) {
+		q := New(WithCoalescing(), WithMaxBytes(10), WithOverflowPolicy(DropNewest))
+		q.EnqueueUnique("a", sized(`aaaa`), 0)
+		q.EnqueueUnique("b", sized(`bbbb`), 0)
+		assert.Equal(t, nil, q.EnqueueUnique("b", sized(`bbbbbbbb`), 0))
+		assert.Equal(t, int64(8), q.Bytes())
+		assert.Equal(t, uint64(1), q.Stats().Dropped())
+
+		q = New(WithCoalescing(), WithMaxBytes(10), WithOverflowPolicy(DropOldest))
+		q.EnqueueUnique("a", sized(`aaaa`), 0)
+		q.EnqueueUnique("b", sized(`bbbb`), 0)
+		q.EnqueueUnique("b", sized(`bbbbbbbb`), 0)
+		assert.Equal(t, int64(8), q.Bytes())
+		assert.Equal(t, []interface{}{sized(`bbbbbbbb`)}, q.DequeueBatch(2))
+	})
+}
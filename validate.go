@@ -0,0 +1,67 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import "errors"
+
+// Validator inspects a task before it is committed to the queue, e.g.
+// to check the schema of an inference payload at the queue boundary. It
+// may mutate the task, e.g. to normalize its data or clamp its priority,
+// or reject it by returning an error, preferably a *Rejection. The task
+// has no context.
+type Validator func(task *Task) error
+
+// Rejection is the error of the enqueue of a task rejected by a
+// validator, which producers get with errors.As.
+type Rejection struct {
+	// Field is the part of the task at fault, if any, e.g. "data.prompt".
+	Field string
+	// Reason says what is wrong with it.
+	Reason string
+	// Err is the error returned by the validator, if it was not a
+	// *Rejection.
+	Err error
+}
+
+func (r *Rejection) Error() string {
+	if r.Field == "" {
+		return ErrRejected.Error() + ": " + r.Reason
+	}
+	return ErrRejected.Error() + ": " + r.Field + ": " + r.Reason
+}
+
+// Is reports a rejection as ErrRejected.
+func (r *Rejection) Is(target error) bool {
+	return target == ErrRejected
+}
+
+func (r *Rejection) Unwrap() error {
+	return r.Err
+}
+
+// WithValidator adds a validator to the admission of the tasks into the
+// queue. The validators run in the order they were added, outside of the
+// lock of the queue, after the data is copied, see WithCopyOnEnqueue,
+// and before the priority is mapped, see WithPriorityMapper. The first
+// rejection fails the enqueue, and the task is not queued.
+func WithValidator(v Validator) Option {
+	return func(q *Queue) {
+		q.validators = append(q.validators, v)
+	}
+}
+
+// validate runs the validators on the task.
+func (q *Queue) validate(task *Task) error {
+	for _, v := range q.validators {
+		err := v(task)
+		if err == nil {
+			continue
+		}
+		var r *Rejection
+		if errors.As(err, &r) {
+			return err
+		}
+		return &Rejection{Reason: err.Error(), Err: err}
+	}
+	return nil
+}
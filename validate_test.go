@@ -0,0 +1,61 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidator(t *testing.T) {
+	errTooLong := errors.New("too long")
+	q := New(
+		WithValidator(func(task *Task) error {
+			prompt, ok := task.Data.(string)
+			if !ok {
+				return &Rejection{Field: "data", Reason: "not a prompt"}
+			}
+			task.Data = strings.TrimSpace(prompt)
+			if task.Priority < 0 {
+				task.Priority = 0
+			}
+			return nil
+		}),
+		WithValidator(func(task *Task) error {
+			if len(task.Data.(string)) > 5 {
+				return errTooLong
+			}
+			return nil
+		}),
+	)
+
+	assert.Equal(t, nil, q.Enqueue("  hi ", -1))
+	data, priority, _ := q.Peek()
+	assert.Equal(t, "hi", data)
+	assert.Equal(t, 0, priority)
+
+	err := q.Enqueue(42, 1)
+	var r *Rejection
+	assert.Equal(t, true, errors.As(err, &r))
+	assert.Equal(t, "data", r.Field)
+	assert.Equal(t, "not a prompt", r.Reason)
+	assert.EqualError(t, err, "task rejected: data: not a prompt")
+
+	err = q.TryEnqueue("a long prompt", 1)
+	assert.Equal(t, true, errors.Is(err, ErrRejected))
+	assert.Equal(t, true, errors.Is(err, errTooLong))
+	assert.EqualError(t, err, "task rejected: too long")
+
+	err = q.EnqueueBatch([]Task{{Data: "ok", Priority: 1}, {Data: 1, Priority: 1}})
+	assert.Equal(t, true, errors.Is(err, ErrRejected))
+	assert.EqualError(t, err, "task 1: task rejected: data: not a prompt")
+	assert.Equal(t, 1, q.Len(), "none of the batch is queued")
+
+	_, err = q.Submit(context.Background(), 1, 1)
+	assert.Equal(t, true, errors.Is(err, ErrRejected))
+	assert.Equal(t, 1, q.Len())
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+// blockedConsumer is a consumer blocked in DequeueCtx. Blocked consumers
+// are woken up in the order they blocked, one per new item, and
+// consumers that don't block yet can't take items while others wait, so
+// that a busy consumer can't starve the others.
+type blockedConsumer struct {
+	wake  chan struct{}
+	woken bool // since it last checked the queue
+}
+
+// wakeConsumers wakes up the first n blocked consumers not woken up
+// yet, or all of them if n is negative, and the consumer of a decorated
+// channel. It must be called with the lock held.
+func (q *Queue) wakeConsumers(n int) {
+	if n < 0 {
+		q.notEmpty.Broadcast()
+	} else {
+		q.notEmpty.Signal()
+	}
+	for _, w := range q.waiters {
+		if n == 0 {
+			return
+		}
+		if w.woken {
+			continue
+		}
+		w.woken = true
+		w.wake <- struct{}{}
+		n--
+	}
+}
+
+// leave removes a consumer that stops waiting. If items remain, the
+// next consumer is woken up, in case the one leaving was woken up for
+// one of them. It must be called with the lock held.
+func (q *Queue) leave(w *blockedConsumer) {
+	for i, x := range q.waiters {
+		if x == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	if q.size() > 0 && !q.held() {
+		q.wakeConsumers(1)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blocked waits until n consumers are blocked on q.
+func blocked(t *testing.T, q *Queue, n int) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		return len(q.waiters) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestFairWakeup(t *testing.T) {
+	t.Run("FIFO wakeup", func(t *testing.T) {
+		q := New()
+		const consumers = 8
+		got := make([]chan interface{}, consumers)
+		for i := range got {
+			got[i] = make(chan interface{}, 1)
+			go func(i int) {
+				data, _ := q.DequeueCtx(context.Background())
+				got[i] <- data
+			}(i)
+			blocked(t, q, i+1)
+		}
+		for i := 0; i < consumers; i++ {
+			q.Enqueue(i, 1)
+			assert.Equal(t, i, <-got[i])
+		}
+	})
+
+	t.Run("no starvation", func(t *testing.T) {
+		q := New()
+		const consumers, items = 4, 400
+		counts := make([]int, consumers)
+		var wg sync.WaitGroup
+		for i := 0; i < consumers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for {
+					if _, err := q.DequeueCtx(context.Background()); err != nil {
+						return
+					}
+					counts[i]++
+					time.Sleep(10 * time.Microsecond) // some work, so that all the consumers run on a single CPU
+				}
+			}(i)
+		}
+		blocked(t, q, consumers)
+		for i := 0; i < items; i++ {
+			q.Enqueue(i, 1)
+		}
+		q.Close()
+		wg.Wait()
+		total := 0
+		for _, n := range counts {
+			assert.Greater(t, n, items/consumers/4, "fair share: %v", counts)
+			total += n
+		}
+		assert.Equal(t, items, total)
+	})
+
+	t.Run("leaving consumers wake the next one up", func(t *testing.T) {
+		q := New()
+		a := &blockedConsumer{wake: make(chan struct{}, 1)}
+		b := &blockedConsumer{wake: make(chan struct{}, 1)}
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.waiters = []*blockedConsumer{a, b}
+		q.push(newEntry(`a`, 1))
+		q.wakeConsumers(1)
+		assert.True(t, a.woken)
+		assert.False(t, b.woken)
+		q.leave(a)
+		assert.Equal(t, []*blockedConsumer{b}, q.waiters)
+		assert.True(t, b.woken)
+		assert.Equal(t, 1, len(b.wake))
+	})
+}
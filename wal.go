@@ -0,0 +1,299 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// SyncPolicy tells when the write-ahead log of a queue is flushed to
+// stable storage, trading durability for throughput.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the log after every record, so that no
+	// acknowledged operation is lost on a crash of the machine.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodically flushes the log every second, so that a crash of
+	// the machine loses at most the last second of operations.
+	SyncPeriodically
+	// SyncNever leaves the flushes to the operating system. Operations
+	// still survive a crash of the process.
+	SyncNever
+)
+
+// syncInterval is the flush period of SyncPeriodically.
+const syncInterval = time.Second
+
+// WithSyncPolicy sets when the write-ahead log of a queue opened by
+// OpenQueue is flushed. The default is SyncAlways.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(q *Queue) {
+		q.syncPolicy = policy
+	}
+}
+
+type walOp uint8
+
+const (
+	walEnqueue walOp = iota + 1
+	walRemove
+)
+
+// walRecord is a record of the log. Enqueues carry the entry, removals
+// only its ID.
+type walRecord struct {
+	Op       walOp
+	ID       uint64
+	Priority int
+	Key      heap.Key
+	Deadline time.Time
+	Visible  time.Time // of delayed data, see EnqueueAt
+	Data     interface{}
+}
+
+// persistence is the state of a durable queue, see OpenQueue.
+type persistence struct {
+	wal        *wal
+	syncPolicy SyncPolicy
+}
+
+// wal is the write-ahead log of a queue. It is guarded by the lock of the
+// queue, but for the periodic flushes.
+type wal struct {
+	file   *os.File
+	enc    *gob.Encoder
+	policy SyncPolicy
+	nextID uint64
+	err    error // the first write error
+	lock   sync.Mutex
+	stop   chan struct{}
+}
+
+// OpenQueue returns a durable queue, whose operations are appended to
+// the write-ahead log at path, so that the queued data survives a
+// restart: the log is replayed on open to rebuild the queue, and then
+// compacted. The data must be encodable by encoding/gob, and its
+// concrete types registered with gob.Register, but for the basic types.
+//
+// Delayed data is logged with its time, and stays delayed on replay.
+// Contexts are not logged, so data of EnqueueCtx still queued is
+// replayed even if its context is done. The log is closed once the
+// queue is closed and drained; see LogErr for write errors.
+func OpenQueue(path string, opts ...Option) (*Queue, error) {
+	live, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	q := New(opts...)
+	for _, r := range live {
+		e := newEntry(r.Data, r.Priority)
+		e.Key, e.deadline = r.Key, r.Deadline
+		q.lock.Lock()
+		if r.Visible.After(q.now()) {
+			e.visible = r.Visible
+			q.postpone(e)
+		} else {
+			q.push(e)
+		}
+		q.lock.Unlock()
+	}
+
+	// compaction: the live entries are written to a new log in their
+	// order, which then replaces the old one
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{file: file, enc: gob.NewEncoder(file), policy: q.syncPolicy}
+	q.lock.Lock()
+	q.wal = w
+	for _, e := range q.entries() {
+		q.logEnqueue(e)
+	}
+	q.lock.Unlock()
+	if err := w.firstErr(file.Sync()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if w.policy == SyncPeriodically {
+		w.stop = make(chan struct{})
+		go w.syncPeriodically()
+	}
+	return q, nil
+}
+
+// entries returns the queued entries that are not cancelled in their
+// order, and then the delayed ones. It must be called with the lock
+// held.
+func (q *Queue) entries() []*entry {
+	var entries []*entry
+	for _, item := range (*q.heap)[1:] {
+		if e := entryOf(item); !e.cancelled {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Order < entries[j].Order })
+	if q.delayed != nil {
+		for _, item := range (*q.delayed)[1:] {
+			entries = append(entries, entryOf(item))
+		}
+	}
+	return entries
+}
+
+// syncDir flushes the directory, so that a file renamed into it
+// survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// replay returns the enqueue records of the log at path that were not
+// removed, in order. A torn last record, as left by a crash, is ignored.
+func replay(path string) ([]*walRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dec := gob.NewDecoder(file)
+	live := make(map[uint64]*walRecord)
+	for {
+		r := new(walRecord)
+		err := dec.Decode(r)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch r.Op {
+		case walEnqueue:
+			live[r.ID] = r
+		case walRemove:
+			delete(live, r.ID)
+		}
+	}
+	records := make([]*walRecord, 0, len(live))
+	for _, r := range live {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records, nil
+}
+
+// LogErr returns the first error writing the write-ahead log of a queue
+// opened by OpenQueue, after which operations are no longer logged.
+func (q *Queue) LogErr() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.wal == nil {
+		return nil
+	}
+	q.wal.lock.Lock()
+	defer q.wal.lock.Unlock()
+	return q.wal.err
+}
+
+// logEnqueue logs an entry pushed into the heap. It must be called with
+// the lock held.
+func (q *Queue) logEnqueue(e *entry) {
+	q.wal.nextID++
+	e.id = q.wal.nextID
+	q.wal.append(&walRecord{Op: walEnqueue, ID: e.id, Priority: e.Priority, Key: e.Key, Deadline: e.deadline, Visible: e.visible, Data: e.data})
+}
+
+// logRemove logs an entry leaving the heap, or cancelled, once. It must
+// be called with the lock held.
+func (q *Queue) logRemove(e *entry) {
+	if q.wal != nil && e.id != 0 {
+		q.wal.append(&walRecord{Op: walRemove, ID: e.id})
+		e.id = 0
+	}
+}
+
+// closeLog closes the log once the queue is closed and drained. It must
+// be called with the lock held.
+func (q *Queue) closeLog() {
+	if q.wal == nil || !q.closed || !q.heap.Empty() {
+		return
+	}
+	if q.wal.stop != nil {
+		close(q.wal.stop)
+	}
+	q.wal.lock.Lock()
+	q.wal.firstErr(q.wal.file.Sync())
+	q.wal.firstErr(q.wal.file.Close())
+	q.wal.lock.Unlock()
+	q.wal = nil
+}
+
+func (w *wal) append(r *walRecord) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return
+	}
+	if w.err = w.enc.Encode(r); w.err == nil && w.policy == SyncAlways {
+		w.err = w.file.Sync()
+	}
+}
+
+// firstErr records err if it is the first one, and returns the first
+// one. It must be called with the lock of w held, or before the log is
+// shared.
+func (w *wal) firstErr(err error) error {
+	if w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func (w *wal) syncPeriodically() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.lock.Lock()
+			if w.err == nil {
+				w.err = w.file.Sync()
+			}
+			w.lock.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build requestpq_minimal
+// +build requestpq_minimal
+
+package requestpq
+
+// persistence stands for the state of a durable queue, which the
+// requestpq_minimal build leaves out with OpenQueue: no queue has a
+// write-ahead log.
+type persistence struct {
+	wal *wal
+}
+
+type wal struct{}
+
+func (q *Queue) logEnqueue(e *entry) {}
+
+func (q *Queue) logRemove(e *entry) {}
+
+func (q *Queue) closeLog() {}
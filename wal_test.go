@@ -0,0 +1,105 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+//go:build !requestpq_minimal
+// +build !requestpq_minimal
+
+package requestpq
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+
+	q, err := OpenQueue(path)
+	assert.Equal(t, nil, err)
+	for i, data := range []string{`low`, `high 1`, `dequeued`, `high 2`, `cancelled`} {
+		priority := 1
+		switch i {
+		case 0:
+			priority = 2
+		case 2:
+			priority = 0
+		}
+		if data == `cancelled` {
+			q.EnqueueCancelable(data, 0)()
+			continue
+		}
+		q.Enqueue(data, priority)
+	}
+	data, _ := q.Dequeue()
+	assert.Equal(t, `dequeued`, data)
+	assert.Equal(t, nil, q.LogErr())
+
+	// a crash: the file is not closed, and the last record is torn
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0x42})
+	f.Close()
+
+	for _, policy := range []SyncPolicy{SyncNever, SyncPeriodically, SyncAlways} {
+		q, err = OpenQueue(path, WithSyncPolicy(policy))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 3, q.Len())
+	}
+	q.Enqueue(`new`, 1)
+	assert.Equal(t, []interface{}{`high 1`, `high 2`, `new`}, q.DequeueBatch(3))
+
+	q, err = OpenQueue(path, WithMaxFirst())
+	assert.Equal(t, nil, err)
+	q.Close()
+	data, _ = q.Dequeue()
+	assert.Equal(t, `low`, data)
+	assert.Equal(t, nil, q.LogErr())
+	assert.Equal(t, (*wal)(nil), q.wal, "closed once drained")
+
+	q, err = OpenQueue(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestOpenQueueOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	q, _ := OpenQueue(path)
+	var want []interface{}
+	for i := 0; i < 8; i++ {
+		q.Enqueue(fmt.Sprintf("b%d", i), 2)
+		q.Enqueue(fmt.Sprintf("a%d", i), 1)
+	}
+	for i := 0; i < 8; i++ {
+		want = append(want, fmt.Sprintf("a%d", i))
+	}
+	for i := 0; i < 8; i++ {
+		want = append(want, fmt.Sprintf("b%d", i))
+	}
+	q.EnqueueAt(`later`, 0, time.Now().Add(time.Hour))
+
+	for i := 0; i < 2; i++ { // replays the log, and then its compaction
+		var err error
+		q, err = OpenQueue(path)
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, 1, q.Delayed())
+	assert.Equal(t, want, q.DequeueBatch(len(want)))
+	assert.Equal(t, nil, q.LogErr())
+}
+
+func TestCoalescingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.wal")
+	q, _ := OpenQueue(path, WithCoalescing())
+	q.EnqueueUnique("a", `old`, 2)
+	q.EnqueueUnique("a", `new`, 1)
+	assert.Equal(t, nil, q.LogErr())
+	q, err := OpenQueue(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, q.Len())
+	data, priority, _ := q.Peek()
+	assert.Equal(t, `new`, data)
+	assert.Equal(t, 1, priority)
+}
@@ -0,0 +1,219 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/lkevinzc/requestpq/v2/heap"
+)
+
+// Class is a class of priorities of a WeightedQueue. Like a Band, it
+// holds the priorities from Min up to the Min of the next class, and the
+// first class also holds the priorities below its Min.
+type Class struct {
+	Name   string
+	Min    int
+	Weight int // the share of the dequeues, at least 1
+}
+
+// WeightedQueue is a priority queue whose classes of priorities share the
+// dequeues in proportion to their weights, e.g. 8:2:1, instead of the
+// lower classes starving behind the higher ones. Each class has its own
+// heap, in priority order and then in FIFO order, and the classes are
+// scheduled by deficit round robin (DRR): the class in turn is dequeued
+// up to its weight, and then the turn passes to the next class, by Min.
+// A class without data loses its turn and doesn't bank credit.
+type WeightedQueue struct {
+	lock    sync.Mutex
+	classes []*weightedClass // by Min
+	cur     int              // the class in turn
+	size    int
+	count   uint64
+	closed  bool
+	wait    chan struct{} // closed on enqueue and on close, if not nil
+}
+
+type weightedClass struct {
+	Class
+	heap    heap.ItemHeap
+	deficit int
+}
+
+// NewWeightedQueue returns a WeightedQueue with the given classes. With
+// no class, all the data is in one class.
+func NewWeightedQueue(classes ...Class) *WeightedQueue {
+	sorted := append([]Class(nil), classes...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Min < sorted[j].Min })
+	if len(sorted) == 0 {
+		sorted = []Class{{Weight: 1}}
+	}
+	w := &WeightedQueue{classes: make([]*weightedClass, len(sorted))}
+	for i, class := range sorted {
+		if class.Weight < 1 {
+			class.Weight = 1
+		}
+		w.classes[i] = &weightedClass{Class: class, heap: heap.NewHeap()}
+	}
+	w.classes[0].deficit = w.classes[0].Weight
+	return w
+}
+
+// classOf returns the class of the priority.
+func (w *WeightedQueue) classOf(priority int) *weightedClass {
+	i := sort.Search(len(w.classes), func(i int) bool { return w.classes[i].Min > priority }) - 1
+	if i < 0 {
+		i = 0
+	}
+	return w.classes[i]
+}
+
+// Enqueue puts the data into the heap of the class of its priority. It
+// returns ErrQueueClosed if the queue is closed.
+func (w *WeightedQueue) Enqueue(data interface{}, priority int) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return ErrQueueClosed
+	}
+	c := w.classOf(priority)
+	if w.count == math.MaxUint64 {
+		w.count = 0
+		for _, c := range w.classes {
+			if n := c.heap.ReOrder(); n > w.count {
+				w.count = n
+			}
+		}
+	}
+	w.count++
+	c.heap.Push(heap.NewItem(data, priority, heap.WithOrder(w.count)))
+	w.size++
+	w.signal()
+	return nil
+}
+
+// signal wakes the blocked consumers up. It must be called with the lock
+// held.
+func (w *WeightedQueue) signal() {
+	if w.wait != nil {
+		close(w.wait)
+		w.wait = nil
+	}
+}
+
+// turn returns the class to dequeue from, passing the turn over the
+// classes until one has both data and credit, or nil if the queue is
+// empty. It must be called with the lock held.
+func (w *WeightedQueue) turn() *weightedClass {
+	if w.size == 0 {
+		return nil
+	}
+	for {
+		c := w.classes[w.cur]
+		if c.heap.Empty() {
+			c.deficit = 0
+		} else if c.deficit >= 1 {
+			return c
+		}
+		w.cur = (w.cur + 1) % len(w.classes)
+		next := w.classes[w.cur]
+		next.deficit += next.Weight
+	}
+}
+
+// pop removes and returns the next item, or nil if the queue is empty.
+// It must be called with the lock held.
+func (w *WeightedQueue) pop() *heap.Item {
+	c := w.turn()
+	if c == nil {
+		return nil
+	}
+	c.deficit--
+	w.size--
+	return c.heap.Pop().(*heap.Item)
+}
+
+// Dequeue takes the next data of the class in turn, or returns
+// ErrQueueEmpty if the queue is empty, or ErrQueueClosed if it is closed
+// and drained.
+func (w *WeightedQueue) Dequeue() (interface{}, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	item := w.pop()
+	if item == nil {
+		if w.closed {
+			return nil, ErrQueueClosed
+		}
+		return nil, ErrQueueEmpty
+	}
+	return item.GetData(), nil
+}
+
+// DequeueCtx is like Dequeue, but blocks until data is available or ctx
+// is done, in which case it returns ctx.Err().
+func (w *WeightedQueue) DequeueCtx(ctx context.Context) (interface{}, error) {
+	for {
+		w.lock.Lock()
+		item := w.pop()
+		if item != nil || w.closed {
+			w.lock.Unlock()
+			if item == nil {
+				return nil, ErrQueueClosed
+			}
+			return item.GetData(), nil
+		}
+		if w.wait == nil {
+			w.wait = make(chan struct{})
+		}
+		wait := w.wait
+		w.lock.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Peek gets the data that Dequeue would take and its priority, without
+// removing it from the queue.
+func (w *WeightedQueue) Peek() (interface{}, int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	c := w.turn()
+	if c == nil {
+		return nil, 0, ErrQueueEmpty
+	}
+	item := c.heap.Peek().(*heap.Item)
+	return item.GetData(), item.GetPriority(), nil
+}
+
+// Len returns the size of the queue.
+func (w *WeightedQueue) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.size
+}
+
+// LenByClass returns the size of every class, by name.
+func (w *WeightedQueue) LenByClass() map[string]int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	lens := make(map[string]int, len(w.classes))
+	for _, c := range w.classes {
+		lens[c.Name] += c.heap.Len()
+	}
+	return lens
+}
+
+// Close closes the queue: enqueues fail, while the remaining data may
+// still be dequeued.
+func (w *WeightedQueue) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	w.signal()
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedQueue(t *testing.T) {
+	w := NewWeightedQueue(
+		Class{Name: "batch", Min: 20, Weight: 1},
+		Class{Name: "interactive", Min: 0, Weight: 3},
+		Class{Name: "bulk", Min: 10, Weight: 2},
+	)
+	for i := 0; i < 6; i++ {
+		w.Enqueue("i", 1)
+		w.Enqueue("b", 15)
+		w.Enqueue("B", 99)
+	}
+	w.Enqueue("first", -1)
+	assert.Equal(t, 19, w.Len())
+	assert.Equal(t, map[string]int{"interactive": 7, "bulk": 6, "batch": 6}, w.LenByClass())
+	data, priority, err := w.Peek()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "first", data)
+	assert.Equal(t, -1, priority)
+
+	var got []string
+	for {
+		data, err := w.Dequeue()
+		if err != nil {
+			assert.Equal(t, true, errors.Is(err, ErrQueueEmpty))
+			break
+		}
+		got = append(got, data.(string))
+	}
+	assert.Equal(t, "first i i b b B i i i b b B i b b B B B B", strings.Join(got, " "))
+
+	t.Run("idle classes do not bank credit", func(t *testing.T) {
+		w := NewWeightedQueue(Class{Min: 0, Weight: 1}, Class{Min: 10, Weight: 1})
+		for i := 0; i < 3; i++ {
+			w.Enqueue("high", 0)
+		}
+		w.Dequeue()
+		w.Dequeue() // the low class gets its turn and loses it
+		for i := 0; i < 3; i++ {
+			w.Enqueue("low", 10)
+		}
+		var got []interface{}
+		for w.Len() > 0 {
+			data, _ := w.Dequeue()
+			got = append(got, data)
+		}
+		assert.Equal(t, []interface{}{"low", "high", "low", "low"}, got)
+	})
+
+	t.Run("blocks", func(t *testing.T) {
+		w := NewWeightedQueue()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			w.Enqueue("data", 1)
+			w.Close()
+		}()
+		data, err := w.DequeueCtx(context.Background())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "data", data)
+		_, err = w.DequeueCtx(context.Background())
+		assert.Equal(t, ErrQueueClosed, err)
+		assert.Equal(t, ErrQueueClosed, w.Enqueue("late", 1))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		_, err = NewWeightedQueue().DequeueCtx(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+}
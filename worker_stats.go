@@ -0,0 +1,107 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WorkerStats is a snapshot of the counters of a worker of Dispatch,
+// DispatchCtx or Serve, or of a device of a DispatchGroup, to spot a
+// single bad worker or device.
+type WorkerStats struct {
+	// Worker identifies the worker among those of the queue, in the
+	// order they were started.
+	Worker int
+	// Device is the key of the device, or empty for a worker of a pool.
+	Device   string
+	Inflight int
+	Handled  uint64
+	// Failed counts the handled items whose handler returned an error.
+	Failed uint64
+	// MeanLatency and LastLatency are the mean and last handling times,
+	// of an item for a worker and of a batch for a device.
+	MeanLatency time.Duration
+	LastLatency time.Duration
+}
+
+// ErrorRate returns the fraction of the handled items that failed.
+func (w WorkerStats) ErrorRate() float64 {
+	if w.Handled == 0 {
+		return 0
+	}
+	return float64(w.Failed) / float64(w.Handled)
+}
+
+type workerCounters struct {
+	handled  uint64
+	failed   uint64
+	calls    uint64 // of the handler, i.e. batches for a device
+	busy     int64  // total handling time, in nanoseconds
+	last     int64  // last handling time, in nanoseconds
+	inflight int64
+	id       int
+	device   string
+}
+
+// begin counts n items in flight and returns the start time.
+func (w *workerCounters) begin(n int) time.Time {
+	atomic.AddInt64(&w.inflight, int64(n))
+	return time.Now()
+}
+
+// end counts n handled items, of which failed failed, since start.
+func (w *workerCounters) end(start time.Time, n, failed int) {
+	elapsed := int64(time.Since(start))
+	atomic.AddInt64(&w.inflight, -int64(n))
+	atomic.AddUint64(&w.handled, uint64(n))
+	atomic.AddUint64(&w.failed, uint64(failed))
+	atomic.AddUint64(&w.calls, 1)
+	atomic.AddInt64(&w.busy, elapsed)
+	atomic.StoreInt64(&w.last, elapsed)
+}
+
+// Workers returns the counters of the workers and devices currently
+// processing the items of the queue, in the order they were started.
+func (s *Stats) Workers() []WorkerStats {
+	s.workerLock.Lock()
+	defer s.workerLock.Unlock()
+	workers := make([]WorkerStats, len(s.workers))
+	for i, w := range s.workers {
+		workers[i] = WorkerStats{
+			Worker:      w.id,
+			Device:      w.device,
+			Inflight:    int(atomic.LoadInt64(&w.inflight)),
+			Handled:     atomic.LoadUint64(&w.handled),
+			Failed:      atomic.LoadUint64(&w.failed),
+			LastLatency: time.Duration(atomic.LoadInt64(&w.last)),
+		}
+		if calls := atomic.LoadUint64(&w.calls); calls > 0 {
+			workers[i].MeanLatency = time.Duration(atomic.LoadInt64(&w.busy) / int64(calls))
+		}
+	}
+	return workers
+}
+
+// addWorker registers the counters of a new worker or device.
+func (s *Stats) addWorker(device string) *workerCounters {
+	s.workerLock.Lock()
+	defer s.workerLock.Unlock()
+	w := &workerCounters{id: s.nextWorker, device: device}
+	s.nextWorker++
+	s.workers = append(s.workers, w)
+	return w
+}
+
+// removeWorker unregisters the counters of a worker that stopped.
+func (s *Stats) removeWorker(w *workerCounters) {
+	s.workerLock.Lock()
+	defer s.workerLock.Unlock()
+	for i, x := range s.workers {
+		if x == w {
+			s.workers = append(s.workers[:i], s.workers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 lkevinzc. All rights reserved.
+
+package requestpq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerStats(t *testing.T) {
+	q := New()
+	for i := 0; i < 4; i++ {
+		q.Enqueue(i, i)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Dispatch(ctx, 2, func(data interface{}) error {
+			switch data {
+			case 0, 1:
+				started <- struct{}{}
+				<-release
+			case 2:
+				return errors.New(`failed`)
+			}
+			return nil
+		})
+	}()
+	<-started
+	<-started
+	workers := q.Stats().Workers()
+	assert.Equal(t, 2, len(workers))
+	assert.NotEqual(t, workers[0].Worker, workers[1].Worker)
+	for _, w := range workers {
+		assert.Equal(t, 1, w.Inflight)
+		assert.Equal(t, ``, w.Device)
+	}
+	close(release)
+
+	var handled, failed uint64
+	assert.Eventually(t, func() bool {
+		handled, failed = 0, 0
+		for _, w := range q.Stats().Workers() {
+			handled += w.Handled
+			failed += w.Failed
+		}
+		return handled == 4
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), failed)
+
+	cancel()
+	<-done
+	assert.Empty(t, q.Stats().Workers())
+}
+
+func TestWorkerStatsErrorRate(t *testing.T) {
+	assert.Equal(t, 0.0, WorkerStats{}.ErrorRate())
+	assert.Equal(t, 0.25, WorkerStats{Handled: 4, Failed: 1}.ErrorRate())
+}